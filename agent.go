@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/agent"
+	"github.com/swissmakers/wireguard-manager/util"
+	"github.com/swissmakers/wireguard-manager/wgctl"
+)
+
+// runAgent implements the agent subcommand, which serves the agent API on a
+// node so a central instance can write the config files and control the
+// WireGuard interfaces of the node. The API is only served over TLS and
+// requests are authenticated by a bearer token, a client certificate or both.
+// It returns the process exit code.
+func runAgent(args []string) int {
+	cmd := flag.NewFlagSet("agent", flag.ExitOnError)
+	listen := cmd.String("listen", util.LookupEnvOrString(util.AgentListenEnvVar, "0.0.0.0:5001"), "Address:Port the agent API is served on")
+	token := cmd.String("token", util.LookupEnvOrString(util.AgentTokenEnvVar, ""), "Bearer token the central instance authenticates with")
+	tokenFile := cmd.String("token-file", util.LookupEnvOrString(util.AgentTokenFileEnvVar, ""), "File containing the bearer token")
+	certFile := cmd.String("tls-cert", util.LookupEnvOrString(util.AgentTLSCertEnvVar, ""), "TLS certificate of the agent API")
+	keyFile := cmd.String("tls-key", util.LookupEnvOrString(util.AgentTLSKeyEnvVar, ""), "TLS private key of the agent API")
+	clientCA := cmd.String("client-ca", util.LookupEnvOrString(util.AgentClientCAEnvVar, ""), "CA certificate client certificates are verified with. Without a token, a client certificate is required.")
+	configDir := cmd.String("config-dir", util.LookupEnvOrString(util.AgentConfigDirEnvVar, "/etc/wireguard"), "Directory the config files of the interfaces are written to")
+	backendName := cmd.String("wg-backend", flagWgBackend, "Backend controlling the WireGuard interfaces: wg-quick, systemd, userspace or fake")
+	cmd.Parse(args)
+
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Errorf("Cannot read the token file: %v", err)
+			return 2
+		}
+		*token = strings.TrimSpace(string(data))
+	}
+	if *certFile == "" || *keyFile == "" {
+		log.Errorf("The agent API is only served over TLS (-tls-cert and -tls-key)")
+		return 2
+	}
+	if *token == "" && *clientCA == "" {
+		log.Errorf("The agent needs a token (-token or -token-file), a client CA (-client-ca) or both")
+		return 2
+	}
+
+	tlsConfig, err := agent.TLSConfig(*certFile, *keyFile, *clientCA, *token == "")
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	backend, err := wgctl.New(*backendName, flagWgUserspace)
+	if err != nil {
+		log.Errorf("Invalid WireGuard backend: %v", err)
+		return 2
+	}
+
+	srv := &http.Server{
+		Addr: *listen,
+		Handler: agent.NewServer(agent.Options{
+			Backend:   backend,
+			ConfigDir: *configDir,
+			Token:     *token,
+			Version:   appVersion,
+		}),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Infof("Serving the agent API on %s with the %s backend, config files in %s", *listen, backend.Name(), *configDir)
+	if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("Agent stopped: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store/sqlitedb"
+	"github.com/swissmakers/wireguard-manager/wgctl"
+)
+
+// testCA issues the certificates of an agent and its central instance.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return testCA{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// issue returns a certificate for 127.0.0.1 with the given usage.
+func (ca testCA) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startAgent serves the agent API with a fake backend on loopback.
+func startAgent(t *testing.T, ca testCA, token string) (*httptest.Server, *wgctl.FakeBackend, string) {
+	t.Helper()
+	backend := wgctl.NewFakeBackend()
+	configDir := t.TempDir()
+	srv := httptest.NewUnstartedServer(NewServer(Options{Backend: backend, ConfigDir: configDir, Token: token, Version: "test"}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, 2, x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, backend, configDir
+}
+
+// TestAuthentication accepts the token of the agent or a client certificate
+// issued by its client CA.
+func TestAuthentication(t *testing.T) {
+	ca := newTestCA(t)
+	srv, _, _ := startAgent(t, ca, "secret")
+	clientCert := ca.issue(t, 3, x509.ExtKeyUsageClientAuth)
+
+	tests := []struct {
+		name  string
+		token string
+		cert  *tls.Certificate
+		ok    bool
+	}{
+		{"token", "secret", nil, true},
+		{"wrong token", "guess", nil, false},
+		{"no credentials", "", nil, false},
+		{"client certificate", "", &clientCert, true},
+	}
+	for _, tt := range tests {
+		client, err := NewClient(model.Node{Name: "gw1", URL: srv.URL, Token: tt.token, CACert: ca.pem}, tt.cert)
+		if err != nil {
+			t.Fatalf("%s: NewClient failed: %v", tt.name, err)
+		}
+		status, err := client.Status()
+		if tt.ok && (err != nil || status.Version != "test" || status.Backend != wgctl.Fake) {
+			t.Errorf("%s: Status = %+v, %v", tt.name, status, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: Status succeeded", tt.name)
+		}
+	}
+
+	if _, err := NewClient(model.Node{Name: "gw1", URL: "http://127.0.0.1:5001"}, nil); err == nil {
+		t.Error("NewClient accepted a plain http URL")
+	}
+	untrusted, _ := NewClient(model.Node{Name: "gw1", URL: srv.URL, Token: "secret"}, nil)
+	if _, err := untrusted.Status(); err == nil {
+		t.Error("Status succeeded without trusting the certificate of the agent")
+	}
+}
+
+// TestRemoteInterface runs an interface assigned to a node through its agent:
+// the config is applied on the node, its device is configured and shows up in
+// the devices of the central backend.
+func TestRemoteInterface(t *testing.T) {
+	ca := newTestCA(t)
+	srv, agentBackend, configDir := startAgent(t, ca, "secret")
+
+	db, err := sqlitedb.New(filepath.Join(t.TempDir(), "wireguard-manager.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	node := model.Node{ID: "gw1", Name: "gw1", URL: srv.URL, Token: "secret", CACert: ca.pem}
+	down := model.Node{ID: "gw2", Name: "gw2", URL: "https://127.0.0.1:1", CACert: ca.pem}
+	for _, n := range []model.Node{node, down} {
+		if err := db.SaveNode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, iface := range []model.WireGuardInterface{
+		{Name: "wg1", Addresses: []string{"10.9.0.1/24"}, ConfigFilePath: "/etc/wireguard/wg1.conf", Node: node.ID},
+		{Name: "wg2", Addresses: []string{"10.10.0.1/24"}, ConfigFilePath: "/etc/wireguard/wg2.conf", Node: down.ID},
+		{Name: "wg3", Addresses: []string{"10.11.0.1/24"}, ConfigFilePath: "/etc/wireguard/wg3.conf"},
+	} {
+		if err := db.SaveWireGuardInterface(iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	local := wgctl.NewFakeBackend()
+	backend := NewBackend(db, local, nil)
+	if err := backend.Up("wg1"); err != nil {
+		t.Fatalf("Up of the remote interface failed: %v", err)
+	}
+	if err := backend.Up("wg3"); err != nil {
+		t.Fatalf("Up of the local interface failed: %v", err)
+	}
+	if up, _ := agentBackend.IsUp("wg1"); !up {
+		t.Fatal("wg1 is not running on the node")
+	}
+	if up, _ := local.IsUp("wg1"); up {
+		t.Fatal("wg1 is running on this host")
+	}
+
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	peerKey, _ := wgtypes.GeneratePrivateKey()
+	config := fmt.Sprintf("[Interface]\nAddress = 10.9.0.1/24\nListenPort = 51821\nPrivateKey = %s\n\n# ID: a\n# Name: laptop\n[Peer]\nPublicKey = %s\nAllowedIPs = 10.9.0.2/32\n",
+		serverKey, peerKey.PublicKey())
+	result, remote, err := backend.ApplyConfig("wg1", []byte(config))
+	if !remote || err != nil || len(result.Peers) != 1 || !result.Interface {
+		t.Fatalf("ApplyConfig = %+v, %v, %v", result, remote, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(configDir, "wg1.conf")); err != nil || string(data) != config {
+		t.Fatalf("Config on the node = %q, %v", data, err)
+	}
+	if content, remote, err := backend.ReadConfig("wg1"); !remote || err != nil || string(content) != config {
+		t.Fatalf("ReadConfig = %q, %v, %v", content, remote, err)
+	}
+	if _, remote, _ := backend.ApplyConfig("wg3", []byte(config)); remote {
+		t.Fatal("ApplyConfig handled a local interface")
+	}
+
+	// An invalid config is rejected and leaves the file alone
+	if _, _, err := backend.ApplyConfig("wg1", []byte("[Peer]\n")); err == nil {
+		t.Fatal("ApplyConfig accepted an invalid config")
+	}
+	if data, _ := os.ReadFile(filepath.Join(configDir, "wg1.conf")); string(data) != config {
+		t.Fatal("An invalid config replaced the file on the node")
+	}
+
+	device, err := backend.Device("wg1")
+	if err != nil || device.PublicKey != serverKey.PublicKey() || len(device.Peers) != 1 {
+		t.Fatalf("Device = %+v, %v", device, err)
+	}
+	if device.PrivateKey != (wgtypes.Key{}) {
+		t.Fatal("The agent sent the private key of the device")
+	}
+	if _, err := backend.Device("wg4"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Device of a stopped interface = %v, want os.ErrNotExist", err)
+	}
+
+	devices, err := backend.Devices()
+	var unreachable *wgctl.UnreachableError
+	if !errors.As(err, &unreachable) || len(unreachable.Hosts) != 1 || unreachable.Hosts["gw2"] == nil {
+		t.Fatalf("Devices error = %v, want gw2 unreachable", err)
+	}
+	names := map[string]bool{}
+	for _, device := range devices {
+		names[device.Name] = true
+	}
+	if len(devices) != 2 || !names["wg1"] || !names["wg3"] {
+		t.Fatalf("Devices = %v, want wg1 and wg3", names)
+	}
+
+	if err := backend.Down("wg1"); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if up, err := backend.IsUp("wg1"); up || err != nil {
+		t.Fatalf("IsUp after Down = %v, %v", up, err)
+	}
+}
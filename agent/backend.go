@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/wgctl"
+)
+
+// Backend controls the interfaces assigned to a node through the agent of the
+// node and all other interfaces through a local backend. It implements
+// wgctl.RemoteConfigs for the config files of the remote interfaces.
+type Backend struct {
+	wgctl.Backend
+
+	db          store.IStore
+	certificate *tls.Certificate
+
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+// NewBackend returns a backend that runs the interfaces of nodes through their
+// agents and all others through local. certificate is presented to agents
+// that verify client certificates and may be nil.
+func NewBackend(db store.IStore, local wgctl.Backend, certificate *tls.Certificate) *Backend {
+	return &Backend{
+		Backend:     local,
+		db:          db,
+		certificate: certificate,
+		clients:     make(map[string]*Client),
+	}
+}
+
+// Client returns the client of the agent of node. Clients are kept until the
+// node is changed.
+func (b *Backend) Client(node model.Node) (*Client, error) {
+	key := fmt.Sprintf("%s@%d", node.ID, node.Revision)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if client, ok := b.clients[key]; ok {
+		return client, nil
+	}
+	client, err := NewClient(node, b.certificate)
+	if err != nil {
+		return nil, err
+	}
+	for k, c := range b.clients {
+		if c.node.ID == node.ID {
+			delete(b.clients, k)
+		}
+	}
+	b.clients[key] = client
+	return client, nil
+}
+
+// remote returns the client of the node iface is assigned to, nil if it runs
+// on this host.
+func (b *Backend) remote(iface string) (*Client, error) {
+	ifaces, err := b.db.GetWireGuardInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get interfaces: %v", err)
+	}
+	for _, i := range ifaces {
+		if i.Name != iface || i.Node == "" {
+			continue
+		}
+		node, err := b.db.GetNode(i.Node)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %v", iface, err)
+		}
+		return b.Client(node)
+	}
+	return nil, nil
+}
+
+// backend returns the backend running iface.
+func (b *Backend) backend(iface string) (wgctl.Backend, error) {
+	client, err := b.remote(iface)
+	if err != nil || client == nil {
+		return b.Backend, err
+	}
+	return client, nil
+}
+
+// Up brings the interface up on its host.
+func (b *Backend) Up(iface string) error {
+	backend, err := b.backend(iface)
+	if err != nil {
+		return err
+	}
+	return backend.Up(iface)
+}
+
+// Down takes the interface down on its host.
+func (b *Backend) Down(iface string) error {
+	backend, err := b.backend(iface)
+	if err != nil {
+		return err
+	}
+	return backend.Down(iface)
+}
+
+// Restart takes the interface down and brings it up again on its host.
+func (b *Backend) Restart(iface string) error {
+	backend, err := b.backend(iface)
+	if err != nil {
+		return err
+	}
+	return backend.Restart(iface)
+}
+
+// IsUp reports whether the interface is running on its host.
+func (b *Backend) IsUp(iface string) (bool, error) {
+	backend, err := b.backend(iface)
+	if err != nil {
+		return false, err
+	}
+	return backend.IsUp(iface)
+}
+
+// Device returns the device of an interface from its host.
+func (b *Backend) Device(name string) (*wgtypes.Device, error) {
+	backend, err := b.backend(name)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Device(name)
+}
+
+// ConfigureDevice changes the configuration of a running device on its host.
+func (b *Backend) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	backend, err := b.backend(name)
+	if err != nil {
+		return err
+	}
+	return backend.ConfigureDevice(name, cfg)
+}
+
+// Devices returns the local devices and the devices of the interfaces
+// assigned to each node. If some nodes cannot be reached, the devices of the
+// others are returned with a *wgctl.UnreachableError.
+func (b *Backend) Devices() ([]*wgtypes.Device, error) {
+	devices, err := b.Backend.Devices()
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := b.db.GetWireGuardInterfaces()
+	if err != nil {
+		return devices, fmt.Errorf("cannot get interfaces: %v", err)
+	}
+	assigned := make(map[string]map[string]bool)
+	for _, iface := range ifaces {
+		if iface.Node == "" {
+			continue
+		}
+		if assigned[iface.Node] == nil {
+			assigned[iface.Node] = make(map[string]bool)
+		}
+		assigned[iface.Node][iface.Name] = true
+	}
+	if len(assigned) == 0 {
+		return devices, nil
+	}
+
+	nodes, err := b.db.GetNodes()
+	if err != nil {
+		return devices, fmt.Errorf("cannot get nodes: %v", err)
+	}
+	unreachable := &wgctl.UnreachableError{Hosts: make(map[string]error)}
+	for _, node := range nodes {
+		names, ok := assigned[node.ID]
+		if !ok {
+			continue
+		}
+		client, err := b.Client(node)
+		if err != nil {
+			unreachable.Hosts[node.Name] = err
+			continue
+		}
+		remote, err := client.Devices()
+		if err != nil {
+			unreachable.Hosts[node.Name] = err
+			continue
+		}
+		for _, device := range remote {
+			if names[device.Name] {
+				devices = append(devices, device)
+			}
+		}
+	}
+	if len(unreachable.Hosts) > 0 {
+		return devices, unreachable
+	}
+	return devices, nil
+}
+
+// ReadConfig returns the config file of an interface assigned to a node.
+func (b *Backend) ReadConfig(iface string) ([]byte, bool, error) {
+	client, err := b.remote(iface)
+	if err != nil || client == nil {
+		return nil, err != nil, err
+	}
+	content, err := client.ReadConfig(iface)
+	return content, true, err
+}
+
+// ApplyConfig writes the config file of an interface assigned to a node
+// through its agent.
+func (b *Backend) ApplyConfig(iface string, content []byte) (model.DeviceSync, bool, error) {
+	client, err := b.remote(iface)
+	if err != nil || client == nil {
+		return model.DeviceSync{Device: iface}, err != nil, err
+	}
+	result, err := client.ApplyConfig(iface, content)
+	return result, true, err
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+)
+
+// requestTimeout bounds every request to an agent
+const requestTimeout = 30 * time.Second
+
+// Client talks to the agent of one node. It controls the interfaces of the
+// node like a local wgctl.Backend.
+type Client struct {
+	node model.Node
+	base string
+	http *http.Client
+}
+
+// NewClient returns a client for the agent of node. The certificate of the
+// agent is verified with the CA certificate of the node, or the system roots
+// if it has none. certificate is presented to agents that verify client
+// certificates and may be nil.
+func NewClient(node model.Node, certificate *tls.Certificate) (*Client, error) {
+	base, err := url.Parse(node.URL)
+	if err != nil || base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("node %s: the agent URL must be an https URL", node.Name)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if node.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(node.CACert)) {
+			return nil, fmt.Errorf("node %s: no certificate found in the CA certificate", node.Name)
+		}
+		config.RootCAs = pool
+	}
+	if certificate != nil {
+		config.Certificates = []tls.Certificate{*certificate}
+	}
+	return &Client{
+		node: node,
+		base: strings.TrimSuffix(base.String(), "/") + APIPath,
+		http: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+// Name returns the name of the node.
+func (c *Client) Name() string {
+	return "agent:" + c.node.Name
+}
+
+// Status returns what the agent reports about its host.
+func (c *Client) Status() (model.NodeStatus, error) {
+	var status model.NodeStatus
+	err := c.do(http.MethodGet, "/status", nil, &status)
+	return status, err
+}
+
+// Up brings the interface up from its config file on the node.
+func (c *Client) Up(iface string) error {
+	return c.do(http.MethodPost, "/interfaces/"+url.PathEscape(iface)+"/up", nil, nil)
+}
+
+// Down takes the interface down.
+func (c *Client) Down(iface string) error {
+	return c.do(http.MethodPost, "/interfaces/"+url.PathEscape(iface)+"/down", nil, nil)
+}
+
+// Restart takes the interface down and brings it up again.
+func (c *Client) Restart(iface string) error {
+	return c.do(http.MethodPost, "/interfaces/"+url.PathEscape(iface)+"/restart", nil, nil)
+}
+
+// IsUp reports whether the interface is running.
+func (c *Client) IsUp(iface string) (bool, error) {
+	var state interfaceResponse
+	err := c.do(http.MethodGet, "/interfaces/"+url.PathEscape(iface), nil, &state)
+	return state.Running, err
+}
+
+// Devices returns all WireGuard devices of the node. Their private keys are
+// not sent.
+func (c *Client) Devices() ([]*wgtypes.Device, error) {
+	var devices []*wgtypes.Device
+	err := c.do(http.MethodGet, "/devices", nil, &devices)
+	return devices, err
+}
+
+// Device returns the device of an interface. The error wraps os.ErrNotExist
+// if the interface is not running.
+func (c *Client) Device(name string) (*wgtypes.Device, error) {
+	var device wgtypes.Device
+	if err := c.do(http.MethodGet, "/devices/"+url.PathEscape(name), nil, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// ConfigureDevice changes the configuration of a running device.
+func (c *Client) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	return c.do(http.MethodPost, "/devices/"+url.PathEscape(name)+"/configure", cfg, nil)
+}
+
+// ReadConfig returns the config file of an interface. The error wraps
+// os.ErrNotExist if the file does not exist.
+func (c *Client) ReadConfig(iface string) ([]byte, error) {
+	var config configResponse
+	if err := c.do(http.MethodGet, "/interfaces/"+url.PathEscape(iface)+"/config", nil, &config); err != nil {
+		return nil, err
+	}
+	return []byte(config.Config), nil
+}
+
+// ApplyConfig writes the config file of an interface and configures its
+// device if it is running. The agent restores the former file if the device
+// cannot be configured.
+func (c *Client) ApplyConfig(iface string, content []byte) (model.DeviceSync, error) {
+	var applied applyResponse
+	err := c.do(http.MethodPut, "/interfaces/"+url.PathEscape(iface)+"/config", configRequest{Config: string(content)}, &applied)
+	if applied.Result.Device == "" {
+		applied.Result.Device = iface
+	}
+	return applied.Result, err
+}
+
+// do sends a request to the agent and decodes the response into out. The
+// response of a failed request is decoded as well, as it may carry a result.
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.node.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.node.Token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("node %s: %w", c.node.Name, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return fmt.Errorf("node %s: %w", c.node.Name, err)
+	}
+
+	if resp.StatusCode >= 300 {
+		var failure response
+		if json.Unmarshal(data, &failure) != nil || failure.Message == "" {
+			failure.Message = resp.Status
+		}
+		if out != nil {
+			json.Unmarshal(data, out)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("node %s: %s: %w", c.node.Name, failure.Message, os.ErrNotExist)
+		}
+		return fmt.Errorf("node %s: %s", c.node.Name, failure.Message)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("node %s: invalid response: %v", c.node.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+// Package agent runs WireGuard interfaces on remote nodes. The agent serves a
+// small API on each node through which a central instance writes config
+// files and reads and configures devices; Backend is the central side.
+package agent
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/util"
+	"github.com/swissmakers/wireguard-manager/wgctl"
+)
+
+// APIPath is the path all agent endpoints are served below
+const APIPath = "/agent/v1"
+
+// Options configures the agent API.
+type Options struct {
+	// Backend controls the WireGuard interfaces of the node
+	Backend wgctl.Backend
+
+	// ConfigDir is the directory the config files are written to, each
+	// named after its interface
+	ConfigDir string
+
+	// Token is the bearer token requests are authenticated with. Requests
+	// with a verified client certificate are accepted without it. Empty
+	// accepts only client certificates.
+	Token string
+
+	// Version is reported in the status of the node
+	Version string
+}
+
+type response struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// configRequest and configResponse carry a config file
+type configRequest struct {
+	Config string `json:"config"`
+}
+
+type configResponse struct {
+	Config string `json:"config"`
+}
+
+// applyResponse is the outcome of writing a config file. Problems lists why
+// an invalid config was rejected.
+type applyResponse struct {
+	Success  bool             `json:"success"`
+	Message  string           `json:"message"`
+	Result   model.DeviceSync `json:"result"`
+	Problems []string         `json:"problems,omitempty"`
+}
+
+type interfaceResponse struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+}
+
+type server struct {
+	Options
+}
+
+// NewServer returns the handler serving the agent API.
+func NewServer(opts Options) http.Handler {
+	s := server{Options: opts}
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+
+	g := e.Group(APIPath, s.authenticate)
+	g.GET("/status", s.status)
+	g.GET("/devices", s.devices)
+	g.GET("/devices/:name", s.device, validName)
+	g.POST("/devices/:name/configure", s.configureDevice, validName)
+	g.GET("/interfaces/:name", s.isUp, validName)
+	g.POST("/interfaces/:name/up", s.lifecycle("start", opts.Backend.Up), validName)
+	g.POST("/interfaces/:name/down", s.lifecycle("stop", opts.Backend.Down), validName)
+	g.POST("/interfaces/:name/restart", s.lifecycle("restart", opts.Backend.Restart), validName)
+	g.GET("/interfaces/:name/config", s.readConfig, validName)
+	g.PUT("/interfaces/:name/config", s.applyConfig, validName)
+	return e
+}
+
+// TLSConfig returns the TLS config of the agent API. With clientCAFile, client
+// certificates are verified against it; they are required if the agent has no
+// token.
+func TLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the client CA %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// authenticate accepts requests with a verified client certificate or the
+// bearer token of the agent.
+func (s server) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			return next(c)
+		}
+		token, ok := strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if ok && s.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1 {
+			return next(c)
+		}
+		log.Warnf("Rejected agent request from %s to %s", c.RealIP(), req.URL.Path)
+		return c.JSON(http.StatusUnauthorized, response{Success: false, Message: "Unauthorized"})
+	}
+}
+
+// validName rejects requests for an invalid interface name, which would also
+// be an invalid file name.
+func validName(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := util.ValidateInterfaceName(c.Param("name")); err != nil {
+			return c.JSON(http.StatusBadRequest, response{Success: false, Message: err.Error()})
+		}
+		return next(c)
+	}
+}
+
+// status reports the host, the backend and a summary of the devices.
+func (s server) status(c echo.Context) error {
+	devices, err := s.Backend.Devices()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, response{Success: false, Message: err.Error()})
+	}
+	hostname, _ := os.Hostname()
+	status := model.NodeStatus{
+		Hostname: hostname,
+		Version:  s.Version,
+		Backend:  s.Backend.Name(),
+		Devices:  []model.NodeDevice{},
+	}
+	for _, device := range devices {
+		summary := model.NodeDevice{
+			Name:       device.Name,
+			PublicKey:  device.PublicKey.String(),
+			ListenPort: device.ListenPort,
+			Peers:      len(device.Peers),
+		}
+		for _, peer := range device.Peers {
+			if time.Since(peer.LastHandshakeTime) < 3*time.Minute {
+				summary.Connected++
+			}
+		}
+		status.Devices = append(status.Devices, summary)
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// devices returns all devices without their private keys.
+func (s server) devices(c echo.Context) error {
+	devices, err := s.Backend.Devices()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, response{Success: false, Message: err.Error()})
+	}
+	for _, device := range devices {
+		device.PrivateKey = wgtypes.Key{}
+	}
+	if devices == nil {
+		devices = []*wgtypes.Device{}
+	}
+	return c.JSON(http.StatusOK, devices)
+}
+
+// device returns a device without its private key.
+func (s server) device(c echo.Context) error {
+	device, err := s.Backend.Device(c.Param("name"))
+	if err != nil {
+		return deviceError(c, err)
+	}
+	device.PrivateKey = wgtypes.Key{}
+	return c.JSON(http.StatusOK, device)
+}
+
+// configureDevice changes the configuration of a running device.
+func (s server) configureDevice(c echo.Context) error {
+	var cfg wgtypes.Config
+	if err := c.Bind(&cfg); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Success: false, Message: "Invalid device config"})
+	}
+	if err := s.Backend.ConfigureDevice(c.Param("name"), cfg); err != nil {
+		return deviceError(c, err)
+	}
+	return c.JSON(http.StatusOK, response{Success: true, Message: "Device configured"})
+}
+
+func (s server) isUp(c echo.Context) error {
+	running, err := s.Backend.IsUp(c.Param("name"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, response{Success: false, Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, interfaceResponse{Name: c.Param("name"), Running: running})
+}
+
+// lifecycle starts, stops or restarts an interface with fn.
+func (s server) lifecycle(action string, fn func(iface string) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		if err := fn(name); err != nil {
+			return c.JSON(http.StatusInternalServerError, response{Success: false, Message: err.Error()})
+		}
+		log.Infof("Agent: %s of WireGuard interface %s requested by %s", action, name, c.RealIP())
+		return c.JSON(http.StatusOK, response{Success: true, Message: fmt.Sprintf("Interface %s: %s done", name, action)})
+	}
+}
+
+func (s server) configPath(name string) string {
+	return filepath.Join(s.ConfigDir, name+".conf")
+}
+
+// readConfig returns the config file of an interface.
+func (s server) readConfig(c echo.Context) error {
+	content, err := os.ReadFile(s.configPath(c.Param("name")))
+	if errors.Is(err, os.ErrNotExist) {
+		return c.JSON(http.StatusNotFound, response{Success: false, Message: fmt.Sprintf("No config file for interface %s", c.Param("name"))})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, response{Success: false, Message: err.Error()})
+	}
+	return c.JSON(http.StatusOK, configResponse{Config: string(content)})
+}
+
+// applyConfig writes the config file of an interface and configures its
+// device if it is running. If the device cannot be configured, the former
+// file is written and configured again.
+func (s server) applyConfig(c echo.Context) error {
+	var req configRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Success: false, Message: "Invalid config"})
+	}
+	name := c.Param("name")
+	content := []byte(req.Config)
+	if problems := util.ValidateWireGuardConfig(content); len(problems) > 0 {
+		return c.JSON(http.StatusBadRequest, applyResponse{
+			Success:  false,
+			Message:  "Invalid config: " + strings.Join(problems, "; "),
+			Result:   model.DeviceSync{Device: name},
+			Problems: problems,
+		})
+	}
+
+	path := s.configPath(name)
+	backup, backupErr := os.ReadFile(path)
+	result := model.DeviceSync{Device: name}
+	err := util.WriteConfigFile(path, content)
+	if err == nil {
+		result, err = s.configureIfUp(name, content)
+	}
+	if err != nil {
+		message := err.Error()
+		if backupErr == nil {
+			restoreErr := util.WriteConfigFile(path, backup)
+			if restoreErr == nil {
+				_, restoreErr = s.configureIfUp(name, backup)
+			}
+			if restoreErr != nil {
+				log.Errorf("Agent: cannot restore the config of %s: %v", name, restoreErr)
+				message += fmt.Sprintf(", and the former config cannot be restored: %v", restoreErr)
+			} else {
+				message += ", restored the former config"
+			}
+		}
+		log.Errorf("Agent: cannot apply the config of %s: %s", name, message)
+		return c.JSON(http.StatusInternalServerError, applyResponse{Success: false, Message: message, Result: result})
+	}
+
+	log.Infof("Agent: applied the config of %s requested by %s and configured %d peers", name, c.RealIP(), len(result.Peers))
+	return c.JSON(http.StatusOK, applyResponse{Success: true, Message: "Config applied", Result: result})
+}
+
+// configureIfUp configures the device of a running interface to match
+// content. A stopped interface reads the file when it is started.
+func (s server) configureIfUp(name string, content []byte) (model.DeviceSync, error) {
+	if up, err := s.Backend.IsUp(name); err == nil && !up {
+		return model.DeviceSync{Device: name}, nil
+	}
+	server, clients, settings, err := util.ParseServerConfig(content)
+	if err != nil {
+		return model.DeviceSync{Device: name}, err
+	}
+	settings.ConfigFilePath = s.configPath(name)
+	result, err := util.SyncDevice(s.Backend, name, server, clients, settings)
+	result.Device = name
+	if err == nil && result.Failed > 0 {
+		err = fmt.Errorf("cannot configure %d of %d peers of %s", result.Failed, len(result.Peers), name)
+	}
+	return result, err
+}
+
+// deviceError responds to an error reading or configuring a device.
+func deviceError(c echo.Context, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return c.JSON(http.StatusNotFound, response{Success: false, Message: fmt.Sprintf("Interface %s is not running", c.Param("name"))})
+	}
+	return c.JSON(http.StatusInternalServerError, response{Success: false, Message: err.Error()})
+}
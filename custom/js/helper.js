@@ -125,6 +125,7 @@ function renderClientList(data) {
             </div>
           </div>
           <div class="card-body">
+            ${obj.Client.config_outdated ? '<div class="info-box-text text-warning"><i class="fas fa-exclamation-triangle"></i> Configuration outdated, please download it again</div>' : ''}
             <div class="info-box-text"><i class="fas fa-user"></i> ${escapeHtml(obj.Client.name)}</div>
             <div style="display: none"><i class="fas fa-key"></i> ${escapeHtml(obj.Client.public_key)}</div>
             <div style="display: none"><i class="fas fa-subnetrange"></i> ${escapeHtml(subnetRangesString)}</div>
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -149,6 +150,7 @@ func CreateAPIKey(db store.IStore) echo.HandlerFunc {
 		}
 
 		log.Infof("Created API key: %s (ID: %s)", apiKey.Name, apiKey.ID)
+		recordAudit(db, c, "create", "api_key", apiKey.ID, nil, apiKey)
 
 		// Return the API key with the raw key (only shown once)
 		apiKey.Key = ""
@@ -182,6 +184,7 @@ func UpdateAPIKey(db store.IStore) echo.HandlerFunc {
 		}
 
 		// Update fields
+		previous := apiKey
 		apiKey.Name = req.Name
 		apiKey.Permissions = req.Permissions
 		apiKey.Enabled = req.Enabled
@@ -196,6 +199,7 @@ func UpdateAPIKey(db store.IStore) echo.HandlerFunc {
 		}
 
 		log.Infof("Updated API key: %s (ID: %s)", apiKey.Name, apiKey.ID)
+		recordAudit(db, c, "update", "api_key", apiKey.ID, previous, apiKey)
 
 		return c.JSON(http.StatusOK, jsonHTTPResponse{
 			Success: true,
@@ -215,6 +219,14 @@ func DeleteAPIKey(db store.IStore) echo.HandlerFunc {
 			})
 		}
 
+		previous, err := db.GetAPIKeyByID(req.ID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{
+				Success: false,
+				Message: "API key not found",
+			})
+		}
+
 		// Delete from database
 		if err := db.DeleteAPIKey(req.ID); err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
@@ -224,6 +236,7 @@ func DeleteAPIKey(db store.IStore) echo.HandlerFunc {
 		}
 
 		log.Infof("Deleted API key with ID: %s", req.ID)
+		recordAudit(db, c, "delete", "api_key", req.ID, previous, nil)
 
 		return c.JSON(http.StatusOK, jsonHTTPResponse{
 			Success: true,
@@ -250,27 +263,38 @@ func SetGroupStatus(db store.IStore) echo.HandlerFunc {
 			})
 		}
 
-		// Get all clients
-		clients, err := db.GetClients(false)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to retrieve clients: %v", err),
-			})
-		}
-
-		// Update clients in the specified group
+		// Update all clients of the group in one transaction, so the group is
+		// never left partially enabled
 		updatedCount := 0
-		for _, clientData := range clients {
-			if clientData.Client.Group == req.Group {
-				client := *clientData.Client
-				client.Enabled = req.Enabled
-				if err := db.SaveClient(client); err != nil {
-					log.Errorf("Failed to update client %s: %v", client.ID, err)
-					continue
+		err := db.WithTx(func(tx store.IStore) error {
+			clients, err := tx.GetClients(false)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve clients: %v", err)
+			}
+
+			for _, clientData := range clients {
+				if clientData.Client.Group == req.Group {
+					client := *clientData.Client
+					client.Enabled = req.Enabled
+					if err := tx.SaveClient(client); err != nil {
+						return fmt.Errorf("failed to update client %s: %w", client.ID, err)
+					}
+					recordAudit(tx, c, "status", "client", client.ID, *clientData.Client, client)
+					updatedCount++
 				}
-				updatedCount++
 			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Failed to change status of group '%s': %v", req.Group, err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, store.ErrRevisionConflict) {
+				status = http.StatusConflict
+			}
+			return c.JSON(status, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to update group '%s', no clients were changed: %v", req.Group, err),
+			})
 		}
 
 		status := "enabled"
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/rs/xid"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// auditSecretFields lists JSON fields that are recorded as changed in the
+// audit log, but never with their values.
+var auditSecretFields = map[string]bool{
+	"private_key":   true,
+	"preshared_key": true,
+	"password":      true,
+	"password_hash": true,
+	"key":           true,
+}
+
+// auditIgnoredFields lists JSON fields that change on every save and are
+// left out of the audit log.
+var auditIgnoredFields = map[string]bool{
+	"revision":   true,
+	"updated_at": true,
+}
+
+// maxAuditEntries caps the number of entries returned by one audit query.
+const maxAuditEntries = 1000
+
+// recordAudit writes an audit entry for a change made by the current request.
+// before and after are the changed record as it was and as it is now; either
+// may be nil for records that were created or deleted. A failure to write the
+// entry is logged, but does not fail the request.
+func recordAudit(db store.IStore, c echo.Context, action, targetType, targetID string, before, after interface{}) {
+	actor := currentActor(c)
+	if actor == "" {
+		actor = "anonymous"
+	}
+	entry := model.AuditEntry{
+		ID:         xid.New().String(),
+		Actor:      actor,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		SourceIP:   c.RealIP(),
+		Changes:    auditChanges(before, after),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := db.SaveAuditEntry(entry); err != nil {
+		log.Errorf("Cannot write audit entry for %s %s %s: %v", action, targetType, targetID, err)
+	}
+}
+
+// auditChanges compares the JSON representation of two records field by field.
+func auditChanges(before, after interface{}) map[string]model.AuditChange {
+	oldFields, newFields := auditFields(before), auditFields(after)
+
+	changes := make(map[string]model.AuditChange)
+	for name, value := range newFields {
+		if old, ok := oldFields[name]; !ok || !reflect.DeepEqual(old, value) {
+			changes[name] = model.AuditChange{Before: old, After: value}
+		}
+	}
+	for name, old := range oldFields {
+		if _, ok := newFields[name]; !ok {
+			changes[name] = model.AuditChange{Before: old}
+		}
+	}
+
+	for name, change := range changes {
+		if auditIgnoredFields[name] {
+			delete(changes, name)
+		} else if auditSecretFields[name] {
+			changes[name] = model.AuditChange{Before: redact(change.Before), After: redact(change.After)}
+		}
+	}
+	return changes
+}
+
+// auditFields returns the top-level JSON fields of a record.
+func auditFields(record interface{}) map[string]interface{} {
+	if record == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// redact hides a secret value, keeping only whether it was set.
+func redact(value interface{}) interface{} {
+	if value == nil || value == "" {
+		return value
+	}
+	return "[redacted]"
+}
+
+// AuditLogPage renders the audit log page
+func AuditLogPage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.Render(http.StatusOK, "audit.html", map[string]interface{}{
+			"baseData": model.BaseData{
+				Active:      "audit",
+				CurrentUser: currentUser(c),
+				Admin:       isAdmin(c),
+			},
+		})
+	}
+}
+
+// GetAuditLog returns the audit entries matching the query parameters actor,
+// action, target_type, target_id, since and until (RFC 3339) and limit.
+func GetAuditLog(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter := model.AuditFilter{
+			Actor:      c.QueryParam("actor"),
+			Action:     c.QueryParam("action"),
+			TargetType: c.QueryParam("target_type"),
+			TargetID:   c.QueryParam("target_id"),
+			Limit:      100,
+		}
+
+		for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if value := c.QueryParam(param); value != "" {
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Invalid %s, expected an RFC 3339 timestamp", param)})
+				}
+				*dst = t
+			}
+		}
+		if value := c.QueryParam("limit"); value != "" {
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 {
+				return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid limit"})
+			}
+			filter.Limit = min(limit, maxAuditEntries)
+		}
+
+		entries, err := db.GetAuditEntries(filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get audit log: %v", err),
+			})
+		}
+		if entries == nil {
+			entries = []model.AuditEntry{}
+		}
+		return c.JSON(http.StatusOK, entries)
+	}
+}
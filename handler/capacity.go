@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/swissmakers/wireguard-manager/ipam"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// Capacity statuses, from the least to the most severe
+const (
+	capacityOK       = "ok"
+	capacityWarning  = "warning"
+	capacityCritical = "critical"
+)
+
+// capacityEntry is the utilization of a server interface address or of a
+// subnet range
+type capacityEntry struct {
+	Type             string   `json:"type"`
+	Name             string   `json:"name"`
+	Interface        string   `json:"interface,omitempty"`
+	CIDRs            []string `json:"cidrs"`
+	Total            *big.Int `json:"total"`
+	Allocated        int      `json:"allocated"`
+	Reserved         *big.Int `json:"reserved"`
+	Free             *big.Int `json:"free"`
+	FreeBlocks       int      `json:"free_blocks"`
+	LargestFreeBlock *big.Int `json:"largest_free_block"`
+	Utilization      float64  `json:"utilization"`
+	Fragmentation    float64  `json:"fragmentation"`
+	Status           string   `json:"status"`
+}
+
+// capacityReport lists the utilization of all server interface addresses and
+// subnet ranges. Warnings has a message for every entry that reached a
+// threshold.
+type capacityReport struct {
+	WarningThreshold  int             `json:"warning_threshold"`
+	CriticalThreshold int             `json:"critical_threshold"`
+	Status            string          `json:"status"`
+	Interfaces        []capacityEntry `json:"interfaces"`
+	SubnetRanges      []capacityEntry `json:"subnet_ranges"`
+	Warnings          []string        `json:"warnings"`
+}
+
+// GetCapacityReport returns the utilization of each address of the WireGuard
+// interfaces and of each subnet range, rated against the capacity thresholds
+func GetCapacityReport(db store.IStore, pool *ipam.Pool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		report, err := buildCapacityReport(db, pool)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get capacity report: %v", err),
+			})
+		}
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+// buildCapacityReport computes the usage of all networks in one pass over the
+// allocations.
+func buildCapacityReport(db store.IStore, pool *ipam.Pool) (capacityReport, error) {
+	ifaces, err := util.GetInterfaces(db)
+	if err != nil {
+		return capacityReport{}, err
+	}
+	ranges, err := db.GetSubnetRanges()
+	if err != nil {
+		return capacityReport{}, err
+	}
+
+	var addresses, names, cidrs []string
+	for _, iface := range ifaces {
+		for _, address := range iface.Addresses {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(address))
+			if err != nil {
+				continue
+			}
+			addresses = append(addresses, address)
+			names = append(names, iface.Name)
+			cidrs = append(cidrs, prefix.Masked().String())
+		}
+	}
+	for _, subnetRange := range ranges {
+		cidrs = append(cidrs, subnetRange.CIDRs...)
+	}
+	usages, err := pool.Usage(cidrs)
+	if err != nil {
+		return capacityReport{}, err
+	}
+
+	report := capacityReport{
+		WarningThreshold:  util.CapacityWarning,
+		CriticalThreshold: util.CapacityCritical,
+		Status:            capacityOK,
+		Interfaces:        []capacityEntry{},
+		SubnetRanges:      []capacityEntry{},
+		Warnings:          []string{},
+	}
+	add := func(entries *[]capacityEntry, kind, name, iface string, usage []ipam.Usage) {
+		entry := newCapacityEntry(kind, name, usage)
+		entry.Interface = iface
+		*entries = append(*entries, entry)
+		if entry.Status == capacityOK {
+			return
+		}
+		if entry.Status == capacityCritical || report.Status == capacityOK {
+			report.Status = entry.Status
+		}
+		label := "Server address"
+		if kind == "subnet_range" {
+			label = "Subnet range"
+		} else if len(ifaces) > 1 {
+			label = "Address of " + iface
+		}
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%s %s is %.1f%% used, %s of %s addresses are free",
+			label, name, entry.Utilization, entry.Free, entry.Total))
+	}
+	for i, address := range addresses {
+		add(&report.Interfaces, "interface", address, names[i], usages[i:i+1])
+	}
+	usages = usages[len(addresses):]
+	for _, subnetRange := range ranges {
+		add(&report.SubnetRanges, "subnet_range", subnetRange.Name, "", usages[:len(subnetRange.CIDRs)])
+		usages = usages[len(subnetRange.CIDRs):]
+	}
+	return report, nil
+}
+
+// newCapacityEntry sums up the usage of the CIDRs of a network and rates it
+// against the thresholds. A network without free addresses is always
+// critical.
+func newCapacityEntry(kind, name string, usages []ipam.Usage) capacityEntry {
+	sum := ipam.Sum(usages)
+	entry := capacityEntry{
+		Type:             kind,
+		Name:             name,
+		CIDRs:            []string{},
+		Total:            sum.Total,
+		Allocated:        len(sum.Allocated),
+		Reserved:         sum.Reserved,
+		Free:             sum.Free,
+		FreeBlocks:       sum.FreeBlocks,
+		LargestFreeBlock: sum.LargestFreeBlock,
+		Utilization:      math.Round(sum.Utilization()*10) / 10,
+		Fragmentation:    math.Round(sum.Fragmentation()*10) / 10,
+		Status:           capacityOK,
+	}
+	for _, usage := range usages {
+		entry.CIDRs = append(entry.CIDRs, usage.CIDR)
+	}
+
+	utilization := sum.Utilization()
+	switch {
+	case sum.Free.Sign() == 0, util.CapacityCritical > 0 && utilization >= float64(util.CapacityCritical):
+		entry.Status = capacityCritical
+	case util.CapacityWarning > 0 && utilization >= float64(util.CapacityWarning):
+		entry.Status = capacityWarning
+	}
+	return entry
+}
@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/rs/xid"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/ipam"
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+	"github.com/swissmakers/wireguard-manager/wgctl"
+)
+
+type adoptPeersRequest struct {
+	// PublicKeys selects the unknown peers to adopt, all of them if empty
+	PublicKeys []string `json:"public_keys"`
+}
+
+// adoptResult is the outcome of adopting one unknown peer
+type adoptResult struct {
+	PublicKey string `json:"public_key"`
+	ClientID  string `json:"client_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// deviceSyncResponse lists the peers configured on the device and the config
+// revision written
+type deviceSyncResponse struct {
+	Success  bool                  `json:"success"`
+	Message  string                `json:"message"`
+	Result   model.DeviceSync      `json:"result"`
+	Revision *model.ConfigRevision `json:"revision,omitempty"`
+}
+
+// GetDrift compares the live WireGuard device of the interface given by the
+// "interface" query parameter with the interface and its clients in the
+// database
+func GetDrift(db store.IStore, backend wgctl.Backend) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		iface, err := interfaceParam(db, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		clients, err := db.GetClients(false)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get client config"})
+		}
+		device, err := liveDevice(backend, iface)
+		if err != nil {
+			log.Error("Cannot read WireGuard device: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		return c.JSON(http.StatusOK, util.CheckDrift(device, iface.Server(), util.InterfaceClients(clients, iface)))
+	}
+}
+
+// ReconcileDrift writes the server config file and configures the live device
+// to match the database, removing peers without an enabled client
+func ReconcileDrift(db store.IStore, tmplDir fs.FS, backend wgctl.Backend) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		iface, err := interfaceParam(db, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		rendered, err := renderServerConfig(db, tmplDir, iface)
+		if err != nil {
+			log.Error("Cannot reconcile WireGuard device: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		server, clients, settings := rendered.server, rendered.clients, rendered.settings
+
+		// Keep the config file in line, so a restart does not bring the drift back
+		result, revision, err := applyRevision(db, backend, model.ConfigRevision{
+			Path:    settings.ConfigFilePath,
+			Content: string(rendered.data),
+			Author:  currentActor(c),
+			Comment: "reconcile",
+		}, server, clients, settings)
+		if result.Interface || len(result.Peers) > 0 {
+			recordAudit(db, c, "reconcile", "wireguard", result.Device, nil, nil)
+		}
+		if err != nil {
+			log.Errorf("Cannot reconcile WireGuard device %s: %v", result.Device, err)
+			return c.JSON(http.StatusInternalServerError, deviceSyncResponse{
+				Success:  false,
+				Message:  fmt.Sprintf("Cannot reconcile WireGuard device %s: %v", result.Device, err),
+				Result:   result,
+				Revision: &revision,
+			})
+		}
+
+		// The device and the config file now match the database
+		if err := util.UpdateAppliedState(db, iface, util.NewConfigState(server, clients, settings)); err != nil {
+			log.Error("Cannot update hashes: ", err)
+		}
+		return c.JSON(http.StatusOK, deviceSyncResponse{
+			Success:  true,
+			Message:  fmt.Sprintf("Reconciled %d peers of %s", len(result.Peers), result.Device),
+			Result:   result,
+			Revision: &revision,
+		})
+	}
+}
+
+// AdoptPeers creates a client for each selected peer of the live device that
+// has none in the database. The client gets the peer's public key, preshared
+// key and allowed IPs and is bound to the interface of the device; its private
+// key is unknown.
+func AdoptPeers(db store.IStore, pool *ipam.Pool, backend wgctl.Backend) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req adoptPeersRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid request"})
+		}
+		iface, err := interfaceParam(db, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		clients, err := db.GetClients(false)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get client config"})
+		}
+		device, err := liveDevice(backend, iface)
+		if err != nil {
+			log.Error("Cannot read WireGuard device: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		unknown := make(map[string]bool)
+		for _, drift := range util.CheckDrift(device, iface.Server(), util.InterfaceClients(clients, iface)).Peers {
+			if drift.Status == model.DriftUnknown {
+				unknown[drift.PublicKey] = true
+			}
+		}
+		// A peer whose addresses cannot be allocated is reported and skipped.
+		// Any other failure undoes the clients adopted so far.
+		defaults := util.ClientDefaultsFromEnv()
+		var results []adoptResult
+		err = db.WithTx(func(tx store.IStore) error {
+			results = []adoptResult{}
+			for _, peer := range device.Peers {
+				publicKey := peer.PublicKey.String()
+				if !unknown[publicKey] || len(req.PublicKeys) > 0 && !slices.Contains(req.PublicKeys, publicKey) {
+					continue
+				}
+				result := adoptResult{PublicKey: publicKey}
+				client, err := adoptPeer(tx, pool, peer, defaults, util.ClientInterfaceName(iface))
+				switch {
+				case errors.Is(err, ipam.ErrInvalidAllocation):
+					result.Error = err.Error()
+				case err != nil:
+					return fmt.Errorf("cannot adopt peer %s: %w", publicKey, err)
+				default:
+					result.ClientID, result.Name = client.ID, client.Name
+					recordAudit(tx, c, "adopt", "client", client.ID, nil, client)
+				}
+				results = append(results, result)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Error("Cannot adopt peers: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("%v, no peers were adopted", err)})
+		}
+		for _, result := range results {
+			if result.Error == "" {
+				log.Infof("Adopted peer %s as client %s", result.PublicKey, result.Name)
+			}
+		}
+		return c.JSON(http.StatusOK, results)
+	}
+}
+
+// adoptPeer saves a live peer as a new client of the named interface.
+func adoptPeer(db store.IStore, pool *ipam.Pool, peer wgtypes.Peer, defaults model.ClientDefaults, interfaceName string) (model.Client, error) {
+	publicKey := peer.PublicKey.String()
+	now := time.Now().UTC()
+	client := model.Client{
+		ID:              xid.New().String(),
+		PublicKey:       publicKey,
+		Name:            "adopted-" + publicKey[:8],
+		Interface:       interfaceName,
+		AllocatedIPs:    []string{},
+		AllowedIPs:      defaults.AllowedIPs,
+		ExtraAllowedIPs: defaults.ExtraAllowedIPs,
+		UseServerDNS:    defaults.UseServerDNS,
+		Enabled:         true,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if peer.PresharedKey != (wgtypes.Key{}) {
+		client.PresharedKey = peer.PresharedKey.String()
+	}
+	for _, ipNet := range peer.AllowedIPs {
+		client.AllocatedIPs = append(client.AllocatedIPs, ipNet.String())
+	}
+
+	err := pool.Assign(client.ID, client.AllocatedIPs, func() error {
+		return db.SaveClient(client)
+	})
+	if errors.Is(err, ipam.ErrInvalidAllocation) {
+		return client, fmt.Errorf("cannot allocate the allowed IPs of the peer: %w", err)
+	}
+	client.Revision = 1
+	return client, err
+}
+
+// syncDevice configures the WireGuard device of the server config file to
+// match the database.
+func syncDevice(backend wgctl.Backend, server model.Server, clients []model.ClientData, settings model.GlobalSetting) (model.DeviceSync, error) {
+	name := util.GetWireGuardInterface(settings.ConfigFilePath)
+	result, err := util.SyncDevice(backend, name, server, clients, settings)
+	result.Device = name
+	return result, err
+}
+
+// liveDevice reads the WireGuard device of iface.
+func liveDevice(backend wgctl.Backend, iface model.WireGuardInterface) (*wgtypes.Device, error) {
+	device, err := backend.Device(iface.Name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read WireGuard device %s: %w", iface.Name, err)
+	}
+	return device, nil
+}
@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// interfaceParam returns the WireGuard interface given by the "interface"
+// query parameter, the primary one if it is empty.
+func interfaceParam(db store.IStore, c echo.Context) (model.WireGuardInterface, error) {
+	return util.LookupInterface(db, c.QueryParam("interface"))
+}
+
+// publicInterface strips the private key and the applied state of iface for a
+// response.
+func publicInterface(iface model.WireGuardInterface) model.WireGuardInterface {
+	iface.PrivateKey = ""
+	iface.Applied = nil
+	return iface
+}
+
+// checkPrimaryConflicts checks the primary interface as configured by server
+// and settings against the further interfaces.
+func checkPrimaryConflicts(db store.IStore, server model.Server, settings model.GlobalSetting) error {
+	others, err := db.GetWireGuardInterfaces()
+	if err != nil {
+		return fmt.Errorf("cannot get interfaces: %v", err)
+	}
+	return util.CheckInterfaceConflicts(others, util.PrimaryInterface(server, settings))
+}
+
+// GetWireGuardInterfaces returns all WireGuard interfaces, the primary one
+// first, without their private keys
+func GetWireGuardInterfaces(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ifaces, err := util.GetInterfaces(db)
+		if err != nil {
+			log.Error("Cannot get interfaces: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get interfaces"})
+		}
+		for i := range ifaces {
+			ifaces[i] = publicInterface(ifaces[i])
+		}
+		return c.JSON(http.StatusOK, ifaces)
+	}
+}
+
+// GetWireGuardInterface returns a WireGuard interface without its private key
+func GetWireGuardInterface(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		iface, err := util.LookupInterface(db, c.Param("name"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		setETag(c, iface.Revision)
+		return c.JSON(http.StatusOK, publicInterface(iface))
+	}
+}
+
+// CreateWireGuardInterface adds a WireGuard interface with a new key pair.
+// Its config file is written by the first apply.
+func CreateWireGuardInterface(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var iface model.WireGuardInterface
+		if err := c.Bind(&iface); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid interface data"})
+		}
+		settings, err := db.GetGlobalSettings()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get global settings"})
+		}
+		iface.Name = strings.TrimSpace(iface.Name)
+		if iface.ConfigFilePath == "" {
+			iface.ConfigFilePath = util.InterfaceConfigPath(settings.ConfigFilePath, iface.Name)
+		}
+		if err := validateInterface(db, &iface); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			log.Error("Cannot generate wireguard key pair: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot generate WireGuard key pair"})
+		}
+		now := time.Now().UTC()
+		iface.PrivateKey = key.String()
+		iface.PublicKey = key.PublicKey().String()
+		iface.CreatedAt = now
+		iface.UpdatedAt = now
+		iface.Revision = 0
+		if err := db.SaveWireGuardInterface(iface); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return c.JSON(http.StatusConflict, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Interface %s already exists", iface.Name)})
+			}
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		iface.Revision = 1
+
+		log.Infof("Created wireguard interface %s: %v", iface.Name, iface.Addresses)
+		recordAudit(db, c, "create", "wireguard_interface", iface.Name, nil, publicInterface(iface))
+		reloadSubnetRanges(db)
+		setETag(c, iface.Revision)
+		return c.JSON(http.StatusOK, publicInterface(iface))
+	}
+}
+
+// UpdateWireGuardInterface changes the settings of a WireGuard interface. Its
+// name and key pair are kept. The primary interface is changed through the
+// server and global settings instead.
+func UpdateWireGuardInterface(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var update model.WireGuardInterface
+		if err := c.Bind(&update); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid interface data"})
+		}
+		previous, err := db.GetWireGuardInterface(c.Param("name"))
+		if err != nil {
+			return primaryOrNotFound(db, c)
+		}
+		revision, err := expectedRevision(c, update.Revision, previous.Revision)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		iface := previous
+		iface.Description = update.Description
+		iface.Addresses = update.Addresses
+		iface.ListenPort = update.ListenPort
+		iface.PostUp = update.PostUp
+		iface.PreDown = update.PreDown
+		iface.PostDown = update.PostDown
+		iface.MTU = update.MTU
+		iface.DNSServers = update.DNSServers
+		iface.Node = update.Node
+		if update.ConfigFilePath != "" {
+			iface.ConfigFilePath = update.ConfigFilePath
+		}
+		if err := validateInterface(db, &iface); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		iface.UpdatedAt = time.Now().UTC()
+		iface.Revision = revision
+		if err := db.SaveWireGuardInterface(iface); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "interface")
+			}
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		iface.Revision = revision + 1
+
+		log.Infof("Updated wireguard interface %s: %v", iface.Name, iface.Addresses)
+		recordAudit(db, c, "update", "wireguard_interface", iface.Name, publicInterface(previous), publicInterface(iface))
+		reloadSubnetRanges(db)
+		setETag(c, iface.Revision)
+		return c.JSON(http.StatusOK, publicInterface(iface))
+	}
+}
+
+// RegenerateWireGuardInterfaceKeyPair gives a WireGuard interface a new key
+// pair. The configs of its clients have to be distributed again.
+func RegenerateWireGuardInterfaceKeyPair(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		iface, err := db.GetWireGuardInterface(c.Param("name"))
+		if err != nil {
+			return primaryOrNotFound(db, c)
+		}
+		if iface.Revision, err = expectedRevision(c, 0, iface.Revision); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			log.Error("Cannot generate wireguard key pair: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot generate WireGuard key pair"})
+		}
+		previousKey := iface.PublicKey
+		iface.PrivateKey = key.String()
+		iface.PublicKey = key.PublicKey().String()
+		iface.UpdatedAt = time.Now().UTC()
+		if err := db.SaveWireGuardInterface(iface); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "interface")
+			}
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot generate WireGuard key pair"})
+		}
+		iface.Revision++
+
+		log.Infof("Updated key pair of wireguard interface %s: %s", iface.Name, iface.PublicKey)
+		recordAudit(db, c, "regenerate", "wireguard_interface", iface.Name,
+			map[string]string{"public_key": previousKey}, map[string]string{"public_key": iface.PublicKey})
+		setETag(c, iface.Revision)
+		return c.JSON(http.StatusOK, publicInterface(iface))
+	}
+}
+
+// DeleteWireGuardInterface removes a WireGuard interface without clients. Its
+// config file is left on disk and the device keeps running until it is
+// stopped.
+func DeleteWireGuardInterface(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		iface, err := db.GetWireGuardInterface(c.Param("name"))
+		if err != nil {
+			return primaryOrNotFound(db, c)
+		}
+		clients, err := db.GetClients(false)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get clients"})
+		}
+		trashed, err := db.GetTrashedClients()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get trashed clients"})
+		}
+		if bound := util.InterfaceClients(append(clients, trashed...), iface); len(bound) > 0 {
+			return c.JSON(http.StatusConflict, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Interface %s still has %d clients, including trashed ones. Move or purge them first.", iface.Name, len(bound)),
+			})
+		}
+		if err := db.DeleteWireGuardInterface(iface.Name); err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		log.Infof("Wireguard interface %s removed by %s", iface.Name, currentActor(c))
+		recordAudit(db, c, "delete", "wireguard_interface", iface.Name, publicInterface(iface), nil)
+		reloadSubnetRanges(db)
+		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Interface removed successfully"})
+	}
+}
+
+// primaryOrNotFound responds to a change of an interface that is not stored:
+// either the primary one or one that does not exist.
+func primaryOrNotFound(db store.IStore, c echo.Context) error {
+	if iface, err := util.LookupInterface(db, c.Param("name")); err == nil && iface.Primary {
+		return c.JSON(http.StatusBadRequest, jsonHTTPResponse{
+			Success: false,
+			Message: fmt.Sprintf("Interface %s is the primary interface, change it in the server and global settings", iface.Name),
+		})
+	}
+	return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Interface %s not found", c.Param("name"))})
+}
+
+// validateInterface checks the settings of a new or changed interface, that
+// its node exists and that it conflicts with none of the others.
+func validateInterface(db store.IStore, iface *model.WireGuardInterface) error {
+	if err := util.ValidateInterfaceName(iface.Name); err != nil {
+		return err
+	}
+	if filepath.Base(iface.ConfigFilePath) != iface.Name+".conf" || !filepath.IsAbs(iface.ConfigFilePath) {
+		return fmt.Errorf("config file must be an absolute path named %s.conf", iface.Name)
+	}
+	if len(iface.Addresses) == 0 || !util.ValidateServerAddresses(iface.Addresses) {
+		return fmt.Errorf("interface IP address must be in CIDR format")
+	}
+	if iface.ListenPort < 0 || iface.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port %d", iface.ListenPort)
+	}
+	if iface.MTU < 0 {
+		return fmt.Errorf("invalid MTU %d", iface.MTU)
+	}
+	if !util.ValidateIPAndSearchDomainAddressList(iface.DNSServers) {
+		return fmt.Errorf("invalid DNS server address")
+	}
+	if iface.Node != "" {
+		if _, err := db.GetNode(iface.Node); err != nil {
+			return fmt.Errorf("node %s not found", iface.Node)
+		}
+	}
+	ifaces, err := util.GetInterfaces(db)
+	if err != nil {
+		return err
+	}
+	return util.CheckInterfaceConflicts(ifaces, *iface)
+}
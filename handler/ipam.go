@@ -0,0 +1,412 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/rs/xid"
+
+	"github.com/swissmakers/wireguard-manager/ipam"
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+type createIPReservationRequest struct {
+	Address     string `json:"address"`
+	Description string `json:"description"`
+}
+
+type deleteIPReservationRequest struct {
+	ID string `json:"id"`
+}
+
+// GetIPReservations returns the addresses reserved from client allocation
+func GetIPReservations(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		reservations, err := db.GetIPReservations()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get IP reservations: %v", err),
+			})
+		}
+		if reservations == nil {
+			reservations = []model.IPReservation{}
+		}
+		return c.JSON(http.StatusOK, reservations)
+	}
+}
+
+// CreateIPReservation reserves an address or prefix so that it is never
+// allocated to a client
+func CreateIPReservation(db store.IStore, pool *ipam.Pool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req createIPReservationRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{
+				Success: false,
+				Message: "Invalid request data",
+			})
+		}
+
+		reservation, err := pool.Reserve(model.IPReservation{
+			Address:     req.Address,
+			Description: req.Description,
+			CreatedBy:   currentActor(c),
+		})
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ipam.ErrInvalidAllocation) {
+				status = http.StatusBadRequest
+			}
+			return c.JSON(status, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot reserve %s: %v", req.Address, err),
+			})
+		}
+
+		log.Infof("Reserved %s: %s", reservation.Address, reservation.Description)
+		recordAudit(db, c, "create", "ip_reservation", reservation.ID, nil, reservation)
+		return c.JSON(http.StatusOK, reservation)
+	}
+}
+
+// DeleteIPReservation releases a reserved address or prefix
+func DeleteIPReservation(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req deleteIPReservationRequest
+		if err := c.Bind(&req); err != nil || req.ID == "" {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{
+				Success: false,
+				Message: "Invalid request data",
+			})
+		}
+
+		var previous interface{}
+		if reservations, err := db.GetIPReservations(); err == nil {
+			for _, reservation := range reservations {
+				if reservation.ID == req.ID {
+					previous = reservation
+					break
+				}
+			}
+		}
+
+		if err := db.DeleteIPReservation(req.ID); err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot delete IP reservation: %v", err),
+			})
+		}
+
+		log.Infof("IP reservation %s removed by %s", req.ID, currentActor(c))
+		recordAudit(db, c, "delete", "ip_reservation", req.ID, previous, nil)
+		return c.JSON(http.StatusOK, jsonHTTPResponse{
+			Success: true,
+			Message: "IP reservation removed successfully",
+		})
+	}
+}
+
+type subnetRangeRequest struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	CIDRs    []string `json:"cidrs"`
+	Position *int     `json:"position"`
+}
+
+type deleteSubnetRangeRequest struct {
+	ID string `json:"id"`
+}
+
+// subnetRangeUsage is a subnet range with the utilization of its CIDRs.
+type subnetRangeUsage struct {
+	model.SubnetRange
+	Usage []ipam.Usage `json:"usage"`
+}
+
+// GetSubnetRanges returns the subnet ranges with their CIDRs
+func GetSubnetRanges(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ranges, err := db.GetSubnetRanges()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get subnet ranges: %v", err),
+			})
+		}
+		if ranges == nil {
+			ranges = []model.SubnetRange{}
+		}
+		return c.JSON(http.StatusOK, ranges)
+	}
+}
+
+// GetSubnetRangeUsage returns the subnet ranges with the allocated and free
+// addresses of each of their CIDRs
+func GetSubnetRangeUsage(db store.IStore, pool *ipam.Pool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ranges, err := db.GetSubnetRanges()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get subnet ranges: %v", err),
+			})
+		}
+
+		usages := make([]subnetRangeUsage, 0, len(ranges))
+		for _, subnetRange := range ranges {
+			usage, err := pool.Usage(subnetRange.CIDRs)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+					Success: false,
+					Message: fmt.Sprintf("Cannot get usage of subnet range %s: %v", subnetRange.Name, err),
+				})
+			}
+			usages = append(usages, subnetRangeUsage{SubnetRange: subnetRange, Usage: usage})
+		}
+		return c.JSON(http.StatusOK, usages)
+	}
+}
+
+// CreateSubnetRange adds a subnet range
+func CreateSubnetRange(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req subnetRangeRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{
+				Success: false,
+				Message: "Invalid request data",
+			})
+		}
+
+		ranges, err := db.GetSubnetRanges()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get subnet ranges: %v", err),
+			})
+		}
+
+		now := time.Now().UTC()
+		subnetRange := model.SubnetRange{
+			ID:        xid.New().String(),
+			Name:      req.Name,
+			CIDRs:     req.CIDRs,
+			Position:  len(ranges),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if req.Position != nil {
+			subnetRange.Position = *req.Position
+		}
+		if err := validateSubnetRange(db, ranges, &subnetRange); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		if err := db.SaveSubnetRange(subnetRange); err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot create subnet range: %v", err),
+			})
+		}
+		reloadSubnetRanges(db)
+
+		log.Infof("Created subnet range %s", subnetRange.Name)
+		recordAudit(db, c, "create", "subnet_range", subnetRange.ID, nil, subnetRange)
+		return c.JSON(http.StatusOK, subnetRange)
+	}
+}
+
+// UpdateSubnetRange changes the name, CIDRs or position of a subnet range
+func UpdateSubnetRange(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req subnetRangeRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{
+				Success: false,
+				Message: "Invalid request data",
+			})
+		}
+
+		ranges, err := db.GetSubnetRanges()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get subnet ranges: %v", err),
+			})
+		}
+		idx := slices.IndexFunc(ranges, func(r model.SubnetRange) bool { return r.ID == req.ID })
+		if idx < 0 {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{
+				Success: false,
+				Message: "Subnet range not found",
+			})
+		}
+
+		previous := ranges[idx]
+		subnetRange := previous
+		subnetRange.Name = req.Name
+		subnetRange.CIDRs = req.CIDRs
+		if req.Position != nil {
+			subnetRange.Position = *req.Position
+		}
+		subnetRange.UpdatedAt = time.Now().UTC()
+		if err := validateSubnetRange(db, ranges, &subnetRange); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		if err := db.SaveSubnetRange(subnetRange); err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot update subnet range: %v", err),
+			})
+		}
+		reloadSubnetRanges(db)
+
+		log.Infof("Updated subnet range %s", subnetRange.Name)
+		recordAudit(db, c, "update", "subnet_range", subnetRange.ID, previous, subnetRange)
+		return c.JSON(http.StatusOK, subnetRange)
+	}
+}
+
+// DeleteSubnetRange removes a subnet range. The addresses of its clients are
+// not changed.
+func DeleteSubnetRange(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req deleteSubnetRangeRequest
+		if err := c.Bind(&req); err != nil || req.ID == "" {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{
+				Success: false,
+				Message: "Invalid request data",
+			})
+		}
+
+		var previous interface{}
+		if ranges, err := db.GetSubnetRanges(); err == nil {
+			for _, subnetRange := range ranges {
+				if subnetRange.ID == req.ID {
+					previous = subnetRange
+					break
+				}
+			}
+		}
+
+		if err := db.DeleteSubnetRange(req.ID); err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot delete subnet range: %v", err),
+			})
+		}
+		reloadSubnetRanges(db)
+
+		log.Infof("Subnet range %s removed by %s", req.ID, currentActor(c))
+		recordAudit(db, c, "delete", "subnet_range", req.ID, previous, nil)
+		return c.JSON(http.StatusOK, jsonHTTPResponse{
+			Success: true,
+			Message: "Subnet range removed successfully",
+		})
+	}
+}
+
+// validateSubnetRange checks a new or changed subnet range against the
+// networks of the interfaces and the names of the other ranges.
+func validateSubnetRange(db store.IStore, ranges []model.SubnetRange, subnetRange *model.SubnetRange) error {
+	ifaces, err := util.GetInterfaces(db)
+	if err != nil {
+		return err
+	}
+	if err := util.ValidateSubnetRange(ifaces, subnetRange); err != nil {
+		return err
+	}
+	for _, other := range ranges {
+		if other.ID != subnetRange.ID && other.Name == subnetRange.Name {
+			return fmt.Errorf("subnet range %s already exists", subnetRange.Name)
+		}
+	}
+	return nil
+}
+
+// reloadSubnetRanges refreshes the subnet ranges used to serve requests after
+// they or the server networks were changed.
+func reloadSubnetRanges(db store.IStore) {
+	if err := util.LoadSubnetRanges(db); err != nil {
+		log.Errorf("Cannot reload subnet ranges: %v", err)
+	}
+}
+
+type renumberRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// PreviewRenumbering returns the changes that moving a network of the
+// interface given by the "interface" query parameter onto a new network would
+// make, without saving them
+func PreviewRenumbering(db store.IStore, pool *ipam.Pool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return renumber(c, db, pool, false)
+	}
+}
+
+// RenumberNetwork moves a network of the interface given by the "interface"
+// query parameter onto a new network together with the addresses of its
+// clients and of the reservations and subnet ranges in it
+func RenumberNetwork(db store.IStore, pool *ipam.Pool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return renumber(c, db, pool, true)
+	}
+}
+
+// renumber plans and, if apply is set, applies a renumbering. Every changed
+// record gets its own audit entry.
+func renumber(c echo.Context, db store.IStore, pool *ipam.Pool, apply bool) error {
+	var req renumberRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, jsonHTTPResponse{
+			Success: false,
+			Message: "Invalid request data",
+		})
+	}
+
+	iface, err := interfaceParam(db, c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+	}
+
+	plan, err := pool.Renumber(iface.Name, req.From, req.To, apply)
+	if err != nil {
+		if errors.Is(err, store.ErrRevisionConflict) {
+			return revisionConflict(c, "server configuration")
+		}
+		status := http.StatusInternalServerError
+		if errors.Is(err, ipam.ErrInvalidAllocation) || errors.Is(err, ipam.ErrExhausted) {
+			status = http.StatusBadRequest
+		}
+		return c.JSON(status, jsonHTTPResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+	}
+	if !apply {
+		return c.JSON(http.StatusOK, plan)
+	}
+
+	for _, change := range plan.Changes {
+		before := map[string][]string{"addresses": change.Old}
+		after := map[string][]string{"addresses": change.New}
+		if change.NewAllowedIPs != nil {
+			before["allowed_ips"], after["allowed_ips"] = change.OldAllowedIPs, change.NewAllowedIPs
+		}
+		recordAudit(db, c, "renumber", change.Type, change.ID, before, after)
+	}
+	reloadSubnetRanges(db)
+	log.Infof("Renumbered %s of %s to %s, %d records changed", plan.From, plan.Interface, plan.To, len(plan.Changes))
+	return c.JSON(http.StatusOK, plan)
+}
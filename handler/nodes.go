@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/rs/xid"
+
+	"github.com/swissmakers/wireguard-manager/agent"
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// nodeResponse is a node without its token. HasToken tells whether one is set.
+type nodeResponse struct {
+	model.Node
+	HasToken bool `json:"has_token"`
+}
+
+// publicNode strips the token of node for a response.
+func publicNode(node model.Node) nodeResponse {
+	hasToken := node.Token != ""
+	node.Token = ""
+	return nodeResponse{Node: node, HasToken: hasToken}
+}
+
+// interfaceNodeNames maps the name of every interface that runs on a node to
+// the name of the node.
+func interfaceNodeNames(db store.IStore) (map[string]string, error) {
+	ifaces, err := db.GetWireGuardInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get interfaces: %v", err)
+	}
+	nodes, err := db.GetNodes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get nodes: %v", err)
+	}
+	names := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		names[node.ID] = node.Name
+	}
+	byInterface := make(map[string]string)
+	for _, iface := range ifaces {
+		if iface.Node != "" {
+			byInterface[iface.Name] = names[iface.Node]
+		}
+	}
+	return byInterface, nil
+}
+
+// GetNodes returns all nodes without their tokens
+func GetNodes(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		nodes, err := db.GetNodes()
+		if err != nil {
+			log.Error("Cannot get nodes: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get nodes"})
+		}
+		response := make([]nodeResponse, 0, len(nodes))
+		for _, node := range nodes {
+			response = append(response, publicNode(node))
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// GetNode returns a node without its token
+func GetNode(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		node, err := db.GetNode(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Node %s not found", c.Param("id"))})
+		}
+		setETag(c, node.Revision)
+		return c.JSON(http.StatusOK, publicNode(node))
+	}
+}
+
+// CreateNode registers the agent of a node
+func CreateNode(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var node model.Node
+		if err := c.Bind(&node); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid node data"})
+		}
+		now := time.Now().UTC()
+		node.ID = xid.New().String()
+		node.CreatedAt = now
+		node.UpdatedAt = now
+		node.Revision = 0
+		if err := validateNode(db, &node); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		if err := db.SaveNode(node); err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Cannot create node: %v", err)})
+		}
+		node.Revision = 1
+
+		log.Infof("Created node %s: %s", node.Name, node.URL)
+		recordAudit(db, c, "create", "node", node.ID, nil, publicNode(node))
+		setETag(c, node.Revision)
+		return c.JSON(http.StatusOK, publicNode(node))
+	}
+}
+
+// UpdateNode changes a node. An empty token keeps the current one; the token
+// is removed with remove_token.
+func UpdateNode(db store.IStore) echo.HandlerFunc {
+	type updateNodeRequest struct {
+		model.Node
+		RemoveToken bool `json:"remove_token"`
+	}
+
+	return func(c echo.Context) error {
+		var update updateNodeRequest
+		if err := c.Bind(&update); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid node data"})
+		}
+		previous, err := db.GetNode(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Node %s not found", c.Param("id"))})
+		}
+		revision, err := expectedRevision(c, update.Revision, previous.Revision)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		node := previous
+		node.Name = update.Name
+		node.Description = update.Description
+		node.URL = update.URL
+		node.CACert = update.CACert
+		switch {
+		case update.Token != "":
+			node.Token = update.Token
+		case update.RemoveToken:
+			node.Token = ""
+		}
+		if err := validateNode(db, &node); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		node.UpdatedAt = time.Now().UTC()
+		node.Revision = revision
+		if err := db.SaveNode(node); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "node")
+			}
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		node.Revision = revision + 1
+
+		log.Infof("Updated node %s: %s", node.Name, node.URL)
+		recordAudit(db, c, "update", "node", node.ID, publicNode(previous), publicNode(node))
+		setETag(c, node.Revision)
+		return c.JSON(http.StatusOK, publicNode(node))
+	}
+}
+
+// DeleteNode removes a node no interface is assigned to
+func DeleteNode(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		node, err := db.GetNode(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Node %s not found", c.Param("id"))})
+		}
+		ifaces, err := db.GetWireGuardInterfaces()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get interfaces"})
+		}
+		var assigned []string
+		for _, iface := range ifaces {
+			if iface.Node == node.ID {
+				assigned = append(assigned, iface.Name)
+			}
+		}
+		if len(assigned) > 0 {
+			return c.JSON(http.StatusConflict, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Node %s still runs the interfaces %s. Move or delete them first.", node.Name, strings.Join(assigned, ", ")),
+			})
+		}
+		if err := db.DeleteNode(node.ID); err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		log.Infof("Node %s removed by %s", node.Name, currentActor(c))
+		recordAudit(db, c, "delete", "node", node.ID, publicNode(node), nil)
+		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Node removed successfully"})
+	}
+}
+
+// GetNodeStatus asks the agent of a node for the status of its host
+func GetNodeStatus(db store.IStore, backend *agent.Backend) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		node, err := db.GetNode(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Node %s not found", c.Param("id"))})
+		}
+		client, err := backend.Client(node)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		status, err := client.Status()
+		if err != nil {
+			log.Warnf("Cannot get the status of node %s: %v", node.Name, err)
+			return c.JSON(http.StatusBadGateway, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		return c.JSON(http.StatusOK, status)
+	}
+}
+
+// validateNode checks the settings of a new or changed node and that no other
+// node has its name.
+func validateNode(db store.IStore, node *model.Node) error {
+	node.Name = strings.TrimSpace(node.Name)
+	node.URL = strings.TrimSpace(node.URL)
+	if node.Name == "" {
+		return fmt.Errorf("node name is required")
+	}
+	if u, err := url.Parse(node.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("the agent URL must be an https URL")
+	}
+	if _, err := agent.NewClient(*node, nil); err != nil {
+		return err
+	}
+	nodes, err := db.GetNodes()
+	if err != nil {
+		return fmt.Errorf("cannot get nodes: %v", err)
+	}
+	for _, other := range nodes {
+		if other.ID != node.ID && strings.EqualFold(other.Name, node.Name) {
+			return fmt.Errorf("node %s already exists", node.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// pendingChanges lists what an apply would change in the server
+// configuration. AppliedAt is nil if the configuration was never applied.
+type pendingChanges struct {
+	Changed   bool                 `json:"changed"`
+	AppliedAt *time.Time           `json:"applied_at"`
+	Changes   []model.ConfigChange `json:"changes"`
+}
+
+// GetPendingChanges returns the peer, interface and settings changes made
+// to the interface given by the "interface" query parameter since its last
+// successful apply
+func GetPendingChanges(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		iface, err := interfaceParam(db, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		applied, appliedAt, err := util.AppliedState(db, iface)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get applied configuration: %v", err),
+			})
+		}
+		desired, err := util.DesiredInterfaceState(db, iface)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: fmt.Sprintf("Cannot get configuration: %v", err),
+			})
+		}
+
+		changes := diffConfigState(applied, desired)
+		return c.JSON(http.StatusOK, pendingChanges{
+			Changed:   len(changes) > 0,
+			AppliedAt: appliedAt,
+			Changes:   changes,
+		})
+	}
+}
+
+// diffConfigState lists the differences between the applied and the desired
+// configuration state. Without an applied state everything is added.
+func diffConfigState(applied *model.ConfigState, desired model.ConfigState) []model.ConfigChange {
+	changes := []model.ConfigChange{}
+	action := model.ConfigChangeAdded
+	var appliedInterface, appliedSettings interface{}
+	var appliedPeers []model.PeerState
+	if applied != nil {
+		action = model.ConfigChangeChanged
+		appliedInterface, appliedSettings, appliedPeers = applied.Interface, applied.Settings, applied.Peers
+	}
+	if fields := auditChanges(appliedInterface, desired.Interface); len(fields) > 0 {
+		changes = append(changes, model.ConfigChange{Type: model.ConfigChangeInterface, Action: action, Changes: fields})
+	}
+	if fields := auditChanges(appliedSettings, desired.Settings); len(fields) > 0 {
+		changes = append(changes, model.ConfigChange{Type: model.ConfigChangeSettings, Action: action, Changes: fields})
+	}
+
+	// Both peer lists are sorted by ID
+	i, j := 0, 0
+	for i < len(appliedPeers) || j < len(desired.Peers) {
+		switch {
+		case j == len(desired.Peers) || i < len(appliedPeers) && appliedPeers[i].ID < desired.Peers[j].ID:
+			peer := appliedPeers[i]
+			changes = append(changes, model.ConfigChange{Type: model.ConfigChangePeer, Action: model.ConfigChangeRemoved,
+				ID: peer.ID, Name: peer.Name, Changes: auditChanges(peer, nil)})
+			i++
+		case i == len(appliedPeers) || desired.Peers[j].ID < appliedPeers[i].ID:
+			peer := desired.Peers[j]
+			changes = append(changes, model.ConfigChange{Type: model.ConfigChangePeer, Action: model.ConfigChangeAdded,
+				ID: peer.ID, Name: peer.Name, Changes: auditChanges(nil, peer)})
+			j++
+		default:
+			peer := desired.Peers[j]
+			if fields := auditChanges(appliedPeers[i], peer); len(fields) > 0 {
+				changes = append(changes, model.ConfigChange{Type: model.ConfigChangePeer, Action: model.ConfigChangeChanged,
+					ID: peer.ID, Name: peer.Name, Changes: fields})
+			}
+			i++
+			j++
+		}
+	}
+	return changes
+}
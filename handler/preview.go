@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+	"github.com/swissmakers/wireguard-manager/wgctl"
+)
+
+// configPreview is the server config rendered from the database, compared
+// with the file on disk. Private and preshared keys are redacted.
+type configPreview struct {
+	Path     string   `json:"path"`
+	Exists   bool     `json:"exists"`
+	Changed  bool     `json:"changed"`
+	Config   string   `json:"config"`
+	Diff     string   `json:"diff"`
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems"`
+	// Token binds an apply to exactly this config
+	Token string `json:"token"`
+}
+
+type applyConfigRequest struct {
+	// PreviewToken is the token of the reviewed preview, if any
+	PreviewToken string `json:"preview_token"`
+	// Comment is kept with the config revision
+	Comment string `json:"comment"`
+}
+
+// renderedServerConfig is the server config of an interface rendered from the
+// database together with the data it was rendered from.
+type renderedServerConfig struct {
+	iface    model.WireGuardInterface
+	server   model.Server
+	clients  []model.ClientData
+	settings model.GlobalSetting
+	data     []byte
+}
+
+// PreviewServerConfig renders the server config of the interface given by the
+// "interface" query parameter into memory and returns it with a diff against
+// the file on disk, on its node for a remote interface, and the problems
+// found parsing it.
+func PreviewServerConfig(db store.IStore, tmplDir fs.FS, backend wgctl.Backend) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		iface, err := interfaceParam(db, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		rendered, err := renderServerConfig(db, tmplDir, iface)
+		if err != nil {
+			log.Error("Cannot render server config: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		path := rendered.settings.ConfigFilePath
+		current, err := readConfigFile(backend, path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error("Cannot read server config: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Cannot read server config: %v", err)})
+		}
+
+		config := util.RedactWireGuardConfig(rendered.data)
+		problems := util.ValidateWireGuardConfig(rendered.data)
+		return c.JSON(http.StatusOK, configPreview{
+			Path:     path,
+			Exists:   err == nil,
+			Changed:  string(current) != string(rendered.data),
+			Config:   config,
+			Diff:     util.UnifiedDiff(path, path+" (preview)", util.RedactWireGuardConfig(current), config),
+			Valid:    len(problems) == 0,
+			Problems: problems,
+			Token:    util.ConfigToken(rendered.data),
+		})
+	}
+}
+
+// readConfigFile reads the config file at path, through the agent of its node
+// if its interface runs on one.
+func readConfigFile(backend wgctl.Backend, path string) ([]byte, error) {
+	if configs, ok := backend.(wgctl.RemoteConfigs); ok {
+		if content, remote, err := configs.ReadConfig(util.GetWireGuardInterface(path)); remote {
+			return content, err
+		}
+	}
+	return os.ReadFile(path)
+}
+
+// renderServerConfig loads the clients of iface, the users and settings and
+// renders the server config of iface from them.
+func renderServerConfig(db store.IStore, tmplDir fs.FS, iface model.WireGuardInterface) (renderedServerConfig, error) {
+	rendered := renderedServerConfig{iface: iface, server: iface.Server()}
+	clients, err := db.GetClients(false)
+	if err != nil {
+		return rendered, fmt.Errorf("Cannot get client config: %w", err)
+	}
+	rendered.clients = util.InterfaceClients(clients, iface)
+	users, err := db.GetUsers()
+	if err != nil {
+		return rendered, fmt.Errorf("Cannot get users config: %w", err)
+	}
+	settings, err := db.GetGlobalSettings()
+	if err != nil {
+		return rendered, fmt.Errorf("Cannot get global settings: %w", err)
+	}
+	rendered.settings = iface.Settings(settings)
+	rendered.data, err = util.RenderWireGuardServerConfig(tmplDir, rendered.server, rendered.clients, users, rendered.settings)
+	if err != nil {
+		return rendered, fmt.Errorf("Cannot render server config: %w", err)
+	}
+	return rendered, nil
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// setETag exposes the revision of a record as the ETag of the response.
+func setETag(c echo.Context, revision int64) {
+	c.Response().Header().Set("ETag", strconv.Quote(strconv.FormatInt(revision, 10)))
+}
+
+// expectedRevision returns the revision an update is based on. The If-Match
+// header, as returned in the ETag of a previous read, takes precedence over
+// the revision in the request body. Without either, the update is not
+// conditional and is based on current, the revision that is stored.
+func expectedRevision(c echo.Context, bodyRevision, current int64) (int64, error) {
+	ifMatch := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if ifMatch == "" {
+		if bodyRevision == 0 {
+			return current, nil
+		}
+		return bodyRevision, nil
+	}
+	revision, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid If-Match header %q", ifMatch)
+	}
+	return revision, nil
+}
+
+// revisionConflict responds to a save that was rejected because the record
+// has been changed since the client read it.
+func revisionConflict(c echo.Context, record string) error {
+	return c.JSON(http.StatusConflict, jsonHTTPResponse{
+		Success: false,
+		Message: fmt.Sprintf("The %s has been changed by someone else in the meantime. Please reload and try again.", record),
+	})
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/ipam"
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/sqlitedb"
+	"github.com/swissmakers/wireguard-manager/util"
+	"github.com/swissmakers/wireguard-manager/wgctl"
+)
+
+// testPasswordHash is the bcrypt hash of "test-password" at the lowest cost
+const testPasswordHash = "$2a$04$fFGC0k1pJzCuITpsCULKGuyltBV0rE3iL5NjZaO7aw4YnjBCrRm22"
+
+// newTestDB creates an initialized SQLite store in a temporary directory.
+func newTestDB(t *testing.T) store.IStore {
+	t.Helper()
+
+	// Avoid the public IP lookup and slow password hashing during default data seeding
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordHashEnvVar, testPasswordHash)
+
+	db, err := sqlitedb.New(filepath.Join(t.TempDir(), "wireguard-manager.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	return db
+}
+
+// serve runs handler for a JSON request by an API key. ifMatch is sent as
+// If-Match header unless it is empty.
+func serve(t *testing.T, handler echo.HandlerFunc, method, body, ifMatch string, params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set("api_key", model.APIKey{ID: "test"})
+	for i := 0; i+1 < len(params); i += 2 {
+		c.SetParamNames(params[i])
+		c.SetParamValues(params[i+1])
+	}
+	if err := handler(c); err != nil {
+		t.Fatalf("Handler failed: %v", err)
+	}
+	return rec
+}
+
+// TestUpdateClientRevision verifies that an update based on a stale revision
+// is rejected, whether it is sent as If-Match header or in the body, and that
+// an update without either is not conditional.
+func TestUpdateClientRevision(t *testing.T) {
+	db := newTestDB(t)
+	id := xid.New().String()
+	if err := db.SaveClient(model.Client{ID: id, Name: "laptop", AllocatedIPs: []string{"10.8.0.2/32"}, AllowedIPs: []string{"0.0.0.0/0"}, Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	update := UpdateClient(db, ipam.New(db))
+	body := func(name string, revision int) string {
+		return fmt.Sprintf(`{"id":%q,"name":%q,"allocated_ips":["10.8.0.2/32"],"allowed_ips":["0.0.0.0/0"],"enabled":true,"revision":%d}`, id, name, revision)
+	}
+
+	rec := serve(t, GetClient(db), http.MethodGet, "", "", "id", id)
+	if etag := rec.Header().Get("ETag"); rec.Code != http.StatusOK || etag != `"1"` {
+		t.Fatalf("GetClient = %d with ETag %s, want 200 with \"1\"", rec.Code, etag)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		ifMatch string
+		code    int
+		etag    string
+	}{
+		{"If-Match", body("renamed", 0), `"1"`, http.StatusOK, `"2"`},
+		{"stale If-Match", body("stale", 0), `"1"`, http.StatusConflict, ""},
+		{"stale body revision", body("stale", 1), "", http.StatusConflict, ""},
+		{"If-Match over body revision", body("again", 1), `W/"2"`, http.StatusOK, `"3"`},
+		{"body revision", body("body", 3), "", http.StatusOK, `"4"`},
+		{"no precondition", body("unconditional", 0), "", http.StatusOK, `"5"`},
+		{"invalid If-Match", body("invalid", 0), "*", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := serve(t, update, http.MethodPost, tt.body, tt.ifMatch)
+		if rec.Code != tt.code || rec.Header().Get("ETag") != tt.etag {
+			t.Errorf("%s: UpdateClient = %d with ETag %q, want %d with %q: %s", tt.name, rec.Code, rec.Header().Get("ETag"), tt.code, tt.etag, rec.Body)
+		}
+	}
+
+	client, err := db.GetClientByID(id, model.QRCodeSettings{})
+	if err != nil || client.Client.Name != "unconditional" || client.Client.Revision != 5 {
+		t.Errorf("Stored client = %+v, %v, want the last successful update", client.Client, err)
+	}
+}
+
+// TestUpdateRevisionPreconditions verifies the same rule for the other records
+// that are updated with a revision check.
+func TestUpdateRevisionPreconditions(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.SaveNode(model.Node{ID: "gw1", Name: "gw1", URL: "https://gw1.example.com:5001"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveWireGuardInterface(model.WireGuardInterface{Name: "wg1", Addresses: []string{"10.9.0.1/24"}, ListenPort: 51821, ConfigFilePath: "/etc/wireguard/wg1.conf"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		get    echo.HandlerFunc
+		update echo.HandlerFunc
+		body   string
+		params []string
+	}{
+		{"node", GetNode(db), UpdateNode(db), `{"name":"gw1","url":"https://gw1.example.com:5001"}`, []string{"id", "gw1"}},
+		{"interface", GetWireGuardInterface(db), UpdateWireGuardInterface(db), `{"addresses":["10.9.0.1/24"],"listen_port":"51821","config_file_path":"/etc/wireguard/wg1.conf"}`, []string{"name", "wg1"}},
+		{"security settings", GetSecuritySettings(db), UpdateSecuritySettings(db), `{"geoip_default_action":"allow"}`, nil},
+	}
+	for _, tt := range tests {
+		etag := serve(t, tt.get, http.MethodGet, "", "", tt.params...).Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s: no ETag", tt.name)
+		}
+		rec := serve(t, tt.update, http.MethodPut, tt.body, etag, tt.params...)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: update with If-Match %s = %d: %s", tt.name, etag, rec.Code, rec.Body)
+		}
+		next := rec.Header().Get("ETag")
+		if next == etag || next == "" {
+			t.Errorf("%s: ETag after the update = %q, want a new revision", tt.name, next)
+		}
+		if rec := serve(t, tt.update, http.MethodPut, tt.body, etag, tt.params...); rec.Code != http.StatusConflict {
+			t.Errorf("%s: update with the stale If-Match %s = %d, want 409", tt.name, etag, rec.Code)
+		}
+		if rec := serve(t, tt.update, http.MethodPut, tt.body, "", tt.params...); rec.Code != http.StatusOK {
+			t.Errorf("%s: update without a precondition = %d, want 200: %s", tt.name, rec.Code, rec.Body)
+		}
+	}
+}
+
+// TestRollbackWithoutInterface verifies that a revision of a config file no
+// interface uses anymore is not rolled back onto another interface.
+func TestRollbackWithoutInterface(t *testing.T) {
+	db := newTestDB(t)
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.AddConfigRevision(model.ConfigRevision{Path: "/etc/wireguard/wg9.conf", Author: "admin", Result: model.RevisionApplied,
+		Content: fmt.Sprintf("[Interface]\nAddress = 10.99.0.1/24\nListenPort = 51829\nPrivateKey = %s\n", key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := wgctl.NewFakeBackend()
+	rec := serve(t, RollbackConfigRevision(db, backend), http.MethodPost, `{}`, "", "id", fmt.Sprint(id))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("RollbackConfigRevision = %d, want 409: %s", rec.Code, rec.Body)
+	}
+	if revisions, _ := db.GetConfigRevisions(); len(revisions) != 1 {
+		t.Errorf("The rollback saved %d revisions", len(revisions)-1)
+	}
+}
+
+// TestRegenerateKeyPairRevision verifies that a new key pair is only generated
+// for the revision of the interface sent as If-Match header.
+func TestRegenerateKeyPairRevision(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.SaveWireGuardInterface(model.WireGuardInterface{Name: "wg1", PublicKey: "old", Addresses: []string{"10.9.0.1/24"}, ListenPort: 51821, ConfigFilePath: "/etc/wireguard/wg1.conf"}); err != nil {
+		t.Fatal(err)
+	}
+	regenerate := RegenerateWireGuardInterfaceKeyPair(db)
+
+	etag := serve(t, GetWireGuardInterface(db), http.MethodGet, "", "", "name", "wg1").Header().Get("ETag")
+	if rec := serve(t, regenerate, http.MethodPost, "", "*", "name", "wg1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("RegenerateWireGuardInterfaceKeyPair with an invalid If-Match = %d, want 400", rec.Code)
+	}
+	if rec := serve(t, regenerate, http.MethodPost, "", etag, "name", "wg1"); rec.Code != http.StatusOK {
+		t.Fatalf("RegenerateWireGuardInterfaceKeyPair with If-Match %s = %d: %s", etag, rec.Code, rec.Body)
+	}
+	iface, err := db.GetWireGuardInterface("wg1")
+	if err != nil || iface.PublicKey == "old" {
+		t.Fatalf("Stored interface = %+v, %v, want a new key pair", iface, err)
+	}
+	if rec := serve(t, regenerate, http.MethodPost, "", etag, "name", "wg1"); rec.Code != http.StatusConflict {
+		t.Errorf("RegenerateWireGuardInterfaceKeyPair with the stale If-Match %s = %d, want 409", etag, rec.Code)
+	}
+	if stored, _ := db.GetWireGuardInterface("wg1"); stored.PublicKey != iface.PublicKey {
+		t.Error("The stale request replaced the key pair")
+	}
+}
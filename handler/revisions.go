@@ -0,0 +1,301 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+	"github.com/swissmakers/wireguard-manager/wgctl"
+)
+
+type rollbackRequest struct {
+	Comment string `json:"comment"`
+}
+
+// revisionDiff is the diff between two config revisions
+type revisionDiff struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	Diff string `json:"diff"`
+}
+
+// GetConfigRevisions lists the revisions of the server config files, newest
+// first and without their content. The "interface" query parameter selects the
+// revisions of one interface.
+func GetConfigRevisions(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		revisions, err := db.GetConfigRevisions()
+		if err != nil {
+			log.Error("Cannot get config revisions: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get config revisions"})
+		}
+		path := ""
+		if c.QueryParam("interface") != "" {
+			iface, err := interfaceParam(db, c)
+			if err != nil {
+				return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+			}
+			path = iface.ConfigFilePath
+		}
+		selected := []model.ConfigRevision{}
+		for _, revision := range revisions {
+			if path == "" || revision.Path == path {
+				revision.Content = ""
+				selected = append(selected, revision)
+			}
+		}
+		return c.JSON(http.StatusOK, selected)
+	}
+}
+
+// GetConfigRevision returns a revision of the server config file. Private and
+// preshared keys are redacted.
+func GetConfigRevision(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		revision, err := revisionParam(db, c, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		revision.Content = util.RedactWireGuardConfig([]byte(revision.Content))
+		return c.JSON(http.StatusOK, revision)
+	}
+}
+
+// DiffConfigRevisions returns the diff from the revision given by the "from"
+// query parameter, by default the one before, to a revision.
+func DiffConfigRevisions(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		to, err := revisionParam(db, c, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		from := model.ConfigRevision{}
+		if c.QueryParam("from") != "" {
+			if from, err = revisionParam(db, c, c.QueryParam("from")); err != nil {
+				return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+			}
+		} else if to.ID > 1 {
+			// Revisions can be missing if they were pruned
+			if from, err = db.GetConfigRevision(to.ID - 1); err != nil {
+				from = model.ConfigRevision{}
+			}
+		}
+
+		diff := util.UnifiedDiff(
+			fmt.Sprintf("revision %d", from.ID), fmt.Sprintf("revision %d", to.ID),
+			util.RedactWireGuardConfig([]byte(from.Content)), util.RedactWireGuardConfig([]byte(to.Content)))
+		return c.JSON(http.StatusOK, revisionDiff{From: from.ID, To: to.ID, Diff: diff})
+	}
+}
+
+// RollbackConfigRevision applies the content of a former revision again, as a
+// new revision of the interface whose config file it was written to. The
+// database is left unchanged, so the difference to it shows as pending
+// changes.
+func RollbackConfigRevision(db store.IStore, backend wgctl.Backend) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req rollbackRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid request"})
+		}
+		target, err := revisionParam(db, c, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		server, clients, settings, err := util.ParseServerConfig([]byte(target.Content))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Cannot roll back to revision %d: %v", target.ID, err)})
+		}
+		iface, err := revisionInterface(db, target)
+		if errors.Is(err, errNoRevisionInterface) {
+			return c.JSON(http.StatusConflict, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Cannot roll back to revision %d: %v", target.ID, err)})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		settings.ConfigFilePath = iface.ConfigFilePath
+
+		result, revision, err := applyRevision(db, backend, model.ConfigRevision{
+			Path:       settings.ConfigFilePath,
+			Content:    target.Content,
+			Author:     currentActor(c),
+			Comment:    req.Comment,
+			RollbackOf: target.ID,
+		}, server, clients, settings)
+		recordAudit(db, c, "rollback", "server_config", settings.ConfigFilePath, nil, map[string]int{"revision": revision.ID, "rollback_of": target.ID})
+		if err != nil {
+			log.Errorf("Cannot roll back to config revision %d: %v", target.ID, err)
+			return c.JSON(http.StatusInternalServerError, deviceSyncResponse{
+				Success:  false,
+				Message:  fmt.Sprintf("Cannot roll back to revision %d: %v", target.ID, err),
+				Result:   result,
+				Revision: &revision,
+			})
+		}
+
+		if err := util.UpdateAppliedState(db, iface, util.NewConfigState(server, clients, settings)); err != nil {
+			log.Error("Cannot update hashes: ", err)
+		}
+		return c.JSON(http.StatusOK, deviceSyncResponse{
+			Success:  true,
+			Message:  fmt.Sprintf("Rolled back to revision %d as revision %d", target.ID, revision.ID),
+			Result:   result,
+			Revision: &revision,
+		})
+	}
+}
+
+// revisionParam reads the revision numbered by value.
+func revisionParam(db store.IStore, c echo.Context, value string) (model.ConfigRevision, error) {
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return model.ConfigRevision{}, fmt.Errorf("invalid config revision %q", value)
+	}
+	return db.GetConfigRevision(id)
+}
+
+// errNoRevisionInterface is returned for a revision of a config file that no
+// interface writes anymore.
+var errNoRevisionInterface = errors.New("no interface uses the config file of the revision")
+
+// revisionInterface returns the interface whose config file revision was
+// written to.
+func revisionInterface(db store.IStore, revision model.ConfigRevision) (model.WireGuardInterface, error) {
+	ifaces, err := util.GetInterfaces(db)
+	if err != nil {
+		return model.WireGuardInterface{}, err
+	}
+	for _, iface := range ifaces {
+		if iface.ConfigFilePath == revision.Path {
+			return iface, nil
+		}
+	}
+	return model.WireGuardInterface{}, fmt.Errorf("%w: %s", errNoRevisionInterface, revision.Path)
+}
+
+// applyMu serializes applies, reconciles and rollbacks, so that a failed one
+// restores the revision that was applied last and not one written meanwhile.
+var applyMu sync.Mutex
+
+// applyRevision writes the content of revision to its path and configures the
+// device to match the server, clients and settings it was rendered from. If
+// the device cannot be configured, the last applied revision of the same file
+// is written and configured again. The config file of an interface assigned
+// to a node is written by the agent of the node, which restores its former
+// file itself. The revision is saved with its result under the next number,
+// which counts across all config files, and returned without its content.
+func applyRevision(db store.IStore, backend wgctl.Backend, revision model.ConfigRevision, server model.Server, clients []model.ClientData, settings model.GlobalSetting) (model.DeviceSync, model.ConfigRevision, error) {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	revisions, err := db.GetConfigRevisions()
+	if err != nil {
+		return model.DeviceSync{}, revision, fmt.Errorf("cannot get config revisions: %w", err)
+	}
+	var previous *model.ConfigRevision
+	for i := range revisions {
+		if revisions[i].Path == revision.Path && revisions[i].Result == model.RevisionApplied {
+			previous = &revisions[i]
+			break
+		}
+	}
+	revision.CreatedAt = time.Now().UTC()
+
+	name := util.GetWireGuardInterface(revision.Path)
+	var result model.DeviceSync
+	remote := false
+	if configs, ok := backend.(wgctl.RemoteConfigs); ok {
+		result, remote, err = configs.ApplyConfig(name, []byte(revision.Content))
+	}
+	if !remote {
+		result, err = applyConfigFile(backend, &revision, previous, server, clients, settings)
+	}
+
+	if err != nil {
+		revision.Result = model.RevisionFailed
+		revision.Error = err.Error()
+	} else {
+		revision.Result = model.RevisionApplied
+	}
+
+	id, saveErr := db.AddConfigRevision(revision)
+	switch {
+	case saveErr != nil && err != nil:
+		err = fmt.Errorf("%w, and the config revision cannot be saved: %v", err, saveErr)
+	case saveErr != nil:
+		err = fmt.Errorf("the config was applied, but its revision cannot be saved: %w", saveErr)
+	}
+	revision.ID = id
+	revision.Content = ""
+	return result, revision, err
+}
+
+// applyConfigFile writes the content of revision to its path on this host and
+// configures the device. On failure, previous or else the former file is
+// restored.
+func applyConfigFile(backend wgctl.Backend, revision *model.ConfigRevision, previous *model.ConfigRevision, server model.Server, clients []model.ClientData, settings model.GlobalSetting) (model.DeviceSync, error) {
+	// Without an earlier revision, the file on disk is restored on failure
+	backup, backupErr := os.ReadFile(revision.Path)
+
+	name := util.GetWireGuardInterface(revision.Path)
+	result := model.DeviceSync{Device: name}
+	err := util.WriteConfigFile(revision.Path, []byte(revision.Content))
+	if err == nil {
+		result, err = configureIfUp(backend, name, server, clients, settings)
+	}
+	if err == nil {
+		return result, nil
+	}
+
+	var restoreErr error
+	switch {
+	case previous != nil:
+		revision.RestoredID = previous.ID
+		restoreErr = restoreConfig(backend, revision.Path, []byte(previous.Content))
+	case backupErr == nil:
+		restoreErr = restoreConfig(backend, revision.Path, backup)
+	}
+	if restoreErr != nil {
+		log.Errorf("Cannot restore the previous server config: %v", restoreErr)
+		err = fmt.Errorf("%w, and the previous config cannot be restored: %v", err, restoreErr)
+	}
+	return result, err
+}
+
+// configureIfUp configures the device of a running interface. A stopped
+// interface reads the config file when it is started.
+func configureIfUp(backend wgctl.Backend, name string, server model.Server, clients []model.ClientData, settings model.GlobalSetting) (model.DeviceSync, error) {
+	if up, err := backend.IsUp(name); err == nil && !up {
+		return model.DeviceSync{Device: name}, nil
+	}
+	result, err := syncDevice(backend, server, clients, settings)
+	if err == nil && result.Failed > 0 {
+		err = fmt.Errorf("cannot configure %d of %d peers of %s", result.Failed, len(result.Peers), result.Device)
+	}
+	return result, err
+}
+
+// restoreConfig writes a former config to path and configures the device to
+// match it.
+func restoreConfig(backend wgctl.Backend, path string, content []byte) error {
+	if err := util.WriteConfigFile(path, content); err != nil {
+		return err
+	}
+	server, clients, settings, err := util.ParseServerConfig(content)
+	if err != nil {
+		return err
+	}
+	settings.ConfigFilePath = path
+	_, err = configureIfUp(backend, util.GetWireGuardInterface(path), server, clients, settings)
+	return err
+}
@@ -3,12 +3,15 @@ package handler
 import (
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,14 +20,15 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 	"github.com/rs/xid"
-	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
 	"github.com/swissmakers/wireguard-manager/emailer"
 	"github.com/swissmakers/wireguard-manager/i18n"
+	"github.com/swissmakers/wireguard-manager/ipam"
 	"github.com/swissmakers/wireguard-manager/model"
 	"github.com/swissmakers/wireguard-manager/store"
 	"github.com/swissmakers/wireguard-manager/util"
+	"github.com/swissmakers/wireguard-manager/wgctl"
 )
 
 var usernameRegexp = regexp.MustCompile(`^\w[\w\-.]*$`)
@@ -61,6 +65,10 @@ type setClientStatusRequest struct {
 	Status bool   `json:"status"`
 }
 
+type clientIDRequest struct {
+	ID string `json:"id"`
+}
+
 //
 // Handlers
 //
@@ -309,6 +317,7 @@ func UpdateUser(db store.IStore) echo.HandlerFunc {
 		if err != nil {
 			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
+		previous := user
 
 		if req.Username == "" || !usernameRegexp.MatchString(req.Username) {
 			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Please provide a valid username"})
@@ -337,14 +346,19 @@ func UpdateUser(db store.IStore) echo.HandlerFunc {
 			user.Admin = req.Admin
 		}
 
-		// Replace user entry in DB.
-		if err := db.DeleteUser(req.PreviousUsername); err != nil {
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
-		}
-		if err := db.SaveUser(user); err != nil {
+		// Replace user entry in DB. Both writes are kept or undone together,
+		// so a failed save cannot lose the user.
+		err = db.WithTx(func(tx store.IStore) error {
+			if err := tx.DeleteUser(req.PreviousUsername); err != nil {
+				return err
+			}
+			return tx.SaveUser(user)
+		})
+		if err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 		log.Infof("Updated user information successfully")
+		recordAudit(db, c, "update", "user", req.PreviousUsername, previous, user)
 
 		// Update session if the current user was changed.
 		if req.PreviousUsername == currentUser(c) {
@@ -387,6 +401,7 @@ func CreateUser(db store.IStore) echo.HandlerFunc {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 		log.Infof("Created user successfully")
+		recordAudit(db, c, "create", "user", user.Username, nil, user)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Created user successfully"})
 	}
 }
@@ -408,12 +423,17 @@ func RemoveUser(db store.IStore) echo.HandlerFunc {
 			return c.JSON(http.StatusForbidden, jsonHTTPResponse{Success: false, Message: "User cannot delete itself"})
 		}
 
+		previous, err := db.GetUserByName(req.Username)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
 		if err := db.DeleteUser(req.Username); err != nil {
 			log.Error("Cannot delete user: ", err)
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot delete user from database"})
 		}
 
 		log.Infof("Removed user: %s", req.Username)
+		recordAudit(db, c, "delete", "user", req.Username, previous, nil)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "User removed"})
 	}
 }
@@ -435,19 +455,83 @@ func WireGuardClients(db store.IStore) echo.HandlerFunc {
 }
 
 // GetClients handler returns a JSON list of WireGuard client data.
+// The list can be narrowed with the query parameters described at
+// clientQueryFromRequest. If more clients match than the requested limit, the
+// cursor for the next page is returned in the X-Next-Cursor header.
 func GetClients(db store.IStore) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		clientDataList, err := db.GetClients(true)
+		query, err := clientQueryFromRequest(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		page, err := db.QueryClients(query, true)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
 				Success: false, Message: fmt.Sprintf("Cannot get client list: %v", err),
 			})
 		}
-		for i, clientData := range clientDataList {
-			clientDataList[i] = util.FillClientSubnetRange(clientData)
+		for i, clientData := range page.Clients {
+			page.Clients[i] = util.FillClientSubnetRange(clientData)
 		}
-		return c.JSON(http.StatusOK, clientDataList)
+		if page.NextCursor != "" {
+			c.Response().Header().Set("X-Next-Cursor", page.NextCursor)
+		}
+		return c.JSON(http.StatusOK, page.Clients)
+	}
+}
+
+// maxClientPageSize caps the limit of one client list request.
+const maxClientPageSize = 1000
+
+// clientQueryFromRequest builds a client query from the query parameters q
+// (name, email or group search), group, enabled, subnet_range, created_after,
+// created_before, updated_after, updated_before (RFC 3339), sort, limit and
+// cursor.
+func clientQueryFromRequest(c echo.Context) (model.ClientQuery, error) {
+	query := model.ClientQuery{
+		Search: c.QueryParam("q"),
+		Group:  c.QueryParam("group"),
+		Sort:   c.QueryParam("sort"),
+		Cursor: c.QueryParam("cursor"),
+	}
+
+	if value := c.QueryParam("enabled"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, fmt.Errorf("invalid enabled, expected true or false")
+		}
+		query.Enabled = &enabled
+	}
+	if name := c.QueryParam("subnet_range"); name != "" {
+		subnets, ok := util.GetSubnetRange(name)
+		if !ok {
+			return query, fmt.Errorf("unknown subnet range %q", name)
+		}
+		query.Subnets = subnets
+	}
+	for param, dst := range map[string]*time.Time{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+		"updated_after":  &query.UpdatedAfter,
+		"updated_before": &query.UpdatedBefore,
+	} {
+		if value := c.QueryParam(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("invalid %s, expected an RFC 3339 timestamp", param)
+			}
+			*dst = t
+		}
+	}
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return query, fmt.Errorf("invalid limit")
+		}
+		query.Limit = min(limit, maxClientPageSize)
 	}
+
+	return query, query.Validate()
 }
 
 // GetClient handler returns a JSON object of WireGuard client data.
@@ -469,34 +553,19 @@ func GetClient(db store.IStore) echo.HandlerFunc {
 			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: "Client not found"})
 		}
 
+		setETag(c, clientData.Client.Revision)
 		return c.JSON(http.StatusOK, util.FillClientSubnetRange(clientData))
 	}
 }
 
 // NewClient handler creates a new WireGuard client.
-func NewClient(db store.IStore) echo.HandlerFunc {
+func NewClient(db store.IStore, pool *ipam.Pool) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var client model.Client
 		if err := c.Bind(&client); err != nil {
 			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid client data"})
 		}
 
-		// Fetch server configuration.
-		server, err := db.GetServer()
-		if err != nil {
-			log.Error("Cannot fetch server from database: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
-		}
-
-		// Validate allocation IPs.
-		allocatedIPs, err := util.GetAllocatedIPs("")
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("%s", err)})
-		}
-		if check, err := util.ValidateIPAllocation(server.Interface.Addresses, allocatedIPs, client.AllocatedIPs); !check {
-			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("%s", err)})
-		}
-
 		// Validate AllowedIPs and ExtraAllowedIPs.
 		if !util.ValidateAllowedIPs(client.AllowedIPs) {
 			log.Warnf("Invalid Allowed IPs input from user: %v", client.AllowedIPs)
@@ -507,6 +576,10 @@ func NewClient(db store.IStore) echo.HandlerFunc {
 			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Extra AllowedIPs must be in CIDR format"})
 		}
 
+		if err := util.CheckClientInterface(db, &client); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
 		// Generate a new client ID.
 		client.ID = xid.New().String()
 
@@ -557,15 +630,29 @@ func NewClient(db store.IStore) echo.HandlerFunc {
 			}
 		}
 
+		// A new client is neither in the trash nor outdated, whatever was sent
 		now := time.Now().UTC()
 		client.CreatedAt = now
 		client.UpdatedAt = now
-
-		// Save client in the database.
-		if err := db.SaveClient(client); err != nil {
+		client.DeletedAt = nil
+		client.DeletedBy = ""
+		client.ConfigOutdated = false
+		client.Revision = 0
+
+		// Save the client, unless one of its IPs has been allocated in the meantime.
+		err := pool.Assign(client.ID, client.AllocatedIPs, func() error {
+			return db.SaveClient(client)
+		})
+		if err != nil {
+			if errors.Is(err, ipam.ErrInvalidAllocation) {
+				return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+			}
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
+		client.Revision = 1
 		log.Infof("Created wireguard client: %v", client.Name)
+		recordAudit(db, c, "create", "client", client.ID, nil, client)
+		setETag(c, client.Revision)
 		return c.JSON(http.StatusOK, client)
 	}
 }
@@ -593,14 +680,16 @@ func EmailClient(db store.IStore, mailer emailer.Emailer, emailSubject, emailCon
 			IncludeMTU: true,
 		}
 		clientData, err := db.GetClientByID(payload.ID, qrCodeSettings)
+		if err == nil && clientData.Client.DeletedAt != nil {
+			err = fmt.Errorf("client is in the trash")
+		}
 		if err != nil {
 			log.Errorf("Cannot generate client config for id %s: %v", payload.ID, err)
 			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: "Client not found"})
 		}
 
 		// Build configuration.
-		server, _ := db.GetServer()
-		globalSettings, _ := db.GetGlobalSettings()
+		server, globalSettings, _ := util.ClientServer(db, *clientData.Client)
 		config := util.BuildClientConfig(*clientData.Client, server, globalSettings)
 
 		cfgAtt := emailer.Attachment{Name: "wg0.conf", Data: []byte(config)}
@@ -625,12 +714,13 @@ func EmailClient(db store.IStore, mailer emailer.Emailer, emailSubject, emailCon
 		); err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
+		configDelivered(db, *clientData.Client)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Email sent successfully"})
 	}
 }
 
 // UpdateClient handler updates client information.
-func UpdateClient(db store.IStore) echo.HandlerFunc {
+func UpdateClient(db store.IStore, pool *ipam.Pool) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var clientUpdate model.Client
 		if err := c.Bind(&clientUpdate); err != nil {
@@ -643,23 +733,16 @@ func UpdateClient(db store.IStore) echo.HandlerFunc {
 
 		// Validate client existence.
 		clientData, err := db.GetClientByID(clientUpdate.ID, model.QRCodeSettings{Enabled: false})
-		if err != nil {
+		if err != nil || clientData.Client.DeletedAt != nil {
 			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: "Client not found"})
 		}
 
-		server, err := db.GetServer()
+		revision, err := expectedRevision(c, clientUpdate.Revision, clientData.Client.Revision)
 		if err != nil {
-			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Cannot fetch server config: %s", err)})
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 
 		client := *clientData.Client
-		allocatedIPs, err := util.GetAllocatedIPs(client.ID)
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("%s", err)})
-		}
-		if check, err := util.ValidateIPAllocation(server.Interface.Addresses, allocatedIPs, clientUpdate.AllocatedIPs); !check {
-			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("%s", err)})
-		}
 
 		// Validate AllowedIPs and ExtraAllowedIPs.
 		if !util.ValidateAllowedIPs(clientUpdate.AllowedIPs) {
@@ -714,13 +797,33 @@ func UpdateClient(db store.IStore) echo.HandlerFunc {
 		client.Endpoint = clientUpdate.Endpoint
 		client.PublicKey = clientUpdate.PublicKey
 		client.PresharedKey = clientUpdate.PresharedKey
+		if clientUpdate.Interface != "" {
+			// Moves the client, the primary interface is selected by its name
+			client.Interface = clientUpdate.Interface
+		}
 		client.UpdatedAt = time.Now().UTC()
+		client.Revision = revision
+		if err := util.CheckClientInterface(db, &client); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
 
-		// Save the updated client.
-		if err := db.SaveClient(client); err != nil {
+		// Save the updated client, unless it was changed since the caller read
+		// it or one of its new IPs has been allocated in the meantime.
+		err = pool.Assign(client.ID, client.AllocatedIPs, func() error {
+			return db.SaveClient(client)
+		})
+		if err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "client")
+			}
+			if errors.Is(err, ipam.ErrInvalidAllocation) {
+				return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+			}
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 		log.Infof("Updated client information successfully => %v", client.Name)
+		recordAudit(db, c, "update", "client", client.ID, *clientData.Client, client)
+		setETag(c, client.Revision+1)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Updated client successfully"})
 	}
 }
@@ -741,13 +844,24 @@ func SetClientStatus(db store.IStore) echo.HandlerFunc {
 		if err != nil {
 			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
+		if clientData.Client.DeletedAt != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: "Client not found"})
+		}
 
 		client := *clientData.Client
 		client.Enabled = req.Status
+		if client.Revision, err = expectedRevision(c, 0, client.Revision); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
 		if err := db.SaveClient(client); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "client")
+			}
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 		log.Infof("Changed client %s enabled status to %v", client.ID, req.Status)
+		recordAudit(db, c, "status", "client", client.ID, *clientData.Client, client)
+		setETag(c, client.Revision+1)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Changed client status successfully"})
 	}
 }
@@ -765,47 +879,182 @@ func DownloadClient(db store.IStore) echo.HandlerFunc {
 		}
 
 		clientData, err := db.GetClientByID(clientID, model.QRCodeSettings{Enabled: false})
+		if err == nil && clientData.Client.DeletedAt != nil {
+			err = fmt.Errorf("client is in the trash")
+		}
 		if err != nil {
 			log.Errorf("Cannot generate client config for id %s: %v", clientID, err)
 			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: "Client not found"})
 		}
 
-		server, err := db.GetServer()
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
-		}
-		globalSettings, err := db.GetGlobalSettings()
+		server, globalSettings, err := util.ClientServer(db, *clientData.Client)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 		config := util.BuildClientConfig(*clientData.Client, server, globalSettings)
+		configDelivered(db, *clientData.Client)
 		reader := strings.NewReader(config)
 		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%s.conf", clientData.Client.Email))
 		return c.Stream(http.StatusOK, "text/conf", reader)
 	}
 }
 
-// RemoveClient handler deletes a WireGuard client.
+// configDelivered clears the outdated mark of a client once it was given its
+// current configuration. A failure is logged, the client is then still shown
+// as outdated.
+func configDelivered(db store.IStore, client model.Client) {
+	if !client.ConfigOutdated {
+		return
+	}
+	client.ConfigOutdated = false
+	if err := db.SaveClient(client); err != nil {
+		log.Warnf("Cannot clear the outdated configuration mark of client %s: %v", client.ID, err)
+	}
+}
+
+// RemoveClient handler moves a WireGuard client to the trash. It stays there,
+// excluded from the configuration, until it is restored or purged.
 func RemoveClient(db store.IStore) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		var client model.Client
-		if err := c.Bind(&client); err != nil {
-			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid client data"})
+		clientID, err := bindClientID(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 
-		if _, err := xid.FromString(client.ID); err != nil {
-			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Please provide a valid client ID"})
+		clientData, err := db.GetClientByID(clientID, model.QRCodeSettings{Enabled: false})
+		if err != nil || clientData.Client.DeletedAt != nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: "Client not found"})
 		}
 
-		if err := db.DeleteClient(client.ID); err != nil {
-			log.Error("Cannot delete wireguard client: ", err)
+		client := *clientData.Client
+		if client.Revision, err = expectedRevision(c, 0, client.Revision); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		now := time.Now().UTC()
+		client.DeletedAt = &now
+		client.DeletedBy = currentActor(c)
+		if err := db.SaveClient(client); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "client")
+			}
+			log.Error("Cannot move wireguard client to trash: ", err)
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot delete client from database"})
 		}
-		log.Infof("Removed wireguard client: %v", client.ID)
+		log.Infof("Moved wireguard client %v to trash", client.ID)
+		recordAudit(db, c, "delete", "client", client.ID, *clientData.Client, client)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Client removed"})
 	}
 }
 
+// GetTrashedClients handler returns a JSON list of the clients in the trash.
+func GetTrashedClients(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		clientDataList, err := db.GetTrashedClients()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false, Message: fmt.Sprintf("Cannot get trashed clients: %v", err),
+			})
+		}
+		sort.Slice(clientDataList, func(i, j int) bool {
+			return clientDataList[i].Client.DeletedAt.After(*clientDataList[j].Client.DeletedAt)
+		})
+		for i, clientData := range clientDataList {
+			clientDataList[i] = util.FillClientSubnetRange(clientData)
+		}
+		return c.JSON(http.StatusOK, clientDataList)
+	}
+}
+
+// RestoreClient handler moves a client out of the trash. It fails if another
+// client took over its public key or IP addresses in the meantime.
+func RestoreClient(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		clientID, err := bindClientID(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		clientData, err := db.GetClientByID(clientID, model.QRCodeSettings{Enabled: false})
+		if err != nil || clientData.Client.DeletedAt == nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: "Client not found in trash"})
+		}
+		client := *clientData.Client
+
+		clients, err := db.GetClients(false)
+		if err != nil {
+			log.Error("Cannot get clients for conflict check: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get clients for conflict check"})
+		}
+		for _, other := range clients {
+			if other.Client.PublicKey == client.PublicKey {
+				return c.JSON(http.StatusConflict, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Client %s uses the same public key", other.Client.Name)})
+			}
+			for _, ip := range client.AllocatedIPs {
+				if slices.Contains(other.Client.AllocatedIPs, ip) {
+					return c.JSON(http.StatusConflict, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("IP address %s is now allocated to client %s", ip, other.Client.Name)})
+				}
+			}
+		}
+
+		if client.Revision, err = expectedRevision(c, 0, client.Revision); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		client.DeletedAt = nil
+		client.DeletedBy = ""
+		if err := db.SaveClient(client); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "client")
+			}
+			log.Error("Cannot restore wireguard client: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot restore client"})
+		}
+		log.Infof("Restored wireguard client %v from trash", client.ID)
+		recordAudit(db, c, "restore", "client", client.ID, *clientData.Client, client)
+		setETag(c, client.Revision+1)
+		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Client restored"})
+	}
+}
+
+// PurgeClient handler permanently deletes a client from the trash.
+func PurgeClient(db store.IStore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		clientID, err := bindClientID(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+
+		clientData, err := db.GetClientByID(clientID, model.QRCodeSettings{Enabled: false})
+		if err != nil || clientData.Client.DeletedAt == nil {
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: "Client not found in trash"})
+		}
+
+		if err := db.DeleteClient(clientID); err != nil {
+			log.Error("Cannot purge wireguard client: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot delete client from database"})
+		}
+		log.Infof("Purged wireguard client: %v", clientID)
+		recordAudit(db, c, "purge", "client", clientID, *clientData.Client, nil)
+		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Client deleted permanently"})
+	}
+}
+
+// bindClientID returns the client ID from the URL of the external API or
+// from the JSON body of the web UI.
+func bindClientID(c echo.Context) (string, error) {
+	clientID := c.Param("id")
+	if clientID == "" {
+		var req clientIDRequest
+		if err := c.Bind(&req); err != nil {
+			return "", fmt.Errorf("Invalid client data")
+		}
+		clientID = req.ID
+	}
+	if _, err := xid.FromString(clientID); err != nil {
+		return "", fmt.Errorf("Please provide a valid client ID")
+	}
+	return clientID, nil
+}
+
 // WireGuardServer handler renders the WireGuard server page.
 func WireGuardServer(db store.IStore) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -832,11 +1081,31 @@ func WireGuardServerInterfaces(db store.IStore) echo.HandlerFunc {
 			log.Warnf("Invalid server interface addresses input: %v", serverInterface.Addresses)
 			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Interface IP address must be in CIDR format"})
 		}
+		previous, _ := db.GetServer()
+		var current int64
+		if previous.Interface != nil {
+			current = previous.Interface.Revision
+		}
+		revision, err := expectedRevision(c, serverInterface.Revision, current)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		serverInterface.Revision = revision
 		serverInterface.UpdatedAt = time.Now().UTC()
+		settings, _ := db.GetGlobalSettings()
+		if err := checkPrimaryConflicts(db, model.Server{Interface: &serverInterface}, settings); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
 		if err := db.SaveServerInterface(serverInterface); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "server interface")
+			}
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 		log.Infof("Updated wireguard server interfaces settings: %v", serverInterface.Addresses)
+		recordAudit(db, c, "update", "server_interface", "server_interface", previous.Interface, serverInterface)
+		reloadSubnetRanges(db)
+		setETag(c, revision+1)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Updated interface addresses successfully"})
 	}
 }
@@ -854,9 +1123,11 @@ func WireGuardServerKeyPair(db store.IStore) echo.HandlerFunc {
 			PublicKey:  key.PublicKey().String(),
 			UpdatedAt:  time.Now().UTC(),
 		}
+		previous, _ := db.GetServer()
 		if err := db.SaveServerKeyPair(serverKeyPair); err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot generate WireGuard key pair"})
 		}
+		recordAudit(db, c, "regenerate", "server_keypair", "server_keypair", previous.KeyPair, serverKeyPair)
 		log.Infof("Updated wireguard server key pair: %v", serverKeyPair)
 		return c.JSON(http.StatusOK, serverKeyPair)
 	}
@@ -887,9 +1158,11 @@ func Status(db store.IStore) echo.HandlerFunc {
 	}
 }
 
-// APIStatus returns the current WireGuard status as JSON.
+// APIStatus returns the current WireGuard status as JSON, including the
+// devices of the interfaces that run on nodes. Nodes that cannot be reached
+// are listed with their error.
 // This handler is intended to be polled via AJAX to update the VPN status table dynamically.
-func APIStatus(db store.IStore) echo.HandlerFunc {
+func APIStatus(db store.IStore, backend wgctl.Backend) echo.HandlerFunc {
 	// Define the view model structures.
 	type PeerVM struct {
 		Name              string        `json:"name"`
@@ -904,20 +1177,27 @@ func APIStatus(db store.IStore) echo.HandlerFunc {
 		Endpoint          string        `json:"endpoint,omitempty"`
 	}
 	type DeviceVM struct {
-		Name  string   `json:"name"`
+		Name string `json:"name"`
+		// Node is the name of the node running the device, empty for this host
+		Node  string   `json:"node,omitempty"`
 		Peers []PeerVM `json:"peers"`
 	}
 
 	return func(c echo.Context) error {
-		// Create a new WireGuard client.
-		wgClient, err := wgctrl.New()
-		if err != nil {
+		// Retrieve the list of WireGuard devices.
+		devices, err := backend.Devices()
+		unreachableNodes := map[string]string{}
+		var unreachable *wgctl.UnreachableError
+		if errors.As(err, &unreachable) {
+			for name, nodeErr := range unreachable.Hosts {
+				unreachableNodes[name] = nodeErr.Error()
+			}
+		} else if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
 				"error": err.Error(),
 			})
 		}
-		// Retrieve the list of WireGuard clients.
-		devices, err := wgClient.Devices()
+		deviceNodes, err := interfaceNodeNames(db)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
 				"error": err.Error(),
@@ -945,6 +1225,7 @@ func APIStatus(db store.IStore) echo.HandlerFunc {
 			for _, dev := range devices {
 				devVm := DeviceVM{
 					Name: dev.Name,
+					Node: deviceNodes[dev.Name],
 				}
 				// Process each peer on the device.
 				for _, peer := range dev.Peers {
@@ -992,7 +1273,8 @@ func APIStatus(db store.IStore) echo.HandlerFunc {
 
 		// Return the final client-devices status as JSON.
 		return c.JSON(http.StatusOK, map[string]interface{}{
-			"devices": devicesVM,
+			"devices":           devicesVM,
+			"unreachable_nodes": unreachableNodes,
 		})
 	}
 }
@@ -1008,11 +1290,26 @@ func GlobalSettingSubmit(db store.IStore) echo.HandlerFunc {
 			log.Warnf("Invalid DNS server list input: %v", globalSettings.DNSServers)
 			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid DNS server address"})
 		}
+		previous, _ := db.GetGlobalSettings()
+		revision, err := expectedRevision(c, globalSettings.Revision, previous.Revision)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
+		globalSettings.Revision = revision
 		globalSettings.UpdatedAt = time.Now().UTC()
+		server, _ := db.GetServer()
+		if err := checkPrimaryConflicts(db, server, globalSettings); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
+		}
 		if err := db.SaveGlobalSettings(globalSettings); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "global settings")
+			}
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot update global settings"})
 		}
 		log.Infof("Updated global settings: %v", globalSettings)
+		recordAudit(db, c, "update", "global_settings", "global_settings", previous, globalSettings)
+		setETag(c, revision+1)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Updated global settings successfully"})
 	}
 }
@@ -1037,108 +1334,106 @@ func MachineIPAddresses() echo.HandlerFunc {
 // GetOrderedSubnetRanges handler returns the ordered list of subnet ranges.
 func GetOrderedSubnetRanges() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		return c.JSON(http.StatusOK, util.SubnetRangesOrder)
+		return c.JSON(http.StatusOK, util.GetSubnetRangeNames())
 	}
 }
 
-// SuggestIPAllocation handler returns a list of suggested IP addresses.
-func SuggestIPAllocation(db store.IStore) echo.HandlerFunc {
+// SuggestIPAllocation handler returns a list of suggested IP addresses from the
+// subnet range given by the "sr" query parameter or else from the networks of
+// the interface given by the "interface" query parameter.
+func SuggestIPAllocation(db store.IStore, pool *ipam.Pool) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		server, err := db.GetServer()
+		iface, err := interfaceParam(db, c)
 		if err != nil {
-			log.Error("Cannot fetch server config: ", err)
+			log.Error("Cannot fetch interface: ", err)
 			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 
-		allocatedIPs, err := util.GetAllocatedIPs("")
-		if err != nil {
-			log.Error("Cannot suggest ip allocation: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
-				Success: false,
-				Message: "Cannot suggest ip allocation: failed to get list of allocated ip addresses",
-			})
-		}
-
 		sr := c.QueryParam("sr")
 		searchCIDRList := make([]string, 0)
-		found := false
-
-		if util.SubnetRanges[sr] != nil {
-			for _, cidr := range util.SubnetRanges[sr] {
+		if subnets, ok := util.GetSubnetRange(sr); ok {
+			for _, cidr := range subnets {
 				searchCIDRList = append(searchCIDRList, cidr.String())
 			}
 		} else {
-			searchCIDRList = append(searchCIDRList, server.Interface.Addresses...)
+			searchCIDRList = append(searchCIDRList, iface.Addresses...)
 		}
 
-		ipSet := make(map[string]struct{})
-		for _, cidr := range searchCIDRList {
-			ip, err := util.GetAvailableIP(cidr, allocatedIPs, server.Interface.Addresses)
-			if err != nil {
-				log.Error("Failed to get available ip from CIDR: ", err)
-				continue
-			}
-			found = true
-			if strings.Contains(ip, ":") {
-				ipSet[fmt.Sprintf("%s/128", ip)] = struct{}{}
-			} else {
-				ipSet[fmt.Sprintf("%s/32", ip)] = struct{}{}
-			}
-		}
-		if !found {
+		suggestedIPs, err := pool.Suggest(searchCIDRList)
+		if errors.Is(err, ipam.ErrExhausted) {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
 				Success: false,
 				Message: "Cannot suggest ip allocation: failed to get available ip. Try a different subnet or deallocate some ips.",
 			})
 		}
-		suggestedIPs := make([]string, 0, len(ipSet))
-		for ip := range ipSet {
-			suggestedIPs = append(suggestedIPs, ip)
+		if err != nil {
+			log.Error("Cannot suggest ip allocation: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
+				Success: false,
+				Message: "Cannot suggest ip allocation: failed to get list of allocated ip addresses",
+			})
 		}
 		return c.JSON(http.StatusOK, suggestedIPs)
 	}
 }
 
-// ApplyServerConfig handler writes the config file and reloads the WireGuard server using wg syncconf.
-func ApplyServerConfig(db store.IStore, tmplDir fs.FS) echo.HandlerFunc {
+// ApplyServerConfig handler writes the config file of the interface given by
+// the "interface" query parameter and configures the changed peers on its
+// running WireGuard device. With the token of a preview, only the previewed
+// config is applied.
+func ApplyServerConfig(db store.IStore, tmplDir fs.FS, backend wgctl.Backend) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		server, err := db.GetServer()
-		if err != nil {
-			log.Error("Cannot get server config: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get server config"})
+		var req applyConfigRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{Success: false, Message: "Invalid request"})
 		}
-		clients, err := db.GetClients(false)
+		iface, err := interfaceParam(db, c)
 		if err != nil {
-			log.Error("Cannot get client config: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get client config"})
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
-		users, err := db.GetUsers()
+		rendered, err := renderServerConfig(db, tmplDir, iface)
 		if err != nil {
-			log.Error("Cannot get users config: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get users config"})
+			log.Error("Cannot apply server config: ", err)
+			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
-		settings, err := db.GetGlobalSettings()
-		if err != nil {
-			log.Error("Cannot get global settings: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get global settings"})
+		if req.PreviewToken != "" && req.PreviewToken != util.ConfigToken(rendered.data) {
+			return c.JSON(http.StatusConflict, jsonHTTPResponse{Success: false, Message: "The configuration changed since the preview, please review it again"})
 		}
+		server, clients, settings := rendered.server, rendered.clients, rendered.settings
 
-		if err := util.WriteWireGuardServerConfig(tmplDir, server, clients, users, settings); err != nil {
+		// Configure only the changed peers on the running device, going back
+		// to the last applied revision if that fails
+		result, revision, err := applyRevision(db, backend, model.ConfigRevision{
+			Path:    settings.ConfigFilePath,
+			Content: string(rendered.data),
+			Author:  currentActor(c),
+			Comment: req.Comment,
+		}, server, clients, settings)
+		recordAudit(db, c, "apply", "server_config", settings.ConfigFilePath, nil, map[string]int{"revision": revision.ID})
+		if err != nil {
 			log.Error("Cannot apply server config: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Cannot apply server config: %v", err)})
-		}
-
-		// Reload WireGuard using wg syncconf instead of full restart
-		if err := util.ReloadWireGuard(settings); err != nil {
-			log.Error("Cannot reload WireGuard: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Config written but failed to reload WireGuard: %v", err)})
+			message := fmt.Sprintf("Cannot apply server config: %v", err)
+			if revision.RestoredID > 0 {
+				message += fmt.Sprintf(", restored revision %d", revision.RestoredID)
+			}
+			return c.JSON(http.StatusInternalServerError, deviceSyncResponse{
+				Success:  false,
+				Message:  message,
+				Result:   result,
+				Revision: &revision,
+			})
 		}
 
-		if err := util.UpdateHashes(db); err != nil {
+		if err := util.UpdateAppliedState(db, iface, util.NewConfigState(server, clients, settings)); err != nil {
 			log.Error("Cannot update hashes: ", err)
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Cannot update hashes: %v", err)})
 		}
-		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "Applied config and reloaded WireGuard successfully"})
+		return c.JSON(http.StatusOK, deviceSyncResponse{
+			Success:  true,
+			Message:  fmt.Sprintf("Applied config as revision %d and configured %d peers", revision.ID, len(result.Peers)),
+			Result:   result,
+			Revision: &revision,
+		})
 	}
 }
 
@@ -1153,67 +1448,70 @@ func GetHashesChanges(db store.IStore) echo.HandlerFunc {
 	}
 }
 
-// StartWireGuardServer starts the WireGuard server interface
-func StartWireGuardServer(db store.IStore) echo.HandlerFunc {
+// StartWireGuardServer starts the WireGuard interface given by the "interface"
+// query parameter, the primary one by default
+func StartWireGuardServer(db store.IStore, backend wgctl.Backend) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		settings, err := db.GetGlobalSettings()
+		iface, err := interfaceParam(db, c)
 		if err != nil {
-			log.Error("Cannot get global settings: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get global settings"})
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 
-		if err := util.StartWireGuard(settings); err != nil {
+		if err := backend.Up(iface.Name); err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Failed to start WireGuard: %v", err)})
 		}
 
+		recordAudit(db, c, "start", "wireguard", iface.ConfigFilePath, nil, nil)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "WireGuard server started successfully"})
 	}
 }
 
-// StopWireGuardServer stops the WireGuard server interface
-func StopWireGuardServer(db store.IStore) echo.HandlerFunc {
+// StopWireGuardServer stops the WireGuard interface given by the "interface"
+// query parameter, the primary one by default
+func StopWireGuardServer(db store.IStore, backend wgctl.Backend) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		settings, err := db.GetGlobalSettings()
+		iface, err := interfaceParam(db, c)
 		if err != nil {
-			log.Error("Cannot get global settings: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get global settings"})
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 
-		if err := util.StopWireGuard(settings); err != nil {
+		if err := backend.Down(iface.Name); err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Failed to stop WireGuard: %v", err)})
 		}
 
+		recordAudit(db, c, "stop", "wireguard", iface.ConfigFilePath, nil, nil)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "WireGuard server stopped successfully"})
 	}
 }
 
-// RestartWireGuardServer restarts the WireGuard server interface
-func RestartWireGuardServer(db store.IStore) echo.HandlerFunc {
+// RestartWireGuardServer restarts the WireGuard interface given by the
+// "interface" query parameter, the primary one by default
+func RestartWireGuardServer(db store.IStore, backend wgctl.Backend) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		settings, err := db.GetGlobalSettings()
+		iface, err := interfaceParam(db, c)
 		if err != nil {
-			log.Error("Cannot get global settings: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get global settings"})
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 
-		if err := util.RestartWireGuard(settings); err != nil {
+		if err := backend.Restart(iface.Name); err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Failed to restart WireGuard: %v", err)})
 		}
 
+		recordAudit(db, c, "restart", "wireguard", iface.ConfigFilePath, nil, nil)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{Success: true, Message: "WireGuard server restarted successfully"})
 	}
 }
 
-// GetWireGuardStatus returns the status of the WireGuard interface
-func GetWireGuardStatus(db store.IStore) echo.HandlerFunc {
+// GetWireGuardStatus returns the status of the WireGuard interface given by the
+// "interface" query parameter, the primary one by default
+func GetWireGuardStatus(db store.IStore, backend wgctl.Backend) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		settings, err := db.GetGlobalSettings()
+		iface, err := interfaceParam(db, c)
 		if err != nil {
-			log.Error("Cannot get global settings: ", err)
-			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: "Cannot get global settings"})
+			return c.JSON(http.StatusNotFound, jsonHTTPResponse{Success: false, Message: err.Error()})
 		}
 
-		isRunning, err := util.GetWireGuardStatus(settings)
+		isRunning, err := backend.IsUp(iface.Name)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{Success: false, Message: fmt.Sprintf("Failed to get WireGuard status: %v", err)})
 		}
@@ -1224,9 +1522,10 @@ func GetWireGuardStatus(db store.IStore) echo.HandlerFunc {
 		}
 
 		return c.JSON(http.StatusOK, map[string]interface{}{
-			"success": true,
-			"status":  status,
-			"running": isRunning,
+			"success":   true,
+			"interface": iface.Name,
+			"status":    status,
+			"running":   isRunning,
 		})
 	}
 }
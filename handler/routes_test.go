@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/swissmakers/wireguard-manager/ipam"
+	"github.com/swissmakers/wireguard-manager/model"
+)
+
+// TestNewClientIgnoresState verifies that a new client cannot be created in
+// the trash or marked as outdated.
+func TestNewClientIgnoresState(t *testing.T) {
+	db := newTestDB(t)
+
+	body := `{"name":"laptop","allocated_ips":["10.8.0.2/32"],"allowed_ips":["0.0.0.0/0"],"enabled":true,
+		"deleted_at":"2000-01-01T00:00:00Z","deleted_by":"mallory","config_outdated":true}`
+	rec := serve(t, NewClient(db, ipam.New(db)), http.MethodPost, body, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("NewClient = %d: %s", rec.Code, rec.Body)
+	}
+	var created model.Client
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := db.GetClientByID(created.ID, model.QRCodeSettings{})
+	if err != nil {
+		t.Fatalf("GetClientByID failed: %v", err)
+	}
+	if client.Client.DeletedAt != nil || client.Client.DeletedBy != "" || client.Client.ConfigOutdated {
+		t.Errorf("New client = %+v, want it active and up to date", client.Client)
+	}
+	if trashed, _ := db.GetTrashedClients(); len(trashed) != 0 {
+		t.Errorf("%d clients are in the trash, want none", len(trashed))
+	}
+}
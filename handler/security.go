@@ -2,6 +2,7 @@ package handler
 
 import (
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -94,58 +95,69 @@ func RecordFailedLogin(db store.IStore, ip string, username string) {
 		return
 	}
 
-	// Get or create attempt record
-	attempt, err := db.GetBruteForceAttempt(ip)
-	if err != nil {
-		// Create new attempt record
-		attempt = model.BruteForceAttempt{
-			IP:          ip,
-			Attempts:    0,
-			LastAttempt: time.Now().UTC(),
+	// Record the attempt and its events together, so a failed write cannot
+	// leave a counted attempt without its security event or vice versa
+	err = db.WithTx(func(tx store.IStore) error {
+		// Get or create attempt record
+		attempt, err := tx.GetBruteForceAttempt(ip)
+		if err != nil {
+			// Create new attempt record
+			attempt = model.BruteForceAttempt{
+				IP:          ip,
+				Attempts:    0,
+				LastAttempt: time.Now().UTC(),
+			}
 		}
-	}
 
-	// Check if attempt is within the time window
-	windowStart := time.Now().UTC().Add(-time.Duration(settings.BruteForceWindowMinutes) * time.Minute)
-	if attempt.LastAttempt.Before(windowStart) {
-		// Reset attempts if outside window
-		attempt.Attempts = 0
-	}
+		// Check if attempt is within the time window
+		windowStart := time.Now().UTC().Add(-time.Duration(settings.BruteForceWindowMinutes) * time.Minute)
+		if attempt.LastAttempt.Before(windowStart) {
+			// Reset attempts if outside window
+			attempt.Attempts = 0
+		}
 
-	// Increment attempts
-	attempt.Attempts++
-	attempt.LastAttempt = time.Now().UTC()
+		// Increment attempts
+		attempt.Attempts++
+		attempt.LastAttempt = time.Now().UTC()
 
-	// Check if should be blocked
-	if attempt.Attempts >= settings.BruteForceMaxAttempts {
-		attempt.BlockedUntil = time.Now().UTC().Add(time.Duration(settings.BruteForceBlockMinutes) * time.Minute)
+		// Check if should be blocked
+		if attempt.Attempts >= settings.BruteForceMaxAttempts {
+			attempt.BlockedUntil = time.Now().UTC().Add(time.Duration(settings.BruteForceBlockMinutes) * time.Minute)
 
-		// Log security event
+			// Log security event
+			event := model.SecurityEvent{
+				ID:          xid.New().String(),
+				EventType:   "brute_force",
+				IP:          ip,
+				Username:    username,
+				Description: fmt.Sprintf("Brute force detected from IP %s (user: %s) - blocked for %d minutes", ip, username, settings.BruteForceBlockMinutes),
+				CreatedAt:   time.Now().UTC(),
+			}
+			if err := tx.SaveSecurityEvent(event); err != nil {
+				return err
+			}
+
+			log.Warnf("Brute force detected from IP %s - blocked for %d minutes", ip, settings.BruteForceBlockMinutes)
+		}
+
+		if err := tx.SaveBruteForceAttempt(attempt); err != nil {
+			return err
+		}
+
+		// Log failed login event
 		event := model.SecurityEvent{
 			ID:          xid.New().String(),
-			EventType:   "brute_force",
+			EventType:   "failed_login",
 			IP:          ip,
 			Username:    username,
-			Description: fmt.Sprintf("Brute force detected from IP %s (user: %s) - blocked for %d minutes", ip, username, settings.BruteForceBlockMinutes),
+			Description: fmt.Sprintf("Failed login attempt from IP %s (user: %s) - attempt %d of %d", ip, username, attempt.Attempts, settings.BruteForceMaxAttempts),
 			CreatedAt:   time.Now().UTC(),
 		}
-		_ = db.SaveSecurityEvent(event)
-
-		log.Warnf("Brute force detected from IP %s - blocked for %d minutes", ip, settings.BruteForceBlockMinutes)
-	}
-
-	_ = db.SaveBruteForceAttempt(attempt)
-
-	// Log failed login event
-	event := model.SecurityEvent{
-		ID:          xid.New().String(),
-		EventType:   "failed_login",
-		IP:          ip,
-		Username:    username,
-		Description: fmt.Sprintf("Failed login attempt from IP %s (user: %s) - attempt %d of %d", ip, username, attempt.Attempts, settings.BruteForceMaxAttempts),
-		CreatedAt:   time.Now().UTC(),
+		return tx.SaveSecurityEvent(event)
+	})
+	if err != nil {
+		log.Errorf("Failed to record failed login from IP %s: %v", ip, err)
 	}
-	_ = db.SaveSecurityEvent(event)
 }
 
 // ClearFailedLogins clears failed login attempts for an IP (called on successful login)
@@ -189,6 +201,7 @@ func GetSecuritySettings(db store.IStore) echo.HandlerFunc {
 				Message: fmt.Sprintf("Cannot get security settings: %v", err),
 			})
 		}
+		setETag(c, settings.Revision)
 		return c.JSON(http.StatusOK, settings)
 	}
 }
@@ -204,8 +217,21 @@ func UpdateSecuritySettings(db store.IStore) echo.HandlerFunc {
 			})
 		}
 
+		previous, _ := db.GetSecuritySettings()
+		revision, err := expectedRevision(c, settings.Revision, previous.Revision)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, jsonHTTPResponse{
+				Success: false,
+				Message: err.Error(),
+			})
+		}
+
+		settings.Revision = revision
 		settings.UpdatedAt = time.Now().UTC()
 		if err := db.SaveSecuritySettings(settings); err != nil {
+			if errors.Is(err, store.ErrRevisionConflict) {
+				return revisionConflict(c, "security settings")
+			}
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
 				Success: false,
 				Message: fmt.Sprintf("Cannot update security settings: %v", err),
@@ -213,6 +239,8 @@ func UpdateSecuritySettings(db store.IStore) echo.HandlerFunc {
 		}
 
 		log.Infof("Updated security settings")
+		recordAudit(db, c, "update", "security_settings", "security_settings", previous, settings)
+		setETag(c, revision+1)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{
 			Success: true,
 			Message: "Security settings updated successfully",
@@ -305,6 +333,7 @@ func CreateIPBlock(db store.IStore) echo.HandlerFunc {
 		_ = db.SaveSecurityEvent(event)
 
 		log.Infof("IP %s blocked by admin %s", req.IP, currentUser(c))
+		recordAudit(db, c, "create", "ip_block", block.ID, nil, block)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{
 			Success: true,
 			Message: "IP blocked successfully",
@@ -327,6 +356,16 @@ func DeleteIPBlock(db store.IStore) echo.HandlerFunc {
 			})
 		}
 
+		var previous interface{}
+		if blocks, err := db.GetIPBlocks(); err == nil {
+			for _, block := range blocks {
+				if block.ID == req.ID {
+					previous = block
+					break
+				}
+			}
+		}
+
 		if err := db.DeleteIPBlock(req.ID); err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
 				Success: false,
@@ -335,6 +374,7 @@ func DeleteIPBlock(db store.IStore) echo.HandlerFunc {
 		}
 
 		log.Infof("IP block removed by admin %s", currentUser(c))
+		recordAudit(db, c, "delete", "ip_block", req.ID, previous, nil)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{
 			Success: true,
 			Message: "IP block removed successfully",
@@ -404,6 +444,7 @@ func CreateGeoIPRule(db store.IStore) echo.HandlerFunc {
 		}
 
 		log.Infof("GeoIP rule created by admin %s: %s -> %s", currentUser(c), req.CountryCode, req.Action)
+		recordAudit(db, c, "create", "geoip_rule", rule.ID, nil, rule)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{
 			Success: true,
 			Message: "GeoIP rule created successfully",
@@ -426,6 +467,16 @@ func DeleteGeoIPRule(db store.IStore) echo.HandlerFunc {
 			})
 		}
 
+		var previous interface{}
+		if rules, err := db.GetGeoIPRules(); err == nil {
+			for _, rule := range rules {
+				if rule.ID == req.ID {
+					previous = rule
+					break
+				}
+			}
+		}
+
 		if err := db.DeleteGeoIPRule(req.ID); err != nil {
 			return c.JSON(http.StatusInternalServerError, jsonHTTPResponse{
 				Success: false,
@@ -434,6 +485,7 @@ func DeleteGeoIPRule(db store.IStore) echo.HandlerFunc {
 		}
 
 		log.Infof("GeoIP rule removed by admin %s", currentUser(c))
+		recordAudit(db, c, "delete", "geoip_rule", req.ID, previous, nil)
 		return c.JSON(http.StatusOK, jsonHTTPResponse{
 			Success: true,
 			Message: "GeoIP rule removed successfully",
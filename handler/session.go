@@ -8,6 +8,7 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"github.com/swissmakers/wireguard-manager/model"
 	"github.com/swissmakers/wireguard-manager/util"
 )
 
@@ -229,6 +230,15 @@ func currentUser(c echo.Context) string {
 	return fmt.Sprintf("%s", sess.Values["username"])
 }
 
+// currentActor returns who performs the request: the ID of the API key for
+// the external API, otherwise the logged-in user.
+func currentActor(c echo.Context) string {
+	if key, ok := c.Get("api_key").(model.APIKey); ok {
+		return "api-key:" + key.ID
+	}
+	return currentUser(c)
+}
+
 // isAdmin checks whether the logged-in user is an admin.
 func isAdmin(c echo.Context) bool {
 	if util.DisableLogin {
@@ -0,0 +1,560 @@
+// Package ipam allocates the addresses of WireGuard clients.
+//
+// The allocated addresses are read from the store on every operation, so the
+// pool never disagrees with the database, whichever backend is used. The
+// networks of all WireGuard interfaces form one address space. The addresses
+// of the interfaces, of active and trashed clients and of IP reservations are
+// taken. Trashed clients keep their addresses until they are
+// purged, so they can be restored without conflicts.
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// ErrInvalidAllocation is returned when requested addresses cannot be
+// allocated or reserved.
+var ErrInvalidAllocation = errors.New("invalid IP allocation")
+
+// ErrExhausted is returned by Suggest when none of the networks has a free
+// address left.
+var ErrExhausted = errors.New("no more available ip address")
+
+// Pool allocates client addresses from the server networks. Its methods are
+// serialized, so an address checked to be free is not handed out twice.
+type Pool struct {
+	db store.IStore
+	mu sync.Mutex
+}
+
+// New returns a pool that allocates the addresses recorded in db.
+func New(db store.IStore) *Pool {
+	return &Pool{db: db}
+}
+
+// Assign checks that the addresses in cidrs can be allocated to the client
+// with the given ID and calls commit to save the client. No other address is
+// allocated or reserved until commit returns. The addresses the client already
+// has are considered free, so an updated client may keep them.
+func (p *Pool) Assign(clientID string, cidrs []string, commit func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ix, err := p.load(clientID)
+	if err != nil {
+		return err
+	}
+	requested := make(map[netip.Addr]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return invalid("invalid ip allocation input %s. Must be in CIDR format", cidr)
+		}
+		addr := prefix.Addr().Unmap()
+		if requested[addr] {
+			return invalid("IP %s is requested more than once", addr)
+		}
+		requested[addr] = true
+		if err := ix.check(addr); err != nil {
+			return err
+		}
+	}
+	return commit()
+}
+
+// Suggest returns the first free address of each of the given networks, as a
+// single host prefix. Networks without a free address are skipped; if none
+// has one, ErrExhausted is returned.
+func (p *Pool) Suggest(cidrs []string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ix, err := p.load("")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[netip.Addr]bool)
+	suggested := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		addr, ok := ix.next(prefix)
+		if !ok || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		suggested = append(suggested, netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+	if len(suggested) == 0 {
+		return nil, ErrExhausted
+	}
+	return suggested, nil
+}
+
+// Reserve saves a reservation for an address or prefix of the server
+// networks. None of its addresses may be allocated or reserved already. The
+// ID and creation time are set if they are empty.
+func (p *Pool) Reserve(reservation model.IPReservation) (model.IPReservation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prefix, err := netip.ParsePrefix(reservation.Address)
+	if err != nil {
+		return reservation, invalid("invalid reservation %s. Must be in CIDR format", reservation.Address)
+	}
+	prefix = unmap(prefix.Masked())
+	ix, err := p.load("")
+	if err != nil {
+		return reservation, err
+	}
+	if !ix.inNetwork(prefix.Addr()) || !ix.inNetwork(lastAddr(prefix)) {
+		return reservation, invalid("%s does not belong to any network addresses of WireGuard server", prefix)
+	}
+	for addr, owner := range ix.owners {
+		if prefix.Contains(addr) {
+			return reservation, invalid("IP %s already allocated to %s", addr, owner)
+		}
+	}
+	for _, r := range ix.reserved {
+		if r.prefix.Overlaps(prefix) {
+			return reservation, invalid("%s overlaps reservation %s", prefix, r.prefix)
+		}
+	}
+
+	reservation.Address = prefix.String()
+	if reservation.ID == "" {
+		reservation.ID = xid.New().String()
+	}
+	if reservation.CreatedAt.IsZero() {
+		reservation.CreatedAt = time.Now().UTC()
+	}
+	return reservation, p.db.SaveIPReservation(reservation)
+}
+
+// Usage is the utilization of a network.
+type Usage struct {
+	// CIDR is the network in CIDR notation
+	CIDR string `json:"cidr"`
+
+	// Total is the number of addresses that can be given to clients, i.e.
+	// without network and broadcast addresses
+	Total *big.Int `json:"total"`
+
+	// Allocated lists the addresses of the server and of clients
+	Allocated []Allocation `json:"allocated"`
+
+	// Reserved is the number of reserved addresses
+	Reserved *big.Int `json:"reserved"`
+
+	// Free is the number of addresses left for new clients
+	Free *big.Int `json:"free"`
+
+	// FreeBlocks is the number of contiguous runs of free addresses
+	FreeBlocks int `json:"free_blocks"`
+
+	// LargestFreeBlock is the number of addresses of the longest run of free
+	// addresses
+	LargestFreeBlock *big.Int `json:"largest_free_block"`
+}
+
+// Used returns the number of allocated and reserved addresses.
+func (u Usage) Used() *big.Int {
+	return new(big.Int).Add(u.Reserved, big.NewInt(int64(len(u.Allocated))))
+}
+
+// Utilization returns the percentage of the addresses that are allocated or
+// reserved. A network without usable addresses is fully utilized.
+func (u Usage) Utilization() float64 {
+	return percent(u.Used(), u.Total, 100)
+}
+
+// Fragmentation returns the percentage of the free addresses that are outside
+// of the largest free block. It is 0 if all free addresses are contiguous.
+func (u Usage) Fragmentation() float64 {
+	outside := new(big.Int).Sub(u.Free, u.LargestFreeBlock)
+	return percent(outside, u.Free, 0)
+}
+
+// Sum adds up the usage of several networks, e.g. of the CIDRs of a subnet
+// range. The largest free block is the largest of any of the networks.
+func Sum(usages []Usage) Usage {
+	sum := Usage{
+		Total:            new(big.Int),
+		Allocated:        []Allocation{},
+		Reserved:         new(big.Int),
+		Free:             new(big.Int),
+		LargestFreeBlock: new(big.Int),
+	}
+	var cidrs []string
+	for _, u := range usages {
+		cidrs = append(cidrs, u.CIDR)
+		sum.Total.Add(sum.Total, u.Total)
+		sum.Allocated = append(sum.Allocated, u.Allocated...)
+		sum.Reserved.Add(sum.Reserved, u.Reserved)
+		sum.Free.Add(sum.Free, u.Free)
+		sum.FreeBlocks += u.FreeBlocks
+		if u.LargestFreeBlock.Cmp(sum.LargestFreeBlock) > 0 {
+			sum.LargestFreeBlock.Set(u.LargestFreeBlock)
+		}
+	}
+	sum.CIDR = strings.Join(cidrs, ", ")
+	return sum
+}
+
+// Allocation is an address in use.
+type Allocation struct {
+	Address string `json:"address"`
+	Owner   string `json:"owner"`
+}
+
+// Usage returns the utilization of each of the given networks.
+func (p *Pool) Usage(cidrs []string) ([]Usage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ix, err := p.load("")
+	if err != nil {
+		return nil, err
+	}
+	usages := make([]Usage, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, ix.usage(prefix))
+	}
+	return usages, nil
+}
+
+// reservedPrefix is a reserved address or prefix.
+type reservedPrefix struct {
+	prefix netip.Prefix
+	owner  string
+}
+
+// index is a snapshot of the allocated and reserved addresses.
+type index struct {
+	networks []netip.Prefix
+	owners   map[netip.Addr]string
+	reserved []reservedPrefix
+}
+
+// load builds the index from the store. The addresses of the client with the
+// ID ignoreClientID are left out.
+func (p *Pool) load(ignoreClientID string) (*index, error) {
+	server, err := p.db.GetServer()
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch server config: %v", err)
+	}
+	clients, err := p.db.GetClients(false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch clients: %v", err)
+	}
+	trashed, err := p.db.GetTrashedClients()
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch trashed clients: %v", err)
+	}
+	reservations, err := p.db.GetIPReservations()
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch IP reservations: %v", err)
+	}
+	ifaces, err := p.db.GetWireGuardInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch interfaces: %v", err)
+	}
+
+	ix := &index{owners: make(map[netip.Addr]string)}
+	if server.Interface != nil {
+		ix.addNetworks(server.Interface.Addresses, "the server")
+	}
+	for _, iface := range ifaces {
+		ix.addNetworks(iface.Addresses, fmt.Sprintf("interface %s", iface.Name))
+	}
+	for _, clientData := range append(clients, trashed...) {
+		client := clientData.Client
+		if client.ID == ignoreClientID {
+			continue
+		}
+		for _, cidr := range client.AllocatedIPs {
+			if prefix, err := netip.ParsePrefix(cidr); err == nil {
+				ix.owners[prefix.Addr().Unmap()] = fmt.Sprintf("client %q", client.Name)
+			}
+		}
+	}
+	for _, r := range reservations {
+		prefix, err := netip.ParsePrefix(r.Address)
+		if err != nil {
+			continue
+		}
+		prefix = unmap(prefix.Masked())
+		ix.reserved = append(ix.reserved, reservedPrefix{prefix: prefix, owner: fmt.Sprintf("reservation %q", r.Description)})
+	}
+	return ix, nil
+}
+
+// addNetworks adds the networks of the interface addresses in cidrs, taking
+// the addresses themselves for owner.
+func (ix *index) addNetworks(cidrs []string, owner string) {
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			continue
+		}
+		prefix = unmap(prefix)
+		ix.networks = append(ix.networks, prefix.Masked())
+		ix.owners[prefix.Addr()] = owner
+	}
+}
+
+// check returns an error if addr cannot be allocated.
+func (ix *index) check(addr netip.Addr) error {
+	network, ok := ix.network(addr)
+	if !ok {
+		return invalid("IP %s does not belong to any network addresses of WireGuard server", addr)
+	}
+	if !usable(addr, network) {
+		return invalid("IP %s is the network or broadcast address of %s", addr, network)
+	}
+	if owner, ok := ix.owners[addr]; ok {
+		return invalid("IP %s already allocated to %s", addr, owner)
+	}
+	if r, ok := ix.reservedAt(addr); ok {
+		return invalid("IP %s is reserved by %s", addr, r.owner)
+	}
+	return nil
+}
+
+// next returns the first free address of prefix. It steps over every
+// allocated address and jumps over reserved prefixes, so it takes time in the
+// number of allocations and not in the size of the prefix.
+func (ix *index) next(prefix netip.Prefix) (netip.Addr, bool) {
+	prefix = unmap(prefix.Masked())
+	for _, network := range ix.networks {
+		if !network.Overlaps(prefix) {
+			continue
+		}
+		within := smaller(network, prefix)
+		last := lastAddr(within)
+		for addr := within.Addr(); addr.IsValid() && addr.Compare(last) <= 0; {
+			if r, ok := ix.reservedAt(addr); ok {
+				addr = lastAddr(r.prefix).Next()
+				continue
+			}
+			if _, taken := ix.owners[addr]; !taken && usable(addr, network) {
+				return addr, true
+			}
+			addr = addr.Next()
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// usage counts the addresses of prefix.
+func (ix *index) usage(prefix netip.Prefix) Usage {
+	prefix = unmap(prefix.Masked())
+
+	// The network and broadcast addresses of the server networks are never
+	// given out and not counted.
+	var unusable []netip.Addr
+	for _, network := range ix.networks {
+		for _, addr := range []netip.Addr{network.Addr(), lastAddr(network)} {
+			if prefix.Contains(addr) && !usable(addr, network) && !slices.Contains(unusable, addr) {
+				unusable = append(unusable, addr)
+			}
+		}
+	}
+	usage := Usage{
+		CIDR:      prefix.String(),
+		Total:     new(big.Int).Sub(size(prefix), big.NewInt(int64(len(unusable)))),
+		Allocated: []Allocation{},
+		Reserved:  new(big.Int),
+	}
+
+	for _, r := range ix.reserved {
+		if !r.prefix.Overlaps(prefix) {
+			continue
+		}
+		within := smaller(r.prefix, prefix)
+		n := size(within)
+		for _, addr := range unusable {
+			if within.Contains(addr) {
+				n.Sub(n, big.NewInt(1))
+			}
+		}
+		usage.Reserved.Add(usage.Reserved, n)
+	}
+
+	var addrs []netip.Addr
+	for addr := range ix.owners {
+		if prefix.Contains(addr) && !slices.Contains(unusable, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	for _, addr := range addrs {
+		usage.Allocated = append(usage.Allocated, Allocation{Address: addr.String(), Owner: ix.owners[addr]})
+	}
+
+	usage.Free = new(big.Int).Sub(usage.Total, usage.Reserved)
+	usage.Free.Sub(usage.Free, big.NewInt(int64(len(addrs))))
+	if usage.Free.Sign() < 0 {
+		usage.Free.SetInt64(0)
+	}
+
+	// The free blocks are the gaps between the addresses that are taken.
+	taken := make([]span, 0, len(unusable)+len(addrs))
+	for _, addr := range append(unusable, addrs...) {
+		taken = append(taken, span{addr, addr})
+	}
+	for _, r := range ix.reserved {
+		if r.prefix.Overlaps(prefix) {
+			within := smaller(r.prefix, prefix)
+			taken = append(taken, span{within.Addr(), lastAddr(within)})
+		}
+	}
+	usage.FreeBlocks, usage.LargestFreeBlock = freeBlocks(prefix, taken)
+	return usage
+}
+
+// span is a range of addresses from first to last, inclusive.
+type span struct {
+	first, last netip.Addr
+}
+
+// freeBlocks returns the number of contiguous runs of addresses of prefix
+// that are not in any of the taken spans, and the length of the longest run.
+func freeBlocks(prefix netip.Prefix, taken []span) (int, *big.Int) {
+	slices.SortFunc(taken, func(a, b span) int { return a.first.Compare(b.first) })
+
+	blocks, largest := 0, new(big.Int)
+	gap := func(first, last netip.Addr) {
+		n := new(big.Int).Sub(addrInt(last), addrInt(first))
+		n.Add(n, big.NewInt(1))
+		blocks++
+		if n.Cmp(largest) > 0 {
+			largest = n
+		}
+	}
+
+	// next is the first address not covered by the spans seen so far.
+	next, end := prefix.Addr(), lastAddr(prefix)
+	for _, s := range taken {
+		if s.last.Compare(next) < 0 {
+			continue
+		}
+		if s.first.Compare(next) > 0 {
+			gap(next, s.first.Prev())
+		}
+		if s.last == end {
+			return blocks, largest
+		}
+		next = s.last.Next()
+	}
+	gap(next, end)
+	return blocks, largest
+}
+
+// network returns the server network containing addr.
+func (ix *index) network(addr netip.Addr) (netip.Prefix, bool) {
+	for _, network := range ix.networks {
+		if network.Contains(addr) {
+			return network, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// inNetwork reports whether addr belongs to a server network.
+func (ix *index) inNetwork(addr netip.Addr) bool {
+	_, ok := ix.network(addr)
+	return ok
+}
+
+// reservedAt returns the reserved prefix containing addr.
+func (ix *index) reservedAt(addr netip.Addr) (reservedPrefix, bool) {
+	for _, r := range ix.reserved {
+		if r.prefix.Contains(addr) {
+			return r, true
+		}
+	}
+	return reservedPrefix{}, false
+}
+
+// usable reports whether addr may be given to a client of network, i.e. it is
+// not the network address or, in IPv4 networks, the broadcast address.
+func usable(addr netip.Addr, network netip.Prefix) bool {
+	if network.IsSingleIP() || (addr.Is4() && network.Bits() == 31) {
+		return true
+	}
+	if addr == network.Addr() {
+		return false
+	}
+	return !addr.Is4() || addr != lastAddr(network)
+}
+
+// smaller returns the smaller of two overlapping prefixes, which is contained
+// in the other one.
+func smaller(a, b netip.Prefix) netip.Prefix {
+	if a.Bits() > b.Bits() {
+		return a
+	}
+	return b
+}
+
+// size returns the number of addresses of prefix.
+func size(prefix netip.Prefix) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(prefix.Addr().BitLen()-prefix.Bits()))
+}
+
+// addrInt returns addr as an integer.
+func addrInt(addr netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(addr.AsSlice())
+}
+
+// percent returns part as a percentage of whole, or ifEmpty if whole is zero.
+func percent(part, whole *big.Int, ifEmpty float64) float64 {
+	if whole.Sign() == 0 {
+		return ifEmpty
+	}
+	ratio, _ := new(big.Rat).SetFrac(new(big.Int).Mul(part, big.NewInt(100)), whole).Float64()
+	return ratio
+}
+
+// lastAddr returns the highest address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr()
+	bytes := addr.AsSlice()
+	for bit := prefix.Bits(); bit < addr.BitLen(); bit++ {
+		bytes[bit/8] |= 1 << (7 - bit%8)
+	}
+	last, _ := netip.AddrFromSlice(bytes)
+	return last
+}
+
+// unmap converts a prefix of IPv4-mapped IPv6 addresses to IPv4.
+func unmap(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+}
+
+// invalid returns an ErrInvalidAllocation error with the given message.
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidAllocation, fmt.Sprintf(format, args...))
+}
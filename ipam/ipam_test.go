@@ -0,0 +1,317 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/sqlitedb"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// newTestPool creates a pool on an SQLite store whose server has the given
+// addresses.
+func newTestPool(t *testing.T, addresses ...string) (*Pool, store.IStore) {
+	t.Helper()
+
+	// Avoid the public IP lookup during default data seeding
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordEnvVar, "test-password")
+
+	tmpDir, err := os.MkdirTemp("", "wireguard-manager-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	db, err := sqlitedb.New(filepath.Join(tmpDir, "wireguard-manager.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	server, err := db.GetServer()
+	if err != nil {
+		t.Fatalf("Failed to get server: %v", err)
+	}
+	server.Interface.Addresses = addresses
+	if err := db.SaveServerInterface(*server.Interface); err != nil {
+		t.Fatalf("Failed to save server interface: %v", err)
+	}
+	return New(db), db
+}
+
+// assign allocates cidrs to a new client with the given ID.
+func assign(p *Pool, db store.IStore, id string, cidrs ...string) error {
+	return p.Assign(id, cidrs, func() error {
+		return db.SaveClient(model.Client{ID: id, Name: id, AllocatedIPs: cidrs})
+	})
+}
+
+// TestAssign verifies which addresses can be allocated to a client.
+func TestAssign(t *testing.T) {
+	p, db := newTestPool(t, "10.8.0.1/24", "fd00::1/64")
+
+	if err := assign(p, db, "c1", "10.8.0.2/32", "fd00::2/128"); err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+	if _, err := p.Reserve(model.IPReservation{Address: "10.8.0.3/32", Description: "dns"}); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	for _, cidr := range []string{
+		"10.8.0.1/32",    // server
+		"10.8.0.2/32",    // client c1
+		"10.8.0.3/32",    // reservation
+		"10.8.0.0/32",    // network address
+		"10.8.0.255/32",  // broadcast address
+		"10.9.0.2/32",    // outside the server networks
+		"fd00::2/128",    // client c1
+		"not-an-address", // invalid
+	} {
+		if err := assign(p, db, "c2", cidr); !errors.Is(err, ErrInvalidAllocation) {
+			t.Errorf("Assign(%s) = %v, want ErrInvalidAllocation", cidr, err)
+		}
+	}
+	if err := assign(p, db, "c2", "10.8.0.4/32", "10.8.0.4/32"); !errors.Is(err, ErrInvalidAllocation) {
+		t.Errorf("Assign of a duplicate = %v, want ErrInvalidAllocation", err)
+	}
+
+	// A client keeps its own addresses when it is updated
+	if err := p.Assign("c1", []string{"10.8.0.2/32", "fd00::3/128"}, func() error { return nil }); err != nil {
+		t.Errorf("Assign of the client's own address failed: %v", err)
+	}
+}
+
+// TestAssignConcurrent verifies that concurrent requests for the same address
+// allocate it only once.
+func TestAssignConcurrent(t *testing.T) {
+	p, db := newTestPool(t, "10.8.0.1/24")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = assign(p, db, string(rune('a'+i)), "10.8.0.10/32")
+		}(i)
+	}
+	wg.Wait()
+
+	allocated := 0
+	for _, err := range errs {
+		if err == nil {
+			allocated++
+		} else if !errors.Is(err, ErrInvalidAllocation) {
+			t.Errorf("Assign failed: %v", err)
+		}
+	}
+	if allocated != 1 {
+		t.Errorf("Address was allocated %d times, want 1", allocated)
+	}
+}
+
+// TestSuggest verifies that suggestions skip allocated and reserved
+// addresses, also in large prefixes.
+func TestSuggest(t *testing.T) {
+	p, db := newTestPool(t, "10.8.0.1/24", "fd00::1/64")
+
+	if err := assign(p, db, "c1", "10.8.0.2/32", "fd00::2/128", "fd00::3/128"); err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+	if _, err := p.Reserve(model.IPReservation{Address: "fd00::4/126", Description: "infrastructure"}); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if _, err := p.Reserve(model.IPReservation{Address: "fd00::5/128"}); err == nil {
+		t.Error("Reserve of an overlapping prefix succeeded")
+	}
+
+	suggested, err := p.Suggest([]string{"10.8.0.1/24", "fd00::1/64"})
+	if err != nil {
+		t.Fatalf("Suggest failed: %v", err)
+	}
+	want := []string{"10.8.0.3/32", "fd00::8/128"}
+	if len(suggested) != len(want) || suggested[0] != want[0] || suggested[1] != want[1] {
+		t.Errorf("Suggest = %v, want %v", suggested, want)
+	}
+
+	usage, err := p.Usage([]string{"10.8.0.0/24", "fd00::/64"})
+	if err != nil {
+		t.Fatalf("Usage failed: %v", err)
+	}
+	// 254 usable addresses, allocated to the server and c1
+	if v4 := usage[0]; v4.Total.Int64() != 254 || len(v4.Allocated) != 2 || v4.Free.Int64() != 252 {
+		t.Errorf("Usage of 10.8.0.0/24 = %+v", v4)
+	}
+	// 2^64 - 1 usable addresses, 3 allocated and 4 reserved
+	if v6 := usage[1]; v6.Reserved.Int64() != 4 || len(v6.Allocated) != 3 || v6.Free.String() != "18446744073709551608" {
+		t.Errorf("Usage of fd00::/64 = %+v", v6)
+	}
+
+	if _, err := p.Suggest([]string{"10.8.0.2/32"}); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Suggest of an allocated address = %v, want ErrExhausted", err)
+	}
+}
+
+// TestUsageFreeBlocks verifies that allocations and reservations split the
+// free addresses into blocks.
+func TestUsageFreeBlocks(t *testing.T) {
+	p, db := newTestPool(t, "10.8.0.1/24")
+
+	if err := assign(p, db, "c1", "10.8.0.10/32"); err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+	if _, err := p.Reserve(model.IPReservation{Address: "10.8.0.100/30"}); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	usage, err := p.Usage([]string{"10.8.0.0/24", "10.8.0.0/28"})
+	if err != nil {
+		t.Fatalf("Usage failed: %v", err)
+	}
+	// Free are .2-.9, .11-.99 and .104-.254
+	u := usage[0]
+	if u.Free.Int64() != 248 || u.FreeBlocks != 3 || u.LargestFreeBlock.Int64() != 151 {
+		t.Errorf("Usage of 10.8.0.0/24 = %+v, want 248 free in 3 blocks of at most 151", u)
+	}
+	if got := fmt.Sprintf("%.2f/%.2f", u.Utilization(), u.Fragmentation()); got != "2.36/39.11" {
+		t.Errorf("Utilization/Fragmentation = %s, want 2.36/39.11", got)
+	}
+	// Free are .2-.9 and .11-.15
+	if u := usage[1]; u.Free.Int64() != 13 || u.FreeBlocks != 2 || u.LargestFreeBlock.Int64() != 8 {
+		t.Errorf("Usage of 10.8.0.0/28 = %+v, want 13 free in 2 blocks of at most 8", u)
+	}
+
+	sum := Sum(usage)
+	if sum.Free.Int64() != 261 || sum.FreeBlocks != 5 || sum.LargestFreeBlock.Int64() != 151 {
+		t.Errorf("Sum = %+v", sum)
+	}
+}
+
+// TestRenumber verifies that renumbering keeps host offsets where possible
+// and saves nothing until it is applied.
+func TestRenumber(t *testing.T) {
+	p, db := newTestPool(t, "10.8.0.1/24")
+
+	if err := db.SaveClient(model.Client{ID: "c1", Name: "c1", AllocatedIPs: []string{"10.8.0.2/32"}, AllowedIPs: []string{"10.8.0.0/24", "0.0.0.0/0"}}); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+	if err := assign(p, db, "c2", "10.8.0.200/32"); err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+	if _, err := p.Reserve(model.IPReservation{ID: "r1", Address: "10.8.0.3/32"}); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if err := db.SaveSubnetRange(model.SubnetRange{ID: "s1", Name: "upper", CIDRs: []string{"10.8.0.128/25"}}); err != nil {
+		t.Fatalf("SaveSubnetRange failed: %v", err)
+	}
+
+	// The subnet range is beyond the smaller network
+	if _, err := p.Renumber("wg0", "10.8.0.0/24", "10.9.0.0/25", false); !errors.Is(err, ErrInvalidAllocation) {
+		t.Errorf("Renumber with a subnet range beyond the new network = %v, want ErrInvalidAllocation", err)
+	}
+	if err := db.DeleteSubnetRange("s1"); err != nil {
+		t.Fatalf("DeleteSubnetRange failed: %v", err)
+	}
+
+	plan, err := p.Renumber("wg0", "10.8.0.1/24", "10.9.0.0/25", false)
+	if err != nil {
+		t.Fatalf("Renumber preview failed: %v", err)
+	}
+	if len(plan.Changes) != 4 {
+		t.Errorf("Renumber preview has %d changes, want 4: %+v", len(plan.Changes), plan.Changes)
+	}
+	if client, _ := db.GetClientByID("c2", model.QRCodeSettings{}); client.Client.AllocatedIPs[0] != "10.8.0.200/32" {
+		t.Errorf("Renumber preview changed client c2 to %v", client.Client.AllocatedIPs)
+	}
+
+	if _, err := p.Renumber("wg0", "10.8.0.0/24", "10.9.0.0/25", true); err != nil {
+		t.Fatalf("Renumber failed: %v", err)
+	}
+	server, _ := db.GetServer()
+	if got := server.Interface.Addresses; len(got) != 1 || got[0] != "10.9.0.1/25" {
+		t.Errorf("Server addresses = %v, want [10.9.0.1/25]", got)
+	}
+	for id, want := range map[string]string{
+		"c1": "10.9.0.2/32", // same host offset
+		"c2": "10.9.0.4/32", // reallocated after the reservation
+	} {
+		client, err := db.GetClientByID(id, model.QRCodeSettings{})
+		if err != nil {
+			t.Fatalf("GetClientByID(%s) failed: %v", id, err)
+		}
+		if client.Client.AllocatedIPs[0] != want || !client.Client.ConfigOutdated {
+			t.Errorf("Client %s = %v, outdated %v, want %s and outdated", id, client.Client.AllocatedIPs, client.Client.ConfigOutdated, want)
+		}
+	}
+	c1, _ := db.GetClientByID("c1", model.QRCodeSettings{})
+	if got := c1.Client.AllowedIPs; got[0] != "10.9.0.0/25" || got[1] != "0.0.0.0/0" {
+		t.Errorf("Allowed IPs of c1 = %v", got)
+	}
+	reservations, _ := db.GetIPReservations()
+	if len(reservations) != 1 || reservations[0].Address != "10.9.0.3/32" {
+		t.Errorf("Reservations = %+v, want 10.9.0.3/32", reservations)
+	}
+}
+
+// TestRenumberInterface verifies that renumbering works on the selected
+// interface and its clients only, and that the new network must not overlap
+// another interface.
+func TestRenumberInterface(t *testing.T) {
+	p, db := newTestPool(t, "10.8.0.1/24")
+	if err := db.SaveWireGuardInterface(model.WireGuardInterface{Name: "wg1", Addresses: []string{"10.9.0.1/24"}, ListenPort: 51821, ConfigFilePath: "/etc/wireguard/wg1.conf"}); err != nil {
+		t.Fatalf("SaveWireGuardInterface failed: %v", err)
+	}
+	for _, client := range []model.Client{
+		{ID: "c1", Name: "c1", AllocatedIPs: []string{"10.8.0.2/32"}, AllowedIPs: []string{"10.8.0.0/24"}},
+		{ID: "c2", Name: "c2", Interface: "wg1", AllocatedIPs: []string{"10.9.0.2/32"}, AllowedIPs: []string{"10.8.0.0/24", "10.9.0.0/24"}},
+	} {
+		if err := db.SaveClient(client); err != nil {
+			t.Fatalf("SaveClient failed: %v", err)
+		}
+	}
+
+	if _, err := p.Renumber("wg0", "10.8.0.0/24", "10.9.0.0/25", false); !errors.Is(err, ErrInvalidAllocation) {
+		t.Errorf("Renumber onto the network of wg1 = %v, want ErrInvalidAllocation", err)
+	}
+	if _, err := p.Renumber("wg1", "10.8.0.0/24", "10.10.0.0/24", false); !errors.Is(err, ErrInvalidAllocation) {
+		t.Errorf("Renumber of a network of another interface = %v, want ErrInvalidAllocation", err)
+	}
+	if _, err := p.Renumber("wg9", "10.8.0.0/24", "10.10.0.0/24", false); !errors.Is(err, ErrInvalidAllocation) {
+		t.Errorf("Renumber of an unknown interface = %v, want ErrInvalidAllocation", err)
+	}
+
+	// Clients of wg1 keep their allowed IPs in the network of wg0
+	if _, err := p.Renumber("wg0", "10.8.0.0/24", "10.10.0.0/24", true); err != nil {
+		t.Fatalf("Renumber of wg0 failed: %v", err)
+	}
+	c2, _ := db.GetClientByID("c2", model.QRCodeSettings{})
+	if got := c2.Client.AllowedIPs; got[0] != "10.8.0.0/24" || c2.Client.ConfigOutdated {
+		t.Errorf("Client of wg1 = %v, outdated %v, want it unchanged", got, c2.Client.ConfigOutdated)
+	}
+
+	if _, err := p.Renumber("wg1", "10.9.0.0/24", "10.11.0.0/24", true); err != nil {
+		t.Fatalf("Renumber of wg1 failed: %v", err)
+	}
+	iface, _ := db.GetWireGuardInterface("wg1")
+	if got := iface.Addresses; len(got) != 1 || got[0] != "10.11.0.1/24" {
+		t.Errorf("Addresses of wg1 = %v, want [10.11.0.1/24]", got)
+	}
+	server, _ := db.GetServer()
+	if got := server.Interface.Addresses; got[0] != "10.10.0.1/24" {
+		t.Errorf("Server addresses = %v, want [10.10.0.1/24]", got)
+	}
+	c1, _ := db.GetClientByID("c1", model.QRCodeSettings{})
+	c2, _ = db.GetClientByID("c2", model.QRCodeSettings{})
+	if c1.Client.AllocatedIPs[0] != "10.10.0.2/32" || c2.Client.AllocatedIPs[0] != "10.11.0.2/32" {
+		t.Errorf("Client addresses = %v and %v, want 10.10.0.2/32 and 10.11.0.2/32", c1.Client.AllocatedIPs, c2.Client.AllocatedIPs)
+	}
+}
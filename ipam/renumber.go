@@ -0,0 +1,392 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// Renumbering lists the changes that move a server network onto a new one.
+type Renumbering struct {
+	// Interface is the name of the interface whose network is renumbered
+	Interface string `json:"interface"`
+
+	// From is the server network that is renumbered
+	From string `json:"from"`
+
+	// To is the network it is moved onto
+	To string `json:"to"`
+
+	// Changes lists every record whose addresses change
+	Changes []Change `json:"changes"`
+}
+
+// Change is a record whose addresses are renumbered.
+type Change struct {
+	// Type is the kind of record: server_interface, interface, client,
+	// ip_reservation or subnet_range
+	Type string `json:"type"`
+
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Old and New are the addresses of the record before and after
+	// renumbering: the addresses of the interface, the allocated IPs
+	// of a client, the address of a reservation or the CIDRs of a range
+	Old []string `json:"old"`
+	New []string `json:"new"`
+
+	// OldAllowedIPs and NewAllowedIPs are set if the allowed IPs of a client
+	// change as well
+	OldAllowedIPs []string `json:"old_allowed_ips,omitempty"`
+	NewAllowedIPs []string `json:"new_allowed_ips,omitempty"`
+
+	// Reallocated lists the new addresses that could not keep their host
+	// offset, because it is beyond the new network, is its network or
+	// broadcast address or is taken
+	Reallocated []string `json:"reallocated,omitempty"`
+}
+
+// renumbered holds the records of a renumbering with their new addresses.
+type renumbered struct {
+	server       *model.ServerInterface
+	iface        *model.WireGuardInterface
+	clients      []model.Client
+	reservations []model.IPReservation
+	ranges       []model.SubnetRange
+}
+
+// Renumber moves the network from of the interface named iface onto the
+// network to, which must not overlap the networks of any interface. Every
+// address of the interface, of its clients and of reservations and subnet
+// ranges in from keeps its host offset in to; client addresses where that is
+// not possible are reallocated from the free addresses of to. Allowed IPs in
+// from of the clients of the interface are moved along.
+//
+// If apply is false, Renumber only returns the changes it would make.
+// Otherwise it saves them in a single transaction and marks the renumbered
+// clients as needing a new configuration.
+func (p *Pool) Renumber(iface, from, to string, apply bool) (Renumbering, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	plan, records, err := p.planRenumbering(iface, from, to)
+	if err != nil || !apply {
+		return plan, err
+	}
+
+	now := time.Now().UTC()
+	err = p.db.WithTx(func(tx store.IStore) error {
+		if records.server != nil {
+			records.server.UpdatedAt = now
+			if err := tx.SaveServerInterface(*records.server); err != nil {
+				return err
+			}
+		}
+		if records.iface != nil {
+			records.iface.UpdatedAt = now
+			if err := tx.SaveWireGuardInterface(*records.iface); err != nil {
+				return err
+			}
+		}
+		for _, client := range records.clients {
+			client.ConfigOutdated = true
+			client.UpdatedAt = now
+			if err := tx.SaveClient(client); err != nil {
+				return err
+			}
+		}
+		for _, reservation := range records.reservations {
+			if err := tx.SaveIPReservation(reservation); err != nil {
+				return err
+			}
+		}
+		for _, subnetRange := range records.ranges {
+			subnetRange.UpdatedAt = now
+			if err := tx.SaveSubnetRange(subnetRange); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return plan, err
+}
+
+// planRenumbering computes the changes of a renumbering from the current
+// records of the store.
+func (p *Pool) planRenumbering(ifaceName, fromCIDR, toCIDR string) (Renumbering, renumbered, error) {
+	var records renumbered
+	from, err := netip.ParsePrefix(strings.TrimSpace(fromCIDR))
+	if err != nil {
+		return Renumbering{}, records, invalid("invalid network %s", fromCIDR)
+	}
+	to, err := netip.ParsePrefix(strings.TrimSpace(toCIDR))
+	if err != nil {
+		return Renumbering{}, records, invalid("invalid network %s", toCIDR)
+	}
+	from, to = unmap(from.Masked()), unmap(to.Masked())
+	plan := Renumbering{Interface: ifaceName, From: from.String(), To: to.String(), Changes: []Change{}}
+	if from.Addr().Is4() != to.Addr().Is4() {
+		return plan, records, invalid("%s and %s are of different address families", from, to)
+	}
+	if from == to {
+		return plan, records, invalid("%s is already the server network", to)
+	}
+
+	ifaces, err := util.GetInterfaces(p.db)
+	if err != nil {
+		return plan, records, err
+	}
+	selected := slices.IndexFunc(ifaces, func(i model.WireGuardInterface) bool { return i.Name == ifaceName })
+	if selected < 0 {
+		return plan, records, invalid("interface %s not found", ifaceName)
+	}
+	iface := ifaces[selected]
+	clients, err := p.db.GetClients(false)
+	if err != nil {
+		return plan, records, fmt.Errorf("cannot fetch clients: %v", err)
+	}
+	trashed, err := p.db.GetTrashedClients()
+	if err != nil {
+		return plan, records, fmt.Errorf("cannot fetch trashed clients: %v", err)
+	}
+	reservations, err := p.db.GetIPReservations()
+	if err != nil {
+		return plan, records, fmt.Errorf("cannot fetch IP reservations: %v", err)
+	}
+	ranges, err := p.db.GetSubnetRanges()
+	if err != nil {
+		return plan, records, fmt.Errorf("cannot fetch subnet ranges: %v", err)
+	}
+
+	// Find the interface address in from. The new network must not overlap
+	// the other networks of the interface nor those of other interfaces.
+	serverIndex := -1
+	for i, address := range iface.Addresses {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(address))
+		if err != nil {
+			continue
+		}
+		network := unmap(prefix.Masked())
+		if network == from {
+			serverIndex = i
+		} else if network.Overlaps(to) {
+			return plan, records, invalid("%s overlaps the network %s of interface %s", to, network, iface.Name)
+		}
+	}
+	if serverIndex < 0 {
+		return plan, records, invalid("%s is not a network of interface %s", from, iface.Name)
+	}
+	moved := iface
+	moved.Addresses = []string{to.String()}
+	if err := util.CheckInterfaceConflicts(ifaces, moved); err != nil {
+		return plan, records, invalid("%v", err)
+	}
+
+	// ix tracks the addresses of to that are taken. Addresses outside of from
+	// keep their place, so they are taken from the start. Only the clients of
+	// the interface are renumbered.
+	ix := &index{networks: []netip.Prefix{to}, owners: make(map[netip.Addr]string)}
+	all := make([]model.Client, 0, len(clients)+len(trashed))
+	for _, clientData := range append(clients, trashed...) {
+		if clientData.Client.Interface == util.ClientInterfaceName(iface) {
+			all = append(all, *clientData.Client)
+		}
+	}
+	slices.SortFunc(all, func(a, b model.Client) int { return strings.Compare(a.Name, b.Name) })
+	for _, client := range all {
+		for _, cidr := range client.AllocatedIPs {
+			if prefix, err := netip.ParsePrefix(cidr); err == nil {
+				addr := prefix.Addr().Unmap()
+				if !from.Contains(addr) && to.Contains(addr) {
+					ix.owners[addr] = fmt.Sprintf("client %q", client.Name)
+				}
+			}
+		}
+	}
+
+	// Reservations keep their offsets, as they usually stand for statically
+	// configured hosts.
+	for _, r := range reservations {
+		prefix, err := netip.ParsePrefix(r.Address)
+		if err != nil || !from.Contains(prefix.Addr().Unmap()) {
+			continue
+		}
+		moved, ok := movePrefix(unmap(prefix.Masked()), from, to)
+		if !ok {
+			return plan, records, invalid("reservation %s does not fit into %s", r.Address, to)
+		}
+		ix.reserved = append(ix.reserved, reservedPrefix{prefix: moved, owner: fmt.Sprintf("reservation %q", r.Description)})
+		plan.Changes = append(plan.Changes, Change{
+			Type: "ip_reservation", ID: r.ID, Name: r.Description,
+			Old: []string{r.Address}, New: []string{moved.String()},
+		})
+		r.Address = moved.String()
+		records.reservations = append(records.reservations, r)
+	}
+
+	// The interface comes first, so it keeps its address if at all possible.
+	// It may be the network address, as in the default configuration.
+	addresses := slices.Clone(iface.Addresses)
+	serverPrefix, _ := netip.ParsePrefix(strings.TrimSpace(addresses[serverIndex]))
+	serverChange := Change{Type: "interface", ID: iface.Name, Name: "interface " + iface.Name, Old: iface.Addresses}
+	if iface.Primary {
+		serverChange.Type, serverChange.ID, serverChange.Name = "server_interface", "server_interface", "the server"
+	}
+	addr, ok := moveAddr(serverPrefix.Addr().Unmap(), from, to)
+	if _, reserved := ix.reservedAt(addr); !ok || reserved || ix.owners[addr] != "" {
+		if addr, ok = ix.next(to); !ok {
+			return plan, records, fmt.Errorf("%w in %s", ErrExhausted, to)
+		}
+		serverChange.Reallocated = []string{addr.String()}
+	}
+	ix.owners[addr] = serverChange.Name
+	addresses[serverIndex] = netip.PrefixFrom(addr, to.Bits()).String()
+	serverChange.New = addresses
+	if iface.Primary {
+		server, err := p.db.GetServer()
+		if err != nil {
+			return plan, records, fmt.Errorf("cannot fetch server config: %v", err)
+		}
+		serverInterface := *server.Interface
+		serverInterface.Addresses = addresses
+		records.server = &serverInterface
+	} else {
+		iface.Addresses = addresses
+		records.iface = &iface
+	}
+	plan.Changes = append(plan.Changes, serverChange)
+
+	// Client addresses keep their host offset where possible. The others are
+	// reallocated once all offsets are taken, so that they do not take the
+	// place of an address that could have been kept.
+	type pending struct{ client, ip int }
+	var moves []pending
+	changed := make([]model.Client, len(all))
+	for i, client := range all {
+		client.AllocatedIPs = slices.Clone(client.AllocatedIPs)
+		for j, cidr := range client.AllocatedIPs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil || !from.Contains(prefix.Addr().Unmap()) {
+				continue
+			}
+			prefix = unmap(prefix)
+			if !prefix.IsSingleIP() {
+				moved, ok := movePrefix(prefix.Masked(), from, to)
+				if !ok {
+					return plan, records, invalid("%s of client %q does not fit into %s", cidr, client.Name, to)
+				}
+				client.AllocatedIPs[j] = moved.String()
+				continue
+			}
+			addr, ok := moveAddr(prefix.Addr(), from, to)
+			if !ok || ix.check(addr) != nil {
+				moves = append(moves, pending{i, j})
+				continue
+			}
+			ix.owners[addr] = fmt.Sprintf("client %q", client.Name)
+			client.AllocatedIPs[j] = netip.PrefixFrom(addr, prefix.Bits()).String()
+		}
+		changed[i] = client
+	}
+	reallocated := make(map[int][]string)
+	for _, move := range moves {
+		client := changed[move.client]
+		addr, ok := ix.next(to)
+		if !ok {
+			return plan, records, fmt.Errorf("%w in %s", ErrExhausted, to)
+		}
+		ix.owners[addr] = fmt.Sprintf("client %q", client.Name)
+		client.AllocatedIPs[move.ip] = netip.PrefixFrom(addr, addr.BitLen()).String()
+		reallocated[move.client] = append(reallocated[move.client], client.AllocatedIPs[move.ip])
+	}
+
+	for i, client := range changed {
+		client.AllowedIPs = slices.Clone(client.AllowedIPs)
+		for j, cidr := range client.AllowedIPs {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+			if err != nil || !from.Contains(prefix.Addr().Unmap()) {
+				continue
+			}
+			moved, ok := movePrefix(unmap(prefix.Masked()), from, to)
+			if !ok {
+				moved = to
+			}
+			client.AllowedIPs[j] = moved.String()
+		}
+
+		original := all[i]
+		allocatedChanged := !slices.Equal(original.AllocatedIPs, client.AllocatedIPs)
+		allowedChanged := !slices.Equal(original.AllowedIPs, client.AllowedIPs)
+		if !allocatedChanged && !allowedChanged {
+			continue
+		}
+		change := Change{
+			Type: "client", ID: client.ID, Name: client.Name,
+			Old: original.AllocatedIPs, New: client.AllocatedIPs,
+			Reallocated: reallocated[i],
+		}
+		if allowedChanged {
+			change.OldAllowedIPs, change.NewAllowedIPs = original.AllowedIPs, client.AllowedIPs
+		}
+		plan.Changes = append(plan.Changes, change)
+		records.clients = append(records.clients, client)
+	}
+
+	for _, subnetRange := range ranges {
+		cidrs := slices.Clone(subnetRange.CIDRs)
+		for i, cidr := range cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil || !from.Contains(prefix.Addr().Unmap()) {
+				continue
+			}
+			moved, ok := movePrefix(unmap(prefix.Masked()), from, to)
+			if !ok {
+				return plan, records, invalid("%s of subnet range %s does not fit into %s", cidr, subnetRange.Name, to)
+			}
+			cidrs[i] = moved.String()
+		}
+		if slices.Equal(cidrs, subnetRange.CIDRs) {
+			continue
+		}
+		plan.Changes = append(plan.Changes, Change{
+			Type: "subnet_range", ID: subnetRange.ID, Name: subnetRange.Name,
+			Old: subnetRange.CIDRs, New: cidrs,
+		})
+		subnetRange.CIDRs = cidrs
+		records.ranges = append(records.ranges, subnetRange)
+	}
+	return plan, records, nil
+}
+
+// moveAddr returns the address at the host offset in to that addr has in
+// from, or false if to is too small for it.
+func moveAddr(addr netip.Addr, from, to netip.Prefix) (netip.Addr, bool) {
+	offset := new(big.Int).Sub(addrInt(addr), addrInt(from.Addr()))
+	if offset.Cmp(size(to)) >= 0 {
+		return netip.Addr{}, false
+	}
+	bytes := offset.Add(offset, addrInt(to.Addr())).FillBytes(make([]byte, to.Addr().BitLen()/8))
+	moved, _ := netip.AddrFromSlice(bytes)
+	return moved, true
+}
+
+// movePrefix moves a prefix of from to the same offset in to, keeping its
+// length. A prefix covering all of from becomes to.
+func movePrefix(prefix, from, to netip.Prefix) (netip.Prefix, bool) {
+	if prefix.Bits() <= from.Bits() {
+		return to, true
+	}
+	addr, ok := moveAddr(prefix.Addr(), from, to)
+	if !ok || prefix.Bits() < to.Bits() {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, prefix.Bits()), true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// retentionPolicy holds how long each kind of record is kept. A zero duration
+// keeps the records forever.
+type retentionPolicy struct {
+	Trash              time.Duration
+	AccessLogs         time.Duration
+	SecurityEvents     time.Duration
+	BruteForceAttempts time.Duration
+	IPBlocks           time.Duration
+	ConfigRevisions    time.Duration
+}
+
+// days converts a retention in days to a duration.
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// pruneReport counts the records deleted by one janitor run.
+type pruneReport struct {
+	Trash              int
+	AccessLogs         int
+	SecurityEvents     int
+	BruteForceAttempts int
+	IPBlocks           int
+	ConfigRevisions    int
+}
+
+// String lists the non-zero counts of the report.
+func (r pruneReport) String() string {
+	var parts []string
+	for _, count := range []struct {
+		n    int
+		name string
+	}{
+		{r.Trash, "trashed clients"},
+		{r.AccessLogs, "API access log entries"},
+		{r.SecurityEvents, "security events"},
+		{r.BruteForceAttempts, "brute-force attempts"},
+		{r.IPBlocks, "expired IP blocks"},
+		{r.ConfigRevisions, "config revisions"},
+	} {
+		if count.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count.n, count.name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// purgeTrash permanently deletes clients that were moved to the trash before
+// the given time. It returns the number of purged clients.
+func purgeTrash(db store.IStore, before time.Time) (int, error) {
+	trashed, err := db.GetTrashedClients()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, clientData := range trashed {
+		client := clientData.Client
+		if client.DeletedAt == nil || !client.DeletedAt.Before(before) {
+			continue
+		}
+		if err := db.DeleteClient(client.ID); err != nil {
+			return purged, err
+		}
+		log.Infof("Purged wireguard client %s, in trash since %s", client.ID, client.DeletedAt.Format(time.RFC3339))
+		purged++
+	}
+	return purged, nil
+}
+
+// pruneConfigRevisions deletes the config revisions written before the given
+// time. The last applied revision of each config file is kept, as it is
+// restored when an apply fails, and so is the newest revision, as the next one
+// is numbered after it. It returns the number of deleted revisions.
+func pruneConfigRevisions(db store.IStore, before time.Time) (int, error) {
+	revisions, err := db.GetConfigRevisions()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	kept := make(map[string]bool)
+	for i, revision := range revisions {
+		if !kept[revision.Path] && revision.Result == model.RevisionApplied {
+			kept[revision.Path] = true
+			continue
+		}
+		if i == 0 || !revision.CreatedAt.Before(before) {
+			continue
+		}
+		if err := db.DeleteConfigRevision(revision.ID); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// runJanitor deletes the records that are older than their retention. A
+// failure to prune one kind of record is logged and does not stop the others.
+func runJanitor(db store.IStore, policy retentionPolicy) pruneReport {
+	var report pruneReport
+	now := time.Now().UTC()
+
+	for _, task := range []struct {
+		name      string
+		retention time.Duration
+		count     *int
+		prune     func(before time.Time) (int, error)
+	}{
+		{"trashed clients", policy.Trash, &report.Trash, func(before time.Time) (int, error) {
+			return purgeTrash(db, before)
+		}},
+		{"API access logs", policy.AccessLogs, &report.AccessLogs, db.PruneAPIAccessLogs},
+		{"security events", policy.SecurityEvents, &report.SecurityEvents, db.PruneSecurityEvents},
+		{"brute-force attempts", policy.BruteForceAttempts, &report.BruteForceAttempts, db.PruneBruteForceAttempts},
+		{"expired IP blocks", policy.IPBlocks, &report.IPBlocks, db.PruneIPBlocks},
+		{"config revisions", policy.ConfigRevisions, &report.ConfigRevisions, func(before time.Time) (int, error) {
+			return pruneConfigRevisions(db, before)
+		}},
+	} {
+		if task.retention <= 0 {
+			continue
+		}
+		n, err := task.prune(now.Add(-task.retention))
+		if err != nil {
+			log.Errorf("Cannot prune %s: %v", task.name, err)
+		}
+		*task.count = n
+	}
+
+	if summary := report.String(); summary != "" {
+		log.Infof("Retention cleanup removed %s", summary)
+	}
+	return report
+}
+
+// startJanitor runs runJanitor once an hour in the background.
+func startJanitor(db store.IStore, policy retentionPolicy) {
+	go func() {
+		for {
+			runJanitor(db, policy)
+			time.Sleep(time.Hour)
+		}
+	}()
+}
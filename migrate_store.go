@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/store/migrate"
+)
+
+// runMigrateStore implements the migrate-store subcommand, which copies all
+// data from one database backend into another. The source defaults to the
+// configured database. It returns the process exit code.
+func runMigrateStore(args []string) int {
+	cmd := flag.NewFlagSet("migrate-store", flag.ExitOnError)
+	fromType := cmd.String("from-type", flagDatabaseType, "Source database type: json, sqlite, mysql or postgres")
+	fromDSN := cmd.String("from-dsn", flagDatabaseDSN, "Source database DSN for MySQL or PostgreSQL")
+	fromPath := cmd.String("from-path", flagDatabasePath, "Source database directory for JSON or SQLite")
+	toType := cmd.String("to-type", "", "Destination database type: json, sqlite, mysql or postgres")
+	toDSN := cmd.String("to-dsn", "", "Destination database DSN for MySQL or PostgreSQL")
+	toPath := cmd.String("to-path", flagDatabasePath, "Destination database directory for JSON or SQLite")
+	dryRun := cmd.Bool("dry-run", false, "Only report what would be copied, without writing to the destination")
+	force := cmd.Bool("force", false, "Copy even if the destination already contains clients or API keys")
+	cmd.Parse(args)
+
+	if *toType == "" {
+		log.Errorf("The destination database type is required (-to-type)")
+		return 2
+	}
+	if strings.EqualFold(*fromType, *toType) && *fromDSN == *toDSN && *fromPath == *toPath {
+		log.Errorf("Source and destination database are the same")
+		return 2
+	}
+
+	src, err := openStore(*fromType, *fromDSN, *fromPath)
+	if err != nil {
+		log.Errorf("Source: %v", err)
+		return 1
+	}
+	dst, err := openStore(*toType, *toDSN, *toPath)
+	if err != nil {
+		log.Errorf("Destination: %v", err)
+		return 1
+	}
+
+	// The destination needs its tables or directories before anything can be copied.
+	if !*dryRun {
+		if err := dst.Init(); err != nil {
+			log.Errorf("Error initializing destination database: %v", err)
+			return 1
+		}
+	}
+
+	report, err := migrate.Run(src, dst, migrate.Options{DryRun: *dryRun, Force: *force})
+	if err != nil {
+		log.Errorf("Migration failed: %v", err)
+		return 1
+	}
+
+	fmt.Printf("Migrating %s -> %s\n", *fromType, *toType)
+	report.Write(os.Stdout)
+
+	if *dryRun {
+		fmt.Println("Dry run: nothing was written.")
+		return 0
+	}
+	if !report.Verified() {
+		fmt.Println("Verification failed: source and destination differ.")
+		return 1
+	}
+	fmt.Println("Verification passed: record counts and hashes match.")
+	return 0
+}
@@ -42,6 +42,7 @@ const (
 	PermissionWriteServer  = "write:server"
 	PermissionManageGroups = "manage:groups"
 	PermissionReadStats    = "read:stats"
+	PermissionReadAudit    = "read:audit"
 )
 
 // APIAccessLog represents a log entry for API access
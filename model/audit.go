@@ -0,0 +1,63 @@
+package model
+
+import (
+	"time"
+)
+
+// AuditEntry records a single configuration change.
+type AuditEntry struct {
+	// ID is a unique identifier for the entry
+	ID string `json:"id"`
+
+	// Actor is the user who made the change, or "api-key:<ID>" for changes
+	// made through the external API
+	Actor string `json:"actor"`
+
+	// Action is what was done, e.g. "create", "update", "delete" or "apply"
+	Action string `json:"action"`
+
+	// TargetType is the kind of record changed, e.g. "client" or "global_settings"
+	TargetType string `json:"target_type"`
+
+	// TargetID identifies the changed record within its type
+	TargetID string `json:"target_id"`
+
+	// SourceIP is the address the request came from
+	SourceIP string `json:"source_ip"`
+
+	// Changes maps each changed field to its value before and after the change.
+	// Secrets are recorded as changed, but not with their values.
+	Changes map[string]AuditChange `json:"changes,omitempty"`
+
+	// CreatedAt is the time of the change
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuditChange holds the old and new value of a changed field.
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditFilter selects audit entries. Empty fields match every entry.
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+
+	// Limit caps the number of entries returned, newest first. 0 returns all.
+	Limit int
+}
+
+// Matches reports whether entry is selected by the filter.
+func (f AuditFilter) Matches(entry AuditEntry) bool {
+	return (f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.Action == "" || entry.Action == f.Action) &&
+		(f.TargetType == "" || entry.TargetType == f.TargetType) &&
+		(f.TargetID == "" || entry.TargetID == f.TargetID) &&
+		(f.Since.IsZero() || !entry.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.CreatedAt.Before(f.Until))
+}
@@ -28,6 +28,10 @@ type Client struct {
 	// Group is the group name to organize clients into logical groupings.
 	Group string `json:"group"`
 
+	// Interface is the name of the WireGuard interface the client is a peer
+	// of. It is empty for the primary interface.
+	Interface string `json:"interface"`
+
 	// SubnetRanges holds the names of subnet ranges from which the client’s IPs were allocated.
 	// This field is omitted from JSON output if empty.
 	SubnetRanges []string `json:"subnet_ranges,omitempty"`
@@ -55,6 +59,23 @@ type Client struct {
 
 	// UpdatedAt is the timestamp of the client's last update.
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// DeletedAt is set when the client was moved to the trash. Trashed clients
+	// are left out of the client list and the WireGuard configuration until
+	// they are restored or purged.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// DeletedBy is the user or API key that moved the client to the trash.
+	DeletedBy string `json:"deleted_by,omitempty"`
+
+	// ConfigOutdated is set when a change on the server, such as renumbering
+	// the VPN network, invalidated the configuration the client has. It is
+	// cleared when the configuration is downloaded or emailed again.
+	ConfigOutdated bool `json:"config_outdated"`
+
+	// Revision is incremented by the store on every save. A save is rejected
+	// if the stored revision no longer matches the one the client was read with.
+	Revision int64 `json:"revision"`
 }
 
 // ClientData wraps a Client with additional related data.
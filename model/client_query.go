@@ -0,0 +1,263 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ClientSortFields lists the fields the client list can be sorted by.
+var ClientSortFields = []string{"name", "email", "group", "created_at", "updated_at"}
+
+// ClientQuery selects, orders and pages the active clients. Empty fields
+// match every client.
+type ClientQuery struct {
+	// Search matches clients whose name, email or group contains it,
+	// ignoring case.
+	Search string
+
+	// Group matches clients in exactly this group.
+	Group string
+
+	// Enabled matches clients with this enabled state.
+	Enabled *bool
+
+	// Interface matches clients of this WireGuard interface, "" of the
+	// primary one.
+	Interface *string
+
+	// Subnets matches clients with an allocated IP in one of these networks.
+	Subnets []*net.IPNet
+
+	// CreatedAfter, CreatedBefore, UpdatedAfter and UpdatedBefore bound the
+	// creation and update times. The lower bounds are inclusive, the upper
+	// bounds exclusive.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+
+	// Sort is one of ClientSortFields, prefixed with "-" for descending
+	// order. Clients with equal values are ordered by ID. Defaults to "name".
+	Sort string
+
+	// Limit caps the number of clients returned. 0 returns all.
+	Limit int
+
+	// Cursor continues a previous query after the last client it returned.
+	Cursor string
+}
+
+// ClientPage is one page of a client query.
+type ClientPage struct {
+	Clients []ClientData
+
+	// NextCursor continues the query after the last client of this page.
+	// It is empty on the last page.
+	NextCursor string
+}
+
+// ClientCursor is the decoded position of a query cursor: the sort value and
+// ID of the last client returned.
+type ClientCursor struct {
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// SortField returns the field the clients are sorted by and whether the
+// order is descending.
+func (q ClientQuery) SortField() (string, bool) {
+	field, desc := strings.CutPrefix(q.Sort, "-")
+	if field == "" {
+		field = "name"
+	}
+	return field, desc
+}
+
+// Validate checks the sort field, limit and cursor of the query.
+func (q ClientQuery) Validate() error {
+	if field, _ := q.SortField(); !slices.Contains(ClientSortFields, field) {
+		return fmt.Errorf("invalid sort field %q, expected one of %s", field, strings.Join(ClientSortFields, ", "))
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", q.Limit)
+	}
+	_, err := q.DecodeCursor()
+	return err
+}
+
+// DecodeCursor returns the position of the query cursor. The zero position is
+// returned if the query has no cursor.
+func (q ClientQuery) DecodeCursor() (ClientCursor, error) {
+	var cursor ClientCursor
+	if q.Cursor == "" {
+		return cursor, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err == nil && cursor.ID == "" {
+		err = fmt.Errorf("missing client ID")
+	}
+	if err == nil && q.SortsByTime() {
+		_, err = time.Parse(time.RFC3339Nano, cursor.Value)
+	}
+	if err != nil {
+		return ClientCursor{}, fmt.Errorf("invalid cursor: %v", err)
+	}
+	return cursor, nil
+}
+
+// CursorTime returns the sort value of a cursor on a time field.
+func (q ClientQuery) CursorTime(cursor ClientCursor) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, cursor.Value)
+	return t
+}
+
+// SortsByTime reports whether the query is sorted by a time field.
+func (q ClientQuery) SortsByTime() bool {
+	field, _ := q.SortField()
+	return field == "created_at" || field == "updated_at"
+}
+
+// encodeCursor returns the cursor that continues the query after client.
+func (q ClientQuery) encodeCursor(client Client) string {
+	cursor := ClientCursor{ID: client.ID}
+	switch field, _ := q.SortField(); field {
+	case "name":
+		cursor.Value = client.Name
+	case "email":
+		cursor.Value = client.Email
+	case "group":
+		cursor.Value = client.Group
+	case "created_at":
+		cursor.Value = client.CreatedAt.Format(time.RFC3339Nano)
+	case "updated_at":
+		cursor.Value = client.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// MatchesSubnets reports whether the client has an allocated IP in one of
+// the query's subnets.
+func (q ClientQuery) MatchesSubnets(client Client) bool {
+	if len(q.Subnets) == 0 {
+		return true
+	}
+	for _, cidr := range client.AllocatedIPs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		for _, subnet := range q.Subnets {
+			if subnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Matches reports whether client is selected by the query's filters.
+func (q ClientQuery) Matches(client Client) bool {
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(client.Name), search) &&
+			!strings.Contains(strings.ToLower(client.Email), search) &&
+			!strings.Contains(strings.ToLower(client.Group), search) {
+			return false
+		}
+	}
+	return (q.Group == "" || client.Group == q.Group) &&
+		(q.Enabled == nil || client.Enabled == *q.Enabled) &&
+		(q.Interface == nil || client.Interface == *q.Interface) &&
+		(q.CreatedAfter.IsZero() || !client.CreatedAt.Before(q.CreatedAfter)) &&
+		(q.CreatedBefore.IsZero() || client.CreatedAt.Before(q.CreatedBefore)) &&
+		(q.UpdatedAfter.IsZero() || !client.UpdatedAt.Before(q.UpdatedAfter)) &&
+		(q.UpdatedBefore.IsZero() || client.UpdatedAt.Before(q.UpdatedBefore)) &&
+		q.MatchesSubnets(client)
+}
+
+// compare orders two clients by the query's sort field and then by ID.
+func (q ClientQuery) compare(a, b Client) int {
+	field, desc := q.SortField()
+	var result int
+	switch field {
+	case "name":
+		result = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	case "email":
+		result = strings.Compare(strings.ToLower(a.Email), strings.ToLower(b.Email))
+	case "group":
+		result = strings.Compare(strings.ToLower(a.Group), strings.ToLower(b.Group))
+	case "created_at":
+		result = a.CreatedAt.Compare(b.CreatedAt)
+	case "updated_at":
+		result = a.UpdatedAt.Compare(b.UpdatedAt)
+	}
+	if result == 0 {
+		result = strings.Compare(a.ID, b.ID)
+	}
+	if desc {
+		result = -result
+	}
+	return result
+}
+
+// Select runs the query in memory on an unordered list of active clients.
+func (q ClientQuery) Select(clients []ClientData) (ClientPage, error) {
+	cursor, err := q.DecodeCursor()
+	if err != nil {
+		return ClientPage{}, err
+	}
+
+	// The client a cursor points to may have been changed or deleted since,
+	// so the position is rebuilt from the values stored in the cursor
+	var after *Client
+	if cursor.ID != "" {
+		after = &Client{ID: cursor.ID, Name: cursor.Value, Email: cursor.Value, Group: cursor.Value}
+		if q.SortsByTime() {
+			after.CreatedAt = q.CursorTime(cursor)
+			after.UpdatedAt = after.CreatedAt
+		}
+	}
+
+	var selected []ClientData
+	for _, clientData := range clients {
+		if !q.Matches(*clientData.Client) {
+			continue
+		}
+		if after != nil && q.compare(*clientData.Client, *after) <= 0 {
+			continue
+		}
+		selected = append(selected, clientData)
+	}
+	slices.SortFunc(selected, func(a, b ClientData) int {
+		return q.compare(*a.Client, *b.Client)
+	})
+	return q.Page(selected), nil
+}
+
+// Page builds the result page from clients that a store has already
+// filtered, ordered and positioned after the cursor. It drops the clients
+// outside the query's subnets, which stores do not filter themselves, and
+// applies the limit.
+func (q ClientQuery) Page(clients []ClientData) ClientPage {
+	page := ClientPage{Clients: []ClientData{}}
+	for _, clientData := range clients {
+		if !q.MatchesSubnets(*clientData.Client) {
+			continue
+		}
+		if q.Limit > 0 && len(page.Clients) == q.Limit {
+			page.NextCursor = q.encodeCursor(*page.Clients[len(page.Clients)-1].Client)
+			break
+		}
+		page.Clients = append(page.Clients, clientData)
+	}
+	return page
+}
@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+// Results of applying a config revision
+const (
+	RevisionApplied = "applied"
+	RevisionFailed  = "failed"
+)
+
+// ConfigRevision is a server config file as it was written by an apply.
+type ConfigRevision struct {
+	// ID numbers the revisions in the order they were written
+	ID int `json:"id"`
+
+	// Path is the file the config was written to
+	Path string `json:"path"`
+
+	// Content is the config, including the private and preshared keys
+	Content string `json:"content,omitempty"`
+
+	// Author is the user who applied the config, or "api-key:<ID>"
+	Author string `json:"author"`
+
+	// Comment is an optional note of the author
+	Comment string `json:"comment,omitempty"`
+
+	// Result is RevisionApplied or RevisionFailed
+	Result string `json:"result"`
+
+	// Error describes why the apply failed
+	Error string `json:"error,omitempty"`
+
+	// RollbackOf is the revision whose content was applied again, if this
+	// revision is a rollback
+	RollbackOf int `json:"rollback_of,omitempty"`
+
+	// RestoredID is the revision restored after this one failed
+	RestoredID int `json:"restored_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
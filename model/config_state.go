@@ -0,0 +1,77 @@
+package model
+
+// Kinds of pending configuration changes
+const (
+	ConfigChangeInterface = "interface"
+	ConfigChangePeer      = "peer"
+	ConfigChangeSettings  = "settings"
+)
+
+// Actions of pending configuration changes
+const (
+	ConfigChangeAdded   = "added"
+	ConfigChangeRemoved = "removed"
+	ConfigChangeChanged = "changed"
+)
+
+// ConfigState is the part of the stored data the WireGuard server
+// configuration is rendered from. The state of the last successful apply is
+// kept with the hashes, so pending changes can be listed on every backend.
+// Secrets are represented by fingerprints or public keys.
+type ConfigState struct {
+	Interface InterfaceState `json:"interface"`
+	Peers     []PeerState    `json:"peers"`
+	Settings  SettingsState  `json:"settings"`
+}
+
+// InterfaceState is the [Interface] section of the server configuration.
+type InterfaceState struct {
+	Addresses  []string `json:"addresses"`
+	ListenPort int      `json:"listen_port"`
+
+	// PublicKey stands for the private key of the server
+	PublicKey string `json:"public_key"`
+
+	PostUp   string `json:"post_up"`
+	PreDown  string `json:"pre_down"`
+	PostDown string `json:"post_down"`
+}
+
+// PeerState is the [Peer] section of an enabled client.
+type PeerState struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+
+	// PresharedKey is a fingerprint of the preshared key, empty without one
+	PresharedKey string `json:"preshared_key"`
+
+	AllowedIPs []string `json:"allowed_ips"`
+	Endpoint   string   `json:"endpoint"`
+}
+
+// SettingsState holds the global settings used by the server configuration.
+type SettingsState struct {
+	MTU                 int    `json:"mtu"`
+	PersistentKeepalive int    `json:"persistent_keepalive"`
+	FirewallMark        string `json:"firewall_mark"`
+	Table               string `json:"table"`
+	ConfigFilePath      string `json:"config_file_path"`
+}
+
+// ConfigChange is a difference between the applied and the desired server
+// configuration.
+type ConfigChange struct {
+	// Type is ConfigChangeInterface, ConfigChangePeer or ConfigChangeSettings
+	Type string `json:"type"`
+
+	// Action is ConfigChangeAdded, ConfigChangeRemoved or ConfigChangeChanged
+	Action string `json:"action"`
+
+	// ID and Name identify the client of a peer
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	// Changes maps each changed field to its applied and desired value
+	Changes map[string]AuditChange `json:"changes,omitempty"`
+}
@@ -0,0 +1,21 @@
+package model
+
+import (
+	"time"
+)
+
+// DataKey is a data encryption key used to encrypt secrets at rest. It is only
+// ever stored wrapped (encrypted) by a key provider.
+type DataKey struct {
+	// ID identifies the key in every value encrypted with it
+	ID string `json:"id"`
+
+	// Provider is the name of the key provider that wrapped the key
+	Provider string `json:"provider"`
+
+	// WrappedKey is the data key as encrypted by the key provider
+	WrappedKey string `json:"wrapped_key"`
+
+	// CreatedAt is the timestamp when the key was generated
+	CreatedAt time.Time `json:"created_at"`
+}
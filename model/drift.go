@@ -0,0 +1,83 @@
+package model
+
+import (
+	"time"
+)
+
+// Kinds of differences between the live WireGuard device and the database
+const (
+	// DriftMissing is an enabled client that is not a peer of the device
+	DriftMissing = "missing"
+
+	// DriftUnknown is a peer of the device without a client in the database
+	DriftUnknown = "unknown"
+
+	// DriftDisabled is a peer of the device whose client is disabled
+	DriftDisabled = "disabled"
+
+	// DriftModified is a peer whose allowed IPs or preshared key differ from
+	// its client
+	DriftModified = "modified"
+)
+
+// DriftReport compares the live WireGuard device with the desired state in
+// the database.
+type DriftReport struct {
+	Device    string      `json:"device"`
+	InSync    bool        `json:"in_sync"`
+	CheckedAt time.Time   `json:"checked_at"`
+	Peers     []PeerDrift `json:"peers"`
+
+	// ListenPort is set if the device listens on another port
+	ListenPort *DriftValue `json:"listen_port,omitempty"`
+
+	// PublicKey is set if the device has another key than the server
+	PublicKey *DriftValue `json:"public_key,omitempty"`
+}
+
+// PeerDrift is a peer that differs between the device and the database.
+type PeerDrift struct {
+	PublicKey string `json:"public_key"`
+
+	// Status is DriftMissing, DriftUnknown, DriftDisabled or DriftModified
+	Status string `json:"status"`
+
+	// ClientID and Name identify the client of the peer, if there is one
+	ClientID string `json:"client_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+
+	// Fields maps each differing field to its desired and live value
+	Fields map[string]DriftValue `json:"fields,omitempty"`
+}
+
+// DriftValue holds the value of a field in the database and on the device.
+// Preshared keys are only given as "set" or "none", or "different" if both
+// are set to different keys.
+type DriftValue struct {
+	Desired interface{} `json:"desired"`
+	Live    interface{} `json:"live"`
+}
+
+// DeviceSync is the outcome of configuring a device to match the database.
+type DeviceSync struct {
+	Device string `json:"device"`
+
+	// Interface is true if the listen port or the key of the device was set
+	Interface bool `json:"interface"`
+
+	// Peers lists each configured peer, Failed counts those with an error
+	Peers  []PeerResult `json:"peers"`
+	Failed int          `json:"failed"`
+}
+
+// PeerResult is the outcome of configuring one peer.
+type PeerResult struct {
+	PublicKey string `json:"public_key"`
+	ClientID  string `json:"client_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+
+	// Action is ConfigChangeAdded, ConfigChangeRemoved or ConfigChangeChanged
+	Action string `json:"action"`
+
+	Error string `json:"error,omitempty"`
+}
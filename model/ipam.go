@@ -0,0 +1,47 @@
+package model
+
+import (
+	"time"
+)
+
+// IPReservation keeps an address or prefix of the server networks from being
+// allocated to clients, e.g. for gateways, DNS servers or statically
+// configured peers.
+type IPReservation struct {
+	// ID is a unique identifier for the reservation
+	ID string `json:"id"`
+
+	// Address is the reserved address or prefix in CIDR notation
+	Address string `json:"address"`
+
+	// Description explains what the address is reserved for
+	Description string `json:"description"`
+
+	// CreatedBy is the user or API key that created the reservation
+	CreatedBy string `json:"created_by"`
+
+	// CreatedAt is the timestamp when the reservation was created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SubnetRange is a named set of networks within the server networks that
+// clients can be allocated from, e.g. one per department or site.
+type SubnetRange struct {
+	// ID is a unique identifier for the subnet range
+	ID string `json:"id"`
+
+	// Name identifies the range in the UI and in client filters
+	Name string `json:"name"`
+
+	// CIDRs are the networks of the range in CIDR notation
+	CIDRs []string `json:"cidrs"`
+
+	// Position orders the ranges, lower positions come first
+	Position int `json:"position"`
+
+	// CreatedAt is the timestamp when the range was created
+	CreatedAt time.Time `json:"created_at"`
+
+	// UpdatedAt is the timestamp when the range was last changed
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 // Interface represents a network interface with its name and IP address.
 type Interface struct {
 	Name      string `json:"name"`       // Name of the interface (e.g., "eth0").
@@ -19,4 +21,11 @@ type BaseData struct {
 type ClientServerHashes struct {
 	Client string `json:"client"` // Hash for the client configuration.
 	Server string `json:"server"` // Hash for the server configuration.
+
+	// Applied is the configuration state of the last successful apply, nil if
+	// it was never applied.
+	Applied *ConfigState `json:"applied,omitempty"`
+
+	// AppliedAt is the time of the last successful apply.
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
 }
@@ -0,0 +1,50 @@
+package model
+
+import "time"
+
+// Node is a host running wireguard-manager in agent mode. The WireGuard
+// interfaces assigned to a node are written and configured through its agent
+// instead of on this host; clients are assigned to a node by their interface.
+type Node struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// URL is the base URL of the agent, e.g. "https://gw1.example.com:5001"
+	URL string `json:"url"`
+
+	// Token is the bearer token the agent expects. It is empty if the agent
+	// only authenticates by client certificate.
+	Token string `json:"token,omitempty"`
+
+	// CACert is the PEM encoded certificate the certificate of the agent is
+	// verified with. The system roots are used if it is empty.
+	CACert string `json:"ca_cert"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Revision is incremented on every save; used to detect conflicting edits
+	Revision int64 `json:"revision"`
+}
+
+// NodeStatus is what the agent of a node reports about its host.
+type NodeStatus struct {
+	Hostname string `json:"hostname"`
+	Version  string `json:"version"`
+	Backend  string `json:"backend"`
+
+	// Devices are the WireGuard devices running on the host
+	Devices []NodeDevice `json:"devices"`
+}
+
+// NodeDevice summarizes a WireGuard device of a node.
+type NodeDevice struct {
+	Name       string `json:"name"`
+	PublicKey  string `json:"public_key"`
+	ListenPort int    `json:"listen_port"`
+	Peers      int    `json:"peers"`
+
+	// Connected counts the peers with a handshake in the last three minutes
+	Connected int `json:"connected"`
+}
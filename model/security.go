@@ -58,6 +58,7 @@ type SecuritySettings struct {
 	GeoIPDefaultAction string `json:"geoip_default_action"` // "allow" or "block"
 
 	UpdatedAt time.Time `json:"updated_at"`
+	Revision  int64     `json:"revision"` // Incremented on every save; used to detect conflicting edits
 }
 
 // DefaultSecuritySettings returns default security settings
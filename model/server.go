@@ -24,4 +24,5 @@ type ServerInterface struct {
 	PostUp     string    `json:"post_up"`            // Command to run after the interface is brought up.
 	PreDown    string    `json:"pre_down"`           // Command to run before the interface is brought down.
 	PostDown   string    `json:"post_down"`          // Command to run after the interface is brought down.
+	Revision   int64     `json:"revision"`           // Incremented on every save; used to detect conflicting edits.
 }
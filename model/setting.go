@@ -13,4 +13,5 @@ type GlobalSetting struct {
 	Table               string    `json:"table"`                       // Routing table identifier.
 	ConfigFilePath      string    `json:"config_file_path"`            // File path where the WireGuard config is generated.
 	UpdatedAt           time.Time `json:"updated_at"`                  // Timestamp of the last update to the settings.
+	Revision            int64     `json:"revision"`                    // Incremented on every save; used to detect conflicting edits.
 }
@@ -0,0 +1,87 @@
+package model
+
+import "time"
+
+// WireGuardInterface is a WireGuard interface with its own keys, networks and
+// config file. The primary interface is configured by the server and the
+// global settings; every further interface is stored as a WireGuardInterface.
+type WireGuardInterface struct {
+	// Name is the name of the network interface, e.g. "wg1". It identifies
+	// the interface and is the base name of its config file.
+	Name string `json:"name"`
+
+	// Description is an optional note, e.g. who the interface is for
+	Description string `json:"description"`
+
+	// Primary is set for the interface of the server and global settings
+	Primary bool `json:"primary"`
+
+	// PrivateKey and PublicKey are the key pair of the interface
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key"`
+
+	// Addresses are the CIDR addresses of the interface. Its clients are
+	// allocated addresses from these networks.
+	Addresses []string `json:"addresses"`
+
+	ListenPort int    `json:"listen_port,string"`
+	PostUp     string `json:"post_up"`
+	PreDown    string `json:"pre_down"`
+	PostDown   string `json:"post_down"`
+
+	// MTU and DNSServers override the global settings for the interface and
+	// its clients, if set
+	MTU        int      `json:"mtu,string"`
+	DNSServers []string `json:"dns_servers"`
+
+	// ConfigFilePath is the file the config of the interface is written to
+	ConfigFilePath string `json:"config_file_path"`
+
+	// Node is the ID of the node running the interface, empty if it runs on
+	// this host. The config file of a node is written by its agent.
+	Node string `json:"node"`
+
+	// Applied is the config state of the last successful apply, nil if the
+	// interface was never applied. AppliedAt is the time of that apply.
+	Applied   *ConfigState `json:"applied,omitempty"`
+	AppliedAt *time.Time   `json:"applied_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Revision is incremented on every save; used to detect conflicting edits
+	Revision int64 `json:"revision"`
+}
+
+// Server returns the interface in the form the server config is rendered from.
+func (i WireGuardInterface) Server() Server {
+	return Server{
+		KeyPair: &ServerKeypair{
+			PrivateKey: i.PrivateKey,
+			PublicKey:  i.PublicKey,
+			UpdatedAt:  i.UpdatedAt,
+		},
+		Interface: &ServerInterface{
+			Addresses:  i.Addresses,
+			ListenPort: i.ListenPort,
+			UpdatedAt:  i.UpdatedAt,
+			PostUp:     i.PostUp,
+			PreDown:    i.PreDown,
+			PostDown:   i.PostDown,
+			Revision:   i.Revision,
+		},
+	}
+}
+
+// Settings returns the global settings with the MTU, DNS servers and config
+// file of the interface.
+func (i WireGuardInterface) Settings(global GlobalSetting) GlobalSetting {
+	if i.MTU > 0 {
+		global.MTU = i.MTU
+	}
+	if len(i.DNSServers) > 0 {
+		global.DNSServers = i.DNSServers
+	}
+	global.ConfigFilePath = i.ConfigFilePath
+	return global
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/store/encrypted"
+)
+
+// runRotateKeys implements the rotate-keys subcommand, which re-encrypts all
+// private keys with a new data key. Both the old and the new key provider
+// default to the configured encryption key, so running it without flags only
+// replaces the data key. A new key of "none" decrypts all private keys. It
+// returns the process exit code.
+func runRotateKeys(args []string) int {
+	cmd := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	oldKey := cmd.String("old-key", flagEncryptionKey, "Key provider the private keys are currently encrypted with; empty if they are not encrypted")
+	newKey := cmd.String("new-key", flagEncryptionKey, "Key provider to encrypt the private keys with, or none to store them unencrypted")
+	cmd.Parse(args)
+
+	var oldProvider, newProvider encrypted.KeyProvider
+	var err error
+	if *oldKey != "" {
+		if oldProvider, err = encrypted.ParseKeyProvider(*oldKey); err != nil {
+			log.Errorf("Invalid old key: %v", err)
+			return 2
+		}
+	}
+	if *newKey == "" {
+		log.Errorf("The new key provider is required (-new-key), use none to decrypt")
+		return 2
+	}
+	if *newKey != "none" {
+		if newProvider, err = encrypted.ParseKeyProvider(*newKey); err != nil {
+			log.Errorf("Invalid new key: %v", err)
+			return 2
+		}
+	}
+
+	db, err := openStore(flagDatabaseType, flagDatabaseDSN, flagDatabasePath)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if err := db.Init(); err != nil {
+		log.Errorf("Error initializing database: %v", err)
+		return 1
+	}
+
+	count, err := encrypted.Rotate(db, oldProvider, newProvider)
+	if err != nil {
+		log.Errorf("Key rotation failed: %v", err)
+		return 1
+	}
+
+	if newProvider == nil {
+		fmt.Printf("Decrypted %d records; private keys are now stored unencrypted.\n", count)
+	} else {
+		fmt.Printf("Re-encrypted %d records with a new data key wrapped by the %s key provider.\n", count, newProvider.Name())
+	}
+	return 0
+}
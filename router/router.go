@@ -157,6 +157,10 @@ func New(tmplDir fs.FS, extraData map[string]interface{}, secret [64]byte) *echo
 	if err != nil {
 		log.Fatal(err)
 	}
+	tmplAuditString, err := util.StringFromEmbedFile(tmplDir, "audit.html")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Create a function map for templates.
 	funcs := template.FuncMap{
@@ -205,6 +209,7 @@ func New(tmplDir fs.FS, extraData map[string]interface{}, secret [64]byte) *echo
 		"api_statistics.html":      template.Must(template.New("api_statistics").Funcs(funcs).Parse(tmplBaseString + tmplAPIStatisticsString)),
 		"security_settings.html":   template.Must(template.New("security_settings").Funcs(funcs).Parse(tmplBaseString + tmplSecuritySettingsString)),
 		"security_statistics.html": template.Must(template.New("security_statistics").Funcs(funcs).Parse(tmplBaseString + tmplSecurityStatisticsString)),
+		"audit.html":               template.Must(template.New("audit").Funcs(funcs).Parse(tmplBaseString + tmplAuditString)),
 	}
 
 	// Register GeoIP middleware
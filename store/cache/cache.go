@@ -0,0 +1,501 @@
+// Package cache provides a read-through caching decorator for store.IStore.
+//
+// Settings, the server configuration, clients, IP blocks and API keys are
+// kept in memory for a limited time and invalidated whenever they are written
+// through the decorator. Updates that only touch an API key's LastUsedAt are
+// collected in memory and written to the underlying store in batches.
+package cache
+
+import (
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// Store wraps a store.IStore. Methods that are not cached are passed through
+// to the embedded store unchanged.
+type Store struct {
+	store.IStore
+
+	ttl time.Duration
+
+	mu               sync.Mutex
+	securitySettings *model.SecuritySettings
+	securityLoadedAt time.Time
+	globalSettings   *model.GlobalSetting
+	globalLoadedAt   time.Time
+	server           *model.Server
+	serverLoadedAt   time.Time
+	clients          []model.Client
+	clientsLoadedAt  time.Time
+	ipBlocks         []model.IPBlock
+	ipBlocksLoadedAt time.Time
+	apiKeys          []model.APIKey
+	apiKeysLoadedAt  time.Time
+
+	// pendingLastUsed holds LastUsedAt updates that have not been written yet, by API key ID.
+	pendingLastUsed map[string]time.Time
+}
+
+// New returns a caching decorator around db. Cached data is reloaded after
+// ttl, so changes made by other instances sharing the same database become
+// visible within that time. Pending LastUsedAt updates are written every
+// flushInterval.
+func New(db store.IStore, ttl, flushInterval time.Duration) *Store {
+	s := &Store{
+		IStore:          db,
+		ttl:             ttl,
+		pendingLastUsed: make(map[string]time.Time),
+	}
+
+	go func() {
+		for range time.Tick(flushInterval) {
+			if err := s.Flush(); err != nil {
+				log.Warnf("Failed to write API key usage: %v", err)
+			}
+		}
+	}()
+
+	return s
+}
+
+// fresh reports whether data loaded at loadedAt may still be used.
+func (s *Store) fresh(loadedAt time.Time) bool {
+	return !loadedAt.IsZero() && time.Since(loadedAt) < s.ttl
+}
+
+// invalidateAll drops every cached collection.
+func (s *Store) invalidateAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.securityLoadedAt = time.Time{}
+	s.globalLoadedAt = time.Time{}
+	s.serverLoadedAt = time.Time{}
+	s.clientsLoadedAt = time.Time{}
+	s.ipBlocksLoadedAt = time.Time{}
+	s.apiKeysLoadedAt = time.Time{}
+}
+
+// WithTx runs fn against the underlying store's transaction. Writes made
+// inside the transaction bypass the cache, so everything is invalidated
+// once it has finished.
+func (s *Store) WithTx(fn func(tx store.IStore) error) error {
+	err := s.IStore.WithTx(fn)
+	s.invalidateAll()
+	return err
+}
+
+// Global Settings and Server Configuration
+
+func (s *Store) GetGlobalSettings() (model.GlobalSetting, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.fresh(s.globalLoadedAt) {
+		settings, err := s.IStore.GetGlobalSettings()
+		if err != nil {
+			return settings, err
+		}
+		s.globalSettings = &settings
+		s.globalLoadedAt = time.Now()
+	}
+
+	settings := *s.globalSettings
+	settings.DNSServers = slices.Clone(settings.DNSServers)
+	return settings, nil
+}
+
+func (s *Store) SaveGlobalSettings(globalSettings model.GlobalSetting) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.globalLoadedAt = time.Time{}
+	return s.IStore.SaveGlobalSettings(globalSettings)
+}
+
+func (s *Store) GetServer() (model.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.fresh(s.serverLoadedAt) {
+		server, err := s.IStore.GetServer()
+		if err != nil {
+			return server, err
+		}
+		s.server = &server
+		s.serverLoadedAt = time.Now()
+	}
+
+	return copyServer(*s.server), nil
+}
+
+func (s *Store) SaveServerInterface(serverInterface model.ServerInterface) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.serverLoadedAt = time.Time{}
+	return s.IStore.SaveServerInterface(serverInterface)
+}
+
+func (s *Store) SaveServerKeyPair(serverKeyPair model.ServerKeypair) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.serverLoadedAt = time.Time{}
+	return s.IStore.SaveServerKeyPair(serverKeyPair)
+}
+
+// Client Management
+
+// loadClients returns the cached clients, reloading them if needed.
+// The caller must hold s.mu.
+func (s *Store) loadClients() ([]model.Client, error) {
+	if !s.fresh(s.clientsLoadedAt) {
+		clients, err := s.IStore.GetClients(false)
+		if err != nil {
+			return nil, err
+		}
+		s.clients = make([]model.Client, 0, len(clients))
+		for _, c := range clients {
+			s.clients = append(s.clients, *c.Client)
+		}
+		s.clientsLoadedAt = time.Now()
+	}
+	return s.clients, nil
+}
+
+// GetClients serves the client list from the cache. Requests that include
+// QR codes are passed through, because the codes are rendered on read.
+func (s *Store) GetClients(hasQRCode bool) ([]model.ClientData, error) {
+	if hasQRCode {
+		return s.IStore.GetClients(true)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients, err := s.loadClients()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []model.ClientData
+	for _, c := range clients {
+		client := copyClient(c)
+		result = append(result, model.ClientData{Client: &client})
+	}
+	return result, nil
+}
+
+func (s *Store) GetClientByID(clientID string, qrCode model.QRCodeSettings) (model.ClientData, error) {
+	if !qrCode.Enabled {
+		s.mu.Lock()
+		clients, err := s.loadClients()
+		if err == nil {
+			for _, c := range clients {
+				if c.ID == clientID {
+					client := copyClient(c)
+					s.mu.Unlock()
+					return model.ClientData{Client: &client}, nil
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	// Let the underlying store produce the QR code or its own not-found error
+	return s.IStore.GetClientByID(clientID, qrCode)
+}
+
+func (s *Store) SaveClient(client model.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientsLoadedAt = time.Time{}
+	return s.IStore.SaveClient(client)
+}
+
+func (s *Store) DeleteClient(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientsLoadedAt = time.Time{}
+	return s.IStore.DeleteClient(clientID)
+}
+
+// API Key Management
+
+// loadAPIKeys returns the cached API keys with pending LastUsedAt updates
+// applied, reloading them if needed. The caller must hold s.mu.
+func (s *Store) loadAPIKeys() ([]model.APIKey, error) {
+	if !s.fresh(s.apiKeysLoadedAt) {
+		keys, err := s.IStore.GetAPIKeys()
+		if err != nil {
+			return nil, err
+		}
+		for i := range keys {
+			if lastUsed, ok := s.pendingLastUsed[keys[i].ID]; ok {
+				keys[i].LastUsedAt = &lastUsed
+			}
+		}
+		s.apiKeys = keys
+		s.apiKeysLoadedAt = time.Now()
+	}
+	return s.apiKeys, nil
+}
+
+func (s *Store) GetAPIKeys() ([]model.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := s.loadAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []model.APIKey
+	for _, k := range keys {
+		result = append(result, copyAPIKey(k))
+	}
+	return result, nil
+}
+
+func (s *Store) GetAPIKeyByID(keyID string) (model.APIKey, error) {
+	s.mu.Lock()
+	keys, err := s.loadAPIKeys()
+	if err == nil {
+		for _, k := range keys {
+			if k.ID == keyID {
+				s.mu.Unlock()
+				return copyAPIKey(k), nil
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	return s.IStore.GetAPIKeyByID(keyID)
+}
+
+func (s *Store) GetAPIKeyByKey(key string) (model.APIKey, error) {
+	s.mu.Lock()
+	keys, err := s.loadAPIKeys()
+	if err == nil {
+		for _, k := range keys {
+			if k.Key == key {
+				s.mu.Unlock()
+				return copyAPIKey(k), nil
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	return s.IStore.GetAPIKeyByKey(key)
+}
+
+// SaveAPIKey writes the key through to the underlying store, unless the
+// only change is a newer LastUsedAt. Such updates are kept in memory and
+// written by the next Flush.
+func (s *Store) SaveAPIKey(key model.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key.LastUsedAt != nil && s.fresh(s.apiKeysLoadedAt) {
+		for i, cached := range s.apiKeys {
+			if cached.ID == key.ID && onlyLastUsedChanged(cached, key) {
+				lastUsed := *key.LastUsedAt
+				s.apiKeys[i].LastUsedAt = &lastUsed
+				s.pendingLastUsed[key.ID] = lastUsed
+				return nil
+			}
+		}
+	}
+
+	delete(s.pendingLastUsed, key.ID)
+	s.apiKeysLoadedAt = time.Time{}
+	return s.IStore.SaveAPIKey(key)
+}
+
+func (s *Store) DeleteAPIKey(keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pendingLastUsed, keyID)
+	s.apiKeysLoadedAt = time.Time{}
+	return s.IStore.DeleteAPIKey(keyID)
+}
+
+// Flush writes all pending LastUsedAt updates to the underlying store.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	pending := s.pendingLastUsed
+	s.pendingLastUsed = make(map[string]time.Time)
+	s.mu.Unlock()
+
+	var firstErr error
+	for id, lastUsed := range pending {
+		key, err := s.IStore.GetAPIKeyByID(id)
+		if err != nil {
+			// The key has been deleted in the meantime
+			continue
+		}
+		if key.LastUsedAt != nil && !key.LastUsedAt.Before(lastUsed) {
+			continue
+		}
+		key.LastUsedAt = &lastUsed
+		if err := s.IStore.SaveAPIKey(key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Security Management
+
+func (s *Store) GetSecuritySettings() (model.SecuritySettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.fresh(s.securityLoadedAt) {
+		settings, err := s.IStore.GetSecuritySettings()
+		if err != nil {
+			return settings, err
+		}
+		s.securitySettings = &settings
+		s.securityLoadedAt = time.Now()
+	}
+	return *s.securitySettings, nil
+}
+
+func (s *Store) SaveSecuritySettings(settings model.SecuritySettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.securityLoadedAt = time.Time{}
+	return s.IStore.SaveSecuritySettings(settings)
+}
+
+// IP Blocking
+
+// loadIPBlocks returns the cached active IP blocks, reloading them if
+// needed. The caller must hold s.mu.
+func (s *Store) loadIPBlocks() ([]model.IPBlock, error) {
+	if !s.fresh(s.ipBlocksLoadedAt) {
+		blocks, err := s.IStore.GetIPBlocks()
+		if err != nil {
+			return nil, err
+		}
+		s.ipBlocks = blocks
+		s.ipBlocksLoadedAt = time.Now()
+	}
+	return s.ipBlocks, nil
+}
+
+func (s *Store) GetIPBlocks() ([]model.IPBlock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blocks, err := s.loadIPBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop blocks that expired since they were loaded
+	var result []model.IPBlock
+	now := time.Now().UTC()
+	for _, b := range blocks {
+		if b.Permanent || b.ExpiresAt.IsZero() || now.Before(b.ExpiresAt) {
+			result = append(result, b)
+		}
+	}
+	return result, nil
+}
+
+func (s *Store) IsIPBlocked(ip string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blocks, err := s.loadIPBlocks()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	for _, b := range blocks {
+		if b.IP == ip && (b.Permanent || (!b.ExpiresAt.IsZero() && now.Before(b.ExpiresAt))) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Store) SaveIPBlock(block model.IPBlock) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ipBlocksLoadedAt = time.Time{}
+	return s.IStore.SaveIPBlock(block)
+}
+
+func (s *Store) DeleteIPBlock(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ipBlocksLoadedAt = time.Time{}
+	return s.IStore.DeleteIPBlock(id)
+}
+
+func (s *Store) PruneIPBlocks(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ipBlocksLoadedAt = time.Time{}
+	return s.IStore.PruneIPBlocks(before)
+}
+
+// copyClient returns a copy of c that shares no slices with it.
+func copyClient(c model.Client) model.Client {
+	c.SubnetRanges = slices.Clone(c.SubnetRanges)
+	c.AllocatedIPs = slices.Clone(c.AllocatedIPs)
+	c.AllowedIPs = slices.Clone(c.AllowedIPs)
+	c.ExtraAllowedIPs = slices.Clone(c.ExtraAllowedIPs)
+	return c
+}
+
+// copyServer returns a copy of server that shares no pointers with it.
+func copyServer(server model.Server) model.Server {
+	if server.Interface != nil {
+		iface := *server.Interface
+		iface.Addresses = slices.Clone(iface.Addresses)
+		server.Interface = &iface
+	}
+	if server.KeyPair != nil {
+		keyPair := *server.KeyPair
+		server.KeyPair = &keyPair
+	}
+	return server
+}
+
+// copyAPIKey returns a copy of k that shares no pointers with it.
+func copyAPIKey(k model.APIKey) model.APIKey {
+	k.Permissions = slices.Clone(k.Permissions)
+	if k.LastUsedAt != nil {
+		lastUsed := *k.LastUsedAt
+		k.LastUsedAt = &lastUsed
+	}
+	return k
+}
+
+// onlyLastUsedChanged reports whether updated differs from cached in nothing
+// but LastUsedAt.
+func onlyLastUsedChanged(cached, updated model.APIKey) bool {
+	cached.LastUsedAt = nil
+	updated.LastUsedAt = nil
+	return reflect.DeepEqual(cached, updated)
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store/sqlitedb"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// TestAPIKeyLastUsedBatching verifies that LastUsedAt-only updates are held
+// in memory until Flush, while other writes go straight through.
+func TestAPIKeyLastUsedBatching(t *testing.T) {
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordEnvVar, "test-password")
+
+	tmpDir, err := os.MkdirTemp("", "wireguard-manager-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	backend, err := sqlitedb.New(filepath.Join(tmpDir, "wireguard-manager.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := backend.Init(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	key := model.APIKey{ID: "key1", Name: "ci", Key: "hash", Permissions: []string{model.PermissionReadClients}, Enabled: true, CreatedAt: now, UpdatedAt: now}
+	if err := backend.SaveAPIKey(key); err != nil {
+		t.Fatalf("SaveAPIKey failed: %v", err)
+	}
+
+	s := New(backend, time.Hour, time.Hour)
+
+	cached, err := s.GetAPIKeyByKey("hash")
+	if err != nil {
+		t.Fatalf("GetAPIKeyByKey failed: %v", err)
+	}
+	used := now.Add(time.Minute)
+	cached.LastUsedAt = &used
+	if err := s.SaveAPIKey(cached); err != nil {
+		t.Fatalf("SaveAPIKey failed: %v", err)
+	}
+
+	stored, _ := backend.GetAPIKeyByID("key1")
+	if stored.LastUsedAt != nil {
+		t.Errorf("Expected LastUsedAt to be held back until Flush, got %v", stored.LastUsedAt)
+	}
+	if got, _ := s.GetAPIKeyByID("key1"); got.LastUsedAt == nil || !got.LastUsedAt.Equal(used) {
+		t.Errorf("Expected the cache to return the pending LastUsedAt, got %v", got.LastUsedAt)
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	stored, _ = backend.GetAPIKeyByID("key1")
+	if stored.LastUsedAt == nil || !stored.LastUsedAt.Equal(used) {
+		t.Errorf("Expected LastUsedAt %v after Flush, got %v", used, stored.LastUsedAt)
+	}
+
+	// A real change is written immediately
+	cached.Enabled = false
+	if err := s.SaveAPIKey(cached); err != nil {
+		t.Fatalf("SaveAPIKey failed: %v", err)
+	}
+	stored, _ = backend.GetAPIKeyByID("key1")
+	if stored.Enabled {
+		t.Error("Expected the disabled key to be written through")
+	}
+}
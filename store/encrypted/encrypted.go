@@ -0,0 +1,473 @@
+// Package encrypted provides a store.IStore decorator that encrypts client
+// private and preshared keys, the private keys of the server and of further
+// WireGuard interfaces and the content of config revisions at rest.
+//
+// Secrets are encrypted with AES-256-GCM using a data key. The data key is
+// stored in the database only in wrapped form, encrypted by a KeyProvider
+// whose key is kept outside of the database. Encrypted values have the form
+// "enc:v1:<data key ID>:<base64 nonce and ciphertext>"; values without this
+// prefix are plaintext written before encryption was enabled.
+package encrypted
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// prefix marks an encrypted value.
+const prefix = "enc:v1:"
+
+// keyring holds unwrapped data keys by ID.
+type keyring struct {
+	keys     map[string][]byte
+	activeID string // key used for new encryptions, empty to store plaintext
+}
+
+// load unwraps all data keys stored in db with provider. The most recently
+// created key becomes the active one.
+func load(db store.IStore, provider KeyProvider) (*keyring, error) {
+	dataKeys, err := db.GetDataKeys()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read data keys: %v", err)
+	}
+	sort.Slice(dataKeys, func(i, j int) bool {
+		return dataKeys[i].CreatedAt.Before(dataKeys[j].CreatedAt)
+	})
+
+	ring := &keyring{keys: make(map[string][]byte)}
+	for _, dk := range dataKeys {
+		if provider == nil {
+			return nil, fmt.Errorf("data key %s is wrapped by the %s key provider, but no key provider is configured", dk.ID, dk.Provider)
+		}
+		if dk.Provider != provider.Name() {
+			return nil, fmt.Errorf("data key %s is wrapped by the %s key provider, not %s", dk.ID, dk.Provider, provider.Name())
+		}
+		key, err := provider.Unwrap(dk.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unwrap data key %s: %v", dk.ID, err)
+		}
+		ring.keys[dk.ID] = key
+		ring.activeID = dk.ID
+	}
+	return ring, nil
+}
+
+// encrypt returns the encrypted form of a secret. Empty secrets stay empty.
+func (r *keyring) encrypt(secret string) (string, error) {
+	if secret == "" || r.activeID == "" {
+		return secret, nil
+	}
+	sealed, err := seal(r.keys[r.activeID], []byte(secret), []byte(r.activeID))
+	if err != nil {
+		return "", err
+	}
+	return prefix + r.activeID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt returns the plaintext of a value written by encrypt, or the value
+// itself if it is not encrypted.
+func (r *keyring) decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, prefix) {
+		return value, nil
+	}
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	key, ok := r.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown data key %s", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(key, sealed, []byte(keyID))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt with data key %s: %v", keyID, err)
+	}
+	return string(plaintext), nil
+}
+
+// Store wraps a store.IStore and encrypts secrets on write and decrypts them
+// on read. All other methods are passed through to the embedded store.
+type Store struct {
+	store.IStore
+
+	provider KeyProvider
+	mu       *sync.RWMutex
+	ring     **keyring // shared with the stores handed to WithTx callbacks
+}
+
+// New returns an encrypting decorator around db. If db has no data key yet,
+// one is generated and all existing secrets are encrypted with it.
+func New(db store.IStore, provider KeyProvider) (*Store, error) {
+	ring, err := load(db, provider)
+	if err != nil {
+		return nil, err
+	}
+	if ring.activeID == "" {
+		if _, err := Rotate(db, nil, provider); err != nil {
+			return nil, fmt.Errorf("cannot encrypt existing secrets: %v", err)
+		}
+		if ring, err = load(db, provider); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Store{IStore: db, provider: provider, mu: &sync.RWMutex{}, ring: &ring}, nil
+}
+
+// keyring returns the current keyring. If a value references a data key that
+// is not known yet, for example because another process rotated the keys,
+// the keys are reloaded from the database.
+func (s *Store) keyring(values ...string) (*keyring, error) {
+	s.mu.RLock()
+	ring := *s.ring
+	s.mu.RUnlock()
+
+	for _, v := range values {
+		if !strings.HasPrefix(v, prefix) {
+			continue
+		}
+		keyID, _, _ := strings.Cut(strings.TrimPrefix(v, prefix), ":")
+		if _, ok := ring.keys[keyID]; ok {
+			continue
+		}
+
+		reloaded, err := load(s.IStore, s.provider)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		*s.ring = reloaded
+		s.mu.Unlock()
+		return reloaded, nil
+	}
+	return ring, nil
+}
+
+func (s *Store) WithTx(fn func(tx store.IStore) error) error {
+	return s.IStore.WithTx(func(tx store.IStore) error {
+		return fn(&Store{IStore: tx, provider: s.provider, mu: s.mu, ring: s.ring})
+	})
+}
+
+// decryptClient replaces the encrypted secrets of client with their plaintext.
+func (s *Store) decryptClient(client *model.Client) error {
+	ring, err := s.keyring(client.PrivateKey, client.PresharedKey)
+	if err != nil {
+		return err
+	}
+	if client.PrivateKey, err = ring.decrypt(client.PrivateKey); err != nil {
+		return fmt.Errorf("client %s: %v", client.ID, err)
+	}
+	if client.PresharedKey, err = ring.decrypt(client.PresharedKey); err != nil {
+		return fmt.Errorf("client %s: %v", client.ID, err)
+	}
+	return nil
+}
+
+// Global Settings and Server Configuration
+
+func (s *Store) GetServer() (model.Server, error) {
+	server, err := s.IStore.GetServer()
+	if err != nil || server.KeyPair == nil {
+		return server, err
+	}
+
+	ring, err := s.keyring(server.KeyPair.PrivateKey)
+	if err != nil {
+		return server, err
+	}
+	keyPair := *server.KeyPair
+	if keyPair.PrivateKey, err = ring.decrypt(keyPair.PrivateKey); err != nil {
+		return server, fmt.Errorf("server keypair: %v", err)
+	}
+	server.KeyPair = &keyPair
+	return server, nil
+}
+
+func (s *Store) SaveServerKeyPair(serverKeyPair model.ServerKeypair) error {
+	ring, err := s.keyring()
+	if err != nil {
+		return err
+	}
+	if serverKeyPair.PrivateKey, err = ring.encrypt(serverKeyPair.PrivateKey); err != nil {
+		return err
+	}
+	return s.IStore.SaveServerKeyPair(serverKeyPair)
+}
+
+// WireGuard Interfaces
+
+func (s *Store) GetWireGuardInterfaces() ([]model.WireGuardInterface, error) {
+	ifaces, err := s.IStore.GetWireGuardInterfaces()
+	if err != nil {
+		return ifaces, err
+	}
+	for i := range ifaces {
+		if err := s.decryptInterface(&ifaces[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ifaces, nil
+}
+
+func (s *Store) GetWireGuardInterface(name string) (model.WireGuardInterface, error) {
+	iface, err := s.IStore.GetWireGuardInterface(name)
+	if err != nil {
+		return iface, err
+	}
+	return iface, s.decryptInterface(&iface)
+}
+
+func (s *Store) SaveWireGuardInterface(iface model.WireGuardInterface) error {
+	ring, err := s.keyring()
+	if err != nil {
+		return err
+	}
+	if iface.PrivateKey, err = ring.encrypt(iface.PrivateKey); err != nil {
+		return err
+	}
+	return s.IStore.SaveWireGuardInterface(iface)
+}
+
+// decryptInterface replaces the encrypted private key of iface with its plaintext.
+func (s *Store) decryptInterface(iface *model.WireGuardInterface) error {
+	ring, err := s.keyring(iface.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if iface.PrivateKey, err = ring.decrypt(iface.PrivateKey); err != nil {
+		return fmt.Errorf("interface %s: %v", iface.Name, err)
+	}
+	return nil
+}
+
+// Nodes
+
+func (s *Store) GetNodes() ([]model.Node, error) {
+	nodes, err := s.IStore.GetNodes()
+	if err != nil {
+		return nodes, err
+	}
+	for i := range nodes {
+		if err := s.decryptNode(&nodes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+func (s *Store) GetNode(id string) (model.Node, error) {
+	node, err := s.IStore.GetNode(id)
+	if err != nil {
+		return node, err
+	}
+	return node, s.decryptNode(&node)
+}
+
+func (s *Store) SaveNode(node model.Node) error {
+	ring, err := s.keyring()
+	if err != nil {
+		return err
+	}
+	if node.Token, err = ring.encrypt(node.Token); err != nil {
+		return err
+	}
+	return s.IStore.SaveNode(node)
+}
+
+// decryptNode replaces the encrypted token of node with its plaintext.
+func (s *Store) decryptNode(node *model.Node) error {
+	ring, err := s.keyring(node.Token)
+	if err != nil {
+		return err
+	}
+	if node.Token, err = ring.decrypt(node.Token); err != nil {
+		return fmt.Errorf("node %s: %v", node.Name, err)
+	}
+	return nil
+}
+
+// Client Management
+
+// The underlying stores render QR codes from the stored, encrypted keys, so
+// clients are always read without QR code and the code is rendered here.
+
+func (s *Store) GetClients(hasQRCode bool) ([]model.ClientData, error) {
+	clients, err := s.IStore.GetClients(false)
+	if err != nil {
+		return clients, err
+	}
+
+	var ifaces map[string]model.WireGuardInterface
+	var globalSettings model.GlobalSetting
+	if hasQRCode {
+		ifaces, globalSettings, _ = util.ClientInterfaces(s)
+	}
+
+	for i := range clients {
+		if err := s.decryptClient(clients[i].Client); err != nil {
+			return nil, err
+		}
+		if hasQRCode && clients[i].Client.PrivateKey != "" {
+			clients[i].QRCode = qrCode(*clients[i].Client, ifaces[clients[i].Client.Interface], globalSettings)
+		}
+	}
+	return clients, nil
+}
+
+func (s *Store) QueryClients(query model.ClientQuery, hasQRCode bool) (model.ClientPage, error) {
+	page, err := s.IStore.QueryClients(query, false)
+	if err != nil {
+		return page, err
+	}
+
+	var ifaces map[string]model.WireGuardInterface
+	var globalSettings model.GlobalSetting
+	if hasQRCode {
+		ifaces, globalSettings, _ = util.ClientInterfaces(s)
+	}
+
+	for i := range page.Clients {
+		if err := s.decryptClient(page.Clients[i].Client); err != nil {
+			return model.ClientPage{}, err
+		}
+		if hasQRCode && page.Clients[i].Client.PrivateKey != "" {
+			page.Clients[i].QRCode = qrCode(*page.Clients[i].Client, ifaces[page.Clients[i].Client.Interface], globalSettings)
+		}
+	}
+	return page, nil
+}
+
+func (s *Store) GetTrashedClients() ([]model.ClientData, error) {
+	clients, err := s.IStore.GetTrashedClients()
+	if err != nil {
+		return clients, err
+	}
+	for i := range clients {
+		if err := s.decryptClient(clients[i].Client); err != nil {
+			return nil, err
+		}
+	}
+	return clients, nil
+}
+
+func (s *Store) GetClientByID(clientID string, qrCodeSettings model.QRCodeSettings) (model.ClientData, error) {
+	clientData, err := s.IStore.GetClientByID(clientID, model.QRCodeSettings{Enabled: false})
+	if err != nil {
+		return clientData, err
+	}
+	if err := s.decryptClient(clientData.Client); err != nil {
+		return clientData, err
+	}
+
+	if qrCodeSettings.Enabled && clientData.Client.PrivateKey != "" {
+		server, globalSettings, _ := util.ClientServer(s, *clientData.Client)
+		if !qrCodeSettings.IncludeDNS {
+			globalSettings.DNSServers = []string{}
+		}
+		if !qrCodeSettings.IncludeMTU {
+			globalSettings.MTU = 0
+		}
+		png, err := qrcode.Encode(util.BuildClientConfig(*clientData.Client, server, globalSettings), qrcode.Medium, 256)
+		if err == nil {
+			clientData.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+		}
+	}
+	return clientData, nil
+}
+
+func (s *Store) SaveClient(client model.Client) error {
+	ring, err := s.keyring()
+	if err != nil {
+		return err
+	}
+	if client.PrivateKey, err = ring.encrypt(client.PrivateKey); err != nil {
+		return err
+	}
+	if client.PresharedKey, err = ring.encrypt(client.PresharedKey); err != nil {
+		return err
+	}
+	return s.IStore.SaveClient(client)
+}
+
+// Config Revisions
+
+// The content of a revision holds the server private key and the preshared
+// keys, so it is encrypted as a whole.
+
+func (s *Store) GetConfigRevisions() ([]model.ConfigRevision, error) {
+	revisions, err := s.IStore.GetConfigRevisions()
+	if err != nil {
+		return revisions, err
+	}
+	for i := range revisions {
+		if err := s.decryptRevision(&revisions[i]); err != nil {
+			return revisions, err
+		}
+	}
+	return revisions, nil
+}
+
+func (s *Store) GetConfigRevision(id int) (model.ConfigRevision, error) {
+	revision, err := s.IStore.GetConfigRevision(id)
+	if err != nil {
+		return revision, err
+	}
+	return revision, s.decryptRevision(&revision)
+}
+
+func (s *Store) AddConfigRevision(revision model.ConfigRevision) (int, error) {
+	ring, err := s.keyring()
+	if err != nil {
+		return 0, err
+	}
+	if revision.Content, err = ring.encrypt(revision.Content); err != nil {
+		return 0, err
+	}
+	return s.IStore.AddConfigRevision(revision)
+}
+
+func (s *Store) SaveConfigRevision(revision model.ConfigRevision) error {
+	ring, err := s.keyring()
+	if err != nil {
+		return err
+	}
+	if revision.Content, err = ring.encrypt(revision.Content); err != nil {
+		return err
+	}
+	return s.IStore.SaveConfigRevision(revision)
+}
+
+// decryptRevision replaces the encrypted content of revision with its plaintext.
+func (s *Store) decryptRevision(revision *model.ConfigRevision) error {
+	ring, err := s.keyring(revision.Content)
+	if err != nil {
+		return err
+	}
+	if revision.Content, err = ring.decrypt(revision.Content); err != nil {
+		return fmt.Errorf("config revision %d: %v", revision.ID, err)
+	}
+	return nil
+}
+
+// qrCode renders the configuration of a client of iface as a PNG data URL.
+func qrCode(client model.Client, iface model.WireGuardInterface, globalSettings model.GlobalSetting) string {
+	png, err := qrcode.Encode(util.BuildClientConfig(client, iface.Server(), iface.Settings(globalSettings)), qrcode.Medium, 256)
+	if err != nil {
+		return ""
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+}
@@ -0,0 +1,188 @@
+package encrypted
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/sqlitedb"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// newTestDB creates an initialized SQLite store in a temporary directory.
+func newTestDB(t *testing.T) store.IStore {
+	t.Helper()
+
+	// Avoid the public IP lookup during default data seeding
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordEnvVar, "test-password")
+
+	db, err := sqlitedb.New(filepath.Join(t.TempDir(), "wireguard-manager.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	return db
+}
+
+// newLocalProvider returns a provider with a random key, read from an environment variable.
+func newLocalProvider(t *testing.T) KeyProvider {
+	t.Helper()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	t.Setenv("WGM_TEST_KEY", base64.StdEncoding.EncodeToString(key))
+	provider, err := ParseKeyProvider("env:WGM_TEST_KEY")
+	if err != nil {
+		t.Fatalf("ParseKeyProvider failed: %v", err)
+	}
+	return provider
+}
+
+// newVaultStandIn starts a minimal transit engine that wraps keys by reversing their encoding.
+func newVaultStandIn(t *testing.T) KeyProvider {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/wgm":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + reverse(req["plaintext"])}})
+		case "/v1/transit/decrypt/wgm":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": reverse(strings.TrimPrefix(req["ciphertext"], "vault:v1:"))}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+	provider, err := ParseKeyProvider("vault:wgm")
+	if err != nil {
+		t.Fatalf("ParseKeyProvider failed: %v", err)
+	}
+	return provider
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// TestEncryptionAtRest verifies that secrets are stored encrypted and read back in plaintext.
+func TestEncryptionAtRest(t *testing.T) {
+	raw := newTestDB(t)
+	server, err := raw.GetServer()
+	if err != nil {
+		t.Fatalf("GetServer failed: %v", err)
+	}
+	serverKey := server.KeyPair.PrivateKey
+
+	db, err := New(raw, newLocalProvider(t))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	client := model.Client{ID: "client1", PrivateKey: "client-private", PresharedKey: "client-psk", PublicKey: "pubkey", Name: "laptop", AllocatedIPs: []string{}, AllowedIPs: []string{}}
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+
+	stored, err := raw.GetClientByID("client1", model.QRCodeSettings{})
+	if err != nil {
+		t.Fatalf("GetClientByID failed: %v", err)
+	}
+	if !strings.HasPrefix(stored.Client.PrivateKey, prefix) || !strings.HasPrefix(stored.Client.PresharedKey, prefix) {
+		t.Errorf("Expected encrypted client secrets at rest, got %q and %q", stored.Client.PrivateKey, stored.Client.PresharedKey)
+	}
+	storedServer, _ := raw.GetServer()
+	if !strings.HasPrefix(storedServer.KeyPair.PrivateKey, prefix) {
+		t.Errorf("Expected the existing server key to be encrypted, got %q", storedServer.KeyPair.PrivateKey)
+	}
+
+	got, err := db.GetClientByID("client1", model.QRCodeSettings{})
+	if err != nil {
+		t.Fatalf("GetClientByID failed: %v", err)
+	}
+	if got.Client.PrivateKey != "client-private" || got.Client.PresharedKey != "client-psk" {
+		t.Errorf("Expected decrypted client secrets, got %q and %q", got.Client.PrivateKey, got.Client.PresharedKey)
+	}
+	if server, _ := db.GetServer(); server.KeyPair.PrivateKey != serverKey {
+		t.Errorf("Expected the decrypted server key %q, got %q", serverKey, server.KeyPair.PrivateKey)
+	}
+
+	if _, err := New(raw, newLocalProvider(t)); err == nil {
+		t.Error("Expected an error when opening with a different key")
+	}
+}
+
+// TestRotate verifies that rotating to another provider re-encrypts every secret.
+func TestRotate(t *testing.T) {
+	raw := newTestDB(t)
+	local := newLocalProvider(t)
+	db, err := New(raw, local)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	client := model.Client{ID: "client1", PrivateKey: "client-private", PublicKey: "pubkey", Name: "laptop", AllocatedIPs: []string{}, AllowedIPs: []string{}}
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+	before, _ := raw.GetClientByID("client1", model.QRCodeSettings{})
+
+	vault := newVaultStandIn(t)
+	count, err := Rotate(raw, local, vault)
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 re-encrypted records, got %d", count)
+	}
+
+	keys, _ := raw.GetDataKeys()
+	if len(keys) != 1 || keys[0].Provider != "vault" {
+		t.Fatalf("Expected a single vault data key, got %+v", keys)
+	}
+	after, _ := raw.GetClientByID("client1", model.QRCodeSettings{})
+	if after.Client.PrivateKey == before.Client.PrivateKey || !strings.Contains(after.Client.PrivateKey, keys[0].ID) {
+		t.Errorf("Expected the client key to be re-encrypted with %s, got %q", keys[0].ID, after.Client.PrivateKey)
+	}
+
+	db, err = New(raw, vault)
+	if err != nil {
+		t.Fatalf("New after rotation failed: %v", err)
+	}
+	got, err := db.GetClientByID("client1", model.QRCodeSettings{})
+	if err != nil {
+		t.Fatalf("GetClientByID failed: %v", err)
+	}
+	if got.Client.PrivateKey != "client-private" {
+		t.Errorf("Expected the decrypted client key, got %q", got.Client.PrivateKey)
+	}
+
+	if _, err := Rotate(raw, vault, nil); err != nil {
+		t.Fatalf("Rotate to plaintext failed: %v", err)
+	}
+	plain, _ := raw.GetClientByID("client1", model.QRCodeSettings{})
+	if plain.Client.PrivateKey != "client-private" {
+		t.Errorf("Expected the plaintext client key after disabling encryption, got %q", plain.Client.PrivateKey)
+	}
+}
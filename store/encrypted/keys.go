@@ -0,0 +1,142 @@
+package encrypted
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyProvider wraps and unwraps data keys with a key encryption key that is
+// kept outside of the database.
+type KeyProvider interface {
+	// Name identifies the provider in stored data keys, e.g. "file".
+	Name() string
+	// Wrap encrypts a data key for storage.
+	Wrap(dataKey []byte) (string, error)
+	// Unwrap decrypts a data key wrapped by Wrap.
+	Unwrap(wrapped string) ([]byte, error)
+}
+
+// ParseKeyProvider returns the key provider described by spec:
+//
+//	file:<path>            a 256-bit key stored base64 or hex encoded in a file
+//	env:<variable>         a 256-bit key stored base64 or hex encoded in an environment variable
+//	vault:[<mount>/]<key>  a HashiCorp Vault transit key, using VAULT_ADDR and VAULT_TOKEN
+//
+// The mount of a Vault key defaults to "transit".
+func ParseKeyProvider(spec string) (KeyProvider, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("invalid key provider %q, expected file:<path>, env:<variable> or vault:<key>", spec)
+	}
+
+	switch kind {
+	case "file":
+		content, err := os.ReadFile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %v", err)
+		}
+		key, err := decodeKey(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %v", arg, err)
+		}
+		return &localProvider{key: key}, nil
+	case "env":
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", arg)
+		}
+		key, err := decodeKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s: %v", arg, err)
+		}
+		return &localProvider{key: key}, nil
+	case "vault":
+		mount, key, found := strings.Cut(arg, "/")
+		if !found {
+			mount, key = "transit", arg
+		}
+		return newVaultProvider(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), mount, key)
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", kind)
+	}
+}
+
+// decodeKey accepts a 256-bit key encoded as base64 or hex.
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(s)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("expected a 256-bit key encoded as base64 or hex")
+	}
+	return key, nil
+}
+
+// localProvider wraps data keys with a key encryption key held in memory. Key
+// files and environment variables share the name "local", so the same key can
+// be moved from one to the other without rotating.
+type localProvider struct {
+	key []byte
+}
+
+func (p *localProvider) Name() string {
+	return "local"
+}
+
+func (p *localProvider) Wrap(dataKey []byte) (string, error) {
+	sealed, err := seal(p.key, dataKey, nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (p *localProvider) Unwrap(wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return open(p.key, sealed, nil)
+}
+
+// seal encrypts plaintext with AES-256-GCM and prepends the random nonce.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts data sealed by seal.
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,151 @@
+package encrypted
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// Rotate generates a new data key wrapped by newProvider and re-encrypts every
+// secret in db with it, in one transaction. The existing data keys are
+// unwrapped with oldProvider and deleted afterwards. oldProvider may be nil if
+// db has no data keys yet; if newProvider is nil, all secrets are decrypted
+// and stored as plaintext. It returns the number of records rewritten.
+func Rotate(db store.IStore, oldProvider, newProvider KeyProvider) (int, error) {
+	count := 0
+	err := db.WithTx(func(tx store.IStore) error {
+		count = 0
+		oldKeys, err := tx.GetDataKeys()
+		if err != nil {
+			return fmt.Errorf("cannot read data keys: %v", err)
+		}
+		oldRing, err := load(tx, oldProvider)
+		if err != nil {
+			return err
+		}
+
+		newRing := &keyring{keys: make(map[string][]byte)}
+		if newProvider != nil {
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return err
+			}
+			wrapped, err := newProvider.Wrap(key)
+			if err != nil {
+				return fmt.Errorf("cannot wrap data key: %v", err)
+			}
+			dataKey := model.DataKey{
+				ID:         xid.New().String(),
+				Provider:   newProvider.Name(),
+				WrappedKey: wrapped,
+				CreatedAt:  time.Now().UTC(),
+			}
+			if err := tx.SaveDataKey(dataKey); err != nil {
+				return fmt.Errorf("cannot save data key: %v", err)
+			}
+			newRing.keys[dataKey.ID] = key
+			newRing.activeID = dataKey.ID
+		}
+
+		// reencrypt moves a single secret from the old to the new keys.
+		reencrypt := func(value string) (string, error) {
+			plaintext, err := oldRing.decrypt(value)
+			if err != nil {
+				return "", err
+			}
+			return newRing.encrypt(plaintext)
+		}
+
+		clients, err := tx.GetClients(false)
+		if err != nil {
+			return fmt.Errorf("cannot read clients: %v", err)
+		}
+		trashed, err := tx.GetTrashedClients()
+		if err != nil {
+			return fmt.Errorf("cannot read trashed clients: %v", err)
+		}
+		for _, clientData := range append(clients, trashed...) {
+			client := *clientData.Client
+			if client.PrivateKey, err = reencrypt(client.PrivateKey); err != nil {
+				return fmt.Errorf("client %s: %v", client.ID, err)
+			}
+			if client.PresharedKey, err = reencrypt(client.PresharedKey); err != nil {
+				return fmt.Errorf("client %s: %v", client.ID, err)
+			}
+			if err := tx.SaveClient(client); err != nil {
+				return fmt.Errorf("cannot save client %s: %v", client.ID, err)
+			}
+			count++
+		}
+
+		server, err := tx.GetServer()
+		if err != nil {
+			return fmt.Errorf("cannot read server: %v", err)
+		}
+		if server.KeyPair != nil {
+			keyPair := *server.KeyPair
+			if keyPair.PrivateKey, err = reencrypt(keyPair.PrivateKey); err != nil {
+				return fmt.Errorf("server keypair: %v", err)
+			}
+			if err := tx.SaveServerKeyPair(keyPair); err != nil {
+				return fmt.Errorf("cannot save server keypair: %v", err)
+			}
+			count++
+		}
+
+		ifaces, err := tx.GetWireGuardInterfaces()
+		if err != nil {
+			return fmt.Errorf("cannot read interfaces: %v", err)
+		}
+		for _, iface := range ifaces {
+			if iface.PrivateKey, err = reencrypt(iface.PrivateKey); err != nil {
+				return fmt.Errorf("interface %s: %v", iface.Name, err)
+			}
+			if err := tx.SaveWireGuardInterface(iface); err != nil {
+				return fmt.Errorf("cannot save interface %s: %v", iface.Name, err)
+			}
+			count++
+		}
+
+		nodes, err := tx.GetNodes()
+		if err != nil {
+			return fmt.Errorf("cannot read nodes: %v", err)
+		}
+		for _, node := range nodes {
+			if node.Token, err = reencrypt(node.Token); err != nil {
+				return fmt.Errorf("node %s: %v", node.Name, err)
+			}
+			if err := tx.SaveNode(node); err != nil {
+				return fmt.Errorf("cannot save node %s: %v", node.Name, err)
+			}
+			count++
+		}
+
+		revisions, err := tx.GetConfigRevisions()
+		if err != nil {
+			return fmt.Errorf("cannot read config revisions: %v", err)
+		}
+		for _, revision := range revisions {
+			if revision.Content, err = reencrypt(revision.Content); err != nil {
+				return fmt.Errorf("config revision %d: %v", revision.ID, err)
+			}
+			if err := tx.SaveConfigRevision(revision); err != nil {
+				return fmt.Errorf("cannot save config revision %d: %v", revision.ID, err)
+			}
+			count++
+		}
+
+		for _, dk := range oldKeys {
+			if err := tx.DeleteDataKey(dk.ID); err != nil {
+				return fmt.Errorf("cannot delete data key %s: %v", dk.ID, err)
+			}
+		}
+		return nil
+	})
+	return count, err
+}
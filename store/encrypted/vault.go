@@ -0,0 +1,99 @@
+package encrypted
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// vaultProvider wraps data keys with the encrypt and decrypt endpoints of a
+// HashiCorp Vault transit secrets engine, or any service implementing them.
+type vaultProvider struct {
+	addr   string
+	token  string
+	mount  string
+	key    string
+	client *http.Client
+}
+
+func newVaultProvider(addr, token, mount, key string) (*vaultProvider, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is required for the vault key provider")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN is required for the vault key provider")
+	}
+	return &vaultProvider{
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		mount:  mount,
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *vaultProvider) Name() string {
+	return "vault"
+}
+
+func (p *vaultProvider) Wrap(dataKey []byte) (string, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := p.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Data.Ciphertext, nil
+}
+
+func (p *vaultProvider) Unwrap(wrapped string) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := p.call("decrypt", map[string]string{"ciphertext": wrapped}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+// call posts a request to a transit endpoint of the configured key.
+func (p *vaultProvider) call(operation string, body interface{}, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", p.addr, p.mount, operation, p.key)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %v", operation, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&vaultErr)
+		return fmt.Errorf("vault %s: %s %s", operation, resp.Status, strings.Join(vaultErr.Errors, "; "))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("vault %s: %v", operation, err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package store
+
+import "errors"
+
+// ErrSchemaTooNew is returned by Init when the database has been upgraded by a
+// newer version of wireguard-manager than the one that is running.
+var ErrSchemaTooNew = errors.New("database schema is newer than supported by this version")
+
+// ErrRevisionConflict is returned by the save methods of revisioned records when
+// the stored record has been modified since it was read.
+var ErrRevisionConflict = errors.New("record was modified concurrently")
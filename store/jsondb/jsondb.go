@@ -7,6 +7,8 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/labstack/gommon/log"
@@ -19,8 +21,11 @@ import (
 )
 
 type JsonDB struct {
-	conn   *scribble.Driver
-	dbPath string
+	conn    *scribble.Driver
+	dbPath  string
+	txMu    *sync.Mutex // serializes writes and transactions
+	journal *journal    // set inside WithTx
+	locked  bool        // set on the copy that holds txMu for a single write
 }
 
 // New returns a new pointer JsonDB
@@ -32,6 +37,7 @@ func New(dbPath string) (*JsonDB, error) {
 	ans := JsonDB{
 		conn:   conn,
 		dbPath: dbPath,
+		txMu:   &sync.Mutex{},
 	}
 	return &ans, nil
 }
@@ -47,6 +53,12 @@ func (o *JsonDB) Init() error {
 	var globalSettingPath = path.Join(serverPath, "global_settings.json")
 	var hashesPath = path.Join(serverPath, "hashes.json")
 
+	// refuse to touch a database written by a newer version
+	version, err := o.checkSchemaVersion()
+	if err != nil {
+		return err
+	}
+
 	// create directories if they do not exist
 	if _, err := os.Stat(clientPath); os.IsNotExist(err) {
 		os.MkdirAll(clientPath, os.ModePerm)
@@ -72,7 +84,7 @@ func (o *JsonDB) Init() error {
 		serverInterface.PostUp = util.LookupEnvOrString(util.ServerPostUpScriptEnvVar, "")
 		serverInterface.PostDown = util.LookupEnvOrString(util.ServerPostDownScriptEnvVar, "")
 		serverInterface.UpdatedAt = time.Now().UTC()
-		o.conn.Write("server", "interfaces", serverInterface)
+		o.write("server", "interfaces", serverInterface)
 		err := util.ManagePerms(serverInterfacePath)
 		if err != nil {
 			return err
@@ -89,7 +101,7 @@ func (o *JsonDB) Init() error {
 		serverKeyPair.PrivateKey = key.String()
 		serverKeyPair.PublicKey = key.PublicKey().String()
 		serverKeyPair.UpdatedAt = time.Now().UTC()
-		o.conn.Write("server", "keypair", serverKeyPair)
+		o.write("server", "keypair", serverKeyPair)
 		err = util.ManagePerms(serverKeyPairPath)
 		if err != nil {
 			return err
@@ -117,7 +129,7 @@ func (o *JsonDB) Init() error {
 		globalSetting.Table = util.LookupEnvOrString(util.TableEnvVar, util.DefaultTable)
 		globalSetting.ConfigFilePath = util.LookupEnvOrString(util.ConfigFilePathEnvVar, util.DefaultConfigFilePath)
 		globalSetting.UpdatedAt = time.Now().UTC()
-		o.conn.Write("server", "global_settings", globalSetting)
+		o.write("server", "global_settings", globalSetting)
 		err := util.ManagePerms(globalSettingPath)
 		if err != nil {
 			return err
@@ -129,7 +141,7 @@ func (o *JsonDB) Init() error {
 		clientServerHashes := new(model.ClientServerHashes)
 		clientServerHashes.Client = "none"
 		clientServerHashes.Server = "none"
-		o.conn.Write("server", "hashes", clientServerHashes)
+		o.write("server", "hashes", clientServerHashes)
 		err := util.ManagePerms(hashesPath)
 		if err != nil {
 			return err
@@ -167,7 +179,7 @@ func (o *JsonDB) Init() error {
 			}
 		}
 
-		o.conn.Write("users", user.Username, user)
+		o.write("users", user.Username, user)
 		results, _ = o.conn.ReadAll("users")
 		err = util.ManagePerms(path.Join(path.Join(o.dbPath, "users"), user.Username+".json"))
 		if err != nil {
@@ -210,7 +222,7 @@ func (o *JsonDB) Init() error {
 		}
 	}
 
-	return nil
+	return o.migrate(version)
 }
 
 // GetUsers func to get all users from the database
@@ -245,7 +257,7 @@ func (o *JsonDB) GetUserByName(username string) (model.User, error) {
 // SaveUser func to save user in the database
 func (o *JsonDB) SaveUser(user model.User) error {
 	userPath := path.Join(path.Join(o.dbPath, "users"), user.Username+".json")
-	output := o.conn.Write("users", user.Username, user)
+	output := o.write("users", user.Username, user)
 	err := util.ManagePerms(userPath)
 	if err != nil {
 		return err
@@ -257,7 +269,7 @@ func (o *JsonDB) SaveUser(user model.User) error {
 // DeleteUser func to remove user from the database
 func (o *JsonDB) DeleteUser(username string) error {
 	delete(util.DBUsersToCRC32, username)
-	return o.conn.Delete("users", username)
+	return o.delete("users", username)
 }
 
 // GetGlobalSettings func to query global settings from the database
@@ -288,6 +300,45 @@ func (o *JsonDB) GetServer() (model.Server, error) {
 }
 
 func (o *JsonDB) GetClients(hasQRCode bool) ([]model.ClientData, error) {
+	return o.readClients(false, hasQRCode)
+}
+
+// GetTrashedClients returns the clients that were moved to the trash.
+func (o *JsonDB) GetTrashedClients() ([]model.ClientData, error) {
+	return o.readClients(true, false)
+}
+
+// QueryClients returns one page of the active clients selected by query.
+// The clients are filtered and ordered in memory.
+func (o *JsonDB) QueryClients(query model.ClientQuery, hasQRCode bool) (model.ClientPage, error) {
+	if err := query.Validate(); err != nil {
+		return model.ClientPage{}, err
+	}
+	clients, err := o.readClients(false, false)
+	if err != nil {
+		return model.ClientPage{}, err
+	}
+	page, err := query.Select(clients)
+	if err != nil || !hasQRCode {
+		return page, err
+	}
+
+	ifaces, globalSettings, _ := util.ClientInterfaces(o)
+	for i, clientData := range page.Clients {
+		if clientData.Client.PrivateKey == "" {
+			continue
+		}
+		iface := ifaces[clientData.Client.Interface]
+		png, err := qrcode.Encode(util.BuildClientConfig(*clientData.Client, iface.Server(), iface.Settings(globalSettings)), qrcode.Medium, 256)
+		if err == nil {
+			page.Clients[i].QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+		}
+	}
+	return page, nil
+}
+
+// readClients returns either the active or the trashed clients.
+func (o *JsonDB) readClients(trashed bool, hasQRCode bool) ([]model.ClientData, error) {
 	var clients []model.ClientData
 
 	// read all client json files in "clients" directory
@@ -296,6 +347,12 @@ func (o *JsonDB) GetClients(hasQRCode bool) ([]model.ClientData, error) {
 		return clients, err
 	}
 
+	var ifaces map[string]model.WireGuardInterface
+	var globalSettings model.GlobalSetting
+	if hasQRCode {
+		ifaces, globalSettings, _ = util.ClientInterfaces(o)
+	}
+
 	// build the ClientData list
 	for _, f := range records {
 		client := model.Client{}
@@ -305,13 +362,14 @@ func (o *JsonDB) GetClients(hasQRCode bool) ([]model.ClientData, error) {
 		if err := json.Unmarshal(f, &client); err != nil {
 			return clients, fmt.Errorf("cannot decode client json structure: %v", err)
 		}
+		if (client.DeletedAt != nil) != trashed {
+			continue
+		}
 
 		// generate client qrcode image in base64
 		if hasQRCode && client.PrivateKey != "" {
-			server, _ := o.GetServer()
-			globalSettings, _ := o.GetGlobalSettings()
-
-			png, err := qrcode.Encode(util.BuildClientConfig(client, server, globalSettings), qrcode.Medium, 256)
+			iface := ifaces[client.Interface]
+			png, err := qrcode.Encode(util.BuildClientConfig(client, iface.Server(), iface.Settings(globalSettings)), qrcode.Medium, 256)
 			if err == nil {
 				clientData.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
 			} else {
@@ -338,8 +396,7 @@ func (o *JsonDB) GetClientByID(clientID string, qrCodeSettings model.QRCodeSetti
 
 	// generate client qrcode image in base64
 	if qrCodeSettings.Enabled && client.PrivateKey != "" {
-		server, _ := o.GetServer()
-		globalSettings, _ := o.GetGlobalSettings()
+		server, globalSettings, _ := util.ClientServer(o, client)
 		client := client
 		if !qrCodeSettings.IncludeDNS {
 			globalSettings.DNSServers = []string{}
@@ -363,8 +420,15 @@ func (o *JsonDB) GetClientByID(clientID string, qrCodeSettings model.QRCodeSetti
 
 func (o *JsonDB) SaveClient(client model.Client) error {
 	clientPath := path.Join(path.Join(o.dbPath, "clients"), client.ID+".json")
-	output := o.conn.Write("clients", client.ID, client)
-	err := util.ManagePerms(clientPath)
+	o, unlock := o.lock()
+	defer unlock()
+	revision, err := o.nextRevision("clients", client.ID, client.Revision)
+	if err != nil {
+		return err
+	}
+	client.Revision = revision
+	output := o.write("clients", client.ID, client)
+	err = util.ManagePerms(clientPath)
 	if err != nil {
 		return err
 	}
@@ -372,13 +436,20 @@ func (o *JsonDB) SaveClient(client model.Client) error {
 }
 
 func (o *JsonDB) DeleteClient(clientID string) error {
-	return o.conn.Delete("clients", clientID)
+	return o.delete("clients", clientID)
 }
 
 func (o *JsonDB) SaveServerInterface(serverInterface model.ServerInterface) error {
 	serverInterfacePath := path.Join(path.Join(o.dbPath, "server"), "interfaces.json")
-	output := o.conn.Write("server", "interfaces", serverInterface)
-	err := util.ManagePerms(serverInterfacePath)
+	o, unlock := o.lock()
+	defer unlock()
+	revision, err := o.nextRevision("server", "interfaces", serverInterface.Revision)
+	if err != nil {
+		return err
+	}
+	serverInterface.Revision = revision
+	output := o.write("server", "interfaces", serverInterface)
+	err = util.ManagePerms(serverInterfacePath)
 	if err != nil {
 		return err
 	}
@@ -387,7 +458,7 @@ func (o *JsonDB) SaveServerInterface(serverInterface model.ServerInterface) erro
 
 func (o *JsonDB) SaveServerKeyPair(serverKeyPair model.ServerKeypair) error {
 	serverKeyPairPath := path.Join(path.Join(o.dbPath, "server"), "keypair.json")
-	output := o.conn.Write("server", "keypair", serverKeyPair)
+	output := o.write("server", "keypair", serverKeyPair)
 	err := util.ManagePerms(serverKeyPairPath)
 	if err != nil {
 		return err
@@ -397,8 +468,15 @@ func (o *JsonDB) SaveServerKeyPair(serverKeyPair model.ServerKeypair) error {
 
 func (o *JsonDB) SaveGlobalSettings(globalSettings model.GlobalSetting) error {
 	globalSettingsPath := path.Join(path.Join(o.dbPath, "server"), "global_settings.json")
-	output := o.conn.Write("server", "global_settings", globalSettings)
-	err := util.ManagePerms(globalSettingsPath)
+	o, unlock := o.lock()
+	defer unlock()
+	revision, err := o.nextRevision("server", "global_settings", globalSettings.Revision)
+	if err != nil {
+		return err
+	}
+	globalSettings.Revision = revision
+	output := o.write("server", "global_settings", globalSettings)
+	err = util.ManagePerms(globalSettingsPath)
 	if err != nil {
 		return err
 	}
@@ -416,7 +494,7 @@ func (o *JsonDB) GetHashes() (model.ClientServerHashes, error) {
 
 func (o *JsonDB) SaveHashes(hashes model.ClientServerHashes) error {
 	hashesPath := path.Join(path.Join(o.dbPath, "server"), "hashes.json")
-	output := o.conn.Write("server", "hashes", hashes)
+	output := o.write("server", "hashes", hashes)
 	err := util.ManagePerms(hashesPath)
 	if err != nil {
 		return err
@@ -477,7 +555,7 @@ func (o *JsonDB) GetAPIKeyByKey(keyValue string) (model.APIKey, error) {
 // SaveAPIKey saves an API key to the database
 func (o *JsonDB) SaveAPIKey(key model.APIKey) error {
 	apiKeyPath := path.Join(path.Join(o.dbPath, "apikeys"), key.ID+".json")
-	output := o.conn.Write("apikeys", key.ID, key)
+	output := o.write("apikeys", key.ID, key)
 	err := util.ManagePerms(apiKeyPath)
 	if err != nil {
 		return err
@@ -487,7 +565,116 @@ func (o *JsonDB) SaveAPIKey(key model.APIKey) error {
 
 // DeleteAPIKey deletes an API key from the database
 func (o *JsonDB) DeleteAPIKey(keyID string) error {
-	return o.conn.Delete("apikeys", keyID)
+	return o.delete("apikeys", keyID)
+}
+
+// GetDataKeys returns all wrapped data keys from the database
+func (o *JsonDB) GetDataKeys() ([]model.DataKey, error) {
+	var keys []model.DataKey
+	dataKeyPath := path.Join(o.dbPath, "datakeys")
+
+	if _, err := os.Stat(dataKeyPath); os.IsNotExist(err) {
+		return keys, nil
+	}
+
+	results, err := o.conn.ReadAll("datakeys")
+	if err != nil {
+		return keys, err
+	}
+
+	for _, i := range results {
+		key := model.DataKey{}
+		if err := json.Unmarshal(i, &key); err != nil {
+			return keys, fmt.Errorf("cannot decode data key json structure: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// SaveDataKey saves a wrapped data key to the database
+func (o *JsonDB) SaveDataKey(key model.DataKey) error {
+	dataKeyPath := path.Join(path.Join(o.dbPath, "datakeys"), key.ID+".json")
+	output := o.write("datakeys", key.ID, key)
+	err := util.ManagePerms(dataKeyPath)
+	if err != nil {
+		return err
+	}
+	return output
+}
+
+// DeleteDataKey deletes a wrapped data key from the database
+func (o *JsonDB) DeleteDataKey(keyID string) error {
+	return o.delete("datakeys", keyID)
+}
+
+// GetIPReservations returns all IP reservations from the database
+func (o *JsonDB) GetIPReservations() ([]model.IPReservation, error) {
+	var reservations []model.IPReservation
+	records, err := o.conn.ReadAll("ip_reservations")
+	if err != nil {
+		// Return empty slice if collection doesn't exist
+		return reservations, nil
+	}
+
+	for _, r := range records {
+		var reservation model.IPReservation
+		if err := json.Unmarshal([]byte(r), &reservation); err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].CreatedAt.Before(reservations[j].CreatedAt)
+	})
+	return reservations, nil
+}
+
+// SaveIPReservation saves an IP reservation to the database
+func (o *JsonDB) SaveIPReservation(reservation model.IPReservation) error {
+	return o.write("ip_reservations", reservation.ID, reservation)
+}
+
+// DeleteIPReservation deletes an IP reservation from the database
+func (o *JsonDB) DeleteIPReservation(id string) error {
+	return o.delete("ip_reservations", id)
+}
+
+// GetSubnetRanges returns all subnet ranges ordered by position and name
+func (o *JsonDB) GetSubnetRanges() ([]model.SubnetRange, error) {
+	var ranges []model.SubnetRange
+	records, err := o.conn.ReadAll("subnet_ranges")
+	if err != nil {
+		// Return empty slice if collection doesn't exist
+		return ranges, nil
+	}
+
+	for _, r := range records {
+		var subnetRange model.SubnetRange
+		if err := json.Unmarshal([]byte(r), &subnetRange); err != nil {
+			return ranges, err
+		}
+		ranges = append(ranges, subnetRange)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].Position != ranges[j].Position {
+			return ranges[i].Position < ranges[j].Position
+		}
+		return ranges[i].Name < ranges[j].Name
+	})
+	return ranges, nil
+}
+
+// SaveSubnetRange saves a subnet range to the database
+func (o *JsonDB) SaveSubnetRange(subnetRange model.SubnetRange) error {
+	return o.write("subnet_ranges", subnetRange.ID, subnetRange)
+}
+
+// DeleteSubnetRange deletes a subnet range from the database
+func (o *JsonDB) DeleteSubnetRange(id string) error {
+	return o.delete("subnet_ranges", id)
 }
 
 // SaveAPIAccessLog saves an API access log entry to the database
@@ -500,7 +687,7 @@ func (o *JsonDB) SaveAPIAccessLog(log model.APIAccessLog) error {
 	}
 
 	logPath := path.Join(apiLogPath, log.ID+".json")
-	output := o.conn.Write("apilogs", log.ID, log)
+	output := o.write("apilogs", log.ID, log)
 	err := util.ManagePerms(logPath)
 	if err != nil {
 		return err
@@ -592,13 +779,10 @@ func (o *JsonDB) GetSecuritySettings() (model.SecuritySettings, error) {
 	settingsPath := path.Join(o.dbPath, "server", "security_settings.json")
 
 	if _, err := os.Stat(settingsPath); os.IsNotExist(err) {
-		// Return default settings if file doesn't exist
-		settings = model.DefaultSecuritySettings()
-		// Save default settings
-		if err := o.SaveSecuritySettings(settings); err != nil {
-			return settings, err
+		// Save default settings if file doesn't exist, then read them back with their revision
+		if err := o.SaveSecuritySettings(model.DefaultSecuritySettings()); err != nil {
+			return model.DefaultSecuritySettings(), err
 		}
-		return settings, nil
 	}
 
 	if err := o.conn.Read("server", "security_settings", &settings); err != nil {
@@ -608,13 +792,261 @@ func (o *JsonDB) GetSecuritySettings() (model.SecuritySettings, error) {
 }
 
 func (o *JsonDB) SaveSecuritySettings(settings model.SecuritySettings) error {
-	return o.conn.Write("server", "security_settings", settings)
+	o, unlock := o.lock()
+	defer unlock()
+	revision, err := o.nextRevision("server", "security_settings", settings.Revision)
+	if err != nil {
+		return err
+	}
+	settings.Revision = revision
+	return o.write("server", "security_settings", settings)
+}
+
+// Audit Log
+
+// SaveAuditEntry stores an audit entry
+func (o *JsonDB) SaveAuditEntry(entry model.AuditEntry) error {
+	return o.write("audit", entry.ID, entry)
+}
+
+// GetAuditEntries returns the audit entries matching filter, newest first
+func (o *JsonDB) GetAuditEntries(filter model.AuditFilter) ([]model.AuditEntry, error) {
+	var entries []model.AuditEntry
+	records, err := o.conn.ReadAll("audit")
+	if err != nil {
+		// Return empty slice if collection doesn't exist
+		return entries, nil
+	}
+
+	for _, r := range records {
+		var entry model.AuditEntry
+		if err := json.Unmarshal([]byte(r), &entry); err != nil {
+			return entries, err
+		}
+		if filter.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+
+	return entries, nil
+}
+
+// WireGuard Interfaces
+
+// GetWireGuardInterfaces returns the interfaces besides the primary one, ordered by name
+func (o *JsonDB) GetWireGuardInterfaces() ([]model.WireGuardInterface, error) {
+	var ifaces []model.WireGuardInterface
+	records, err := o.conn.ReadAll("wireguard_interfaces")
+	if err != nil {
+		// Return empty slice if collection doesn't exist
+		return ifaces, nil
+	}
+
+	for _, r := range records {
+		var iface model.WireGuardInterface
+		if err := json.Unmarshal([]byte(r), &iface); err != nil {
+			return ifaces, err
+		}
+		ifaces = append(ifaces, iface)
+	}
+
+	sort.Slice(ifaces, func(i, j int) bool {
+		return ifaces[i].Name < ifaces[j].Name
+	})
+	return ifaces, nil
+}
+
+// GetWireGuardInterface returns an interface by its name
+func (o *JsonDB) GetWireGuardInterface(name string) (model.WireGuardInterface, error) {
+	iface := model.WireGuardInterface{}
+	if err := o.conn.Read("wireguard_interfaces", name, &iface); err != nil {
+		return iface, fmt.Errorf("interface %s not found", name)
+	}
+	return iface, nil
+}
+
+// SaveWireGuardInterface saves an interface to the database. The applied
+// state is left unchanged. The file holds the private key of the interface, so
+// only the owner may read it.
+func (o *JsonDB) SaveWireGuardInterface(iface model.WireGuardInterface) error {
+	o, unlock := o.lock()
+	defer unlock()
+	revision, err := o.nextRevision("wireguard_interfaces", iface.Name, iface.Revision)
+	if err != nil {
+		return err
+	}
+	current := model.WireGuardInterface{}
+	if err := o.conn.Read("wireguard_interfaces", iface.Name, &current); err == nil {
+		iface.Applied, iface.AppliedAt = current.Applied, current.AppliedAt
+	} else {
+		iface.Applied, iface.AppliedAt = nil, nil
+	}
+	iface.Revision = revision
+	iface.Primary = false
+	iface.UpdatedAt = time.Now().UTC()
+	if err := o.write("wireguard_interfaces", iface.Name, iface); err != nil {
+		return err
+	}
+	return util.ManagePerms(path.Join(o.dbPath, "wireguard_interfaces", iface.Name+".json"))
+}
+
+// SaveWireGuardInterfaceApplied records the state of the last successful apply of an interface
+func (o *JsonDB) SaveWireGuardInterfaceApplied(name string, state model.ConfigState, appliedAt time.Time) error {
+	o, unlock := o.lock()
+	defer unlock()
+	iface := model.WireGuardInterface{}
+	if err := o.conn.Read("wireguard_interfaces", name, &iface); err != nil {
+		return fmt.Errorf("interface %s not found", name)
+	}
+	iface.Applied = &state
+	iface.AppliedAt = &appliedAt
+	if err := o.write("wireguard_interfaces", name, iface); err != nil {
+		return err
+	}
+	return util.ManagePerms(path.Join(o.dbPath, "wireguard_interfaces", name+".json"))
+}
+
+// DeleteWireGuardInterface deletes an interface from the database
+func (o *JsonDB) DeleteWireGuardInterface(name string) error {
+	return o.delete("wireguard_interfaces", name)
+}
+
+// Nodes
+
+// GetNodes returns all nodes ordered by name
+func (o *JsonDB) GetNodes() ([]model.Node, error) {
+	var nodes []model.Node
+	records, err := o.conn.ReadAll("nodes")
+	if err != nil {
+		// Return empty slice if collection doesn't exist
+		return nodes, nil
+	}
+
+	for _, r := range records {
+		var node model.Node
+		if err := json.Unmarshal([]byte(r), &node); err != nil {
+			return nodes, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes, nil
+}
+
+// GetNode returns a node by its ID
+func (o *JsonDB) GetNode(id string) (model.Node, error) {
+	node := model.Node{}
+	if err := o.conn.Read("nodes", id, &node); err != nil {
+		return node, fmt.Errorf("node %s not found", id)
+	}
+	return node, nil
+}
+
+// SaveNode saves a node to the database. The file holds the token of the
+// agent, so only the owner may read it.
+func (o *JsonDB) SaveNode(node model.Node) error {
+	o, unlock := o.lock()
+	defer unlock()
+	revision, err := o.nextRevision("nodes", node.ID, node.Revision)
+	if err != nil {
+		return err
+	}
+	node.Revision = revision
+	node.UpdatedAt = time.Now().UTC()
+	if err := o.write("nodes", node.ID, node); err != nil {
+		return err
+	}
+	return util.ManagePerms(path.Join(o.dbPath, "nodes", node.ID+".json"))
+}
+
+// DeleteNode deletes a node from the database
+func (o *JsonDB) DeleteNode(id string) error {
+	return o.delete("nodes", id)
+}
+
+// Config Revisions
+
+// GetConfigRevisions returns all config revisions, newest first
+func (o *JsonDB) GetConfigRevisions() ([]model.ConfigRevision, error) {
+	var revisions []model.ConfigRevision
+	records, err := o.conn.ReadAll("config_revisions")
+	if err != nil {
+		// Return empty slice if collection doesn't exist
+		return revisions, nil
+	}
+
+	for _, r := range records {
+		var revision model.ConfigRevision
+		if err := json.Unmarshal([]byte(r), &revision); err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].ID > revisions[j].ID
+	})
+	return revisions, nil
+}
+
+// GetConfigRevision returns a config revision by its number
+func (o *JsonDB) GetConfigRevision(id int) (model.ConfigRevision, error) {
+	revision := model.ConfigRevision{}
+	if err := o.conn.Read("config_revisions", strconv.Itoa(id), &revision); err != nil {
+		return revision, fmt.Errorf("config revision %d not found", id)
+	}
+	return revision, nil
+}
+
+// AddConfigRevision saves a new config revision numbered after the newest
+// one. The write lock is held from reading the numbers to the write.
+func (o *JsonDB) AddConfigRevision(revision model.ConfigRevision) (int, error) {
+	o, unlock := o.lock()
+	defer unlock()
+	revisions, err := o.GetConfigRevisions()
+	if err != nil {
+		return 0, err
+	}
+	revision.ID = 1
+	if len(revisions) > 0 {
+		revision.ID = revisions[0].ID + 1
+	}
+	if err := o.SaveConfigRevision(revision); err != nil {
+		return 0, err
+	}
+	return revision.ID, nil
+}
+
+// SaveConfigRevision saves a config revision to the database. The file holds
+// the keys of the config, so only the owner may read it.
+func (o *JsonDB) SaveConfigRevision(revision model.ConfigRevision) error {
+	id := strconv.Itoa(revision.ID)
+	if err := o.write("config_revisions", id, revision); err != nil {
+		return err
+	}
+	return util.ManagePerms(path.Join(o.dbPath, "config_revisions", id+".json"))
+}
+
+// DeleteConfigRevision deletes a config revision from the database
+func (o *JsonDB) DeleteConfigRevision(id int) error {
+	return o.delete("config_revisions", strconv.Itoa(id))
 }
 
 // Security Events
 
 func (o *JsonDB) SaveSecurityEvent(event model.SecurityEvent) error {
-	return o.conn.Write("security_events", event.ID, event)
+	return o.write("security_events", event.ID, event)
 }
 
 func (o *JsonDB) GetSecurityEvents(limit int) ([]model.SecurityEvent, error) {
@@ -716,11 +1148,11 @@ func (o *JsonDB) GetIPBlockByIP(ip string) (model.IPBlock, error) {
 }
 
 func (o *JsonDB) SaveIPBlock(block model.IPBlock) error {
-	return o.conn.Write("ip_blocks", block.ID, block)
+	return o.write("ip_blocks", block.ID, block)
 }
 
 func (o *JsonDB) DeleteIPBlock(id string) error {
-	return o.conn.Delete("ip_blocks", id)
+	return o.delete("ip_blocks", id)
 }
 
 func (o *JsonDB) IsIPBlocked(ip string) (bool, error) {
@@ -786,11 +1218,11 @@ func (o *JsonDB) GetGeoIPRuleByCountry(countryCode string) (model.GeoIPRule, err
 }
 
 func (o *JsonDB) SaveGeoIPRule(rule model.GeoIPRule) error {
-	return o.conn.Write("geoip_rules", rule.ID, rule)
+	return o.write("geoip_rules", rule.ID, rule)
 }
 
 func (o *JsonDB) DeleteGeoIPRule(id string) error {
-	return o.conn.Delete("geoip_rules", id)
+	return o.delete("geoip_rules", id)
 }
 
 // Brute Force Protection
@@ -805,32 +1237,79 @@ func (o *JsonDB) GetBruteForceAttempt(ip string) (model.BruteForceAttempt, error
 }
 
 func (o *JsonDB) SaveBruteForceAttempt(attempt model.BruteForceAttempt) error {
-	return o.conn.Write("brute_force_attempts", attempt.IP, attempt)
+	return o.write("brute_force_attempts", attempt.IP, attempt)
 }
 
 func (o *JsonDB) DeleteBruteForceAttempt(ip string) error {
-	return o.conn.Delete("brute_force_attempts", ip)
+	return o.delete("brute_force_attempts", ip)
+}
+
+// Retention
+
+// PruneAPIAccessLogs deletes the API access log entries written before the given time.
+func (o *JsonDB) PruneAPIAccessLogs(before time.Time) (int, error) {
+	return o.prune("apilogs", func(data []byte) (string, bool) {
+		var entry model.APIAccessLog
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return "", false
+		}
+		return entry.ID, entry.Timestamp.Before(before)
+	})
+}
+
+// PruneSecurityEvents deletes the security events recorded before the given time.
+func (o *JsonDB) PruneSecurityEvents(before time.Time) (int, error) {
+	return o.prune("security_events", func(data []byte) (string, bool) {
+		var event model.SecurityEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return "", false
+		}
+		return event.ID, event.CreatedAt.Before(before)
+	})
 }
 
-func (o *JsonDB) CleanupExpiredBruteForceAttempts() error {
-	records, err := o.conn.ReadAll("brute_force_attempts")
+// PruneBruteForceAttempts deletes the failed login counters whose last attempt
+// and block both ended before the given time.
+func (o *JsonDB) PruneBruteForceAttempts(before time.Time) (int, error) {
+	return o.prune("brute_force_attempts", func(data []byte) (string, bool) {
+		var attempt model.BruteForceAttempt
+		if err := json.Unmarshal(data, &attempt); err != nil {
+			return "", false
+		}
+		return attempt.IP, attempt.LastAttempt.Before(before) && attempt.BlockedUntil.Before(before)
+	})
+}
+
+// PruneIPBlocks deletes the temporary IP blocks that expired before the given time.
+func (o *JsonDB) PruneIPBlocks(before time.Time) (int, error) {
+	return o.prune("ip_blocks", func(data []byte) (string, bool) {
+		var block model.IPBlock
+		if err := json.Unmarshal(data, &block); err != nil {
+			return "", false
+		}
+		return block.ID, !block.Permanent && !block.ExpiresAt.IsZero() && block.ExpiresAt.Before(before)
+	})
+}
+
+// prune deletes the documents of a collection for which expired returns true,
+// and returns how many were deleted.
+func (o *JsonDB) prune(collection string, expired func(data []byte) (string, bool)) (int, error) {
+	records, err := o.conn.ReadAll(collection)
 	if err != nil {
-		// Return nil if collection doesn't exist
-		return nil
+		// Nothing to prune if the collection doesn't exist
+		return 0, nil
 	}
 
-	now := time.Now().UTC()
+	pruned := 0
 	for _, r := range records {
-		var attempt model.BruteForceAttempt
-		if err := json.Unmarshal([]byte(r), &attempt); err != nil {
+		id, ok := expired([]byte(r))
+		if !ok {
 			continue
 		}
-
-		// Delete if block has expired
-		if !attempt.BlockedUntil.IsZero() && now.After(attempt.BlockedUntil) {
-			o.conn.Delete("brute_force_attempts", attempt.IP)
+		if err := o.delete(collection, id); err != nil {
+			return pruned, err
 		}
+		pruned++
 	}
-
-	return nil
+	return pruned, nil
 }
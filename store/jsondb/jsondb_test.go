@@ -0,0 +1,13 @@
+package jsondb
+
+import (
+	"testing"
+
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/storetest"
+)
+
+// TestStore runs the store conformance suite.
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.IStore { return newTestDB(t) })
+}
@@ -0,0 +1,115 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// schemaVersion is the document stored in server/schema.json.
+type schemaVersion struct {
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// migration is a single change to the layout of the JSON documents.
+type migration struct {
+	version     int
+	description string
+	up          func(o *JsonDB) error
+}
+
+// migrations lists the document layout changes in order. Append new
+// migrations to the end and never change a released one. Version 1 is the
+// layout Init created before versioning was introduced and needs no changes.
+// Fields added to a document decode to their zero value, which keeps the
+// former behaviour, so only new collections need a migration.
+var migrations = []migration{
+	{version: 1, description: "initial layout", up: func(o *JsonDB) error { return nil }},
+	{version: 2, description: "store wrapped data encryption keys", up: createCollection("datakeys")},
+	{version: 3, description: "record configuration changes in an audit log", up: createCollection("audit")},
+	{version: 4, description: "reserve addresses for IP address management", up: createCollection("ip_reservations")},
+	{version: 5, description: "manage subnet ranges in the database", up: createCollection("subnet_ranges")},
+	{version: 6, description: "keep the revisions of the server config file", up: createCollection("config_revisions")},
+	{version: 7, description: "manage further WireGuard interfaces", up: createCollection("wireguard_interfaces")},
+	{version: 8, description: "run WireGuard interfaces on remote nodes", up: createCollection("nodes")},
+}
+
+// createCollection returns a migration that creates the directory of a
+// collection readable only by the owner. Several collections hold keys, and
+// the driver would create a missing directory readable by everyone on the
+// first write. The mode of an existing directory is tightened as well.
+func createCollection(name string) func(o *JsonDB) error {
+	return func(o *JsonDB) error {
+		dir := path.Join(o.dbPath, name)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		return os.Chmod(dir, 0700)
+	}
+}
+
+// latestSchemaVersion returns the highest version in migrations.
+func latestSchemaVersion() int {
+	latest := 0
+	for _, m := range migrations {
+		if m.version > latest {
+			latest = m.version
+		}
+	}
+	return latest
+}
+
+// readSchemaVersion returns the recorded schema version, or 0 for a database
+// that has not been migrated yet.
+func (o *JsonDB) readSchemaVersion() (int, error) {
+	var v schemaVersion
+	if err := o.conn.Read("server", "schema", &v); err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("cannot read schema version: %v", err)
+	}
+	return v.Version, nil
+}
+
+// checkSchemaVersion returns store.ErrSchemaTooNew if the database has been
+// upgraded by a newer version of wireguard-manager.
+func (o *JsonDB) checkSchemaVersion() (int, error) {
+	current, err := o.readSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	if latest := latestSchemaVersion(); current > latest {
+		return current, fmt.Errorf("%w: database is at version %d, this build supports up to %d", store.ErrSchemaTooNew, current, latest)
+	}
+	return current, nil
+}
+
+// migrate runs all migrations newer than current in order and records each
+// applied version, so an interrupted upgrade resumes where it stopped.
+func (o *JsonDB) migrate(current int) error {
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.up(o); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+		if err := o.write("server", "schema", schemaVersion{Version: m.version, UpdatedAt: time.Now().UTC()}); err != nil {
+			return fmt.Errorf("failed to record migration %d: %v", m.version, err)
+		}
+		if err := util.ManagePerms(path.Join(o.dbPath, "server", "schema.json")); err != nil {
+			return err
+		}
+
+		log.Infof("Applied database migration %d: %s", m.version, m.description)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package jsondb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// newTestDB creates an initialized JSON store in a temporary directory.
+func newTestDB(t *testing.T) *JsonDB {
+	t.Helper()
+	return openTestDB(t, t.TempDir())
+}
+
+// openTestDB opens and initializes the JSON store in dir.
+func openTestDB(t *testing.T, dir string) *JsonDB {
+	t.Helper()
+
+	// Avoid the public IP lookup during default data seeding
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordEnvVar, "test-password")
+
+	db, err := New(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	return db
+}
+
+// TestMigrations verifies that Init brings a database without a recorded
+// version to the latest one and creates the collections readable only by the
+// owner, tightening one created by an older version.
+func TestMigrations(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "config_revisions"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, dir)
+
+	version, err := db.readSchemaVersion()
+	if err != nil || version != latestSchemaVersion() {
+		t.Fatalf("Schema version = %d (%v), want %d", version, err, latestSchemaVersion())
+	}
+	for _, name := range []string{"datakeys", "audit", "ip_reservations", "subnet_ranges", "config_revisions", "wireguard_interfaces", "nodes"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Collection %s was not created: %v", name, err)
+			continue
+		}
+		if mode := info.Mode().Perm(); mode != 0700 {
+			t.Errorf("Collection %s has mode %o, want 700", name, mode)
+		}
+	}
+
+	// A second Init finds nothing to do
+	if err := db.Init(); err != nil {
+		t.Fatalf("Init of a migrated database failed: %v", err)
+	}
+}
+
+// TestMigrateResumes verifies that migrations run in order from the recorded
+// version and that a failed one is retried without running the earlier ones
+// again.
+func TestMigrateResumes(t *testing.T) {
+	db := newTestDB(t)
+
+	var applied []int
+	record := func(version int) func(o *JsonDB) error {
+		return func(*JsonDB) error {
+			applied = append(applied, version)
+			return nil
+		}
+	}
+	errFull := errors.New("disk full")
+	failing := true
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	migrations = []migration{
+		{version: 1, description: "initial layout", up: record(1)},
+		{version: 2, description: "second", up: record(2)},
+		{version: 3, description: "third", up: func(o *JsonDB) error {
+			if failing {
+				return errFull
+			}
+			return record(3)(o)
+		}},
+		{version: 4, description: "fourth", up: record(4)},
+	}
+
+	if err := db.write("server", "schema", schemaVersion{Version: 1, UpdatedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.migrate(1); err == nil {
+		t.Fatal("migrate succeeded with a failing migration")
+	}
+	if version, _ := db.readSchemaVersion(); version != 2 {
+		t.Fatalf("Schema version after the failure = %d, want 2", version)
+	}
+
+	failing = false
+	current, err := db.checkSchemaVersion()
+	if err != nil {
+		t.Fatalf("checkSchemaVersion failed: %v", err)
+	}
+	if err := db.migrate(current); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if want := []int{2, 3, 4}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("Applied migrations = %v, want %v", applied, want)
+	}
+	if version, _ := db.readSchemaVersion(); version != 4 {
+		t.Errorf("Schema version = %d, want 4", version)
+	}
+}
+
+// TestSchemaTooNew verifies that Init refuses a database migrated by a newer version.
+func TestSchemaTooNew(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.write("server", "schema", schemaVersion{Version: latestSchemaVersion() + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); !errors.Is(err, store.ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+}
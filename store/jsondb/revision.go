@@ -0,0 +1,29 @@
+package jsondb
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// nextRevision implements the compare-and-swap check for revisioned documents.
+// It returns the revision to store for a document that was read at revision
+// given, or ErrRevisionConflict if the stored document has changed since. A
+// document that does not exist yet accepts any revision. The caller must hold
+// the write lock until the document has been written.
+func (o *JsonDB) nextRevision(collection, resource string, given int64) (int64, error) {
+	var current struct {
+		Revision int64 `json:"revision"`
+	}
+	if err := o.conn.Read(collection, resource, &current); err != nil {
+		if os.IsNotExist(err) {
+			return given + 1, nil
+		}
+		return 0, err
+	}
+	if current.Revision != given {
+		return 0, fmt.Errorf("%s/%s: %w", collection, resource, store.ErrRevisionConflict)
+	}
+	return given + 1, nil
+}
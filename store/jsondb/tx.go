@@ -0,0 +1,119 @@
+package jsondb
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// journal remembers the original content of every document written inside a
+// transaction, so that the writes can be undone on rollback.
+type journal struct {
+	originals map[string][]byte // file path -> original content, nil if the file did not exist
+}
+
+// WithTx runs fn with a store that journals every write. If fn returns an
+// error or panics, all documents it wrote or deleted are restored to their
+// previous content. A transaction holds the write lock until it ends, so
+// writes outside of it wait instead of being undone by its rollback. Nested
+// calls join the outer transaction.
+func (o *JsonDB) WithTx(fn func(tx store.IStore) error) error {
+	if o.journal != nil {
+		return fn(o)
+	}
+
+	o.txMu.Lock()
+	defer o.txMu.Unlock()
+
+	txStore := *o
+	txStore.journal = &journal{originals: make(map[string][]byte)}
+	defer func() {
+		if p := recover(); p != nil {
+			txStore.journal.rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(&txStore); err != nil {
+		if rerr := txStore.journal.rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	return nil
+}
+
+// lock takes the write lock for a single write, or a read and the write
+// depending on it. It returns the store to use until the returned function
+// releases the lock. A transaction and a store that holds the lock already
+// are returned as they are.
+func (o *JsonDB) lock() (*JsonDB, func()) {
+	if o.journal != nil || o.locked {
+		return o, func() {}
+	}
+	o.txMu.Lock()
+	locked := *o
+	locked.locked = true
+	return &locked, o.txMu.Unlock
+}
+
+// record saves the current content of a document before it is first changed
+// inside a transaction.
+func (o *JsonDB) record(collection, resource string) error {
+	if o.journal == nil {
+		return nil
+	}
+
+	file := filepath.Join(o.dbPath, collection, resource+".json")
+	if _, seen := o.journal.originals[file]; seen {
+		return nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	o.journal.originals[file] = content
+	return nil
+}
+
+// write stores a document, journaling it when inside a transaction.
+func (o *JsonDB) write(collection, resource string, v interface{}) error {
+	o, unlock := o.lock()
+	defer unlock()
+	if err := o.record(collection, resource); err != nil {
+		return err
+	}
+	return o.conn.Write(collection, resource, v)
+}
+
+// delete removes a document, journaling it when inside a transaction.
+func (o *JsonDB) delete(collection, resource string) error {
+	o, unlock := o.lock()
+	defer unlock()
+	if err := o.record(collection, resource); err != nil {
+		return err
+	}
+	return o.conn.Delete(collection, resource)
+}
+
+// rollback restores every journaled document to its original content.
+func (j *journal) rollback() error {
+	var firstErr error
+	for file, content := range j.originals {
+		var err error
+		if content == nil {
+			err = os.Remove(file)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = os.WriteFile(file, content, 0600)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
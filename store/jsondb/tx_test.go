@@ -0,0 +1,98 @@
+package jsondb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// TestWithTxRollback verifies that a transaction failing halfway restores the
+// documents it changed, created and deleted.
+func TestWithTxRollback(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, client := range []model.Client{
+		{ID: "changed", Name: "laptop", AllocatedIPs: []string{"10.8.0.2/32"}},
+		{ID: "deleted", Name: "phone", AllocatedIPs: []string{"10.8.0.3/32"}},
+	} {
+		if err := db.SaveClient(client); err != nil {
+			t.Fatalf("SaveClient failed: %v", err)
+		}
+	}
+
+	errAbort := errors.New("abort")
+	err := db.WithTx(func(tx store.IStore) error {
+		changed := model.Client{ID: "changed", Name: "renamed", AllocatedIPs: []string{"10.8.0.9/32"}, Revision: 1}
+		if err := tx.SaveClient(changed); err != nil {
+			return err
+		}
+		if err := tx.SaveClient(model.Client{ID: "created", Name: "tablet"}); err != nil {
+			return err
+		}
+		if err := tx.DeleteClient("deleted"); err != nil {
+			return err
+		}
+		// A second write of a document keeps its original for the rollback
+		changed.Name, changed.Revision = "renamed again", 2
+		if err := tx.SaveClient(changed); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("WithTx = %v, want the callback error", err)
+	}
+
+	changed, err := db.GetClientByID("changed", model.QRCodeSettings{})
+	if err != nil {
+		t.Fatalf("GetClientByID failed: %v", err)
+	}
+	if changed.Client.Name != "laptop" || changed.Client.AllocatedIPs[0] != "10.8.0.2/32" || changed.Client.Revision != 1 {
+		t.Errorf("Changed client after the rollback = %+v, want the original", changed.Client)
+	}
+	if _, err := db.GetClientByID("created", model.QRCodeSettings{}); err == nil {
+		t.Error("The created client was not removed by the rollback")
+	}
+	if deleted, err := db.GetClientByID("deleted", model.QRCodeSettings{}); err != nil || deleted.Client.Name != "phone" {
+		t.Errorf("Deleted client after the rollback = %+v, %v, want it restored", deleted.Client, err)
+	}
+}
+
+// TestWithTxBlocksWrites verifies that a write outside of a transaction waits
+// for it to end and is not undone by its rollback.
+func TestWithTxBlocksWrites(t *testing.T) {
+	db := newTestDB(t)
+
+	done := make(chan error, 1)
+	errAbort := errors.New("abort")
+	err := db.WithTx(func(tx store.IStore) error {
+		if err := tx.SaveClient(model.Client{ID: "inside", Name: "laptop"}); err != nil {
+			return err
+		}
+		go func() {
+			done <- db.SaveClient(model.Client{ID: "outside", Name: "phone"})
+		}()
+		select {
+		case <-done:
+			t.Error("A write outside of the transaction did not wait for it")
+		case <-time.After(100 * time.Millisecond):
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("WithTx = %v, want the callback error", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("SaveClient outside of the transaction failed: %v", err)
+	}
+	if _, err := db.GetClientByID("outside", model.QRCodeSettings{}); err != nil {
+		t.Errorf("The write outside of the transaction was lost: %v", err)
+	}
+	if _, err := db.GetClientByID("inside", model.QRCodeSettings{}); err == nil {
+		t.Error("The write inside of the transaction was not rolled back")
+	}
+}
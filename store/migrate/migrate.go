@@ -0,0 +1,501 @@
+// Package migrate copies the contents of one store.IStore into another, for
+// example to move an installation from the JSON database to MySQL.
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// Options control how Run copies the data.
+type Options struct {
+	// DryRun only reads both stores and reports what would be copied.
+	DryRun bool
+	// Force allows copying into a destination that already contains clients or API keys.
+	Force bool
+}
+
+// CollectionReport describes one copied collection.
+type CollectionReport struct {
+	Name              string
+	SourceCount       int
+	DestinationCount  int
+	SourceHash        string
+	DestinationHash   string
+	DestinationFailed bool // The destination could not be read (e.g. not initialized yet).
+}
+
+// Matches reports whether source and destination hold the same records.
+func (c CollectionReport) Matches() bool {
+	return !c.DestinationFailed && c.SourceCount == c.DestinationCount && c.SourceHash == c.DestinationHash
+}
+
+// Report is the result of a migration run.
+type Report struct {
+	DryRun      bool
+	Collections []CollectionReport
+}
+
+// Verified reports whether every collection matches between source and destination.
+func (r Report) Verified() bool {
+	for _, c := range r.Collections {
+		if !c.Matches() {
+			return false
+		}
+	}
+	return true
+}
+
+// Write prints the report as a table.
+func (r Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tSOURCE\tDESTINATION\tSTATUS")
+	for _, c := range r.Collections {
+		dst := fmt.Sprint(c.DestinationCount)
+		if c.DestinationFailed {
+			dst = "-"
+		}
+
+		var status string
+		switch {
+		case r.DryRun:
+			status = fmt.Sprintf("would copy %d", c.SourceCount)
+		case c.DestinationFailed:
+			status = "MISMATCH (unreadable)"
+		case c.SourceCount != c.DestinationCount:
+			status = "MISMATCH (count)"
+		case c.SourceHash != c.DestinationHash:
+			status = "MISMATCH (hash)"
+		default:
+			status = "ok " + c.SourceHash[:12]
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", c.Name, c.SourceCount, dst, status)
+	}
+	return tw.Flush()
+}
+
+// snapshot holds every collection that is migrated.
+type snapshot struct {
+	users      []model.User
+	server     model.Server
+	settings   model.GlobalSetting
+	hashes     model.ClientServerHashes
+	nodes      []model.Node
+	interfaces []model.WireGuardInterface
+	clients    []model.Client
+	apiKeys    []model.APIKey
+	dataKeys   []model.DataKey
+	reserved   []model.IPReservation
+	ranges     []model.SubnetRange
+	security   model.SecuritySettings
+	ipBlocks   []model.IPBlock
+	geoIPRules []model.GeoIPRule
+	revisions  []model.ConfigRevision
+	audit      []model.AuditEntry
+}
+
+// load reads all migrated collections from db.
+func load(db store.IStore) (snapshot, error) {
+	var s snapshot
+	var err error
+
+	if s.users, err = db.GetUsers(); err != nil {
+		return s, fmt.Errorf("cannot read users: %v", err)
+	}
+	if s.server, err = db.GetServer(); err != nil {
+		return s, fmt.Errorf("cannot read server: %v", err)
+	}
+	if s.settings, err = db.GetGlobalSettings(); err != nil {
+		return s, fmt.Errorf("cannot read global settings: %v", err)
+	}
+	if s.hashes, err = db.GetHashes(); err != nil {
+		return s, fmt.Errorf("cannot read applied state: %v", err)
+	}
+	if s.nodes, err = db.GetNodes(); err != nil {
+		return s, fmt.Errorf("cannot read nodes: %v", err)
+	}
+	if s.interfaces, err = db.GetWireGuardInterfaces(); err != nil {
+		return s, fmt.Errorf("cannot read interfaces: %v", err)
+	}
+	clients, err := db.GetClients(false)
+	if err != nil {
+		return s, fmt.Errorf("cannot read clients: %v", err)
+	}
+	trashed, err := db.GetTrashedClients()
+	if err != nil {
+		return s, fmt.Errorf("cannot read trashed clients: %v", err)
+	}
+	for _, c := range append(clients, trashed...) {
+		s.clients = append(s.clients, *c.Client)
+	}
+	if s.apiKeys, err = db.GetAPIKeys(); err != nil {
+		return s, fmt.Errorf("cannot read API keys: %v", err)
+	}
+	if s.dataKeys, err = db.GetDataKeys(); err != nil {
+		return s, fmt.Errorf("cannot read data keys: %v", err)
+	}
+	if s.reserved, err = db.GetIPReservations(); err != nil {
+		return s, fmt.Errorf("cannot read IP reservations: %v", err)
+	}
+	if s.ranges, err = db.GetSubnetRanges(); err != nil {
+		return s, fmt.Errorf("cannot read subnet ranges: %v", err)
+	}
+	if s.security, err = db.GetSecuritySettings(); err != nil {
+		return s, fmt.Errorf("cannot read security settings: %v", err)
+	}
+	if s.ipBlocks, err = db.GetIPBlocks(); err != nil {
+		return s, fmt.Errorf("cannot read IP blocks: %v", err)
+	}
+	if s.geoIPRules, err = db.GetGeoIPRules(); err != nil {
+		return s, fmt.Errorf("cannot read GeoIP rules: %v", err)
+	}
+	if s.revisions, err = db.GetConfigRevisions(); err != nil {
+		return s, fmt.Errorf("cannot read config revisions: %v", err)
+	}
+	if s.audit, err = db.GetAuditEntries(model.AuditFilter{}); err != nil {
+		return s, fmt.Errorf("cannot read audit log: %v", err)
+	}
+	return s, nil
+}
+
+// Run copies users, server interface and keypair, global settings, the state of
+// the last apply, nodes, further WireGuard interfaces, clients including trashed
+// ones, API keys, data keys, security settings, IP blocks, GeoIP rules, config
+// revisions and the audit log from src to dst and verifies the result.
+// Encrypted secrets are copied as they are, together with the wrapped data keys
+// needed to read them. The destination must already be initialized.
+func Run(src, dst store.IStore, opts Options) (Report, error) {
+	report := Report{DryRun: opts.DryRun}
+
+	source, err := load(src)
+	if err != nil {
+		return report, fmt.Errorf("source: %v", err)
+	}
+
+	if opts.DryRun {
+		destination, err := load(dst)
+		report.Collections = compare(source, destination, err != nil)
+		return report, nil
+	}
+
+	if !opts.Force {
+		if clients, _ := dst.GetClients(false); len(clients) > 0 {
+			return report, fmt.Errorf("destination already contains %d clients (use -force to copy anyway)", len(clients))
+		}
+		if keys, _ := dst.GetAPIKeys(); len(keys) > 0 {
+			return report, fmt.Errorf("destination already contains %d API keys (use -force to copy anyway)", len(keys))
+		}
+	}
+
+	// Copy in one transaction, so a failure leaves the destination untouched
+	err = dst.WithTx(func(tx store.IStore) error {
+		return copySnapshot(source, tx)
+	})
+	if err != nil {
+		return report, err
+	}
+
+	destination, err := load(dst)
+	if err != nil {
+		return report, fmt.Errorf("destination: %v", err)
+	}
+	report.Collections = compare(source, destination, false)
+	return report, nil
+}
+
+// copySnapshot writes every record of s into dst.
+func copySnapshot(s snapshot, dst store.IStore) error {
+	// Remove users seeded by the destination's Init that do not exist in the source.
+	keep := make(map[string]bool)
+	for _, u := range s.users {
+		keep[u.Username] = true
+		if err := dst.SaveUser(u); err != nil {
+			return fmt.Errorf("cannot save user %s: %v", u.Username, err)
+		}
+	}
+	existing, err := dst.GetUsers()
+	if err != nil {
+		return fmt.Errorf("cannot read destination users: %v", err)
+	}
+	for _, u := range existing {
+		if !keep[u.Username] {
+			if err := dst.DeleteUser(u.Username); err != nil {
+				return fmt.Errorf("cannot delete user %s: %v", u.Username, err)
+			}
+		}
+	}
+
+	// Revisioned records are saved with a compare-and-swap, so every copy is
+	// based on the revision the destination currently holds
+	if s.server.Interface != nil {
+		serverInterface := *s.server.Interface
+		if current, err := dst.GetServer(); err == nil && current.Interface != nil {
+			serverInterface.Revision = current.Interface.Revision
+		}
+		if err := dst.SaveServerInterface(serverInterface); err != nil {
+			return fmt.Errorf("cannot save server interface: %v", err)
+		}
+	}
+	if s.server.KeyPair != nil {
+		if err := dst.SaveServerKeyPair(*s.server.KeyPair); err != nil {
+			return fmt.Errorf("cannot save server keypair: %v", err)
+		}
+	}
+	settings := s.settings
+	if current, err := dst.GetGlobalSettings(); err == nil {
+		settings.Revision = current.Revision
+	}
+	if err := dst.SaveGlobalSettings(settings); err != nil {
+		return fmt.Errorf("cannot save global settings: %v", err)
+	}
+	if err := dst.SaveHashes(s.hashes); err != nil {
+		return fmt.Errorf("cannot save applied state: %v", err)
+	}
+	for _, n := range s.nodes {
+		n.Revision = 0
+		if current, err := dst.GetNode(n.ID); err == nil {
+			n.Revision = current.Revision
+		}
+		if err := dst.SaveNode(n); err != nil {
+			return fmt.Errorf("cannot save node %s: %v", n.Name, err)
+		}
+	}
+	for _, i := range s.interfaces {
+		i.Revision = 0
+		if current, err := dst.GetWireGuardInterface(i.Name); err == nil {
+			i.Revision = current.Revision
+		}
+		if err := dst.SaveWireGuardInterface(i); err != nil {
+			return fmt.Errorf("cannot save interface %s: %v", i.Name, err)
+		}
+		// SaveWireGuardInterface keeps the applied state the destination holds
+		if i.Applied != nil && i.AppliedAt != nil {
+			if err := dst.SaveWireGuardInterfaceApplied(i.Name, *i.Applied, *i.AppliedAt); err != nil {
+				return fmt.Errorf("cannot save applied state of interface %s: %v", i.Name, err)
+			}
+		}
+	}
+	for _, c := range s.clients {
+		c.Revision = 0
+		if current, err := dst.GetClientByID(c.ID, model.QRCodeSettings{}); err == nil {
+			c.Revision = current.Client.Revision
+		}
+		if err := dst.SaveClient(c); err != nil {
+			return fmt.Errorf("cannot save client %s: %v", c.ID, err)
+		}
+	}
+	for _, k := range s.apiKeys {
+		if err := dst.SaveAPIKey(k); err != nil {
+			return fmt.Errorf("cannot save API key %s: %v", k.ID, err)
+		}
+	}
+	for _, k := range s.dataKeys {
+		if err := dst.SaveDataKey(k); err != nil {
+			return fmt.Errorf("cannot save data key %s: %v", k.ID, err)
+		}
+	}
+	for _, r := range s.reserved {
+		if err := dst.SaveIPReservation(r); err != nil {
+			return fmt.Errorf("cannot save IP reservation %s: %v", r.Address, err)
+		}
+	}
+	for _, r := range s.ranges {
+		if err := dst.SaveSubnetRange(r); err != nil {
+			return fmt.Errorf("cannot save subnet range %s: %v", r.Name, err)
+		}
+	}
+	security := s.security
+	if current, err := dst.GetSecuritySettings(); err == nil {
+		security.Revision = current.Revision
+	}
+	if err := dst.SaveSecuritySettings(security); err != nil {
+		return fmt.Errorf("cannot save security settings: %v", err)
+	}
+	for _, b := range s.ipBlocks {
+		if err := dst.SaveIPBlock(b); err != nil {
+			return fmt.Errorf("cannot save IP block %s: %v", b.IP, err)
+		}
+	}
+	for _, r := range s.geoIPRules {
+		if err := dst.SaveGeoIPRule(r); err != nil {
+			return fmt.Errorf("cannot save GeoIP rule %s: %v", r.CountryCode, err)
+		}
+	}
+	// Revisions keep their IDs, which rollbacks and the janitor refer to
+	for _, r := range s.revisions {
+		if err := dst.SaveConfigRevision(r); err != nil {
+			return fmt.Errorf("cannot save config revision %d: %v", r.ID, err)
+		}
+	}
+	// Audit entries are never changed, so the ones copied by an earlier run are kept
+	existingAudit, err := dst.GetAuditEntries(model.AuditFilter{})
+	if err != nil {
+		return fmt.Errorf("cannot read destination audit log: %v", err)
+	}
+	copied := make(map[string]bool, len(existingAudit))
+	for _, e := range existingAudit {
+		copied[e.ID] = true
+	}
+	for _, e := range s.audit {
+		if copied[e.ID] {
+			continue
+		}
+		if err := dst.SaveAuditEntry(e); err != nil {
+			return fmt.Errorf("cannot save audit entry %s: %v", e.ID, err)
+		}
+	}
+	return nil
+}
+
+// compare builds the per-collection report for source and destination.
+func compare(src, dst snapshot, dstFailed bool) []CollectionReport {
+	srcRecords := records(src)
+	dstRecords := records(dst)
+
+	var reports []CollectionReport
+	for _, name := range collectionOrder {
+		reports = append(reports, CollectionReport{
+			Name:              name,
+			SourceCount:       len(srcRecords[name]),
+			DestinationCount:  len(dstRecords[name]),
+			SourceHash:        hash(srcRecords[name]),
+			DestinationHash:   hash(dstRecords[name]),
+			DestinationFailed: dstFailed,
+		})
+	}
+	return reports
+}
+
+// collectionOrder is the order in which collections are reported.
+var collectionOrder = []string{
+	"users", "server_interface", "server_keypair", "global_settings", "applied_state",
+	"nodes", "wireguard_interfaces", "clients", "api_keys", "data_keys", "ip_reservations", "subnet_ranges", "security_settings", "ip_blocks", "geoip_rules", "config_revisions", "audit",
+}
+
+// records converts a snapshot into canonical, backend-independent records per
+// collection. Timestamps are compared in UTC with second precision because
+// not every backend keeps sub-second precision or time zones, and the
+// "updated at" stamps of single-row settings are set by the backend on save.
+func records(s snapshot) map[string][]string {
+	r := make(map[string][]string)
+
+	for _, u := range s.users {
+		r["users"] = append(r["users"], canonical(u.Username, u.PasswordHash, u.Admin))
+	}
+	if i := s.server.Interface; i != nil {
+		r["server_interface"] = []string{canonical(strs(i.Addresses), i.ListenPort, i.PostUp, i.PreDown, i.PostDown)}
+	}
+	if k := s.server.KeyPair; k != nil {
+		r["server_keypair"] = []string{canonical(k.PrivateKey, k.PublicKey)}
+	}
+	g := s.settings
+	r["global_settings"] = []string{canonical(g.EndpointAddress, strs(g.DNSServers), g.MTU, g.PersistentKeepalive, g.FirewallMark, g.Table, g.ConfigFilePath)}
+	// The primary interface keeps its applied state with the hashes
+	r["applied_state"] = []string{canonical("", s.hashes.Client, s.hashes.Server, s.hashes.Applied, tsPtr(s.hashes.AppliedAt))}
+	for _, i := range s.interfaces {
+		if i.Applied != nil {
+			r["applied_state"] = append(r["applied_state"], canonical(i.Name, "", "", i.Applied, tsPtr(i.AppliedAt)))
+		}
+	}
+	for _, n := range s.nodes {
+		r["nodes"] = append(r["nodes"], canonical(n.ID, n.Name, n.Description, n.URL, n.Token, n.CACert, ts(n.CreatedAt)))
+	}
+	for _, i := range s.interfaces {
+		r["wireguard_interfaces"] = append(r["wireguard_interfaces"], canonical(i.Name, i.Description, i.PrivateKey, i.PublicKey,
+			strs(i.Addresses), i.ListenPort, i.PostUp, i.PreDown, i.PostDown, i.MTU, strs(i.DNSServers), i.ConfigFilePath, i.Node, ts(i.CreatedAt)))
+	}
+	for _, c := range s.clients {
+		var deletedAt string
+		if c.DeletedAt != nil {
+			deletedAt = ts(*c.DeletedAt)
+		}
+		r["clients"] = append(r["clients"], canonical(c.ID, c.PrivateKey, c.PublicKey, c.PresharedKey, c.Name, c.Email, c.Group,
+			strs(c.SubnetRanges), strs(c.AllocatedIPs), strs(c.AllowedIPs), strs(c.ExtraAllowedIPs), c.Endpoint,
+			c.UseServerDNS, c.Enabled, ts(c.CreatedAt), deletedAt, c.DeletedBy, c.Interface))
+	}
+	for _, k := range s.apiKeys {
+		var lastUsed string
+		if k.LastUsedAt != nil {
+			lastUsed = ts(*k.LastUsedAt)
+		}
+		r["api_keys"] = append(r["api_keys"], canonical(k.ID, k.Name, k.Key, k.KeyPrefix, strs(k.Permissions), k.Enabled, ts(k.CreatedAt), lastUsed))
+	}
+	for _, k := range s.dataKeys {
+		r["data_keys"] = append(r["data_keys"], canonical(k.ID, k.Provider, k.WrappedKey, ts(k.CreatedAt)))
+	}
+	for _, res := range s.reserved {
+		r["ip_reservations"] = append(r["ip_reservations"], canonical(res.ID, res.Address, res.Description, res.CreatedBy, ts(res.CreatedAt)))
+	}
+	for _, sr := range s.ranges {
+		r["subnet_ranges"] = append(r["subnet_ranges"], canonical(sr.ID, sr.Name, strs(sr.CIDRs), sr.Position, ts(sr.CreatedAt), ts(sr.UpdatedAt)))
+	}
+	sec := s.security
+	r["security_settings"] = []string{canonical(sec.BruteForceEnabled, sec.BruteForceMaxAttempts, sec.BruteForceWindowMinutes,
+		sec.BruteForceBlockMinutes, sec.IPBlockingEnabled, sec.GeoIPEnabled, sec.GeoIPDefaultAction)}
+	for _, b := range s.ipBlocks {
+		r["ip_blocks"] = append(r["ip_blocks"], canonical(b.ID, b.IP, b.Reason, b.BlockedBy, b.Permanent, ts(b.ExpiresAt), ts(b.CreatedAt)))
+	}
+	for _, g := range s.geoIPRules {
+		r["geoip_rules"] = append(r["geoip_rules"], canonical(g.ID, g.CountryCode, g.CountryName, g.Action, g.CreatedBy, ts(g.CreatedAt)))
+	}
+	for _, rev := range s.revisions {
+		r["config_revisions"] = append(r["config_revisions"], canonical(rev.ID, rev.Path, rev.Content, rev.Author, rev.Comment,
+			rev.Result, rev.Error, rev.RollbackOf, rev.RestoredID, ts(rev.CreatedAt)))
+	}
+
+	for _, e := range s.audit {
+		changes := e.Changes
+		if len(changes) == 0 {
+			changes = nil
+		}
+		r["audit"] = append(r["audit"], canonical(e.ID, e.Actor, e.Action, e.TargetType, e.TargetID, e.SourceIP, changes, ts(e.CreatedAt)))
+	}
+
+	for _, list := range r {
+		sort.Strings(list)
+	}
+	return r
+}
+
+// canonical encodes a record's fields as a JSON array.
+func canonical(fields ...interface{}) string {
+	b, _ := json.Marshal(fields)
+	return string(b)
+}
+
+// strs treats nil and empty slices the same.
+func strs(s []string) string {
+	return strings.Join(s, ",")
+}
+
+// ts normalizes a timestamp to UTC with second precision.
+func ts(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+// tsPtr is ts for optional timestamps.
+func tsPtr(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return ts(*t)
+}
+
+// hash returns the hex SHA-256 of a sorted list of records.
+func hash(records []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(records, "\n")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,216 @@
+package migrate
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/jsondb"
+	"github.com/swissmakers/wireguard-manager/store/sqlitedb"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// testPasswordHash is the bcrypt hash of "test-password" at the lowest cost
+const testPasswordHash = "$2a$04$fFGC0k1pJzCuITpsCULKGuyltBV0rE3iL5NjZaO7aw4YnjBCrRm22"
+
+// openStores returns an initialized JSON source and SQLite destination.
+func openStores(t *testing.T) (*jsondb.JsonDB, *sqlitedb.SQLiteDB) {
+	t.Helper()
+
+	// Avoid the public IP lookup and slow password hashing during default data seeding
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordHashEnvVar, testPasswordHash)
+
+	src, err := jsondb.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open source: %v", err)
+	}
+	dst, err := sqlitedb.New(filepath.Join(t.TempDir(), "wireguard-manager.db"))
+	if err != nil {
+		t.Fatalf("Failed to open destination: %v", err)
+	}
+	for _, db := range []store.IStore{src, dst} {
+		if err := db.Init(); err != nil {
+			t.Fatalf("Failed to initialize database: %v", err)
+		}
+	}
+	return src, dst
+}
+
+// seed adds records to the collections that start out empty.
+func seed(t *testing.T, db store.IStore) {
+	t.Helper()
+
+	now := time.Now().UTC()
+	deletedAt := now.Add(-time.Hour)
+	if err := db.SaveUser(model.User{Username: "operator", PasswordHash: testPasswordHash}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveNode(model.Node{ID: "gw1", Name: "gw1", URL: "https://gw1.example.com:5001", Token: "secret", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveWireGuardInterface(model.WireGuardInterface{Name: "wg1", Addresses: []string{"10.9.0.1/24"},
+		ListenPort: 51821, ConfigFilePath: "/etc/wireguard/wg1.conf", Node: "gw1", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	applied := model.ConfigState{Interface: model.InterfaceState{Addresses: []string{"10.9.0.1/24"}, ListenPort: 51821, PublicKey: "spk"},
+		Peers: []model.PeerState{{ID: "tablet", Name: "tablet", PublicKey: "pk2", AllowedIPs: []string{"10.9.0.2/32"}}}}
+	if err := db.SaveWireGuardInterfaceApplied("wg1", applied, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveHashes(model.ClientServerHashes{Client: "ch", Server: "sh", Applied: &applied, AppliedAt: &now}); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []model.Client{
+		{ID: "laptop", Name: "laptop", PublicKey: "pk1", AllocatedIPs: []string{"10.252.1.2/32"}, AllowedIPs: []string{"0.0.0.0/0"}, Enabled: true, CreatedAt: now},
+		{ID: "tablet", Name: "tablet", PublicKey: "pk2", AllocatedIPs: []string{"10.9.0.2/32"}, Interface: "wg1", CreatedAt: now},
+		{ID: "phone", Name: "phone", PublicKey: "pk3", AllocatedIPs: []string{"10.252.1.3/32"}, CreatedAt: now, DeletedAt: &deletedAt, DeletedBy: "admin"},
+	} {
+		if err := db.SaveClient(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SaveAPIKey(model.APIKey{ID: "key1", Name: "ci", Key: "hash", KeyPrefix: "wgm_abc", Permissions: []string{"clients:read"}, Enabled: true, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveIPReservation(model.IPReservation{ID: "r1", Address: "10.252.1.10", Description: "printer", CreatedBy: "admin", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveIPBlock(model.IPBlock{ID: "b1", IP: "192.0.2.1", Reason: "brute force", BlockedBy: "system", ExpiresAt: now.Add(time.Hour), CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveAuditEntry(model.AuditEntry{ID: "a1", Actor: "admin", Action: "update", TargetType: "client", TargetID: "laptop",
+		SourceIP: "192.0.2.10", Changes: map[string]model.AuditChange{"name": {Before: "old", After: "laptop"}}, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddConfigRevision(model.ConfigRevision{Path: "/etc/wireguard/wg1.conf", Content: "[Interface]\nListenPort = 51821\n",
+		Author: "admin", Comment: "first", Result: model.RevisionApplied, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveGeoIPRule(model.GeoIPRule{ID: "g1", CountryCode: "XX", CountryName: "Nowhere", Action: "block", CreatedBy: "admin", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// collection returns the report of the named collection.
+func collection(t *testing.T, report Report, name string) CollectionReport {
+	t.Helper()
+	for _, c := range report.Collections {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("The report has no collection %s", name)
+	return CollectionReport{}
+}
+
+// TestRunJSONToSQLite copies a JSON store into SQLite and verifies that every
+// collection arrives with the same records.
+func TestRunJSONToSQLite(t *testing.T) {
+	src, dst := openStores(t)
+	seed(t, src)
+
+	report, err := Run(src, dst, Options{})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !report.Verified() {
+		for _, c := range report.Collections {
+			if !c.Matches() {
+				t.Errorf("Collection %s differs: %+v", c.Name, c)
+			}
+		}
+		t.FailNow()
+	}
+	if len(report.Collections) != len(collectionOrder) {
+		t.Errorf("The report has %d collections, want %d", len(report.Collections), len(collectionOrder))
+	}
+	for name, want := range map[string]int{
+		"users": 2, "nodes": 1, "wireguard_interfaces": 1, "clients": 3, "api_keys": 1,
+		"ip_reservations": 1, "ip_blocks": 1, "geoip_rules": 1, "server_keypair": 1, "audit": 1, "applied_state": 2, "config_revisions": 1,
+	} {
+		if c := collection(t, report, name); c.SourceCount != want || c.DestinationCount != want {
+			t.Errorf("Collection %s has %d source and %d destination records, want %d", name, c.SourceCount, c.DestinationCount, want)
+		}
+	}
+
+	trashed, err := dst.GetTrashedClients()
+	if err != nil || len(trashed) != 1 || trashed[0].Client.ID != "phone" {
+		t.Errorf("Trashed clients in the destination = %v, %v, want phone", trashed, err)
+	}
+
+	// A second copy needs -force, and with it leaves the destination verified
+	if _, err := Run(src, dst, Options{}); err == nil {
+		t.Error("Run copied into a destination that already holds clients")
+	}
+	report, err = Run(src, dst, Options{Force: true})
+	if err != nil || !report.Verified() {
+		t.Errorf("Forced Run = verified %v, %v", report.Verified(), err)
+	}
+}
+
+// TestRunDryRun verifies that a dry run reports what would be copied, writes
+// nothing and detects records that differ.
+func TestRunDryRun(t *testing.T) {
+	src, dst := openStores(t)
+	seed(t, src)
+
+	report, err := Run(src, dst, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if !report.DryRun || report.Verified() {
+		t.Errorf("Dry run report = dry run %v, verified %v, want a dry run that does not match", report.DryRun, report.Verified())
+	}
+	if c := collection(t, report, "clients"); c.SourceCount != 3 || c.DestinationCount != 0 {
+		t.Errorf("Dry run clients = %d source and %d destination records, want 3 and 0", c.SourceCount, c.DestinationCount)
+	}
+	if clients, _ := dst.GetClients(false); len(clients) != 0 {
+		t.Errorf("The dry run wrote %d clients", len(clients))
+	}
+
+	if _, err := Run(src, dst, Options{}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// A changed record keeps the counts but not the hash
+	client, err := dst.GetClientByID("laptop", model.QRCodeSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Client.Name = "renamed"
+	if err := dst.SaveClient(*client.Client); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Run(src, dst, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	c := collection(t, report, "clients")
+	if c.Matches() || c.SourceCount != c.DestinationCount || c.SourceHash == c.DestinationHash {
+		t.Errorf("Clients after a change = %+v, want equal counts and different hashes", c)
+	}
+	if !collection(t, report, "api_keys").Matches() {
+		t.Error("Unchanged API keys do not match")
+	}
+}
+
+// TestRunUninitializedDestination verifies that a dry run against a
+// destination without tables reports it as unreadable.
+func TestRunUninitializedDestination(t *testing.T) {
+	src, _ := openStores(t)
+	dst, err := sqlitedb.New(filepath.Join(t.TempDir(), "empty.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Run(src, dst, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if c := collection(t, report, "users"); !c.DestinationFailed || c.SourceCount != 1 {
+		t.Errorf("Users = %+v, want an unreadable destination", c)
+	}
+}
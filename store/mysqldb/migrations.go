@@ -0,0 +1,205 @@
+package mysqldb
+
+import (
+	"database/sql"
+
+	"github.com/swissmakers/wireguard-manager/store/schema"
+)
+
+// migrations lists the schema changes of the MySQL backend in order.
+// Append new migrations to the end and never change a released one.
+var migrations = []schema.Migration{
+	{Version: 1, Description: "initial schema", Up: createTables},
+	{Version: 2, Description: "store API key prefix and last use", Up: addAPIKeyUsageColumns},
+	{Version: 3, Description: "add revisions for optimistic locking", Up: addRevisionColumns},
+	{Version: 4, Description: "store wrapped data encryption keys", Up: createDataKeysTable},
+	{Version: 5, Description: "add trash state to clients", Up: addClientTrashColumns},
+	{Version: 6, Description: "record configuration changes in an audit log", Up: createAuditLogTable},
+	{Version: 7, Description: "reserve addresses for IP address management", Up: createIPReservationsTable},
+	{Version: 8, Description: "manage subnet ranges in the database", Up: createSubnetRangesTable},
+	{Version: 9, Description: "mark clients whose configuration is outdated", Up: addClientConfigOutdatedColumn},
+	{Version: 10, Description: "store the configuration state of the last apply", Up: addAppliedStateColumns},
+	{Version: 11, Description: "keep the revisions of the server config file", Up: createConfigRevisionsTable},
+	{Version: 12, Description: "manage further WireGuard interfaces", Up: createWireGuardInterfacesTable},
+	{Version: 13, Description: "run WireGuard interfaces on remote nodes", Up: createNodesTable},
+}
+
+// addAPIKeyUsageColumns adds the columns for model.APIKey.KeyPrefix and LastUsedAt.
+func addAPIKeyUsageColumns(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE api_keys
+		ADD COLUMN key_prefix VARCHAR(16) NULL AFTER key_value,
+		ADD COLUMN last_used_at DATETIME NULL AFTER updated_at`)
+	return err
+}
+
+// addRevisionColumns adds the revision column to every table whose records are
+// saved with a compare-and-swap.
+func addRevisionColumns(tx *sql.Tx) error {
+	for _, table := range []string{"clients", "server_interface", "global_settings", "security_settings"} {
+		if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN revision BIGINT NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDataKeysTable adds the table for model.DataKey.
+func createDataKeysTable(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS data_keys (
+		id VARCHAR(255) PRIMARY KEY,
+		provider VARCHAR(64) NOT NULL,
+		wrapped_key TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`)
+	return err
+}
+
+// addClientTrashColumns adds the columns recording when and by whom a client
+// was moved to the trash.
+func addClientTrashColumns(tx *sql.Tx) error {
+	if _, err := tx.Exec("ALTER TABLE clients ADD COLUMN deleted_at DATETIME NULL"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("ALTER TABLE clients ADD COLUMN deleted_by VARCHAR(255) NULL")
+	return err
+}
+
+// createAuditLogTable adds the table for model.AuditEntry.
+func createAuditLogTable(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id VARCHAR(255) PRIMARY KEY,
+			actor VARCHAR(255) NOT NULL,
+			action VARCHAR(50) NOT NULL,
+			target_type VARCHAR(50) NOT NULL,
+			target_id VARCHAR(255) NOT NULL,
+			source_ip VARCHAR(45) NOT NULL,
+			changes LONGTEXT NOT NULL,
+			created_at DATETIME(6) NOT NULL
+		)`,
+		`CREATE INDEX idx_audit_log_created_at ON audit_log (created_at)`,
+		`CREATE INDEX idx_audit_log_target ON audit_log (target_type, target_id)`,
+		`CREATE INDEX idx_audit_log_actor ON audit_log (actor)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIPReservationsTable adds the table for model.IPReservation.
+func createIPReservationsTable(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS ip_reservations (
+		id VARCHAR(255) PRIMARY KEY,
+		address VARCHAR(64) NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		created_by VARCHAR(255) NOT NULL,
+		created_at DATETIME NOT NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`)
+	return err
+}
+
+// createSubnetRangesTable adds the table for model.SubnetRange.
+func createSubnetRangesTable(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS subnet_ranges (
+		id VARCHAR(255) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL UNIQUE,
+		cidrs TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`)
+	return err
+}
+
+// addClientConfigOutdatedColumn adds the column recording that a client needs
+// to download its configuration again.
+func addClientConfigOutdatedColumn(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE clients ADD COLUMN config_outdated BOOLEAN NOT NULL DEFAULT FALSE")
+	return err
+}
+
+// addAppliedStateColumns adds the columns holding the configuration state of
+// the last successful apply, from which pending changes are listed.
+func addAppliedStateColumns(tx *sql.Tx) error {
+	if _, err := tx.Exec("ALTER TABLE hashes ADD COLUMN applied_state TEXT NULL"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("ALTER TABLE hashes ADD COLUMN applied_at DATETIME NULL")
+	return err
+}
+
+// createConfigRevisionsTable adds the table for model.ConfigRevision.
+func createConfigRevisionsTable(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS config_revisions (
+		id INT PRIMARY KEY,
+		path VARCHAR(4096) NOT NULL,
+		content MEDIUMTEXT NOT NULL,
+		author VARCHAR(255) NOT NULL,
+		comment TEXT NOT NULL,
+		result VARCHAR(16) NOT NULL,
+		error TEXT NOT NULL,
+		rollback_of INT NOT NULL DEFAULT 0,
+		restored_id INT NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`)
+	return err
+}
+
+// createWireGuardInterfacesTable adds the table for model.WireGuardInterface
+// and binds clients to an interface. Existing clients stay on the primary one.
+func createWireGuardInterfacesTable(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS wireguard_interfaces (
+			name VARCHAR(15) PRIMARY KEY,
+			description TEXT NOT NULL,
+			private_key TEXT NOT NULL,
+			public_key VARCHAR(255) NOT NULL,
+			addresses TEXT NOT NULL,
+			listen_port INT NOT NULL,
+			post_up TEXT NOT NULL,
+			pre_down TEXT NOT NULL,
+			post_down TEXT NOT NULL,
+			mtu INT NOT NULL DEFAULT 0,
+			dns_servers TEXT NOT NULL,
+			config_file_path VARCHAR(4096) NOT NULL,
+			applied_state MEDIUMTEXT NULL,
+			applied_at DATETIME NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			revision BIGINT NOT NULL DEFAULT 0
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+		"ALTER TABLE clients ADD COLUMN interface_name VARCHAR(15) NOT NULL DEFAULT '' AFTER config_outdated",
+		"CREATE INDEX idx_clients_interface_name ON clients (interface_name)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createNodesTable adds the table for model.Node and assigns interfaces to a
+// node. Existing interfaces stay on this host.
+func createNodesTable(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS nodes (
+			id VARCHAR(255) PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE,
+			description TEXT NOT NULL,
+			url VARCHAR(2048) NOT NULL,
+			token TEXT NOT NULL,
+			ca_cert TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			revision BIGINT NOT NULL DEFAULT 0
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+		"ALTER TABLE wireguard_interfaces ADD COLUMN node_id VARCHAR(255) NOT NULL DEFAULT '' AFTER config_file_path",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -15,11 +16,14 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
 	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/schema"
 	"github.com/swissmakers/wireguard-manager/util"
 )
 
 type MySQLDB struct {
-	conn *sql.DB
+	conn querier // the pool, or the transaction inside WithTx
+	db   *sql.DB
 	dsn  string
 }
 
@@ -42,14 +46,15 @@ func New(dsn string) (*MySQLDB, error) {
 
 	ans := MySQLDB{
 		conn: db,
+		db:   db,
 		dsn:  dsn,
 	}
 	return &ans, nil
 }
 
 func (o *MySQLDB) Init() error {
-	// Create tables if they don't exist
-	if err := o.createTables(); err != nil {
+	// Bring the schema up to date, refusing databases from newer versions
+	if err := schema.Apply(o.db, migrations); err != nil {
 		return err
 	}
 
@@ -61,7 +66,9 @@ func (o *MySQLDB) Init() error {
 	return nil
 }
 
-func (o *MySQLDB) createTables() error {
+// createTables creates the initial schema (migration 1). Tables that already
+// exist from before schema versioning was introduced are left untouched.
+func createTables(tx *sql.Tx) error {
 	queries := []string{
 		// Users table
 		`CREATE TABLE IF NOT EXISTS users (
@@ -224,7 +231,7 @@ func (o *MySQLDB) createTables() error {
 	}
 
 	for _, query := range queries {
-		if _, err := o.conn.Exec(query); err != nil {
+		if _, err := tx.Exec(query); err != nil {
 			return fmt.Errorf("failed to create table: %v", err)
 		}
 	}
@@ -493,11 +500,11 @@ func (o *MySQLDB) GetGlobalSettings() (model.GlobalSetting, error) {
 
 	err := o.conn.QueryRow(
 		`SELECT endpoint_address, dns_servers, mtu, persistent_keepalive, 
-		 firewall_mark, table_name, config_file_path, updated_at 
+		 firewall_mark, table_name, config_file_path, updated_at, revision 
 		 FROM global_settings WHERE id = 1`,
 	).Scan(
 		&settings.EndpointAddress, &dnsJSON, &settings.MTU, &settings.PersistentKeepalive,
-		&settings.FirewallMark, &settings.Table, &settings.ConfigFilePath, &settings.UpdatedAt,
+		&settings.FirewallMark, &settings.Table, &settings.ConfigFilePath, &settings.UpdatedAt, &settings.Revision,
 	)
 
 	if err != nil {
@@ -520,8 +527,8 @@ func (o *MySQLDB) GetServer() (model.Server, error) {
 	var addressesJSON []byte
 
 	err := o.conn.QueryRow(
-		"SELECT addresses, listen_port, post_up, post_down, updated_at FROM server_interface WHERE id = 1",
-	).Scan(&addressesJSON, &serverInterface.ListenPort, &serverInterface.PostUp, &serverInterface.PostDown, &serverInterface.UpdatedAt)
+		"SELECT addresses, listen_port, post_up, post_down, updated_at, revision FROM server_interface WHERE id = 1",
+	).Scan(&addressesJSON, &serverInterface.ListenPort, &serverInterface.PostUp, &serverInterface.PostDown, &serverInterface.UpdatedAt, &serverInterface.Revision)
 
 	if err != nil {
 		return server, err
@@ -554,15 +561,25 @@ func (o *MySQLDB) SaveServerInterface(serverInterface model.ServerInterface) err
 	}
 
 	serverInterface.UpdatedAt = time.Now().UTC()
-	_, err = o.conn.Exec(
-		`INSERT INTO server_interface (id, addresses, listen_port, post_up, post_down, updated_at) 
-		 VALUES (?, ?, ?, ?, ?, ?)
-		 ON DUPLICATE KEY UPDATE addresses = ?, listen_port = ?, post_up = ?, post_down = ?, updated_at = ?`,
-		1, addressesJSON, serverInterface.ListenPort, serverInterface.PostUp, serverInterface.PostDown, serverInterface.UpdatedAt,
-		addressesJSON, serverInterface.ListenPort, serverInterface.PostUp, serverInterface.PostDown, serverInterface.UpdatedAt,
+	return o.compareAndSwap("server interface", "server_interface", "id", 1,
+		func() (sql.Result, error) {
+			return o.conn.Exec(
+				`UPDATE server_interface SET addresses = ?, listen_port = ?, post_up = ?, post_down = ?, updated_at = ?,
+				 revision = revision + 1 WHERE id = ? AND revision = ?`,
+				addressesJSON, serverInterface.ListenPort, serverInterface.PostUp, serverInterface.PostDown, serverInterface.UpdatedAt,
+				1, serverInterface.Revision,
+			)
+		},
+		func() error {
+			_, err := o.conn.Exec(
+				`INSERT INTO server_interface (id, addresses, listen_port, post_up, post_down, updated_at, revision) 
+				 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				1, addressesJSON, serverInterface.ListenPort, serverInterface.PostUp, serverInterface.PostDown, serverInterface.UpdatedAt,
+				serverInterface.Revision+1,
+			)
+			return err
+		},
 	)
-
-	return err
 }
 
 // SaveServerKeyPair saves server keypair
@@ -587,92 +604,257 @@ func (o *MySQLDB) SaveGlobalSettings(globalSettings model.GlobalSetting) error {
 	}
 
 	globalSettings.UpdatedAt = time.Now().UTC()
-	_, err = o.conn.Exec(
-		`INSERT INTO global_settings (id, endpoint_address, dns_servers, mtu, persistent_keepalive, 
-		 firewall_mark, table_name, config_file_path, updated_at) 
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		 ON DUPLICATE KEY UPDATE endpoint_address = ?, dns_servers = ?, mtu = ?, persistent_keepalive = ?, 
-		 firewall_mark = ?, table_name = ?, config_file_path = ?, updated_at = ?`,
-		1, globalSettings.EndpointAddress, dnsJSON, globalSettings.MTU, globalSettings.PersistentKeepalive,
-		globalSettings.FirewallMark, globalSettings.Table, globalSettings.ConfigFilePath, globalSettings.UpdatedAt,
-		globalSettings.EndpointAddress, dnsJSON, globalSettings.MTU, globalSettings.PersistentKeepalive,
-		globalSettings.FirewallMark, globalSettings.Table, globalSettings.ConfigFilePath, globalSettings.UpdatedAt,
+	return o.compareAndSwap("global settings", "global_settings", "id", 1,
+		func() (sql.Result, error) {
+			return o.conn.Exec(
+				`UPDATE global_settings SET endpoint_address = ?, dns_servers = ?, mtu = ?, persistent_keepalive = ?, 
+				 firewall_mark = ?, table_name = ?, config_file_path = ?, updated_at = ?,
+				 revision = revision + 1 WHERE id = ? AND revision = ?`,
+				globalSettings.EndpointAddress, dnsJSON, globalSettings.MTU, globalSettings.PersistentKeepalive,
+				globalSettings.FirewallMark, globalSettings.Table, globalSettings.ConfigFilePath, globalSettings.UpdatedAt,
+				1, globalSettings.Revision,
+			)
+		},
+		func() error {
+			_, err := o.conn.Exec(
+				`INSERT INTO global_settings (id, endpoint_address, dns_servers, mtu, persistent_keepalive, 
+				 firewall_mark, table_name, config_file_path, updated_at, revision) 
+				 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				1, globalSettings.EndpointAddress, dnsJSON, globalSettings.MTU, globalSettings.PersistentKeepalive,
+				globalSettings.FirewallMark, globalSettings.Table, globalSettings.ConfigFilePath, globalSettings.UpdatedAt,
+				globalSettings.Revision+1,
+			)
+			return err
+		},
 	)
+}
 
-	return err
+// compareAndSwap saves a revisioned record, identified by id in the key column
+// of table. update must only change the row if its stored revision matches; if
+// it changed nothing, the record is inserted when it does not exist yet, and
+// store.ErrRevisionConflict is returned when it does.
+func (o *MySQLDB) compareAndSwap(record, table, key string, id interface{}, update func() (sql.Result, error), insert func() error) error {
+	result, err := update()
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var count int
+	if err := o.conn.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+key+" = ?", id).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%s: %w", record, store.ErrRevisionConflict)
+	}
+	return insert()
 }
 
-// GetClients returns all clients from the database
-func (o *MySQLDB) GetClients(hasQRCode bool) ([]model.ClientData, error) {
-	var clients []model.ClientData
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
-	rows, err := o.conn.Query(`
-		SELECT id, private_key, public_key, preshared_key, name, email, group_name,
-		subnet_ranges, allocated_ips, allowed_ips, extra_allowed_ips, endpoint,
-		use_server_dns, enabled, created_at, updated_at
-		FROM clients
-	`)
+// clientColumns lists the columns read by scanClient, in order.
+const clientColumns = `id, private_key, public_key, preshared_key, name, email, group_name,
+	subnet_ranges, allocated_ips, allowed_ips, extra_allowed_ips, endpoint,
+	use_server_dns, enabled, created_at, updated_at, deleted_at, deleted_by, config_outdated, interface_name, revision`
+
+// scanClient reads a single client row selected with clientColumns.
+func scanClient(row rowScanner) (model.Client, error) {
+	client := model.Client{}
+	var subnetRangesJSON, allocatedIPsJSON, allowedIPsJSON, extraAllowedIPsJSON []byte
+	var privateKey, presharedKey, email, groupName, endpoint, deletedBy sql.NullString
+	var deletedAt sql.NullTime
+
+	err := row.Scan(
+		&client.ID, &privateKey, &client.PublicKey, &presharedKey, &client.Name,
+		&email, &groupName, &subnetRangesJSON, &allocatedIPsJSON, &allowedIPsJSON,
+		&extraAllowedIPsJSON, &endpoint, &client.UseServerDNS, &client.Enabled,
+		&client.CreatedAt, &client.UpdatedAt, &deletedAt, &deletedBy, &client.ConfigOutdated, &client.Interface, &client.Revision,
+	)
 	if err != nil {
-		return clients, err
+		return client, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		client := model.Client{}
-		var subnetRangesJSON, allocatedIPsJSON, allowedIPsJSON, extraAllowedIPsJSON []byte
-		var privateKey, presharedKey, email, groupName, endpoint sql.NullString
 
-		err := rows.Scan(
-			&client.ID, &privateKey, &client.PublicKey, &presharedKey, &client.Name,
-			&email, &groupName, &subnetRangesJSON, &allocatedIPsJSON, &allowedIPsJSON,
-			&extraAllowedIPsJSON, &endpoint, &client.UseServerDNS, &client.Enabled,
-			&client.CreatedAt, &client.UpdatedAt,
-		)
-		if err != nil {
-			return clients, err
-		}
+	client.PrivateKey = privateKey.String
+	client.PresharedKey = presharedKey.String
+	client.Email = email.String
+	client.Group = groupName.String
+	client.Endpoint = endpoint.String
+	client.DeletedBy = deletedBy.String
+	if deletedAt.Valid {
+		client.DeletedAt = &deletedAt.Time
+	}
 
-		if privateKey.Valid {
-			client.PrivateKey = privateKey.String
-		}
-		if presharedKey.Valid {
-			client.PresharedKey = presharedKey.String
+	if subnetRangesJSON != nil {
+		if err := json.Unmarshal(subnetRangesJSON, &client.SubnetRanges); err != nil {
+			return client, fmt.Errorf("failed to unmarshal subnet ranges: %v", err)
 		}
-		if email.Valid {
-			client.Email = email.String
+	}
+	if err := json.Unmarshal(allocatedIPsJSON, &client.AllocatedIPs); err != nil {
+		return client, fmt.Errorf("failed to unmarshal allocated IPs: %v", err)
+	}
+	if err := json.Unmarshal(allowedIPsJSON, &client.AllowedIPs); err != nil {
+		return client, fmt.Errorf("failed to unmarshal allowed IPs: %v", err)
+	}
+	if extraAllowedIPsJSON != nil {
+		if err := json.Unmarshal(extraAllowedIPsJSON, &client.ExtraAllowedIPs); err != nil {
+			return client, fmt.Errorf("failed to unmarshal extra allowed IPs: %v", err)
 		}
-		if groupName.Valid {
-			client.Group = groupName.String
+	}
+
+	return client, nil
+}
+
+// GetClients returns all clients from the database
+func (o *MySQLDB) GetClients(hasQRCode bool) ([]model.ClientData, error) {
+	return o.queryClients("WHERE deleted_at IS NULL", hasQRCode)
+}
+
+// GetTrashedClients returns the clients that were moved to the trash
+func (o *MySQLDB) GetTrashedClients() ([]model.ClientData, error) {
+	return o.queryClients("WHERE deleted_at IS NOT NULL", false)
+}
+
+// clientSortExprs maps the sort fields of model.ClientQuery to the expression
+// the clients are ordered by and the expression a cursor value is compared with.
+var clientSortExprs = map[string]struct{ column, value string }{
+	"name":       {"LOWER(name)", "LOWER(%s)"},
+	"email":      {"LOWER(COALESCE(email, ''))", "LOWER(%s)"},
+	"group":      {"LOWER(COALESCE(group_name, ''))", "LOWER(%s)"},
+	"created_at": {"created_at", "%s"},
+	"updated_at": {"updated_at", "%s"},
+}
+
+// likeEscaper escapes the LIKE wildcards in a search term, using ! as the
+// escape character.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// QueryClients returns one page of the active clients selected by query
+func (o *MySQLDB) QueryClients(query model.ClientQuery, hasQRCode bool) (model.ClientPage, error) {
+	if err := query.Validate(); err != nil {
+		return model.ClientPage{}, err
+	}
+	cursor, _ := query.DecodeCursor()
+
+	conditions := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "?"
+	}
+
+	if query.Search != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(query.Search)) + "%"
+		conditions = append(conditions, fmt.Sprintf(
+			"(LOWER(name) LIKE %s ESCAPE '!' OR LOWER(COALESCE(email, '')) LIKE %s ESCAPE '!' OR LOWER(COALESCE(group_name, '')) LIKE %s ESCAPE '!')",
+			arg(pattern), arg(pattern), arg(pattern)))
+	}
+	if query.Group != "" {
+		conditions = append(conditions, "group_name = "+arg(query.Group))
+	}
+	if query.Enabled != nil {
+		conditions = append(conditions, "enabled = "+arg(*query.Enabled))
+	}
+	if query.Interface != nil {
+		conditions = append(conditions, "interface_name = "+arg(*query.Interface))
+	}
+	for _, bound := range []struct {
+		column, op string
+		value      time.Time
+	}{
+		{"created_at", ">=", query.CreatedAfter},
+		{"created_at", "<", query.CreatedBefore},
+		{"updated_at", ">=", query.UpdatedAfter},
+		{"updated_at", "<", query.UpdatedBefore},
+	} {
+		if !bound.value.IsZero() {
+			conditions = append(conditions, fmt.Sprintf("%s %s %s", bound.column, bound.op, arg(bound.value)))
 		}
-		if endpoint.Valid {
-			client.Endpoint = endpoint.String
+	}
+
+	field, desc := query.SortField()
+	sort := clientSortExprs[field]
+	order, op := "ASC", ">"
+	if desc {
+		order, op = "DESC", "<"
+	}
+	if cursor.ID != "" {
+		var value interface{} = cursor.Value
+		if query.SortsByTime() {
+			value = query.CursorTime(cursor)
 		}
+		conditions = append(conditions, fmt.Sprintf("(%s %s %s OR (%s = %s AND id %s %s))",
+			sort.column, op, fmt.Sprintf(sort.value, arg(value)),
+			sort.column, fmt.Sprintf(sort.value, arg(value)), op, arg(cursor.ID)))
+	}
+
+	where := "WHERE " + strings.Join(conditions, " AND ") +
+		fmt.Sprintf(" ORDER BY %s %s, id %s", sort.column, order, order)
+	if query.Limit > 0 && len(query.Subnets) == 0 {
+		// One client more than requested tells whether there is a next page
+		where += fmt.Sprintf(" LIMIT %d", query.Limit+1)
+	}
 
-		if subnetRangesJSON != nil {
-			if err := json.Unmarshal(subnetRangesJSON, &client.SubnetRanges); err != nil {
-				return clients, fmt.Errorf("failed to unmarshal subnet ranges: %v", err)
+	clients, err := o.queryClients(where, false, args...)
+	if err != nil {
+		return model.ClientPage{}, err
+	}
+	page := query.Page(clients)
+
+	if hasQRCode {
+		ifaces, globalSettings, _ := util.ClientInterfaces(o)
+		for i, clientData := range page.Clients {
+			if clientData.Client.PrivateKey == "" {
+				continue
 			}
-		}
-		if err := json.Unmarshal(allocatedIPsJSON, &client.AllocatedIPs); err != nil {
-			return clients, fmt.Errorf("failed to unmarshal allocated IPs: %v", err)
-		}
-		if err := json.Unmarshal(allowedIPsJSON, &client.AllowedIPs); err != nil {
-			return clients, fmt.Errorf("failed to unmarshal allowed IPs: %v", err)
-		}
-		if extraAllowedIPsJSON != nil {
-			if err := json.Unmarshal(extraAllowedIPsJSON, &client.ExtraAllowedIPs); err != nil {
-				return clients, fmt.Errorf("failed to unmarshal extra allowed IPs: %v", err)
+			iface := ifaces[clientData.Client.Interface]
+			png, err := qrcode.Encode(util.BuildClientConfig(*clientData.Client, iface.Server(), iface.Settings(globalSettings)), qrcode.Medium, 256)
+			if err == nil {
+				page.Clients[i].QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
 			}
 		}
+	}
+	return page, nil
+}
+
+// queryClients returns the clients matching the given WHERE clause
+func (o *MySQLDB) queryClients(where string, hasQRCode bool, args ...interface{}) ([]model.ClientData, error) {
+	var clients []model.ClientData
+
+	// Load the server configuration before querying the clients, because a
+	// transaction cannot run another query while the rows are still open
+	var ifaces map[string]model.WireGuardInterface
+	var globalSettings model.GlobalSetting
+	if hasQRCode {
+		ifaces, globalSettings, _ = util.ClientInterfaces(o)
+	}
+
+	rows, err := o.conn.Query("SELECT "+clientColumns+" FROM clients "+where, args...)
+	if err != nil {
+		return clients, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		client, err := scanClient(rows)
+		if err != nil {
+			return clients, err
+		}
 
 		clientData := model.ClientData{Client: &client}
 
 		// Generate QR code if requested
 		if hasQRCode && client.PrivateKey != "" {
-			server, _ := o.GetServer()
-			globalSettings, _ := o.GetGlobalSettings()
-
-			png, err := qrcode.Encode(util.BuildClientConfig(client, server, globalSettings), qrcode.Medium, 256)
+			iface := ifaces[client.Interface]
+			png, err := qrcode.Encode(util.BuildClientConfig(client, iface.Server(), iface.Settings(globalSettings)), qrcode.Medium, 256)
 			if err == nil {
 				clientData.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
 			}
@@ -686,24 +868,9 @@ func (o *MySQLDB) GetClients(hasQRCode bool) ([]model.ClientData, error) {
 
 // GetClientByID returns a specific client by ID
 func (o *MySQLDB) GetClientByID(clientID string, qrCodeSettings model.QRCodeSettings) (model.ClientData, error) {
-	client := model.Client{}
 	clientData := model.ClientData{}
 
-	var subnetRangesJSON, allocatedIPsJSON, allowedIPsJSON, extraAllowedIPsJSON []byte
-	var privateKey, presharedKey, email, groupName, endpoint sql.NullString
-
-	err := o.conn.QueryRow(`
-		SELECT id, private_key, public_key, preshared_key, name, email, group_name,
-		subnet_ranges, allocated_ips, allowed_ips, extra_allowed_ips, endpoint,
-		use_server_dns, enabled, created_at, updated_at
-		FROM clients WHERE id = ?
-	`, clientID).Scan(
-		&client.ID, &privateKey, &client.PublicKey, &presharedKey, &client.Name,
-		&email, &groupName, &subnetRangesJSON, &allocatedIPsJSON, &allowedIPsJSON,
-		&extraAllowedIPsJSON, &endpoint, &client.UseServerDNS, &client.Enabled,
-		&client.CreatedAt, &client.UpdatedAt,
-	)
-
+	client, err := scanClient(o.conn.QueryRow("SELECT "+clientColumns+" FROM clients WHERE id = ?", clientID))
 	if err == sql.ErrNoRows {
 		return clientData, fmt.Errorf("client not found")
 	}
@@ -711,45 +878,11 @@ func (o *MySQLDB) GetClientByID(clientID string, qrCodeSettings model.QRCodeSett
 		return clientData, err
 	}
 
-	if privateKey.Valid {
-		client.PrivateKey = privateKey.String
-	}
-	if presharedKey.Valid {
-		client.PresharedKey = presharedKey.String
-	}
-	if email.Valid {
-		client.Email = email.String
-	}
-	if groupName.Valid {
-		client.Group = groupName.String
-	}
-	if endpoint.Valid {
-		client.Endpoint = endpoint.String
-	}
-
-	if subnetRangesJSON != nil {
-		if err := json.Unmarshal(subnetRangesJSON, &client.SubnetRanges); err != nil {
-			return clientData, fmt.Errorf("failed to unmarshal subnet ranges: %v", err)
-		}
-	}
-	if err := json.Unmarshal(allocatedIPsJSON, &client.AllocatedIPs); err != nil {
-		return clientData, fmt.Errorf("failed to unmarshal allocated IPs: %v", err)
-	}
-	if err := json.Unmarshal(allowedIPsJSON, &client.AllowedIPs); err != nil {
-		return clientData, fmt.Errorf("failed to unmarshal allowed IPs: %v", err)
-	}
-	if extraAllowedIPsJSON != nil {
-		if err := json.Unmarshal(extraAllowedIPsJSON, &client.ExtraAllowedIPs); err != nil {
-			return clientData, fmt.Errorf("failed to unmarshal extra allowed IPs: %v", err)
-		}
-	}
-
 	clientData.Client = &client
 
 	// Generate QR code if requested
 	if qrCodeSettings.Enabled && client.PrivateKey != "" {
-		server, _ := o.GetServer()
-		globalSettings, _ := o.GetGlobalSettings()
+		server, globalSettings, _ := util.ClientServer(o, client)
 
 		if !qrCodeSettings.IncludeDNS {
 			globalSettings.DNSServers = []string{}
@@ -797,26 +930,43 @@ func (o *MySQLDB) SaveClient(client model.Client) error {
 	if client.Endpoint != "" {
 		endpoint = client.Endpoint
 	}
-
-	_, err = o.conn.Exec(`
-		INSERT INTO clients (id, private_key, public_key, preshared_key, name, email, group_name,
-		subnet_ranges, allocated_ips, allowed_ips, extra_allowed_ips, endpoint,
-		use_server_dns, enabled, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE
-		private_key = ?, public_key = ?, preshared_key = ?, name = ?, email = ?, group_name = ?,
-		subnet_ranges = ?, allocated_ips = ?, allowed_ips = ?, extra_allowed_ips = ?, endpoint = ?,
-		use_server_dns = ?, enabled = ?, updated_at = ?
-	`,
-		client.ID, privateKey, client.PublicKey, presharedKey, client.Name, email, groupName,
-		subnetRangesJSON, allocatedIPsJSON, allowedIPsJSON, extraAllowedIPsJSON, endpoint,
-		client.UseServerDNS, client.Enabled, client.CreatedAt, client.UpdatedAt,
-		privateKey, client.PublicKey, presharedKey, client.Name, email, groupName,
-		subnetRangesJSON, allocatedIPsJSON, allowedIPsJSON, extraAllowedIPsJSON, endpoint,
-		client.UseServerDNS, client.Enabled, time.Now().UTC(),
+	var deletedAt, deletedBy interface{}
+	if client.DeletedAt != nil {
+		deletedAt = client.DeletedAt.UTC()
+		deletedBy = client.DeletedBy
+	}
+
+	return o.compareAndSwap("client "+client.ID, "clients", "id", client.ID,
+		func() (sql.Result, error) {
+			return o.conn.Exec(`
+				UPDATE clients SET
+				private_key = ?, public_key = ?, preshared_key = ?, name = ?, email = ?, group_name = ?,
+				subnet_ranges = ?, allocated_ips = ?, allowed_ips = ?, extra_allowed_ips = ?, endpoint = ?,
+				use_server_dns = ?, enabled = ?, updated_at = ?, deleted_at = ?, deleted_by = ?, config_outdated = ?,
+				interface_name = ?, revision = revision + 1
+				WHERE id = ? AND revision = ?
+			`,
+				privateKey, client.PublicKey, presharedKey, client.Name, email, groupName,
+				subnetRangesJSON, allocatedIPsJSON, allowedIPsJSON, extraAllowedIPsJSON, endpoint,
+				client.UseServerDNS, client.Enabled, time.Now().UTC(), deletedAt, deletedBy, client.ConfigOutdated,
+				client.Interface, client.ID, client.Revision,
+			)
+		},
+		func() error {
+			_, err := o.conn.Exec(`
+				INSERT INTO clients (id, private_key, public_key, preshared_key, name, email, group_name,
+				subnet_ranges, allocated_ips, allowed_ips, extra_allowed_ips, endpoint,
+				use_server_dns, enabled, created_at, updated_at, deleted_at, deleted_by, config_outdated, interface_name, revision)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`,
+				client.ID, privateKey, client.PublicKey, presharedKey, client.Name, email, groupName,
+				subnetRangesJSON, allocatedIPsJSON, allowedIPsJSON, extraAllowedIPsJSON, endpoint,
+				client.UseServerDNS, client.Enabled, client.CreatedAt, client.UpdatedAt, deletedAt, deletedBy, client.ConfigOutdated,
+				client.Interface, client.Revision+1,
+			)
+			return err
+		},
 	)
-
-	return err
 }
 
 // DeleteClient deletes a client from the database
@@ -830,23 +980,47 @@ func (o *MySQLDB) GetPath() string {
 	return ""
 }
 
-// GetHashes returns configuration hashes
+// GetHashes returns configuration hashes and the state of the last apply
 func (o *MySQLDB) GetHashes() (model.ClientServerHashes, error) {
 	hashes := model.ClientServerHashes{}
+	var appliedState sql.NullString
+	var appliedAt sql.NullTime
 	err := o.conn.QueryRow(
-		"SELECT client_hash, server_hash FROM hashes WHERE id = 1",
-	).Scan(&hashes.Client, &hashes.Server)
-
-	return hashes, err
+		"SELECT client_hash, server_hash, applied_state, applied_at FROM hashes WHERE id = 1",
+	).Scan(&hashes.Client, &hashes.Server, &appliedState, &appliedAt)
+	if err != nil {
+		return hashes, err
+	}
+	if appliedState.Valid {
+		hashes.Applied = &model.ConfigState{}
+		if err := json.Unmarshal([]byte(appliedState.String), hashes.Applied); err != nil {
+			return hashes, err
+		}
+	}
+	if appliedAt.Valid {
+		hashes.AppliedAt = &appliedAt.Time
+	}
+	return hashes, nil
 }
 
-// SaveHashes saves configuration hashes
+// SaveHashes saves configuration hashes and the state of the last apply
 func (o *MySQLDB) SaveHashes(hashes model.ClientServerHashes) error {
+	var appliedState, appliedAt interface{}
+	if hashes.Applied != nil {
+		data, err := json.Marshal(hashes.Applied)
+		if err != nil {
+			return err
+		}
+		appliedState = string(data)
+	}
+	if hashes.AppliedAt != nil {
+		appliedAt = hashes.AppliedAt.UTC()
+	}
 	_, err := o.conn.Exec(
-		`INSERT INTO hashes (id, client_hash, server_hash) VALUES (?, ?, ?)
-		 ON DUPLICATE KEY UPDATE client_hash = ?, server_hash = ?`,
-		1, hashes.Client, hashes.Server,
-		hashes.Client, hashes.Server,
+		`INSERT INTO hashes (id, client_hash, server_hash, applied_state, applied_at) VALUES (?, ?, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE client_hash = ?, server_hash = ?, applied_state = ?, applied_at = ?`,
+		1, hashes.Client, hashes.Server, appliedState, appliedAt,
+		hashes.Client, hashes.Server, appliedState, appliedAt,
 	)
 	return err
 }
@@ -856,7 +1030,7 @@ func (o *MySQLDB) GetAPIKeys() ([]model.APIKey, error) {
 	var keys []model.APIKey
 
 	rows, err := o.conn.Query(`
-		SELECT id, name, key_value, permissions, enabled, created_at, updated_at
+		SELECT id, name, key_value, key_prefix, permissions, enabled, created_at, updated_at, last_used_at
 		FROM api_keys
 	`)
 	if err != nil {
@@ -867,12 +1041,19 @@ func (o *MySQLDB) GetAPIKeys() ([]model.APIKey, error) {
 	for rows.Next() {
 		key := model.APIKey{}
 		var permissionsJSON []byte
+		var keyPrefix sql.NullString
+		var lastUsedAt sql.NullTime
 
-		err := rows.Scan(&key.ID, &key.Name, &key.Key, &permissionsJSON, &key.Enabled, &key.CreatedAt, &key.UpdatedAt)
+		err := rows.Scan(&key.ID, &key.Name, &key.Key, &keyPrefix, &permissionsJSON, &key.Enabled, &key.CreatedAt, &key.UpdatedAt, &lastUsedAt)
 		if err != nil {
 			return keys, err
 		}
 
+		key.KeyPrefix = keyPrefix.String
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+
 		if err := json.Unmarshal(permissionsJSON, &key.Permissions); err != nil {
 			return keys, err
 		}
@@ -887,11 +1068,13 @@ func (o *MySQLDB) GetAPIKeys() ([]model.APIKey, error) {
 func (o *MySQLDB) GetAPIKeyByID(keyID string) (model.APIKey, error) {
 	key := model.APIKey{}
 	var permissionsJSON []byte
+	var keyPrefix sql.NullString
+	var lastUsedAt sql.NullTime
 
 	err := o.conn.QueryRow(`
-		SELECT id, name, key_value, permissions, enabled, created_at, updated_at
+		SELECT id, name, key_value, key_prefix, permissions, enabled, created_at, updated_at, last_used_at
 		FROM api_keys WHERE id = ?
-	`, keyID).Scan(&key.ID, &key.Name, &key.Key, &permissionsJSON, &key.Enabled, &key.CreatedAt, &key.UpdatedAt)
+	`, keyID).Scan(&key.ID, &key.Name, &key.Key, &keyPrefix, &permissionsJSON, &key.Enabled, &key.CreatedAt, &key.UpdatedAt, &lastUsedAt)
 
 	if err == sql.ErrNoRows {
 		return key, fmt.Errorf("API key not found")
@@ -904,6 +1087,11 @@ func (o *MySQLDB) GetAPIKeyByID(keyID string) (model.APIKey, error) {
 		return key, err
 	}
 
+	key.KeyPrefix = keyPrefix.String
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+
 	return key, nil
 }
 
@@ -911,11 +1099,13 @@ func (o *MySQLDB) GetAPIKeyByID(keyID string) (model.APIKey, error) {
 func (o *MySQLDB) GetAPIKeyByKey(keyValue string) (model.APIKey, error) {
 	key := model.APIKey{}
 	var permissionsJSON []byte
+	var keyPrefix sql.NullString
+	var lastUsedAt sql.NullTime
 
 	err := o.conn.QueryRow(`
-		SELECT id, name, key_value, permissions, enabled, created_at, updated_at
+		SELECT id, name, key_value, key_prefix, permissions, enabled, created_at, updated_at, last_used_at
 		FROM api_keys WHERE key_value = ?
-	`, keyValue).Scan(&key.ID, &key.Name, &key.Key, &permissionsJSON, &key.Enabled, &key.CreatedAt, &key.UpdatedAt)
+	`, keyValue).Scan(&key.ID, &key.Name, &key.Key, &keyPrefix, &permissionsJSON, &key.Enabled, &key.CreatedAt, &key.UpdatedAt, &lastUsedAt)
 
 	if err == sql.ErrNoRows {
 		return key, fmt.Errorf("API key not found")
@@ -928,6 +1118,11 @@ func (o *MySQLDB) GetAPIKeyByKey(keyValue string) (model.APIKey, error) {
 		return key, err
 	}
 
+	key.KeyPrefix = keyPrefix.String
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+
 	return key, nil
 }
 
@@ -939,13 +1134,13 @@ func (o *MySQLDB) SaveAPIKey(key model.APIKey) error {
 	}
 
 	_, err = o.conn.Exec(`
-		INSERT INTO api_keys (id, name, key_value, permissions, enabled, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO api_keys (id, name, key_value, key_prefix, permissions, enabled, created_at, updated_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON DUPLICATE KEY UPDATE
-		name = ?, key_value = ?, permissions = ?, enabled = ?, updated_at = ?
+		name = ?, key_value = ?, key_prefix = ?, permissions = ?, enabled = ?, updated_at = ?, last_used_at = ?
 	`,
-		key.ID, key.Name, key.Key, permissionsJSON, key.Enabled, key.CreatedAt, key.UpdatedAt,
-		key.Name, key.Key, permissionsJSON, key.Enabled, time.Now().UTC(),
+		key.ID, key.Name, key.Key, key.KeyPrefix, permissionsJSON, key.Enabled, key.CreatedAt, key.UpdatedAt, key.LastUsedAt,
+		key.Name, key.Key, key.KeyPrefix, permissionsJSON, key.Enabled, time.Now().UTC(), key.LastUsedAt,
 	)
 
 	return err
@@ -957,6 +1152,411 @@ func (o *MySQLDB) DeleteAPIKey(keyID string) error {
 	return err
 }
 
+// GetDataKeys returns all wrapped data keys from the database
+func (o *MySQLDB) GetDataKeys() ([]model.DataKey, error) {
+	var keys []model.DataKey
+
+	rows, err := o.conn.Query("SELECT id, provider, wrapped_key, created_at FROM data_keys")
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key := model.DataKey{}
+		if err := rows.Scan(&key.ID, &key.Provider, &key.WrappedKey, &key.CreatedAt); err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// SaveDataKey saves a wrapped data key to the database
+func (o *MySQLDB) SaveDataKey(key model.DataKey) error {
+	_, err := o.conn.Exec(`
+		INSERT INTO data_keys (id, provider, wrapped_key, created_at)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE provider = VALUES(provider), wrapped_key = VALUES(wrapped_key)
+	`, key.ID, key.Provider, key.WrappedKey, key.CreatedAt)
+	return err
+}
+
+// DeleteDataKey deletes a wrapped data key from the database
+func (o *MySQLDB) DeleteDataKey(keyID string) error {
+	_, err := o.conn.Exec("DELETE FROM data_keys WHERE id = ?", keyID)
+	return err
+}
+
+// GetIPReservations returns all IP reservations from the database
+func (o *MySQLDB) GetIPReservations() ([]model.IPReservation, error) {
+	var reservations []model.IPReservation
+
+	rows, err := o.conn.Query("SELECT id, address, description, created_by, created_at FROM ip_reservations ORDER BY created_at")
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reservation := model.IPReservation{}
+		if err := rows.Scan(&reservation.ID, &reservation.Address, &reservation.Description, &reservation.CreatedBy, &reservation.CreatedAt); err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, rows.Err()
+}
+
+// SaveIPReservation saves an IP reservation to the database
+func (o *MySQLDB) SaveIPReservation(reservation model.IPReservation) error {
+	_, err := o.conn.Exec(`
+		INSERT INTO ip_reservations (id, address, description, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE address = VALUES(address), description = VALUES(description)
+	`, reservation.ID, reservation.Address, reservation.Description, reservation.CreatedBy, reservation.CreatedAt)
+	return err
+}
+
+// DeleteIPReservation deletes an IP reservation from the database
+func (o *MySQLDB) DeleteIPReservation(id string) error {
+	_, err := o.conn.Exec("DELETE FROM ip_reservations WHERE id = ?", id)
+	return err
+}
+
+// GetSubnetRanges returns all subnet ranges ordered by position and name
+func (o *MySQLDB) GetSubnetRanges() ([]model.SubnetRange, error) {
+	var ranges []model.SubnetRange
+
+	rows, err := o.conn.Query("SELECT id, name, cidrs, position, created_at, updated_at FROM subnet_ranges ORDER BY position, name")
+	if err != nil {
+		return ranges, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var subnetRange model.SubnetRange
+		var cidrsJSON []byte
+		if err := rows.Scan(&subnetRange.ID, &subnetRange.Name, &cidrsJSON, &subnetRange.Position, &subnetRange.CreatedAt, &subnetRange.UpdatedAt); err != nil {
+			return ranges, err
+		}
+		if err := json.Unmarshal(cidrsJSON, &subnetRange.CIDRs); err != nil {
+			return ranges, err
+		}
+		ranges = append(ranges, subnetRange)
+	}
+
+	return ranges, rows.Err()
+}
+
+// SaveSubnetRange saves a subnet range to the database
+func (o *MySQLDB) SaveSubnetRange(subnetRange model.SubnetRange) error {
+	cidrsJSON, err := json.Marshal(subnetRange.CIDRs)
+	if err != nil {
+		return err
+	}
+	_, err = o.conn.Exec(`
+		INSERT INTO subnet_ranges (id, name, cidrs, position, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE name = VALUES(name), cidrs = VALUES(cidrs), position = VALUES(position), updated_at = VALUES(updated_at)
+	`, subnetRange.ID, subnetRange.Name, string(cidrsJSON), subnetRange.Position, subnetRange.CreatedAt, subnetRange.UpdatedAt)
+	return err
+}
+
+// DeleteSubnetRange deletes a subnet range from the database
+func (o *MySQLDB) DeleteSubnetRange(id string) error {
+	_, err := o.conn.Exec("DELETE FROM subnet_ranges WHERE id = ?", id)
+	return err
+}
+
+// WireGuard Interfaces
+
+// interfaceColumns lists the columns read by scanWireGuardInterface, in order.
+const interfaceColumns = `name, description, private_key, public_key, addresses, listen_port, post_up, pre_down, post_down,
+	mtu, dns_servers, config_file_path, node_id, applied_state, applied_at, created_at, updated_at, revision`
+
+// GetWireGuardInterfaces returns the interfaces besides the primary one, ordered by name
+func (o *MySQLDB) GetWireGuardInterfaces() ([]model.WireGuardInterface, error) {
+	var ifaces []model.WireGuardInterface
+
+	rows, err := o.conn.Query("SELECT " + interfaceColumns + " FROM wireguard_interfaces ORDER BY name")
+	if err != nil {
+		return ifaces, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		iface, err := scanWireGuardInterface(rows)
+		if err != nil {
+			return ifaces, err
+		}
+		ifaces = append(ifaces, iface)
+	}
+
+	return ifaces, rows.Err()
+}
+
+// GetWireGuardInterface returns an interface by its name
+func (o *MySQLDB) GetWireGuardInterface(name string) (model.WireGuardInterface, error) {
+	iface, err := scanWireGuardInterface(o.conn.QueryRow("SELECT "+interfaceColumns+" FROM wireguard_interfaces WHERE name = ?", name))
+	if err == sql.ErrNoRows {
+		return iface, fmt.Errorf("interface %s not found", name)
+	}
+	return iface, err
+}
+
+// scanWireGuardInterface reads an interface selected with interfaceColumns
+func scanWireGuardInterface(row rowScanner) (model.WireGuardInterface, error) {
+	iface := model.WireGuardInterface{}
+	var addressesJSON, dnsJSON []byte
+	var appliedState sql.NullString
+	var appliedAt sql.NullTime
+	err := row.Scan(&iface.Name, &iface.Description, &iface.PrivateKey, &iface.PublicKey, &addressesJSON,
+		&iface.ListenPort, &iface.PostUp, &iface.PreDown, &iface.PostDown, &iface.MTU, &dnsJSON,
+		&iface.ConfigFilePath, &iface.Node, &appliedState, &appliedAt, &iface.CreatedAt, &iface.UpdatedAt, &iface.Revision)
+	if err != nil {
+		return iface, err
+	}
+	if err := json.Unmarshal(addressesJSON, &iface.Addresses); err != nil {
+		return iface, fmt.Errorf("failed to unmarshal addresses: %v", err)
+	}
+	if err := json.Unmarshal(dnsJSON, &iface.DNSServers); err != nil {
+		return iface, fmt.Errorf("failed to unmarshal DNS servers: %v", err)
+	}
+	if appliedState.Valid {
+		iface.Applied = &model.ConfigState{}
+		if err := json.Unmarshal([]byte(appliedState.String), iface.Applied); err != nil {
+			return iface, err
+		}
+	}
+	if appliedAt.Valid {
+		iface.AppliedAt = &appliedAt.Time
+	}
+	return iface, nil
+}
+
+// SaveWireGuardInterface saves an interface to the database. The applied state
+// is left unchanged.
+func (o *MySQLDB) SaveWireGuardInterface(iface model.WireGuardInterface) error {
+	addressesJSON, err := json.Marshal(iface.Addresses)
+	if err != nil {
+		return err
+	}
+	dnsJSON, err := json.Marshal(iface.DNSServers)
+	if err != nil {
+		return err
+	}
+
+	updatedAt := time.Now().UTC()
+	return o.compareAndSwap("interface "+iface.Name, "wireguard_interfaces", "name", iface.Name,
+		func() (sql.Result, error) {
+			return o.conn.Exec(`
+				UPDATE wireguard_interfaces SET description = ?, private_key = ?, public_key = ?, addresses = ?,
+				listen_port = ?, post_up = ?, pre_down = ?, post_down = ?, mtu = ?, dns_servers = ?, config_file_path = ?,
+				node_id = ?, updated_at = ?, revision = revision + 1
+				WHERE name = ? AND revision = ?
+			`,
+				iface.Description, iface.PrivateKey, iface.PublicKey, addressesJSON,
+				iface.ListenPort, iface.PostUp, iface.PreDown, iface.PostDown, iface.MTU, dnsJSON, iface.ConfigFilePath,
+				iface.Node, updatedAt, iface.Name, iface.Revision,
+			)
+		},
+		func() error {
+			_, err := o.conn.Exec(`
+				INSERT INTO wireguard_interfaces (name, description, private_key, public_key, addresses, listen_port,
+				post_up, pre_down, post_down, mtu, dns_servers, config_file_path, node_id, created_at, updated_at, revision)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`,
+				iface.Name, iface.Description, iface.PrivateKey, iface.PublicKey, addressesJSON, iface.ListenPort,
+				iface.PostUp, iface.PreDown, iface.PostDown, iface.MTU, dnsJSON, iface.ConfigFilePath, iface.Node,
+				iface.CreatedAt, updatedAt, iface.Revision+1,
+			)
+			return err
+		},
+	)
+}
+
+// SaveWireGuardInterfaceApplied records the state of the last successful apply of an interface
+func (o *MySQLDB) SaveWireGuardInterfaceApplied(name string, state model.ConfigState, appliedAt time.Time) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	result, err := o.conn.Exec("UPDATE wireguard_interfaces SET applied_state = ?, applied_at = ? WHERE name = ?",
+		string(data), appliedAt.UTC(), name)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("interface %s not found", name)
+	}
+	return err
+}
+
+// DeleteWireGuardInterface deletes an interface from the database
+func (o *MySQLDB) DeleteWireGuardInterface(name string) error {
+	_, err := o.conn.Exec("DELETE FROM wireguard_interfaces WHERE name = ?", name)
+	return err
+}
+
+// Nodes
+
+// GetNodes returns all nodes ordered by name
+func (o *MySQLDB) GetNodes() ([]model.Node, error) {
+	var nodes []model.Node
+
+	rows, err := o.conn.Query("SELECT id, name, description, url, token, ca_cert, created_at, updated_at, revision FROM nodes ORDER BY name")
+	if err != nil {
+		return nodes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		node, err := scanNode(rows)
+		if err != nil {
+			return nodes, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, rows.Err()
+}
+
+// GetNode returns a node by its ID
+func (o *MySQLDB) GetNode(id string) (model.Node, error) {
+	node, err := scanNode(o.conn.QueryRow("SELECT id, name, description, url, token, ca_cert, created_at, updated_at, revision FROM nodes WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return node, fmt.Errorf("node %s not found", id)
+	}
+	return node, err
+}
+
+// scanNode reads a node row
+func scanNode(row rowScanner) (model.Node, error) {
+	node := model.Node{}
+	err := row.Scan(&node.ID, &node.Name, &node.Description, &node.URL, &node.Token, &node.CACert,
+		&node.CreatedAt, &node.UpdatedAt, &node.Revision)
+	return node, err
+}
+
+// SaveNode saves a node to the database
+func (o *MySQLDB) SaveNode(node model.Node) error {
+	updatedAt := time.Now().UTC()
+	return o.compareAndSwap("node "+node.ID, "nodes", "id", node.ID,
+		func() (sql.Result, error) {
+			return o.conn.Exec(`
+				UPDATE nodes SET name = ?, description = ?, url = ?, token = ?, ca_cert = ?,
+				updated_at = ?, revision = revision + 1
+				WHERE id = ? AND revision = ?
+			`,
+				node.Name, node.Description, node.URL, node.Token, node.CACert,
+				updatedAt, node.ID, node.Revision,
+			)
+		},
+		func() error {
+			_, err := o.conn.Exec(`
+				INSERT INTO nodes (id, name, description, url, token, ca_cert, created_at, updated_at, revision)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`,
+				node.ID, node.Name, node.Description, node.URL, node.Token, node.CACert,
+				node.CreatedAt, updatedAt, node.Revision+1,
+			)
+			return err
+		},
+	)
+}
+
+// DeleteNode deletes a node from the database
+func (o *MySQLDB) DeleteNode(id string) error {
+	_, err := o.conn.Exec("DELETE FROM nodes WHERE id = ?", id)
+	return err
+}
+
+// Config Revisions
+
+// GetConfigRevisions returns all config revisions, newest first
+func (o *MySQLDB) GetConfigRevisions() ([]model.ConfigRevision, error) {
+	var revisions []model.ConfigRevision
+
+	rows, err := o.conn.Query(`
+		SELECT id, path, content, author, comment, result, error, rollback_of, restored_id, created_at
+		FROM config_revisions ORDER BY id DESC
+	`)
+	if err != nil {
+		return revisions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		revision, err := scanConfigRevision(rows)
+		if err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+// GetConfigRevision returns a config revision by its number
+func (o *MySQLDB) GetConfigRevision(id int) (model.ConfigRevision, error) {
+	revision, err := scanConfigRevision(o.conn.QueryRow(`
+		SELECT id, path, content, author, comment, result, error, rollback_of, restored_id, created_at
+		FROM config_revisions WHERE id = ?
+	`, id))
+
+	if err == sql.ErrNoRows {
+		return revision, fmt.Errorf("config revision %d not found", id)
+	}
+	return revision, err
+}
+
+// scanConfigRevision reads a config revision from a row
+func scanConfigRevision(row rowScanner) (model.ConfigRevision, error) {
+	revision := model.ConfigRevision{}
+	err := row.Scan(&revision.ID, &revision.Path, &revision.Content, &revision.Author, &revision.Comment,
+		&revision.Result, &revision.Error, &revision.RollbackOf, &revision.RestoredID, &revision.CreatedAt)
+	return revision, err
+}
+
+// AddConfigRevision saves a new config revision numbered after the newest
+// one. The plain insert fails if another writer took the number in the
+// meantime.
+func (o *MySQLDB) AddConfigRevision(revision model.ConfigRevision) (int, error) {
+	if err := o.conn.QueryRow("SELECT COALESCE(MAX(id), 0) + 1 FROM config_revisions").Scan(&revision.ID); err != nil {
+		return 0, err
+	}
+	_, err := o.conn.Exec(`
+		INSERT INTO config_revisions (id, path, content, author, comment, result, error, rollback_of, restored_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, revision.ID, revision.Path, revision.Content, revision.Author, revision.Comment,
+		revision.Result, revision.Error, revision.RollbackOf, revision.RestoredID, revision.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return revision.ID, nil
+}
+
+// SaveConfigRevision saves a config revision to the database. An existing
+// revision only has its content and result updated.
+func (o *MySQLDB) SaveConfigRevision(revision model.ConfigRevision) error {
+	_, err := o.conn.Exec(`
+		INSERT INTO config_revisions (id, path, content, author, comment, result, error, rollback_of, restored_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE content = VALUES(content), result = VALUES(result), error = VALUES(error), restored_id = VALUES(restored_id)
+	`, revision.ID, revision.Path, revision.Content, revision.Author, revision.Comment,
+		revision.Result, revision.Error, revision.RollbackOf, revision.RestoredID, revision.CreatedAt)
+	return err
+}
+
+// DeleteConfigRevision deletes a config revision from the database
+func (o *MySQLDB) DeleteConfigRevision(id int) error {
+	_, err := o.conn.Exec("DELETE FROM config_revisions WHERE id = ?", id)
+	return err
+}
+
 // SaveAPIAccessLog saves an API access log entry to the database
 func (o *MySQLDB) SaveAPIAccessLog(log model.APIAccessLog) error {
 	_, err := o.conn.Exec(`
@@ -1045,7 +1645,7 @@ func (db *MySQLDB) GetSecuritySettings() (model.SecuritySettings, error) {
 	query := `
 SELECT brute_force_enabled, brute_force_max_attempts, brute_force_window_minutes, 
        brute_force_block_minutes, ip_blocking_enabled, geoip_enabled, 
-       geoip_default_action, updated_at
+       geoip_default_action, updated_at, revision
 FROM security_settings 
 LIMIT 1
 `
@@ -1059,16 +1659,15 @@ LIMIT 1
 		&settings.GeoIPEnabled,
 		&settings.GeoIPDefaultAction,
 		&settings.UpdatedAt,
+		&settings.Revision,
 	)
 
 	if err == sql.ErrNoRows {
-		// Return default settings if none exist
-		settings = model.DefaultSecuritySettings()
-		// Save default settings
-		if err := db.SaveSecuritySettings(settings); err != nil {
-			return settings, err
+		// Save default settings if none exist, then read them back with their revision
+		if err := db.SaveSecuritySettings(model.DefaultSecuritySettings()); err != nil {
+			return model.DefaultSecuritySettings(), err
 		}
-		return settings, nil
+		return db.GetSecuritySettings()
 	}
 
 	if err != nil {
@@ -1079,37 +1678,150 @@ LIMIT 1
 }
 
 func (db *MySQLDB) SaveSecuritySettings(settings model.SecuritySettings) error {
-	query := `
+	return db.compareAndSwap("security settings", "security_settings", "id", 1,
+		func() (sql.Result, error) {
+			return db.conn.Exec(`
+UPDATE security_settings SET
+brute_force_enabled = ?,
+brute_force_max_attempts = ?,
+brute_force_window_minutes = ?,
+brute_force_block_minutes = ?,
+ip_blocking_enabled = ?,
+geoip_enabled = ?,
+geoip_default_action = ?,
+updated_at = ?,
+revision = revision + 1
+WHERE id = 1 AND revision = ?
+`,
+				settings.BruteForceEnabled,
+				settings.BruteForceMaxAttempts,
+				settings.BruteForceWindowMinutes,
+				settings.BruteForceBlockMinutes,
+				settings.IPBlockingEnabled,
+				settings.GeoIPEnabled,
+				settings.GeoIPDefaultAction,
+				settings.UpdatedAt,
+				settings.Revision,
+			)
+		},
+		func() error {
+			_, err := db.conn.Exec(`
 INSERT INTO security_settings (
 id, brute_force_enabled, brute_force_max_attempts, brute_force_window_minutes,
 brute_force_block_minutes, ip_blocking_enabled, geoip_enabled,
-geoip_default_action, updated_at
-) VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?)
-ON DUPLICATE KEY UPDATE
-brute_force_enabled = VALUES(brute_force_enabled),
-brute_force_max_attempts = VALUES(brute_force_max_attempts),
-brute_force_window_minutes = VALUES(brute_force_window_minutes),
-brute_force_block_minutes = VALUES(brute_force_block_minutes),
-ip_blocking_enabled = VALUES(ip_blocking_enabled),
-geoip_enabled = VALUES(geoip_enabled),
-geoip_default_action = VALUES(geoip_default_action),
-updated_at = VALUES(updated_at)
+geoip_default_action, updated_at, revision
+) VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`,
+				settings.BruteForceEnabled,
+				settings.BruteForceMaxAttempts,
+				settings.BruteForceWindowMinutes,
+				settings.BruteForceBlockMinutes,
+				settings.IPBlockingEnabled,
+				settings.GeoIPEnabled,
+				settings.GeoIPDefaultAction,
+				settings.UpdatedAt,
+				settings.Revision+1,
+			)
+			return err
+		},
+	)
+}
+
+// Audit Log
+
+func (db *MySQLDB) SaveAuditEntry(entry model.AuditEntry) error {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+
+	query := `
+INSERT INTO audit_log (id, actor, action, target_type, target_id, source_ip, changes, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 `
 
-	_, err := db.conn.Exec(query,
-		settings.BruteForceEnabled,
-		settings.BruteForceMaxAttempts,
-		settings.BruteForceWindowMinutes,
-		settings.BruteForceBlockMinutes,
-		settings.IPBlockingEnabled,
-		settings.GeoIPEnabled,
-		settings.GeoIPDefaultAction,
-		settings.UpdatedAt,
+	_, err = db.conn.Exec(query,
+		entry.ID,
+		entry.Actor,
+		entry.Action,
+		entry.TargetType,
+		entry.TargetID,
+		entry.SourceIP,
+		string(changes),
+		entry.CreatedAt.UTC(),
 	)
 
 	return err
 }
 
+func (db *MySQLDB) GetAuditEntries(filter model.AuditFilter) ([]model.AuditEntry, error) {
+	var entries []model.AuditEntry
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+
+	if filter.Actor != "" {
+		add("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		add("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		add("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		add("target_id = ?", filter.TargetID)
+	}
+	if !filter.Since.IsZero() {
+		add("created_at >= ?", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		add("created_at < ?", filter.Until.UTC())
+	}
+
+	query := "SELECT id, actor, action, target_type, target_id, source_ip, changes, created_at FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY created_at DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := model.AuditEntry{}
+		var changes []byte
+		err := rows.Scan(
+			&entry.ID,
+			&entry.Actor,
+			&entry.Action,
+			&entry.TargetType,
+			&entry.TargetID,
+			&entry.SourceIP,
+			&changes,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return entries, err
+		}
+		if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+			return entries, fmt.Errorf("failed to unmarshal audit changes: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
 // Security Events
 
 func (db *MySQLDB) SaveSecurityEvent(event model.SecurityEvent) error {
@@ -1471,8 +2183,35 @@ func (db *MySQLDB) DeleteBruteForceAttempt(ip string) error {
 	return err
 }
 
-func (db *MySQLDB) CleanupExpiredBruteForceAttempts() error {
-	query := `DELETE FROM brute_force_attempts WHERE blocked_until IS NOT NULL AND blocked_until < NOW()`
-	_, err := db.conn.Exec(query)
-	return err
+// Retention
+
+// PruneAPIAccessLogs deletes the API access log entries written before the given time
+func (db *MySQLDB) PruneAPIAccessLogs(before time.Time) (int, error) {
+	return db.prune(`DELETE FROM api_access_logs WHERE timestamp < ?`, before)
+}
+
+// PruneSecurityEvents deletes the security events recorded before the given time
+func (db *MySQLDB) PruneSecurityEvents(before time.Time) (int, error) {
+	return db.prune(`DELETE FROM security_events WHERE created_at < ?`, before)
+}
+
+// PruneBruteForceAttempts deletes the failed login counters whose last attempt
+// and block both ended before the given time
+func (db *MySQLDB) PruneBruteForceAttempts(before time.Time) (int, error) {
+	return db.prune(`DELETE FROM brute_force_attempts WHERE last_attempt < ? AND (blocked_until IS NULL OR blocked_until < ?)`, before, before)
+}
+
+// PruneIPBlocks deletes the temporary IP blocks that expired before the given time
+func (db *MySQLDB) PruneIPBlocks(before time.Time) (int, error) {
+	return db.prune(`DELETE FROM ip_blocks WHERE permanent = FALSE AND expires_at IS NOT NULL AND expires_at < ?`, before)
+}
+
+// prune runs a DELETE statement and returns the number of deleted rows
+func (db *MySQLDB) prune(query string, args ...interface{}) (int, error) {
+	result, err := db.conn.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
 }
@@ -0,0 +1,72 @@
+package mysqldb
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/rs/xid"
+
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/storetest"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// testDSNEnvVar names the DSN of a MySQL server the tests may create
+// databases on. The tests are skipped if it is not set.
+const testDSNEnvVar = "WGM_TEST_MYSQL_DSN"
+
+// newTestDB creates an initialized MySQL store in a new database on the test
+// server. The database is dropped when the test ends.
+func newTestDB(t *testing.T) *MySQLDB {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnvVar)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnvVar)
+	}
+
+	// Avoid the public IP lookup during default data seeding
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordEnvVar, "test-password")
+
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("Invalid %s: %v", testDSNEnvVar, err)
+	}
+	admin, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open the test database: %v", err)
+	}
+	name := "wgm_test_" + xid.New().String()
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		admin.Close()
+		t.Fatalf("Failed to create database %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP DATABASE " + name)
+		admin.Close()
+	})
+
+	config.DBName = name
+	config.ParseTime = true
+	db, err := New(config.FormatDSN())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.db.Close() })
+
+	if err := db.Init(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	return db
+}
+
+// TestStore runs the store conformance suite.
+func TestStore(t *testing.T) {
+	if os.Getenv(testDSNEnvVar) == "" {
+		t.Skipf("%s is not set", testDSNEnvVar)
+	}
+	storetest.Run(t, func(t *testing.T) store.IStore { return newTestDB(t) })
+}
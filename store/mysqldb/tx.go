@@ -0,0 +1,42 @@
+package mysqldb
+
+import (
+	"database/sql"
+
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// WithTx runs fn inside a database transaction. The store passed to fn
+// executes every call in that transaction, which is committed if fn returns
+// nil and rolled back otherwise. Nested calls join the outer transaction.
+func (o *MySQLDB) WithTx(fn func(tx store.IStore) error) error {
+	if _, ok := o.conn.(*sql.Tx); ok {
+		return fn(o)
+	}
+
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	txStore := *o
+	txStore.conn = tx
+	if err := fn(&txStore); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,2095 @@
+package postgresdb
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	_ "github.com/lib/pq"
+	"github.com/skip2/go-qrcode"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/schema"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+type PostgresDB struct {
+	conn querier // the pool, or the transaction inside WithTx
+	db   *sql.DB
+	dsn  string
+}
+
+// New returns a new pointer PostgresDB
+func New(dsn string) (*PostgresDB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Test connection
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to ping database: %v", err)
+	}
+
+	// Set connection pool settings
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	ans := PostgresDB{
+		conn: db,
+		db:   db,
+		dsn:  dsn,
+	}
+	return &ans, nil
+}
+
+func (o *PostgresDB) Init() error {
+	// Bring the schema up to date, refusing databases from newer versions
+	if err := schema.Apply(o.db, migrations); err != nil {
+		return err
+	}
+
+	// Initialize default data
+	if err := o.initializeDefaultData(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// createTables creates the initial schema (migration 1). Tables that already
+// exist from before schema versioning was introduced are left untouched.
+func createTables(tx *sql.Tx) error {
+	queries := []string{
+		// Users table
+		`CREATE TABLE IF NOT EXISTS users (
+			username VARCHAR(255) PRIMARY KEY,
+			password_hash TEXT NOT NULL,
+			admin BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Server interface table
+		`CREATE TABLE IF NOT EXISTS server_interface (
+			id INT PRIMARY KEY DEFAULT 1,
+			addresses JSONB NOT NULL,
+			listen_port INT NOT NULL,
+			post_up TEXT,
+			post_down TEXT,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CHECK (id = 1)
+		)`,
+
+		// Server keypair table
+		`CREATE TABLE IF NOT EXISTS server_keypair (
+			id INT PRIMARY KEY DEFAULT 1,
+			private_key TEXT NOT NULL,
+			public_key TEXT NOT NULL,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CHECK (id = 1)
+		)`,
+
+		// Global settings table
+		`CREATE TABLE IF NOT EXISTS global_settings (
+			id INT PRIMARY KEY DEFAULT 1,
+			endpoint_address VARCHAR(255) NOT NULL,
+			dns_servers JSONB NOT NULL,
+			mtu INT NOT NULL,
+			persistent_keepalive INT NOT NULL,
+			firewall_mark VARCHAR(50),
+			table_name VARCHAR(50),
+			config_file_path VARCHAR(255) NOT NULL,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CHECK (id = 1)
+		)`,
+
+		// Hashes table
+		`CREATE TABLE IF NOT EXISTS hashes (
+			id INT PRIMARY KEY DEFAULT 1,
+			client_hash VARCHAR(255) NOT NULL,
+			server_hash VARCHAR(255) NOT NULL,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CHECK (id = 1)
+		)`,
+
+		// Clients table
+		`CREATE TABLE IF NOT EXISTS clients (
+			id VARCHAR(255) PRIMARY KEY,
+			private_key TEXT,
+			public_key TEXT NOT NULL,
+			preshared_key TEXT,
+			name VARCHAR(255) NOT NULL,
+			email VARCHAR(255),
+			group_name VARCHAR(255),
+			subnet_ranges JSONB,
+			allocated_ips JSONB NOT NULL,
+			allowed_ips JSONB NOT NULL,
+			extra_allowed_ips JSONB,
+			endpoint VARCHAR(255),
+			use_server_dns BOOLEAN NOT NULL DEFAULT TRUE,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// API keys table
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id VARCHAR(255) PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			key_value TEXT NOT NULL,
+			key_prefix VARCHAR(16),
+			permissions JSONB NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMPTZ NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_key_value ON api_keys (key_value)`,
+
+		// API access logs table
+		`CREATE TABLE IF NOT EXISTS api_access_logs (
+			id VARCHAR(255) PRIMARY KEY,
+			api_key_id VARCHAR(255) NOT NULL,
+			api_key_name VARCHAR(255) NOT NULL,
+			endpoint VARCHAR(255) NOT NULL,
+			method VARCHAR(10) NOT NULL,
+			ip_address VARCHAR(45) NOT NULL,
+			user_agent TEXT,
+			status_code INT NOT NULL,
+			timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_access_logs_api_key_id ON api_access_logs (api_key_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_access_logs_timestamp ON api_access_logs (timestamp)`,
+
+		// Security settings table
+		`CREATE TABLE IF NOT EXISTS security_settings (
+			id INT PRIMARY KEY DEFAULT 1,
+			brute_force_enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			brute_force_max_attempts INT NOT NULL DEFAULT 5,
+			brute_force_window_minutes INT NOT NULL DEFAULT 15,
+			brute_force_block_minutes INT NOT NULL DEFAULT 30,
+			ip_blocking_enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			geoip_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			geoip_default_action VARCHAR(10) NOT NULL DEFAULT 'allow',
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			CHECK (id = 1)
+		)`,
+
+		// Security events table
+		`CREATE TABLE IF NOT EXISTS security_events (
+			id VARCHAR(255) PRIMARY KEY,
+			event_type VARCHAR(50) NOT NULL,
+			ip VARCHAR(45) NOT NULL,
+			country VARCHAR(2),
+			username VARCHAR(255),
+			description TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_security_events_event_type ON security_events (event_type)`,
+		`CREATE INDEX IF NOT EXISTS idx_security_events_ip ON security_events (ip)`,
+		`CREATE INDEX IF NOT EXISTS idx_security_events_created_at ON security_events (created_at)`,
+
+		// IP blocks table
+		`CREATE TABLE IF NOT EXISTS ip_blocks (
+			id VARCHAR(255) PRIMARY KEY,
+			ip VARCHAR(45) NOT NULL UNIQUE,
+			reason TEXT,
+			blocked_by VARCHAR(255) NOT NULL,
+			permanent BOOLEAN NOT NULL DEFAULT FALSE,
+			expires_at TIMESTAMPTZ NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_ip_blocks_expires_at ON ip_blocks (expires_at)`,
+
+		// GeoIP rules table
+		`CREATE TABLE IF NOT EXISTS geoip_rules (
+			id VARCHAR(255) PRIMARY KEY,
+			country_code VARCHAR(2) NOT NULL UNIQUE,
+			country_name VARCHAR(255),
+			action VARCHAR(10) NOT NULL,
+			created_by VARCHAR(255) NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Brute force attempts table
+		`CREATE TABLE IF NOT EXISTS brute_force_attempts (
+			ip VARCHAR(45) PRIMARY KEY,
+			attempts INT NOT NULL DEFAULT 0,
+			last_attempt TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			blocked_until TIMESTAMPTZ NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_brute_force_attempts_blocked_until ON brute_force_attempts (blocked_until)`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("failed to create table: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (o *PostgresDB) initializeDefaultData() error {
+	// Initialize server interface
+	var count int
+	err := o.conn.QueryRow("SELECT COUNT(*) FROM server_interface").Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		serverInterface := model.ServerInterface{
+			Addresses:  util.LookupEnvOrStrings(util.ServerAddressesEnvVar, []string{util.DefaultServerAddress}),
+			ListenPort: util.LookupEnvOrInt(util.ServerListenPortEnvVar, util.DefaultServerPort),
+			PostUp:     util.LookupEnvOrString(util.ServerPostUpScriptEnvVar, ""),
+			PostDown:   util.LookupEnvOrString(util.ServerPostDownScriptEnvVar, ""),
+			UpdatedAt:  time.Now().UTC(),
+		}
+
+		addressesJSON, _ := json.Marshal(serverInterface.Addresses)
+		_, err = o.conn.Exec(
+			"INSERT INTO server_interface (id, addresses, listen_port, post_up, post_down, updated_at) VALUES ($1, $2, $3, $4, $5, $6)",
+			1, string(addressesJSON), serverInterface.ListenPort, serverInterface.PostUp, serverInterface.PostDown, serverInterface.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Initialize server keypair
+	err = o.conn.QueryRow("SELECT COUNT(*) FROM server_keypair").Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+
+		serverKeyPair := model.ServerKeypair{
+			PrivateKey: key.String(),
+			PublicKey:  key.PublicKey().String(),
+			UpdatedAt:  time.Now().UTC(),
+		}
+
+		_, err = o.conn.Exec(
+			"INSERT INTO server_keypair (id, private_key, public_key, updated_at) VALUES ($1, $2, $3, $4)",
+			1, serverKeyPair.PrivateKey, serverKeyPair.PublicKey, serverKeyPair.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Initialize global settings
+	err = o.conn.QueryRow("SELECT COUNT(*) FROM global_settings").Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		endpointAddress := util.LookupEnvOrString(util.EndpointAddressEnvVar, "")
+		if endpointAddress == "" {
+			publicInterface, err := util.GetPublicIP()
+			if err != nil {
+				return err
+			}
+			endpointAddress = publicInterface.IPAddress
+		}
+
+		globalSetting := model.GlobalSetting{
+			EndpointAddress:     endpointAddress,
+			DNSServers:          util.LookupEnvOrStrings(util.DNSEnvVar, []string{util.DefaultDNS}),
+			MTU:                 util.LookupEnvOrInt(util.MTUEnvVar, util.DefaultMTU),
+			PersistentKeepalive: util.LookupEnvOrInt(util.PersistentKeepaliveEnvVar, util.DefaultPersistentKeepalive),
+			FirewallMark:        util.LookupEnvOrString(util.FirewallMarkEnvVar, util.DefaultFirewallMark),
+			Table:               util.LookupEnvOrString(util.TableEnvVar, util.DefaultTable),
+			ConfigFilePath:      util.LookupEnvOrString(util.ConfigFilePathEnvVar, util.DefaultConfigFilePath),
+			UpdatedAt:           time.Now().UTC(),
+		}
+
+		dnsJSON, _ := json.Marshal(globalSetting.DNSServers)
+		_, err = o.conn.Exec(
+			"INSERT INTO global_settings (id, endpoint_address, dns_servers, mtu, persistent_keepalive, firewall_mark, table_name, config_file_path, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+			1, globalSetting.EndpointAddress, string(dnsJSON), globalSetting.MTU, globalSetting.PersistentKeepalive,
+			globalSetting.FirewallMark, globalSetting.Table, globalSetting.ConfigFilePath, globalSetting.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Initialize hashes
+	err = o.conn.QueryRow("SELECT COUNT(*) FROM hashes").Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		_, err = o.conn.Exec(
+			"INSERT INTO hashes (id, client_hash, server_hash) VALUES ($1, $2, $3)",
+			1, "none", "none",
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Initialize default user
+	err = o.conn.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		user := model.User{
+			Username: util.LookupEnvOrString(util.UsernameEnvVar, util.DefaultUsername),
+			Admin:    util.DefaultIsAdmin,
+		}
+
+		var plaintext string
+		var isGeneratedPassword bool
+
+		user.PasswordHash = util.LookupEnvOrString(util.PasswordHashEnvVar, "")
+		if user.PasswordHash == "" {
+			user.PasswordHash = util.LookupEnvOrFile(util.PasswordHashFileEnvVar, "")
+			if user.PasswordHash == "" {
+				plaintext = util.LookupEnvOrString(util.PasswordEnvVar, "")
+				if plaintext == "" {
+					plaintext = util.LookupEnvOrFile(util.PasswordFileEnvVar, "")
+					if plaintext == "" {
+						// Generate random 8-character password
+						plaintext = util.GenerateRandomPassword(8)
+						isGeneratedPassword = true
+					}
+				}
+				hash, err := util.HashPassword(plaintext)
+				if err != nil {
+					return err
+				}
+				user.PasswordHash = hash
+			}
+		}
+
+		_, err = o.conn.Exec(
+			"INSERT INTO users (username, password_hash, admin) VALUES ($1, $2, $3)",
+			user.Username, user.PasswordHash, user.Admin,
+		)
+		if err != nil {
+			return err
+		}
+
+		util.DBUsersToCRC32[user.Username] = util.GetDBUserCRC32(user)
+
+		// Log and save generated password if it was generated
+		if isGeneratedPassword {
+			log.Infof("=== INITIAL ADMIN PASSWORD CREATED ===")
+			log.Infof("Username: %s", user.Username)
+			log.Infof("Password: %s", plaintext)
+
+			// Write password to log file
+			logFilePath := path.Join("./db", "initial_admin_password.log")
+			logContent := fmt.Sprintf("=== INITIAL ADMIN PASSWORD CREATED ===\n")
+			logContent += fmt.Sprintf("Username: %s\n", user.Username)
+			logContent += fmt.Sprintf("Password: %s\n", plaintext)
+			logContent += fmt.Sprintf("Created at: %s\n", time.Now().Format(time.RFC3339))
+			logContent += fmt.Sprintf("This password has been saved to: %s\n", logFilePath)
+			logContent += "Please change this password after your first login!\n"
+			logContent += "==========================================\n"
+
+			if err := os.WriteFile(logFilePath, []byte(logContent), 0600); err != nil {
+				log.Warnf("Failed to write password to log file: %v", err)
+			} else {
+				log.Infof("This password has been saved to: %s", logFilePath)
+			}
+
+			log.Infof("Please change this password after your first login!")
+			log.Infof("==========================================")
+		}
+	} else {
+		// Load existing users into cache
+		users, err := o.GetUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			util.DBUsersToCRC32[user.Username] = util.GetDBUserCRC32(user)
+		}
+	}
+
+	return nil
+}
+
+// GetUsers returns all users from the database
+func (o *PostgresDB) GetUsers() ([]model.User, error) {
+	var users []model.User
+
+	rows, err := o.conn.Query("SELECT username, password_hash, admin FROM users")
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user model.User
+		if err := rows.Scan(&user.Username, &user.PasswordHash, &user.Admin); err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// GetUserByName returns a specific user by username
+func (o *PostgresDB) GetUserByName(username string) (model.User, error) {
+	user := model.User{}
+	err := o.conn.QueryRow(
+		"SELECT username, password_hash, admin FROM users WHERE username = $1",
+		username,
+	).Scan(&user.Username, &user.PasswordHash, &user.Admin)
+
+	if err == sql.ErrNoRows {
+		return user, fmt.Errorf("user not found")
+	}
+	return user, err
+}
+
+// SaveUser saves a user to the database
+func (o *PostgresDB) SaveUser(user model.User) error {
+	_, err := o.conn.Exec(
+		`INSERT INTO users (username, password_hash, admin) VALUES ($1, $2, $3)
+		 ON CONFLICT (username) DO UPDATE SET password_hash = EXCLUDED.password_hash, admin = EXCLUDED.admin,
+		 updated_at = CURRENT_TIMESTAMP`,
+		user.Username, user.PasswordHash, user.Admin,
+	)
+	if err != nil {
+		return err
+	}
+
+	util.DBUsersToCRC32[user.Username] = util.GetDBUserCRC32(user)
+	return nil
+}
+
+// DeleteUser deletes a user from the database
+func (o *PostgresDB) DeleteUser(username string) error {
+	_, err := o.conn.Exec("DELETE FROM users WHERE username = $1", username)
+	if err != nil {
+		return err
+	}
+	delete(util.DBUsersToCRC32, username)
+	return nil
+}
+
+// GetGlobalSettings returns global settings from the database
+func (o *PostgresDB) GetGlobalSettings() (model.GlobalSetting, error) {
+	settings := model.GlobalSetting{}
+	var dnsJSON []byte
+	var firewallMark, tableName sql.NullString
+
+	err := o.conn.QueryRow(
+		`SELECT endpoint_address, dns_servers, mtu, persistent_keepalive,
+		 firewall_mark, table_name, config_file_path, updated_at, revision
+		 FROM global_settings WHERE id = 1`,
+	).Scan(
+		&settings.EndpointAddress, &dnsJSON, &settings.MTU, &settings.PersistentKeepalive,
+		&firewallMark, &tableName, &settings.ConfigFilePath, &settings.UpdatedAt, &settings.Revision,
+	)
+
+	if err != nil {
+		return settings, err
+	}
+
+	settings.FirewallMark = firewallMark.String
+	settings.Table = tableName.String
+
+	if err := json.Unmarshal(dnsJSON, &settings.DNSServers); err != nil {
+		return settings, err
+	}
+
+	return settings, nil
+}
+
+// GetServer returns server configuration from the database
+func (o *PostgresDB) GetServer() (model.Server, error) {
+	server := model.Server{}
+
+	// Get server interface
+	serverInterface := model.ServerInterface{}
+	var addressesJSON []byte
+	var postUp, postDown sql.NullString
+
+	err := o.conn.QueryRow(
+		"SELECT addresses, listen_port, post_up, post_down, updated_at, revision FROM server_interface WHERE id = 1",
+	).Scan(&addressesJSON, &serverInterface.ListenPort, &postUp, &postDown, &serverInterface.UpdatedAt, &serverInterface.Revision)
+
+	if err != nil {
+		return server, err
+	}
+
+	serverInterface.PostUp = postUp.String
+	serverInterface.PostDown = postDown.String
+
+	if err := json.Unmarshal(addressesJSON, &serverInterface.Addresses); err != nil {
+		return server, err
+	}
+
+	// Get server keypair
+	serverKeyPair := model.ServerKeypair{}
+	err = o.conn.QueryRow(
+		"SELECT private_key, public_key, updated_at FROM server_keypair WHERE id = 1",
+	).Scan(&serverKeyPair.PrivateKey, &serverKeyPair.PublicKey, &serverKeyPair.UpdatedAt)
+
+	if err != nil {
+		return server, err
+	}
+
+	server.Interface = &serverInterface
+	server.KeyPair = &serverKeyPair
+	return server, nil
+}
+
+// SaveServerInterface saves server interface configuration
+func (o *PostgresDB) SaveServerInterface(serverInterface model.ServerInterface) error {
+	addressesJSON, err := json.Marshal(serverInterface.Addresses)
+	if err != nil {
+		return err
+	}
+
+	serverInterface.UpdatedAt = time.Now().UTC()
+	result, err := o.conn.Exec(
+		`INSERT INTO server_interface (id, addresses, listen_port, post_up, post_down, updated_at, revision)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7::bigint + 1)
+		 ON CONFLICT (id) DO UPDATE SET addresses = EXCLUDED.addresses, listen_port = EXCLUDED.listen_port,
+		 post_up = EXCLUDED.post_up, post_down = EXCLUDED.post_down, updated_at = EXCLUDED.updated_at,
+		 revision = server_interface.revision + 1
+		 WHERE server_interface.revision = $7`,
+		1, string(addressesJSON), serverInterface.ListenPort, serverInterface.PostUp, serverInterface.PostDown, serverInterface.UpdatedAt,
+		serverInterface.Revision,
+	)
+
+	return checkRevision(result, err, "server interface")
+}
+
+// SaveServerKeyPair saves server keypair
+func (o *PostgresDB) SaveServerKeyPair(serverKeyPair model.ServerKeypair) error {
+	serverKeyPair.UpdatedAt = time.Now().UTC()
+	_, err := o.conn.Exec(
+		`INSERT INTO server_keypair (id, private_key, public_key, updated_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (id) DO UPDATE SET private_key = EXCLUDED.private_key, public_key = EXCLUDED.public_key,
+		 updated_at = EXCLUDED.updated_at`,
+		1, serverKeyPair.PrivateKey, serverKeyPair.PublicKey, serverKeyPair.UpdatedAt,
+	)
+
+	return err
+}
+
+// SaveGlobalSettings saves global settings
+func (o *PostgresDB) SaveGlobalSettings(globalSettings model.GlobalSetting) error {
+	dnsJSON, err := json.Marshal(globalSettings.DNSServers)
+	if err != nil {
+		return err
+	}
+
+	globalSettings.UpdatedAt = time.Now().UTC()
+	result, err := o.conn.Exec(
+		`INSERT INTO global_settings (id, endpoint_address, dns_servers, mtu, persistent_keepalive,
+		 firewall_mark, table_name, config_file_path, updated_at, revision)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::bigint + 1)
+		 ON CONFLICT (id) DO UPDATE SET endpoint_address = EXCLUDED.endpoint_address, dns_servers = EXCLUDED.dns_servers,
+		 mtu = EXCLUDED.mtu, persistent_keepalive = EXCLUDED.persistent_keepalive, firewall_mark = EXCLUDED.firewall_mark,
+		 table_name = EXCLUDED.table_name, config_file_path = EXCLUDED.config_file_path, updated_at = EXCLUDED.updated_at,
+		 revision = global_settings.revision + 1
+		 WHERE global_settings.revision = $10`,
+		1, globalSettings.EndpointAddress, string(dnsJSON), globalSettings.MTU, globalSettings.PersistentKeepalive,
+		globalSettings.FirewallMark, globalSettings.Table, globalSettings.ConfigFilePath, globalSettings.UpdatedAt,
+		globalSettings.Revision,
+	)
+
+	return checkRevision(result, err, "global settings")
+}
+
+// checkRevision turns the result of a compare-and-swap upsert into
+// store.ErrRevisionConflict if the stored revision did not match and no row
+// was written.
+func checkRevision(result sql.Result, err error, record string) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", record, store.ErrRevisionConflict)
+	}
+	return nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// clientColumns lists the columns read by scanClient, in order.
+const clientColumns = `id, private_key, public_key, preshared_key, name, email, group_name,
+	subnet_ranges, allocated_ips, allowed_ips, extra_allowed_ips, endpoint,
+	use_server_dns, enabled, created_at, updated_at, deleted_at, deleted_by, config_outdated, interface_name, revision`
+
+// scanClient reads a single client row selected with clientColumns.
+func scanClient(row rowScanner) (model.Client, error) {
+	client := model.Client{}
+	var subnetRangesJSON, allocatedIPsJSON, allowedIPsJSON, extraAllowedIPsJSON []byte
+	var privateKey, presharedKey, email, groupName, endpoint, deletedBy sql.NullString
+	var deletedAt sql.NullTime
+
+	err := row.Scan(
+		&client.ID, &privateKey, &client.PublicKey, &presharedKey, &client.Name,
+		&email, &groupName, &subnetRangesJSON, &allocatedIPsJSON, &allowedIPsJSON,
+		&extraAllowedIPsJSON, &endpoint, &client.UseServerDNS, &client.Enabled,
+		&client.CreatedAt, &client.UpdatedAt, &deletedAt, &deletedBy, &client.ConfigOutdated, &client.Interface, &client.Revision,
+	)
+	if err != nil {
+		return client, err
+	}
+
+	client.PrivateKey = privateKey.String
+	client.PresharedKey = presharedKey.String
+	client.Email = email.String
+	client.Group = groupName.String
+	client.Endpoint = endpoint.String
+	client.DeletedBy = deletedBy.String
+	if deletedAt.Valid {
+		client.DeletedAt = &deletedAt.Time
+	}
+
+	if subnetRangesJSON != nil {
+		if err := json.Unmarshal(subnetRangesJSON, &client.SubnetRanges); err != nil {
+			return client, fmt.Errorf("failed to unmarshal subnet ranges: %v", err)
+		}
+	}
+	if err := json.Unmarshal(allocatedIPsJSON, &client.AllocatedIPs); err != nil {
+		return client, fmt.Errorf("failed to unmarshal allocated IPs: %v", err)
+	}
+	if err := json.Unmarshal(allowedIPsJSON, &client.AllowedIPs); err != nil {
+		return client, fmt.Errorf("failed to unmarshal allowed IPs: %v", err)
+	}
+	if extraAllowedIPsJSON != nil {
+		if err := json.Unmarshal(extraAllowedIPsJSON, &client.ExtraAllowedIPs); err != nil {
+			return client, fmt.Errorf("failed to unmarshal extra allowed IPs: %v", err)
+		}
+	}
+
+	return client, nil
+}
+
+// GetClients returns all clients from the database
+func (o *PostgresDB) GetClients(hasQRCode bool) ([]model.ClientData, error) {
+	return o.queryClients("WHERE deleted_at IS NULL", hasQRCode)
+}
+
+// GetTrashedClients returns the clients that were moved to the trash
+func (o *PostgresDB) GetTrashedClients() ([]model.ClientData, error) {
+	return o.queryClients("WHERE deleted_at IS NOT NULL", false)
+}
+
+// clientSortExprs maps the sort fields of model.ClientQuery to the expression
+// the clients are ordered by and the expression a cursor value is compared with.
+var clientSortExprs = map[string]struct{ column, value string }{
+	"name":       {"LOWER(name)", "LOWER(%s)"},
+	"email":      {"LOWER(COALESCE(email, ''))", "LOWER(%s)"},
+	"group":      {"LOWER(COALESCE(group_name, ''))", "LOWER(%s)"},
+	"created_at": {"created_at", "%s"},
+	"updated_at": {"updated_at", "%s"},
+}
+
+// likeEscaper escapes the LIKE wildcards in a search term, using ! as the
+// escape character.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// QueryClients returns one page of the active clients selected by query
+func (o *PostgresDB) QueryClients(query model.ClientQuery, hasQRCode bool) (model.ClientPage, error) {
+	if err := query.Validate(); err != nil {
+		return model.ClientPage{}, err
+	}
+	cursor, _ := query.DecodeCursor()
+
+	conditions := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if query.Search != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(query.Search)) + "%"
+		conditions = append(conditions, fmt.Sprintf(
+			"(LOWER(name) LIKE %s ESCAPE '!' OR LOWER(COALESCE(email, '')) LIKE %s ESCAPE '!' OR LOWER(COALESCE(group_name, '')) LIKE %s ESCAPE '!')",
+			arg(pattern), arg(pattern), arg(pattern)))
+	}
+	if query.Group != "" {
+		conditions = append(conditions, "group_name = "+arg(query.Group))
+	}
+	if query.Enabled != nil {
+		conditions = append(conditions, "enabled = "+arg(*query.Enabled))
+	}
+	if query.Interface != nil {
+		conditions = append(conditions, "interface_name = "+arg(*query.Interface))
+	}
+	for _, bound := range []struct {
+		column, op string
+		value      time.Time
+	}{
+		{"created_at", ">=", query.CreatedAfter},
+		{"created_at", "<", query.CreatedBefore},
+		{"updated_at", ">=", query.UpdatedAfter},
+		{"updated_at", "<", query.UpdatedBefore},
+	} {
+		if !bound.value.IsZero() {
+			conditions = append(conditions, fmt.Sprintf("%s %s %s", bound.column, bound.op, arg(bound.value)))
+		}
+	}
+
+	field, desc := query.SortField()
+	sort := clientSortExprs[field]
+	order, op := "ASC", ">"
+	if desc {
+		order, op = "DESC", "<"
+	}
+	if cursor.ID != "" {
+		var value interface{} = cursor.Value
+		if query.SortsByTime() {
+			value = query.CursorTime(cursor)
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s %s %s OR (%s = %s AND id %s %s))",
+			sort.column, op, fmt.Sprintf(sort.value, arg(value)),
+			sort.column, fmt.Sprintf(sort.value, arg(value)), op, arg(cursor.ID)))
+	}
+
+	where := "WHERE " + strings.Join(conditions, " AND ") +
+		fmt.Sprintf(" ORDER BY %s %s, id %s", sort.column, order, order)
+	if query.Limit > 0 && len(query.Subnets) == 0 {
+		// One client more than requested tells whether there is a next page
+		where += fmt.Sprintf(" LIMIT %d", query.Limit+1)
+	}
+
+	clients, err := o.queryClients(where, false, args...)
+	if err != nil {
+		return model.ClientPage{}, err
+	}
+	page := query.Page(clients)
+
+	if hasQRCode {
+		ifaces, globalSettings, _ := util.ClientInterfaces(o)
+		for i, clientData := range page.Clients {
+			if clientData.Client.PrivateKey == "" {
+				continue
+			}
+			iface := ifaces[clientData.Client.Interface]
+			png, err := qrcode.Encode(util.BuildClientConfig(*clientData.Client, iface.Server(), iface.Settings(globalSettings)), qrcode.Medium, 256)
+			if err == nil {
+				page.Clients[i].QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+			}
+		}
+	}
+	return page, nil
+}
+
+// queryClients returns the clients matching the given WHERE clause
+func (o *PostgresDB) queryClients(where string, hasQRCode bool, args ...interface{}) ([]model.ClientData, error) {
+	var clients []model.ClientData
+
+	// Load the server configuration before querying the clients, because a
+	// transaction cannot run another query while the rows are still open
+	var ifaces map[string]model.WireGuardInterface
+	var globalSettings model.GlobalSetting
+	if hasQRCode {
+		ifaces, globalSettings, _ = util.ClientInterfaces(o)
+	}
+
+	rows, err := o.conn.Query("SELECT "+clientColumns+" FROM clients "+where, args...)
+	if err != nil {
+		return clients, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		client, err := scanClient(rows)
+		if err != nil {
+			return clients, err
+		}
+
+		clientData := model.ClientData{Client: &client}
+
+		// Generate QR code if requested
+		if hasQRCode && client.PrivateKey != "" {
+			iface := ifaces[client.Interface]
+			png, err := qrcode.Encode(util.BuildClientConfig(client, iface.Server(), iface.Settings(globalSettings)), qrcode.Medium, 256)
+			if err == nil {
+				clientData.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+			}
+		}
+
+		clients = append(clients, clientData)
+	}
+
+	return clients, rows.Err()
+}
+
+// GetClientByID returns a specific client by ID
+func (o *PostgresDB) GetClientByID(clientID string, qrCodeSettings model.QRCodeSettings) (model.ClientData, error) {
+	clientData := model.ClientData{}
+
+	client, err := scanClient(o.conn.QueryRow("SELECT "+clientColumns+" FROM clients WHERE id = $1", clientID))
+	if err == sql.ErrNoRows {
+		return clientData, fmt.Errorf("client not found")
+	}
+	if err != nil {
+		return clientData, err
+	}
+
+	clientData.Client = &client
+
+	// Generate QR code if requested
+	if qrCodeSettings.Enabled && client.PrivateKey != "" {
+		server, globalSettings, _ := util.ClientServer(o, client)
+
+		if !qrCodeSettings.IncludeDNS {
+			globalSettings.DNSServers = []string{}
+		}
+		if !qrCodeSettings.IncludeMTU {
+			globalSettings.MTU = 0
+		}
+
+		png, err := qrcode.Encode(util.BuildClientConfig(client, server, globalSettings), qrcode.Medium, 256)
+		if err == nil {
+			clientData.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+		}
+	}
+
+	return clientData, nil
+}
+
+// SaveClient saves a client to the database
+func (o *PostgresDB) SaveClient(client model.Client) error {
+	subnetRangesJSON, _ := json.Marshal(client.SubnetRanges)
+	allocatedIPsJSON, err := json.Marshal(client.AllocatedIPs)
+	if err != nil {
+		return err
+	}
+	allowedIPsJSON, err := json.Marshal(client.AllowedIPs)
+	if err != nil {
+		return err
+	}
+	extraAllowedIPsJSON, _ := json.Marshal(client.ExtraAllowedIPs)
+
+	// Use NULL for empty strings
+	var privateKey, presharedKey, email, groupName, endpoint interface{}
+	if client.PrivateKey != "" {
+		privateKey = client.PrivateKey
+	}
+	if client.PresharedKey != "" {
+		presharedKey = client.PresharedKey
+	}
+	if client.Email != "" {
+		email = client.Email
+	}
+	if client.Group != "" {
+		groupName = client.Group
+	}
+	if client.Endpoint != "" {
+		endpoint = client.Endpoint
+	}
+	var deletedAt, deletedBy interface{}
+	if client.DeletedAt != nil {
+		deletedAt = client.DeletedAt.UTC()
+		deletedBy = client.DeletedBy
+	}
+
+	result, err := o.conn.Exec(`
+		INSERT INTO clients (id, private_key, public_key, preshared_key, name, email, group_name,
+		subnet_ranges, allocated_ips, allowed_ips, extra_allowed_ips, endpoint,
+		use_server_dns, enabled, created_at, updated_at, deleted_at, deleted_by, config_outdated, interface_name, revision)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $22, $21::bigint + 1)
+		ON CONFLICT (id) DO UPDATE SET
+		private_key = EXCLUDED.private_key, public_key = EXCLUDED.public_key, preshared_key = EXCLUDED.preshared_key,
+		name = EXCLUDED.name, email = EXCLUDED.email, group_name = EXCLUDED.group_name,
+		subnet_ranges = EXCLUDED.subnet_ranges, allocated_ips = EXCLUDED.allocated_ips, allowed_ips = EXCLUDED.allowed_ips,
+		extra_allowed_ips = EXCLUDED.extra_allowed_ips, endpoint = EXCLUDED.endpoint,
+		use_server_dns = EXCLUDED.use_server_dns, enabled = EXCLUDED.enabled, updated_at = $20,
+		deleted_at = EXCLUDED.deleted_at, deleted_by = EXCLUDED.deleted_by, config_outdated = EXCLUDED.config_outdated,
+		interface_name = EXCLUDED.interface_name, revision = clients.revision + 1
+		WHERE clients.revision = $21
+	`,
+		client.ID, privateKey, client.PublicKey, presharedKey, client.Name, email, groupName,
+		string(subnetRangesJSON), string(allocatedIPsJSON), string(allowedIPsJSON), string(extraAllowedIPsJSON), endpoint,
+		client.UseServerDNS, client.Enabled, client.CreatedAt, client.UpdatedAt, deletedAt, deletedBy, client.ConfigOutdated,
+		time.Now().UTC(), client.Revision, client.Interface,
+	)
+
+	return checkRevision(result, err, "client "+client.ID)
+}
+
+// DeleteClient deletes a client from the database
+func (o *PostgresDB) DeleteClient(clientID string) error {
+	_, err := o.conn.Exec("DELETE FROM clients WHERE id = $1", clientID)
+	return err
+}
+
+// GetPath returns an empty string for PostgreSQL (not file-based)
+func (o *PostgresDB) GetPath() string {
+	return ""
+}
+
+// GetHashes returns configuration hashes and the state of the last apply
+func (o *PostgresDB) GetHashes() (model.ClientServerHashes, error) {
+	hashes := model.ClientServerHashes{}
+	var appliedState sql.NullString
+	var appliedAt sql.NullTime
+	err := o.conn.QueryRow(
+		"SELECT client_hash, server_hash, applied_state, applied_at FROM hashes WHERE id = 1",
+	).Scan(&hashes.Client, &hashes.Server, &appliedState, &appliedAt)
+	if err != nil {
+		return hashes, err
+	}
+	if appliedState.Valid {
+		hashes.Applied = &model.ConfigState{}
+		if err := json.Unmarshal([]byte(appliedState.String), hashes.Applied); err != nil {
+			return hashes, err
+		}
+	}
+	if appliedAt.Valid {
+		hashes.AppliedAt = &appliedAt.Time
+	}
+	return hashes, nil
+}
+
+// SaveHashes saves configuration hashes and the state of the last apply
+func (o *PostgresDB) SaveHashes(hashes model.ClientServerHashes) error {
+	var appliedState, appliedAt interface{}
+	if hashes.Applied != nil {
+		data, err := json.Marshal(hashes.Applied)
+		if err != nil {
+			return err
+		}
+		appliedState = string(data)
+	}
+	if hashes.AppliedAt != nil {
+		appliedAt = hashes.AppliedAt.UTC()
+	}
+	_, err := o.conn.Exec(
+		`INSERT INTO hashes (id, client_hash, server_hash, applied_state, applied_at) VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (id) DO UPDATE SET client_hash = EXCLUDED.client_hash, server_hash = EXCLUDED.server_hash,
+		 applied_state = EXCLUDED.applied_state, applied_at = EXCLUDED.applied_at, updated_at = CURRENT_TIMESTAMP`,
+		1, hashes.Client, hashes.Server, appliedState, appliedAt,
+	)
+	return err
+}
+
+// scanAPIKey reads a single API key row.
+func scanAPIKey(row rowScanner) (model.APIKey, error) {
+	key := model.APIKey{}
+	var permissionsJSON []byte
+	var keyPrefix sql.NullString
+	var lastUsedAt sql.NullTime
+
+	if err := row.Scan(&key.ID, &key.Name, &key.Key, &keyPrefix, &permissionsJSON, &key.Enabled, &key.CreatedAt, &key.UpdatedAt, &lastUsedAt); err != nil {
+		return key, err
+	}
+
+	key.KeyPrefix = keyPrefix.String
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+
+	if err := json.Unmarshal(permissionsJSON, &key.Permissions); err != nil {
+		return key, err
+	}
+
+	return key, nil
+}
+
+// GetAPIKeys returns all API keys from the database
+func (o *PostgresDB) GetAPIKeys() ([]model.APIKey, error) {
+	var keys []model.APIKey
+
+	rows, err := o.conn.Query(`
+		SELECT id, name, key_value, key_prefix, permissions, enabled, created_at, updated_at, last_used_at
+		FROM api_keys
+	`)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByID returns a specific API key by ID
+func (o *PostgresDB) GetAPIKeyByID(keyID string) (model.APIKey, error) {
+	key, err := scanAPIKey(o.conn.QueryRow(`
+		SELECT id, name, key_value, key_prefix, permissions, enabled, created_at, updated_at, last_used_at
+		FROM api_keys WHERE id = $1
+	`, keyID))
+
+	if err == sql.ErrNoRows {
+		return key, fmt.Errorf("API key not found")
+	}
+	return key, err
+}
+
+// GetAPIKeyByKey returns a specific API key by the key value
+func (o *PostgresDB) GetAPIKeyByKey(keyValue string) (model.APIKey, error) {
+	key, err := scanAPIKey(o.conn.QueryRow(`
+		SELECT id, name, key_value, key_prefix, permissions, enabled, created_at, updated_at, last_used_at
+		FROM api_keys WHERE key_value = $1
+	`, keyValue))
+
+	if err == sql.ErrNoRows {
+		return key, fmt.Errorf("API key not found")
+	}
+	return key, err
+}
+
+// SaveAPIKey saves an API key to the database
+func (o *PostgresDB) SaveAPIKey(key model.APIKey) error {
+	permissionsJSON, err := json.Marshal(key.Permissions)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.conn.Exec(`
+		INSERT INTO api_keys (id, name, key_value, key_prefix, permissions, enabled, created_at, updated_at, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+		name = EXCLUDED.name, key_value = EXCLUDED.key_value, key_prefix = EXCLUDED.key_prefix,
+		permissions = EXCLUDED.permissions, enabled = EXCLUDED.enabled, updated_at = $10,
+		last_used_at = EXCLUDED.last_used_at
+	`,
+		key.ID, key.Name, key.Key, key.KeyPrefix, string(permissionsJSON), key.Enabled, key.CreatedAt, key.UpdatedAt, key.LastUsedAt,
+		time.Now().UTC(),
+	)
+
+	return err
+}
+
+// DeleteAPIKey deletes an API key from the database
+func (o *PostgresDB) DeleteAPIKey(keyID string) error {
+	_, err := o.conn.Exec("DELETE FROM api_keys WHERE id = $1", keyID)
+	return err
+}
+
+// GetDataKeys returns all wrapped data keys from the database
+func (o *PostgresDB) GetDataKeys() ([]model.DataKey, error) {
+	var keys []model.DataKey
+
+	rows, err := o.conn.Query("SELECT id, provider, wrapped_key, created_at FROM data_keys")
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key := model.DataKey{}
+		if err := rows.Scan(&key.ID, &key.Provider, &key.WrappedKey, &key.CreatedAt); err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// SaveDataKey saves a wrapped data key to the database
+func (o *PostgresDB) SaveDataKey(key model.DataKey) error {
+	_, err := o.conn.Exec(`
+		INSERT INTO data_keys (id, provider, wrapped_key, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET provider = EXCLUDED.provider, wrapped_key = EXCLUDED.wrapped_key
+	`, key.ID, key.Provider, key.WrappedKey, key.CreatedAt)
+	return err
+}
+
+// DeleteDataKey deletes a wrapped data key from the database
+func (o *PostgresDB) DeleteDataKey(keyID string) error {
+	_, err := o.conn.Exec("DELETE FROM data_keys WHERE id = $1", keyID)
+	return err
+}
+
+// GetIPReservations returns all IP reservations from the database
+func (o *PostgresDB) GetIPReservations() ([]model.IPReservation, error) {
+	var reservations []model.IPReservation
+
+	rows, err := o.conn.Query("SELECT id, address, description, created_by, created_at FROM ip_reservations ORDER BY created_at")
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reservation := model.IPReservation{}
+		if err := rows.Scan(&reservation.ID, &reservation.Address, &reservation.Description, &reservation.CreatedBy, &reservation.CreatedAt); err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, rows.Err()
+}
+
+// SaveIPReservation saves an IP reservation to the database
+func (o *PostgresDB) SaveIPReservation(reservation model.IPReservation) error {
+	_, err := o.conn.Exec(`
+		INSERT INTO ip_reservations (id, address, description, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET address = EXCLUDED.address, description = EXCLUDED.description
+	`, reservation.ID, reservation.Address, reservation.Description, reservation.CreatedBy, reservation.CreatedAt)
+	return err
+}
+
+// DeleteIPReservation deletes an IP reservation from the database
+func (o *PostgresDB) DeleteIPReservation(id string) error {
+	_, err := o.conn.Exec("DELETE FROM ip_reservations WHERE id = $1", id)
+	return err
+}
+
+// GetSubnetRanges returns all subnet ranges ordered by position and name
+func (o *PostgresDB) GetSubnetRanges() ([]model.SubnetRange, error) {
+	var ranges []model.SubnetRange
+
+	rows, err := o.conn.Query("SELECT id, name, cidrs, position, created_at, updated_at FROM subnet_ranges ORDER BY position, name")
+	if err != nil {
+		return ranges, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var subnetRange model.SubnetRange
+		var cidrsJSON []byte
+		if err := rows.Scan(&subnetRange.ID, &subnetRange.Name, &cidrsJSON, &subnetRange.Position, &subnetRange.CreatedAt, &subnetRange.UpdatedAt); err != nil {
+			return ranges, err
+		}
+		if err := json.Unmarshal(cidrsJSON, &subnetRange.CIDRs); err != nil {
+			return ranges, err
+		}
+		ranges = append(ranges, subnetRange)
+	}
+
+	return ranges, rows.Err()
+}
+
+// SaveSubnetRange saves a subnet range to the database
+func (o *PostgresDB) SaveSubnetRange(subnetRange model.SubnetRange) error {
+	cidrsJSON, err := json.Marshal(subnetRange.CIDRs)
+	if err != nil {
+		return err
+	}
+	_, err = o.conn.Exec(`
+		INSERT INTO subnet_ranges (id, name, cidrs, position, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, cidrs = EXCLUDED.cidrs, position = EXCLUDED.position, updated_at = EXCLUDED.updated_at
+	`, subnetRange.ID, subnetRange.Name, string(cidrsJSON), subnetRange.Position, subnetRange.CreatedAt, subnetRange.UpdatedAt)
+	return err
+}
+
+// DeleteSubnetRange deletes a subnet range from the database
+func (o *PostgresDB) DeleteSubnetRange(id string) error {
+	_, err := o.conn.Exec("DELETE FROM subnet_ranges WHERE id = $1", id)
+	return err
+}
+
+// WireGuard Interfaces
+
+// interfaceColumns lists the columns read by scanWireGuardInterface, in order.
+const interfaceColumns = `name, description, private_key, public_key, addresses, listen_port, post_up, pre_down, post_down,
+	mtu, dns_servers, config_file_path, node_id, applied_state, applied_at, created_at, updated_at, revision`
+
+// GetWireGuardInterfaces returns the interfaces besides the primary one, ordered by name
+func (o *PostgresDB) GetWireGuardInterfaces() ([]model.WireGuardInterface, error) {
+	var ifaces []model.WireGuardInterface
+
+	rows, err := o.conn.Query("SELECT " + interfaceColumns + " FROM wireguard_interfaces ORDER BY name")
+	if err != nil {
+		return ifaces, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		iface, err := scanWireGuardInterface(rows)
+		if err != nil {
+			return ifaces, err
+		}
+		ifaces = append(ifaces, iface)
+	}
+
+	return ifaces, rows.Err()
+}
+
+// GetWireGuardInterface returns an interface by its name
+func (o *PostgresDB) GetWireGuardInterface(name string) (model.WireGuardInterface, error) {
+	iface, err := scanWireGuardInterface(o.conn.QueryRow("SELECT "+interfaceColumns+" FROM wireguard_interfaces WHERE name = $1", name))
+	if err == sql.ErrNoRows {
+		return iface, fmt.Errorf("interface %s not found", name)
+	}
+	return iface, err
+}
+
+// scanWireGuardInterface reads an interface selected with interfaceColumns
+func scanWireGuardInterface(row rowScanner) (model.WireGuardInterface, error) {
+	iface := model.WireGuardInterface{}
+	var addressesJSON, dnsJSON []byte
+	var appliedState sql.NullString
+	var appliedAt sql.NullTime
+	err := row.Scan(&iface.Name, &iface.Description, &iface.PrivateKey, &iface.PublicKey, &addressesJSON,
+		&iface.ListenPort, &iface.PostUp, &iface.PreDown, &iface.PostDown, &iface.MTU, &dnsJSON,
+		&iface.ConfigFilePath, &iface.Node, &appliedState, &appliedAt, &iface.CreatedAt, &iface.UpdatedAt, &iface.Revision)
+	if err != nil {
+		return iface, err
+	}
+	if err := json.Unmarshal(addressesJSON, &iface.Addresses); err != nil {
+		return iface, fmt.Errorf("failed to unmarshal addresses: %v", err)
+	}
+	if err := json.Unmarshal(dnsJSON, &iface.DNSServers); err != nil {
+		return iface, fmt.Errorf("failed to unmarshal DNS servers: %v", err)
+	}
+	if appliedState.Valid {
+		iface.Applied = &model.ConfigState{}
+		if err := json.Unmarshal([]byte(appliedState.String), iface.Applied); err != nil {
+			return iface, err
+		}
+	}
+	if appliedAt.Valid {
+		iface.AppliedAt = &appliedAt.Time
+	}
+	return iface, nil
+}
+
+// SaveWireGuardInterface saves an interface to the database. The applied state
+// is left unchanged.
+func (o *PostgresDB) SaveWireGuardInterface(iface model.WireGuardInterface) error {
+	addressesJSON, err := json.Marshal(iface.Addresses)
+	if err != nil {
+		return err
+	}
+	dnsJSON, err := json.Marshal(iface.DNSServers)
+	if err != nil {
+		return err
+	}
+
+	result, err := o.conn.Exec(`
+		INSERT INTO wireguard_interfaces (name, description, private_key, public_key, addresses, listen_port,
+		post_up, pre_down, post_down, mtu, dns_servers, config_file_path, node_id, created_at, updated_at, revision)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16::bigint + 1)
+		ON CONFLICT (name) DO UPDATE SET
+		description = EXCLUDED.description, private_key = EXCLUDED.private_key, public_key = EXCLUDED.public_key,
+		addresses = EXCLUDED.addresses, listen_port = EXCLUDED.listen_port, post_up = EXCLUDED.post_up,
+		pre_down = EXCLUDED.pre_down, post_down = EXCLUDED.post_down, mtu = EXCLUDED.mtu,
+		dns_servers = EXCLUDED.dns_servers, config_file_path = EXCLUDED.config_file_path, node_id = EXCLUDED.node_id,
+		updated_at = EXCLUDED.updated_at, revision = wireguard_interfaces.revision + 1
+		WHERE wireguard_interfaces.revision = $16
+	`,
+		iface.Name, iface.Description, iface.PrivateKey, iface.PublicKey, string(addressesJSON), iface.ListenPort,
+		iface.PostUp, iface.PreDown, iface.PostDown, iface.MTU, string(dnsJSON), iface.ConfigFilePath, iface.Node,
+		iface.CreatedAt, time.Now().UTC(), iface.Revision,
+	)
+
+	return checkRevision(result, err, "interface "+iface.Name)
+}
+
+// SaveWireGuardInterfaceApplied records the state of the last successful apply of an interface
+func (o *PostgresDB) SaveWireGuardInterfaceApplied(name string, state model.ConfigState, appliedAt time.Time) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	result, err := o.conn.Exec("UPDATE wireguard_interfaces SET applied_state = $1, applied_at = $2 WHERE name = $3",
+		string(data), appliedAt.UTC(), name)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("interface %s not found", name)
+	}
+	return err
+}
+
+// DeleteWireGuardInterface deletes an interface from the database
+func (o *PostgresDB) DeleteWireGuardInterface(name string) error {
+	_, err := o.conn.Exec("DELETE FROM wireguard_interfaces WHERE name = $1", name)
+	return err
+}
+
+// Nodes
+
+// GetNodes returns all nodes ordered by name
+func (o *PostgresDB) GetNodes() ([]model.Node, error) {
+	var nodes []model.Node
+
+	rows, err := o.conn.Query("SELECT id, name, description, url, token, ca_cert, created_at, updated_at, revision FROM nodes ORDER BY name")
+	if err != nil {
+		return nodes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		node, err := scanNode(rows)
+		if err != nil {
+			return nodes, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, rows.Err()
+}
+
+// GetNode returns a node by its ID
+func (o *PostgresDB) GetNode(id string) (model.Node, error) {
+	node, err := scanNode(o.conn.QueryRow("SELECT id, name, description, url, token, ca_cert, created_at, updated_at, revision FROM nodes WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return node, fmt.Errorf("node %s not found", id)
+	}
+	return node, err
+}
+
+// scanNode reads a node row
+func scanNode(row rowScanner) (model.Node, error) {
+	node := model.Node{}
+	err := row.Scan(&node.ID, &node.Name, &node.Description, &node.URL, &node.Token, &node.CACert,
+		&node.CreatedAt, &node.UpdatedAt, &node.Revision)
+	return node, err
+}
+
+// SaveNode saves a node to the database
+func (o *PostgresDB) SaveNode(node model.Node) error {
+	result, err := o.conn.Exec(`
+		INSERT INTO nodes (id, name, description, url, token, ca_cert, created_at, updated_at, revision)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::bigint + 1)
+		ON CONFLICT (id) DO UPDATE SET
+		name = EXCLUDED.name, description = EXCLUDED.description, url = EXCLUDED.url, token = EXCLUDED.token,
+		ca_cert = EXCLUDED.ca_cert, updated_at = EXCLUDED.updated_at, revision = nodes.revision + 1
+		WHERE nodes.revision = $9
+	`,
+		node.ID, node.Name, node.Description, node.URL, node.Token, node.CACert,
+		node.CreatedAt, time.Now().UTC(), node.Revision,
+	)
+
+	return checkRevision(result, err, "node "+node.ID)
+}
+
+// DeleteNode deletes a node from the database
+func (o *PostgresDB) DeleteNode(id string) error {
+	_, err := o.conn.Exec("DELETE FROM nodes WHERE id = $1", id)
+	return err
+}
+
+// Config Revisions
+
+// GetConfigRevisions returns all config revisions, newest first
+func (o *PostgresDB) GetConfigRevisions() ([]model.ConfigRevision, error) {
+	var revisions []model.ConfigRevision
+
+	rows, err := o.conn.Query(`
+		SELECT id, path, content, author, comment, result, error, rollback_of, restored_id, created_at
+		FROM config_revisions ORDER BY id DESC
+	`)
+	if err != nil {
+		return revisions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		revision, err := scanConfigRevision(rows)
+		if err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+// GetConfigRevision returns a config revision by its number
+func (o *PostgresDB) GetConfigRevision(id int) (model.ConfigRevision, error) {
+	revision, err := scanConfigRevision(o.conn.QueryRow(`
+		SELECT id, path, content, author, comment, result, error, rollback_of, restored_id, created_at
+		FROM config_revisions WHERE id = $1
+	`, id))
+
+	if err == sql.ErrNoRows {
+		return revision, fmt.Errorf("config revision %d not found", id)
+	}
+	return revision, err
+}
+
+// scanConfigRevision reads a config revision from a row
+func scanConfigRevision(row rowScanner) (model.ConfigRevision, error) {
+	revision := model.ConfigRevision{}
+	err := row.Scan(&revision.ID, &revision.Path, &revision.Content, &revision.Author, &revision.Comment,
+		&revision.Result, &revision.Error, &revision.RollbackOf, &revision.RestoredID, &revision.CreatedAt)
+	return revision, err
+}
+
+// AddConfigRevision saves a new config revision numbered after the newest
+// one. The plain insert fails if another writer took the number in the
+// meantime.
+func (o *PostgresDB) AddConfigRevision(revision model.ConfigRevision) (int, error) {
+	if err := o.conn.QueryRow("SELECT COALESCE(MAX(id), 0) + 1 FROM config_revisions").Scan(&revision.ID); err != nil {
+		return 0, err
+	}
+	_, err := o.conn.Exec(`
+		INSERT INTO config_revisions (id, path, content, author, comment, result, error, rollback_of, restored_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, revision.ID, revision.Path, revision.Content, revision.Author, revision.Comment,
+		revision.Result, revision.Error, revision.RollbackOf, revision.RestoredID, revision.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return revision.ID, nil
+}
+
+// SaveConfigRevision saves a config revision to the database. An existing
+// revision only has its content and result updated.
+func (o *PostgresDB) SaveConfigRevision(revision model.ConfigRevision) error {
+	_, err := o.conn.Exec(`
+		INSERT INTO config_revisions (id, path, content, author, comment, result, error, rollback_of, restored_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET content = EXCLUDED.content, result = EXCLUDED.result, error = EXCLUDED.error, restored_id = EXCLUDED.restored_id
+	`, revision.ID, revision.Path, revision.Content, revision.Author, revision.Comment,
+		revision.Result, revision.Error, revision.RollbackOf, revision.RestoredID, revision.CreatedAt)
+	return err
+}
+
+// DeleteConfigRevision deletes a config revision from the database
+func (o *PostgresDB) DeleteConfigRevision(id int) error {
+	_, err := o.conn.Exec("DELETE FROM config_revisions WHERE id = $1", id)
+	return err
+}
+
+// SaveAPIAccessLog saves an API access log entry to the database
+func (o *PostgresDB) SaveAPIAccessLog(log model.APIAccessLog) error {
+	_, err := o.conn.Exec(`
+		INSERT INTO api_access_logs (id, api_key_id, api_key_name, endpoint, method, ip_address, user_agent, status_code, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`,
+		log.ID, log.APIKeyID, log.APIKeyName, log.Endpoint, log.Method, log.IPAddress, log.UserAgent, log.StatusCode, log.Timestamp,
+	)
+
+	return err
+}
+
+// queryAPIAccessLogs runs a query selecting API access log rows.
+func (o *PostgresDB) queryAPIAccessLogs(query string, args ...interface{}) ([]model.APIAccessLog, error) {
+	var logs []model.APIAccessLog
+
+	rows, err := o.conn.Query(query, args...)
+	if err != nil {
+		return logs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		log := model.APIAccessLog{}
+		var userAgent sql.NullString
+
+		err := rows.Scan(&log.ID, &log.APIKeyID, &log.APIKeyName, &log.Endpoint, &log.Method, &log.IPAddress, &userAgent, &log.StatusCode, &log.Timestamp)
+		if err != nil {
+			return logs, err
+		}
+
+		log.UserAgent = userAgent.String
+		logs = append(logs, log)
+	}
+
+	return logs, rows.Err()
+}
+
+// GetAPIAccessLogs returns the most recent API access logs
+func (o *PostgresDB) GetAPIAccessLogs(limit int) ([]model.APIAccessLog, error) {
+	query := "SELECT id, api_key_id, api_key_name, endpoint, method, ip_address, user_agent, status_code, timestamp FROM api_access_logs ORDER BY timestamp DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	return o.queryAPIAccessLogs(query)
+}
+
+// GetAPIAccessLogsByKeyID returns API access logs for a specific API key
+func (o *PostgresDB) GetAPIAccessLogsByKeyID(keyID string, limit int) ([]model.APIAccessLog, error) {
+	query := "SELECT id, api_key_id, api_key_name, endpoint, method, ip_address, user_agent, status_code, timestamp FROM api_access_logs WHERE api_key_id = $1 ORDER BY timestamp DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	return o.queryAPIAccessLogs(query, keyID)
+}
+
+// Security Management
+
+func (db *PostgresDB) GetSecuritySettings() (model.SecuritySettings, error) {
+	settings := model.SecuritySettings{}
+
+	query := `
+SELECT brute_force_enabled, brute_force_max_attempts, brute_force_window_minutes,
+       brute_force_block_minutes, ip_blocking_enabled, geoip_enabled,
+       geoip_default_action, updated_at, revision
+FROM security_settings
+LIMIT 1
+`
+
+	err := db.conn.QueryRow(query).Scan(
+		&settings.BruteForceEnabled,
+		&settings.BruteForceMaxAttempts,
+		&settings.BruteForceWindowMinutes,
+		&settings.BruteForceBlockMinutes,
+		&settings.IPBlockingEnabled,
+		&settings.GeoIPEnabled,
+		&settings.GeoIPDefaultAction,
+		&settings.UpdatedAt,
+		&settings.Revision,
+	)
+
+	if err == sql.ErrNoRows {
+		// Save default settings if none exist, then read them back with their revision
+		if err := db.SaveSecuritySettings(model.DefaultSecuritySettings()); err != nil {
+			return model.DefaultSecuritySettings(), err
+		}
+		return db.GetSecuritySettings()
+	}
+
+	if err != nil {
+		return model.SecuritySettings{}, err
+	}
+
+	return settings, nil
+}
+
+func (db *PostgresDB) SaveSecuritySettings(settings model.SecuritySettings) error {
+	query := `
+INSERT INTO security_settings (
+id, brute_force_enabled, brute_force_max_attempts, brute_force_window_minutes,
+brute_force_block_minutes, ip_blocking_enabled, geoip_enabled,
+geoip_default_action, updated_at, revision
+) VALUES (1, $1, $2, $3, $4, $5, $6, $7, $8, $9::bigint + 1)
+ON CONFLICT (id) DO UPDATE SET
+brute_force_enabled = EXCLUDED.brute_force_enabled,
+brute_force_max_attempts = EXCLUDED.brute_force_max_attempts,
+brute_force_window_minutes = EXCLUDED.brute_force_window_minutes,
+brute_force_block_minutes = EXCLUDED.brute_force_block_minutes,
+ip_blocking_enabled = EXCLUDED.ip_blocking_enabled,
+geoip_enabled = EXCLUDED.geoip_enabled,
+geoip_default_action = EXCLUDED.geoip_default_action,
+updated_at = EXCLUDED.updated_at,
+revision = security_settings.revision + 1
+WHERE security_settings.revision = $9
+`
+
+	result, err := db.conn.Exec(query,
+		settings.BruteForceEnabled,
+		settings.BruteForceMaxAttempts,
+		settings.BruteForceWindowMinutes,
+		settings.BruteForceBlockMinutes,
+		settings.IPBlockingEnabled,
+		settings.GeoIPEnabled,
+		settings.GeoIPDefaultAction,
+		settings.UpdatedAt,
+		settings.Revision,
+	)
+
+	return checkRevision(result, err, "security settings")
+}
+
+// Audit Log
+
+func (db *PostgresDB) SaveAuditEntry(entry model.AuditEntry) error {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+
+	query := `
+INSERT INTO audit_log (id, actor, action, target_type, target_id, source_ip, changes, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+`
+
+	_, err = db.conn.Exec(query,
+		entry.ID,
+		entry.Actor,
+		entry.Action,
+		entry.TargetType,
+		entry.TargetID,
+		entry.SourceIP,
+		string(changes),
+		entry.CreatedAt.UTC(),
+	)
+
+	return err
+}
+
+func (db *PostgresDB) GetAuditEntries(filter model.AuditFilter) ([]model.AuditEntry, error) {
+	var entries []model.AuditEntry
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, fmt.Sprintf("$%d", len(args))))
+	}
+
+	if filter.Actor != "" {
+		add("actor = %s", filter.Actor)
+	}
+	if filter.Action != "" {
+		add("action = %s", filter.Action)
+	}
+	if filter.TargetType != "" {
+		add("target_type = %s", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		add("target_id = %s", filter.TargetID)
+	}
+	if !filter.Since.IsZero() {
+		add("created_at >= %s", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		add("created_at < %s", filter.Until.UTC())
+	}
+
+	query := "SELECT id, actor, action, target_type, target_id, source_ip, changes, created_at FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY created_at DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := model.AuditEntry{}
+		var changes []byte
+		err := rows.Scan(
+			&entry.ID,
+			&entry.Actor,
+			&entry.Action,
+			&entry.TargetType,
+			&entry.TargetID,
+			&entry.SourceIP,
+			&changes,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return entries, err
+		}
+		if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+			return entries, fmt.Errorf("failed to unmarshal audit changes: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// Security Events
+
+func (db *PostgresDB) SaveSecurityEvent(event model.SecurityEvent) error {
+	query := `
+INSERT INTO security_events (id, event_type, ip, country, username, description, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+	_, err := db.conn.Exec(query,
+		event.ID,
+		event.EventType,
+		event.IP,
+		event.Country,
+		event.Username,
+		event.Description,
+		event.CreatedAt,
+	)
+
+	return err
+}
+
+// querySecurityEvents runs a query selecting security event rows.
+func (db *PostgresDB) querySecurityEvents(query string, args ...interface{}) ([]model.SecurityEvent, error) {
+	var events []model.SecurityEvent
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := model.SecurityEvent{}
+		err := rows.Scan(
+			&event.ID,
+			&event.EventType,
+			&event.IP,
+			&event.Country,
+			&event.Username,
+			&event.Description,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func (db *PostgresDB) GetSecurityEvents(limit int) ([]model.SecurityEvent, error) {
+	query := `
+SELECT id, event_type, ip, COALESCE(country, ''), COALESCE(username, ''), description, created_at
+FROM security_events
+ORDER BY created_at DESC
+`
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	return db.querySecurityEvents(query)
+}
+
+func (db *PostgresDB) GetSecurityEventsByType(eventType string, limit int) ([]model.SecurityEvent, error) {
+	query := `
+SELECT id, event_type, ip, COALESCE(country, ''), COALESCE(username, ''), description, created_at
+FROM security_events
+WHERE event_type = $1
+ORDER BY created_at DESC
+`
+
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	return db.querySecurityEvents(query, eventType)
+}
+
+// IP Blocking
+
+// scanIPBlock reads a single IP block row.
+func scanIPBlock(row rowScanner) (model.IPBlock, error) {
+	block := model.IPBlock{}
+	var expiresAt sql.NullTime
+
+	err := row.Scan(
+		&block.ID,
+		&block.IP,
+		&block.Reason,
+		&block.BlockedBy,
+		&block.Permanent,
+		&expiresAt,
+		&block.CreatedAt,
+	)
+	if err != nil {
+		return model.IPBlock{}, err
+	}
+
+	if expiresAt.Valid {
+		block.ExpiresAt = expiresAt.Time
+	}
+
+	return block, nil
+}
+
+func (db *PostgresDB) GetIPBlocks() ([]model.IPBlock, error) {
+	var blocks []model.IPBlock
+
+	query := `
+SELECT id, ip, COALESCE(reason, ''), blocked_by, permanent, expires_at, created_at
+FROM ip_blocks
+WHERE permanent = TRUE OR (expires_at IS NOT NULL AND expires_at > NOW())
+ORDER BY created_at DESC
+`
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return blocks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		block, err := scanIPBlock(rows)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, rows.Err()
+}
+
+func (db *PostgresDB) GetIPBlockByIP(ip string) (model.IPBlock, error) {
+	query := `
+SELECT id, ip, COALESCE(reason, ''), blocked_by, permanent, expires_at, created_at
+FROM ip_blocks
+WHERE ip = $1 AND (permanent = TRUE OR (expires_at IS NOT NULL AND expires_at > NOW()))
+LIMIT 1
+`
+
+	return scanIPBlock(db.conn.QueryRow(query, ip))
+}
+
+func (db *PostgresDB) SaveIPBlock(block model.IPBlock) error {
+	query := `
+INSERT INTO ip_blocks (id, ip, reason, blocked_by, permanent, expires_at, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (id) DO UPDATE SET
+reason = EXCLUDED.reason,
+permanent = EXCLUDED.permanent,
+expires_at = EXCLUDED.expires_at
+`
+
+	var expiresAt interface{}
+	if !block.ExpiresAt.IsZero() {
+		expiresAt = block.ExpiresAt
+	}
+
+	_, err := db.conn.Exec(query,
+		block.ID,
+		block.IP,
+		block.Reason,
+		block.BlockedBy,
+		block.Permanent,
+		expiresAt,
+		block.CreatedAt,
+	)
+
+	return err
+}
+
+func (db *PostgresDB) DeleteIPBlock(id string) error {
+	query := `DELETE FROM ip_blocks WHERE id = $1`
+	_, err := db.conn.Exec(query, id)
+	return err
+}
+
+func (db *PostgresDB) IsIPBlocked(ip string) (bool, error) {
+	var count int
+
+	query := `
+SELECT COUNT(*) FROM ip_blocks
+WHERE ip = $1 AND (permanent = TRUE OR (expires_at IS NOT NULL AND expires_at > NOW()))
+`
+
+	err := db.conn.QueryRow(query, ip).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GeoIP Rules
+
+func (db *PostgresDB) GetGeoIPRules() ([]model.GeoIPRule, error) {
+	var rules []model.GeoIPRule
+
+	query := `
+SELECT id, country_code, COALESCE(country_name, ''), action, created_by, created_at
+FROM geoip_rules
+ORDER BY country_code ASC
+`
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rule := model.GeoIPRule{}
+		err := rows.Scan(
+			&rule.ID,
+			&rule.CountryCode,
+			&rule.CountryName,
+			&rule.Action,
+			&rule.CreatedBy,
+			&rule.CreatedAt,
+		)
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func (db *PostgresDB) GetGeoIPRuleByCountry(countryCode string) (model.GeoIPRule, error) {
+	rule := model.GeoIPRule{}
+
+	query := `
+SELECT id, country_code, COALESCE(country_name, ''), action, created_by, created_at
+FROM geoip_rules
+WHERE country_code = $1
+LIMIT 1
+`
+
+	err := db.conn.QueryRow(query, countryCode).Scan(
+		&rule.ID,
+		&rule.CountryCode,
+		&rule.CountryName,
+		&rule.Action,
+		&rule.CreatedBy,
+		&rule.CreatedAt,
+	)
+
+	if err != nil {
+		return model.GeoIPRule{}, err
+	}
+
+	return rule, nil
+}
+
+func (db *PostgresDB) SaveGeoIPRule(rule model.GeoIPRule) error {
+	query := `
+INSERT INTO geoip_rules (id, country_code, country_name, action, created_by, created_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (id) DO UPDATE SET
+country_name = EXCLUDED.country_name,
+action = EXCLUDED.action
+`
+
+	_, err := db.conn.Exec(query,
+		rule.ID,
+		rule.CountryCode,
+		rule.CountryName,
+		rule.Action,
+		rule.CreatedBy,
+		rule.CreatedAt,
+	)
+
+	return err
+}
+
+func (db *PostgresDB) DeleteGeoIPRule(id string) error {
+	query := `DELETE FROM geoip_rules WHERE id = $1`
+	_, err := db.conn.Exec(query, id)
+	return err
+}
+
+// Brute Force Protection
+
+func (db *PostgresDB) GetBruteForceAttempt(ip string) (model.BruteForceAttempt, error) {
+	attempt := model.BruteForceAttempt{}
+	var blockedUntil sql.NullTime
+
+	query := `
+SELECT ip, attempts, last_attempt, blocked_until
+FROM brute_force_attempts
+WHERE ip = $1
+LIMIT 1
+`
+
+	err := db.conn.QueryRow(query, ip).Scan(
+		&attempt.IP,
+		&attempt.Attempts,
+		&attempt.LastAttempt,
+		&blockedUntil,
+	)
+
+	if err != nil {
+		return model.BruteForceAttempt{}, err
+	}
+
+	if blockedUntil.Valid {
+		attempt.BlockedUntil = blockedUntil.Time
+	}
+
+	return attempt, nil
+}
+
+func (db *PostgresDB) SaveBruteForceAttempt(attempt model.BruteForceAttempt) error {
+	query := `
+INSERT INTO brute_force_attempts (ip, attempts, last_attempt, blocked_until)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (ip) DO UPDATE SET
+attempts = EXCLUDED.attempts,
+last_attempt = EXCLUDED.last_attempt,
+blocked_until = EXCLUDED.blocked_until
+`
+
+	var blockedUntil interface{}
+	if !attempt.BlockedUntil.IsZero() {
+		blockedUntil = attempt.BlockedUntil
+	}
+
+	_, err := db.conn.Exec(query,
+		attempt.IP,
+		attempt.Attempts,
+		attempt.LastAttempt,
+		blockedUntil,
+	)
+
+	return err
+}
+
+func (db *PostgresDB) DeleteBruteForceAttempt(ip string) error {
+	query := `DELETE FROM brute_force_attempts WHERE ip = $1`
+	_, err := db.conn.Exec(query, ip)
+	return err
+}
+
+// Retention
+
+// PruneAPIAccessLogs deletes the API access log entries written before the given time
+func (db *PostgresDB) PruneAPIAccessLogs(before time.Time) (int, error) {
+	return db.prune(`DELETE FROM api_access_logs WHERE timestamp < $1`, before)
+}
+
+// PruneSecurityEvents deletes the security events recorded before the given time
+func (db *PostgresDB) PruneSecurityEvents(before time.Time) (int, error) {
+	return db.prune(`DELETE FROM security_events WHERE created_at < $1`, before)
+}
+
+// PruneBruteForceAttempts deletes the failed login counters whose last attempt
+// and block both ended before the given time
+func (db *PostgresDB) PruneBruteForceAttempts(before time.Time) (int, error) {
+	return db.prune(`DELETE FROM brute_force_attempts WHERE last_attempt < $1 AND (blocked_until IS NULL OR blocked_until < $2)`, before, before)
+}
+
+// PruneIPBlocks deletes the temporary IP blocks that expired before the given time
+func (db *PostgresDB) PruneIPBlocks(before time.Time) (int, error) {
+	return db.prune(`DELETE FROM ip_blocks WHERE permanent = FALSE AND expires_at IS NOT NULL AND expires_at < $1`, before)
+}
+
+// prune runs a DELETE statement and returns the number of deleted rows
+func (db *PostgresDB) prune(query string, args ...interface{}) (int, error) {
+	result, err := db.conn.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,96 @@
+package postgresdb
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/rs/xid"
+
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/storetest"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// testDSNEnvVar names the DSN of a PostgreSQL database the tests may create
+// schemas in. The tests are skipped if it is not set.
+const testDSNEnvVar = "WGM_TEST_POSTGRES_DSN"
+
+// newTestDB creates an initialized PostgreSQL store in a new schema of the
+// test database. The schema is dropped when the test ends.
+func newTestDB(t *testing.T) *PostgresDB {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnvVar)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnvVar)
+	}
+
+	// Avoid the public IP lookup during default data seeding
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordEnvVar, "test-password")
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open the test database: %v", err)
+	}
+	name := "wgm_test_" + xid.New().String()
+	if _, err := admin.Exec("CREATE SCHEMA " + name); err != nil {
+		admin.Close()
+		t.Fatalf("Failed to create schema %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + name + " CASCADE")
+		admin.Close()
+	})
+
+	db, err := New(withSearchPath(dsn, name))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.db.Close() })
+
+	if err := db.Init(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	return db
+}
+
+// withSearchPath sets the search_path of the connections of dsn, a URL or a
+// list of key=value settings.
+func withSearchPath(dsn, schema string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// TestStore runs the store conformance suite.
+func TestStore(t *testing.T) {
+	if os.Getenv(testDSNEnvVar) == "" {
+		t.Skipf("%s is not set", testDSNEnvVar)
+	}
+	storetest.Run(t, func(t *testing.T) store.IStore { return newTestDB(t) })
+}
+
+// TestClientPublicKeyIndex verifies that the migrations index the clients by
+// public key like the schema of the SQLite backend.
+func TestClientPublicKeyIndex(t *testing.T) {
+	db := newTestDB(t)
+
+	var count int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename = 'clients' AND indexname = 'idx_clients_public_key'
+	`).Scan(&count)
+	if err != nil {
+		t.Fatalf("Failed to query the indexes: %v", err)
+	}
+	if count != 1 {
+		t.Error("The clients are not indexed by public key")
+	}
+}
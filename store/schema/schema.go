@@ -0,0 +1,92 @@
+// Package schema applies versioned, ordered migrations to the SQL store backends.
+// The applied versions are recorded in the schema_migrations table.
+package schema
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// Migration is a single schema change. Released migrations must never be
+// changed; new ones are appended with the next version number.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+// Latest returns the highest version in migrations.
+func Latest(migrations []Migration) int {
+	latest := 0
+	for _, m := range migrations {
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+	return latest
+}
+
+// Version returns the schema version recorded in db, or 0 for a database
+// that has not been migrated yet.
+func Version(db *sql.DB) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return 0, fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Apply runs all migrations newer than the recorded schema version in order,
+// each in its own transaction. It returns store.ErrSchemaTooNew without
+// touching the database if the recorded version is newer than the latest
+// migration known to this build.
+func Apply(db *sql.DB, migrations []Migration) error {
+	current, err := Version(db)
+	if err != nil {
+		return err
+	}
+
+	latest := Latest(migrations)
+	if current > latest {
+		return fmt.Errorf("%w: database is at version %d, this build supports up to %d", store.ErrSchemaTooNew, current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.Up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		// The version is an int from the migration list, so it can be inlined
+		// without depending on the driver's placeholder syntax.
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO schema_migrations (version) VALUES (%d)", m.Version)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %v", m.Version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		log.Infof("Applied database migration %d: %s", m.Version, m.Description)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package sqlitedb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/store/schema"
+	"github.com/swissmakers/wireguard-manager/store/storetest"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// newTestDB creates an initialized SQLite store in a temporary directory.
+func newTestDB(t *testing.T) *SQLiteDB {
+	t.Helper()
+
+	// Avoid the public IP lookup during default data seeding
+	t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+	t.Setenv(util.PasswordEnvVar, "test-password")
+
+	tmpDir, err := os.MkdirTemp("", "wireguard-manager-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	db, err := New(filepath.Join(tmpDir, "wireguard-manager.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.db.Close() })
+
+	if err := db.Init(); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	return db
+}
+
+// TestSchemaTooNew verifies that Init refuses a database migrated by a newer version.
+func TestSchemaTooNew(t *testing.T) {
+	db := newTestDB(t)
+
+	if _, err := db.conn.Exec("INSERT INTO schema_migrations (version) VALUES (?)", schema.Latest(migrations)+1); err != nil {
+		t.Fatalf("Failed to record future migration: %v", err)
+	}
+
+	if err := db.Init(); !errors.Is(err, store.ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+// TestStore runs the store conformance suite.
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.IStore { return newTestDB(t) })
+}
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"time"
+
 	"github.com/swissmakers/wireguard-manager/model"
 )
 
@@ -11,6 +13,11 @@ type IStore interface {
 	// Initialization
 	Init() error
 
+	// Transactions
+	// WithTx runs fn with a store whose writes are applied all-or-nothing:
+	// they are kept if fn returns nil and undone if it returns an error.
+	WithTx(fn func(tx IStore) error) error
+
 	// User Management
 	GetUsers() ([]model.User, error)
 	GetUserByName(username string) (model.User, error)
@@ -25,7 +32,13 @@ type IStore interface {
 	SaveGlobalSettings(globalSettings model.GlobalSetting) error
 
 	// Client Management
+	// GetClients leaves out trashed clients, GetTrashedClients returns only
+	// those. GetClientByID returns a client regardless of its trash state.
+	// DeleteClient removes a client permanently. QueryClients returns one page
+	// of the active clients selected and ordered by the query.
 	GetClients(hasQRCode bool) ([]model.ClientData, error)
+	QueryClients(query model.ClientQuery, hasQRCode bool) (model.ClientPage, error)
+	GetTrashedClients() ([]model.ClientData, error)
 	GetClientByID(clientID string, qrCode model.QRCodeSettings) (model.ClientData, error)
 	SaveClient(client model.Client) error
 	DeleteClient(clientID string) error
@@ -44,11 +57,62 @@ type IStore interface {
 	SaveAPIKey(key model.APIKey) error
 	DeleteAPIKey(keyID string) error
 
+	// Data Key Management
+	GetDataKeys() ([]model.DataKey, error)
+	SaveDataKey(key model.DataKey) error
+	DeleteDataKey(keyID string) error
+
+	// IP Reservations
+	GetIPReservations() ([]model.IPReservation, error)
+	SaveIPReservation(reservation model.IPReservation) error
+	DeleteIPReservation(id string) error
+
+	// Subnet Ranges
+	// GetSubnetRanges returns the ranges ordered by position and name.
+	GetSubnetRanges() ([]model.SubnetRange, error)
+	SaveSubnetRange(subnetRange model.SubnetRange) error
+	DeleteSubnetRange(id string) error
+
 	// API Access Log Management
 	SaveAPIAccessLog(log model.APIAccessLog) error
 	GetAPIAccessLogs(limit int) ([]model.APIAccessLog, error)
 	GetAPIAccessLogsByKeyID(keyID string, limit int) ([]model.APIAccessLog, error)
 
+	// Audit Log
+	SaveAuditEntry(entry model.AuditEntry) error
+	GetAuditEntries(filter model.AuditFilter) ([]model.AuditEntry, error)
+
+	// WireGuard Interfaces
+	// The primary interface is configured by the server and the global
+	// settings; these are the further interfaces, ordered by name.
+	// SaveWireGuardInterface rejects a save with ErrRevisionConflict if the
+	// interface was changed since it was read. SaveWireGuardInterfaceApplied
+	// records the state of a successful apply without changing the revision.
+	GetWireGuardInterfaces() ([]model.WireGuardInterface, error)
+	GetWireGuardInterface(name string) (model.WireGuardInterface, error)
+	SaveWireGuardInterface(iface model.WireGuardInterface) error
+	SaveWireGuardInterfaceApplied(name string, state model.ConfigState, appliedAt time.Time) error
+	DeleteWireGuardInterface(name string) error
+
+	// Nodes
+	// GetNodes returns the nodes ordered by name. SaveNode rejects a save
+	// with ErrRevisionConflict if the node was changed since it was read.
+	GetNodes() ([]model.Node, error)
+	GetNode(id string) (model.Node, error)
+	SaveNode(node model.Node) error
+	DeleteNode(id string) error
+
+	// Config Revisions
+	// GetConfigRevisions returns the revisions newest first. AddConfigRevision
+	// saves a new revision numbered after the newest one and returns its
+	// number; it fails instead of overwriting a revision saved concurrently.
+	// SaveConfigRevision updates the content and result of an existing one.
+	GetConfigRevisions() ([]model.ConfigRevision, error)
+	GetConfigRevision(id int) (model.ConfigRevision, error)
+	AddConfigRevision(revision model.ConfigRevision) (int, error)
+	SaveConfigRevision(revision model.ConfigRevision) error
+	DeleteConfigRevision(id int) error
+
 	// Security Management
 	GetSecuritySettings() (model.SecuritySettings, error)
 	SaveSecuritySettings(settings model.SecuritySettings) error
@@ -75,5 +139,12 @@ type IStore interface {
 	GetBruteForceAttempt(ip string) (model.BruteForceAttempt, error)
 	SaveBruteForceAttempt(attempt model.BruteForceAttempt) error
 	DeleteBruteForceAttempt(ip string) error
-	CleanupExpiredBruteForceAttempts() error
+
+	// Retention
+	// The prune methods delete the records that ended before the given time
+	// and return how many they deleted.
+	PruneAPIAccessLogs(before time.Time) (int, error)
+	PruneSecurityEvents(before time.Time) (int, error)
+	PruneBruteForceAttempts(before time.Time) (int, error)
+	PruneIPBlocks(before time.Time) (int, error)
 }
@@ -0,0 +1,716 @@
+// Package storetest is a conformance suite for the store.IStore backends.
+// Every backend runs it from its own tests, so they all keep the same
+// behaviour:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.IStore { return newTestDB(t) })
+//	}
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// testPasswordHash is the bcrypt hash of "test-password" at the lowest cost
+const testPasswordHash = "$2a$04$fFGC0k1pJzCuITpsCULKGuyltBV0rE3iL5NjZaO7aw4YnjBCrRm22"
+
+// Open returns a new, initialized store holding only the default data. The
+// store is cleaned up when the test ends.
+type Open func(t *testing.T) store.IStore
+
+// tests lists the conformance tests by name.
+var tests = []struct {
+	name string
+	run  func(t *testing.T, db store.IStore)
+}{
+	{"ClientRoundTrip", testClientRoundTrip},
+	{"IPBlockExpiry", testIPBlockExpiry},
+	{"WithTxRollback", testWithTxRollback},
+	{"SaveClientRevisionConflict", testSaveClientRevisionConflict},
+	{"ClientTrash", testClientTrash},
+	{"AuditEntryFilter", testAuditEntryFilter},
+	{"QueryClients", testQueryClients},
+	{"PruneRecords", testPruneRecords},
+	{"IPReservations", testIPReservations},
+	{"SubnetRanges", testSubnetRanges},
+	{"AppliedState", testAppliedState},
+	{"ConfigRevisions", testConfigRevisions},
+	{"WireGuardInterfaces", testWireGuardInterfaces},
+	{"Nodes", testNodes},
+}
+
+// Run runs every conformance test as a subtest against its own store.
+func Run(t *testing.T, open Open) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Avoid the public IP lookup and hashing the default password
+			// during default data seeding
+			t.Setenv(util.EndpointAddressEnvVar, "vpn.example.com")
+			t.Setenv(util.PasswordHashEnvVar, testPasswordHash)
+			tt.run(t, open(t))
+		})
+	}
+}
+
+// testClientRoundTrip verifies that a client survives a save and reload unchanged.
+func testClientRoundTrip(t *testing.T, db store.IStore) {
+	now := time.Now().UTC().Truncate(time.Second)
+	client := model.Client{
+		ID:           "client1",
+		PublicKey:    "pubkey",
+		Name:         "laptop",
+		Group:        "staff",
+		AllocatedIPs: []string{"10.8.0.2/32"},
+		AllowedIPs:   []string{"0.0.0.0/0"},
+		UseServerDNS: true,
+		Enabled:      true,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+
+	got, err := db.GetClientByID("client1", model.QRCodeSettings{})
+	if err != nil {
+		t.Fatalf("GetClientByID failed: %v", err)
+	}
+	if got.Client.Name != "laptop" || got.Client.Group != "staff" || got.Client.AllocatedIPs[0] != "10.8.0.2/32" {
+		t.Errorf("Unexpected client after reload: %+v", got.Client)
+	}
+	if !got.Client.CreatedAt.Equal(now) {
+		t.Errorf("Expected created_at %v, got %v", now, got.Client.CreatedAt)
+	}
+
+	if _, err := db.GetClientByID("missing", model.QRCodeSettings{}); err == nil {
+		t.Error("Expected an error for a missing client")
+	}
+}
+
+// testIPBlockExpiry verifies that expired blocks are ignored regardless of the stored time zone.
+func testIPBlockExpiry(t *testing.T, db store.IStore) {
+	cet := time.FixedZone("CET", 2*60*60)
+	blocks := []model.IPBlock{
+		{ID: "active", IP: "192.0.2.1", BlockedBy: "admin", ExpiresAt: time.Now().In(cet).Add(time.Hour), CreatedAt: time.Now()},
+		{ID: "expired", IP: "192.0.2.2", BlockedBy: "admin", ExpiresAt: time.Now().In(cet).Add(-time.Minute), CreatedAt: time.Now()},
+		{ID: "permanent", IP: "192.0.2.3", BlockedBy: "admin", Permanent: true, CreatedAt: time.Now()},
+	}
+	for _, block := range blocks {
+		if err := db.SaveIPBlock(block); err != nil {
+			t.Fatalf("SaveIPBlock failed: %v", err)
+		}
+	}
+
+	for ip, want := range map[string]bool{"192.0.2.1": true, "192.0.2.2": false, "192.0.2.3": true, "192.0.2.4": false} {
+		blocked, err := db.IsIPBlocked(ip)
+		if err != nil {
+			t.Fatalf("IsIPBlocked failed: %v", err)
+		}
+		if blocked != want {
+			t.Errorf("IsIPBlocked(%s) = %v, want %v", ip, blocked, want)
+		}
+	}
+
+	active, err := db.GetIPBlocks()
+	if err != nil {
+		t.Fatalf("GetIPBlocks failed: %v", err)
+	}
+	if len(active) != 2 {
+		t.Errorf("Expected 2 active blocks, got %d", len(active))
+	}
+}
+
+// testWithTxRollback verifies that a failed transaction leaves no partial writes.
+func testWithTxRollback(t *testing.T, db store.IStore) {
+	client := model.Client{ID: "client1", PublicKey: "pubkey", Name: "laptop", AllocatedIPs: []string{}, AllowedIPs: []string{}}
+	errAbort := errors.New("abort")
+	err := db.WithTx(func(tx store.IStore) error {
+		if err := tx.SaveClient(client); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Expected the callback error, got %v", err)
+	}
+	if _, err := db.GetClientByID("client1", model.QRCodeSettings{}); err == nil {
+		t.Error("Expected the client write to be rolled back")
+	}
+
+	if err := db.WithTx(func(tx store.IStore) error { return tx.SaveClient(client) }); err != nil {
+		t.Fatalf("WithTx failed: %v", err)
+	}
+	if _, err := db.GetClientByID("client1", model.QRCodeSettings{}); err != nil {
+		t.Errorf("Expected the committed client, got %v", err)
+	}
+}
+
+// testSaveClientRevisionConflict verifies that a save based on a stale revision is rejected.
+func testSaveClientRevisionConflict(t *testing.T, db store.IStore) {
+	client := model.Client{ID: "client1", PublicKey: "pubkey", Name: "laptop", AllocatedIPs: []string{}, AllowedIPs: []string{}}
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+
+	read, err := db.GetClientByID("client1", model.QRCodeSettings{})
+	if err != nil {
+		t.Fatalf("GetClientByID failed: %v", err)
+	}
+	first, second := *read.Client, *read.Client
+	first.Name = "first"
+	second.Name = "second"
+
+	if err := db.SaveClient(first); err != nil {
+		t.Fatalf("First save failed: %v", err)
+	}
+	if err := db.SaveClient(second); !errors.Is(err, store.ErrRevisionConflict) {
+		t.Fatalf("Expected ErrRevisionConflict, got %v", err)
+	}
+
+	got, err := db.GetClientByID("client1", model.QRCodeSettings{})
+	if err != nil {
+		t.Fatalf("GetClientByID failed: %v", err)
+	}
+	if got.Client.Name != "first" || got.Client.Revision != read.Client.Revision+1 {
+		t.Errorf("Expected the first save at revision %d, got %q at revision %d", read.Client.Revision+1, got.Client.Name, got.Client.Revision)
+	}
+}
+
+// testClientTrash verifies that trashed clients are only returned by GetTrashedClients.
+func testClientTrash(t *testing.T, db store.IStore) {
+	client := model.Client{ID: "client1", PublicKey: "pubkey", Name: "laptop", AllocatedIPs: []string{}, AllowedIPs: []string{}}
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+
+	deletedAt := time.Now().UTC().Truncate(time.Second)
+	client.DeletedAt = &deletedAt
+	client.DeletedBy = "admin"
+	client.Revision = 1
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("Trashing the client failed: %v", err)
+	}
+
+	if clients, err := db.GetClients(false); err != nil || len(clients) != 0 {
+		t.Errorf("Expected no active clients, got %d (%v)", len(clients), err)
+	}
+	trashed, err := db.GetTrashedClients()
+	if err != nil {
+		t.Fatalf("GetTrashedClients failed: %v", err)
+	}
+	if len(trashed) != 1 || trashed[0].Client.DeletedBy != "admin" || !trashed[0].Client.DeletedAt.Equal(deletedAt) {
+		t.Fatalf("Unexpected trashed clients: %+v", trashed)
+	}
+
+	restored := *trashed[0].Client
+	restored.DeletedAt = nil
+	restored.DeletedBy = ""
+	if err := db.SaveClient(restored); err != nil {
+		t.Fatalf("Restoring the client failed: %v", err)
+	}
+	if clients, _ := db.GetClients(false); len(clients) != 1 {
+		t.Errorf("Expected the restored client to be active, got %d clients", len(clients))
+	}
+}
+
+// testAuditEntryFilter verifies that audit entries are filtered and returned newest first.
+func testAuditEntryFilter(t *testing.T, db store.IStore) {
+	now := time.Now().UTC()
+	entries := []model.AuditEntry{
+		{ID: "a1", Actor: "admin", Action: "create", TargetType: "client", TargetID: "c1", SourceIP: "192.0.2.1", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "a2", Actor: "api-key:k1", Action: "update", TargetType: "client", TargetID: "c1", SourceIP: "192.0.2.2", CreatedAt: now.Add(-time.Hour),
+			Changes: map[string]model.AuditChange{"name": {Before: "old", After: "new"}}},
+		{ID: "a3", Actor: "admin", Action: "update", TargetType: "global_settings", TargetID: "global_settings", SourceIP: "192.0.2.1", CreatedAt: now},
+	}
+	for _, entry := range entries {
+		if err := db.SaveAuditEntry(entry); err != nil {
+			t.Fatalf("SaveAuditEntry failed: %v", err)
+		}
+	}
+
+	got, err := db.GetAuditEntries(model.AuditFilter{TargetType: "client", TargetID: "c1"})
+	if err != nil {
+		t.Fatalf("GetAuditEntries failed: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != "a2" || got[0].Changes["name"].After != "new" {
+		t.Errorf("Unexpected entries for client c1: %+v", got)
+	}
+
+	got, err = db.GetAuditEntries(model.AuditFilter{Actor: "admin", Since: now.Add(-90 * time.Minute)})
+	if err != nil {
+		t.Fatalf("GetAuditEntries failed: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != "a3" {
+		t.Errorf("Expected only a3 for admin in the last 90 minutes, got %+v", got)
+	}
+}
+
+// testQueryClients verifies client filtering and cursor paging in both sort directions.
+func testQueryClients(t *testing.T, db store.IStore) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"delta", "Alpha", "charlie", "bravo", "echo_1"} {
+		client := model.Client{
+			ID:           fmt.Sprintf("client%d", i),
+			PublicKey:    fmt.Sprintf("pubkey%d", i),
+			Name:         name,
+			Group:        "office",
+			AllocatedIPs: []string{fmt.Sprintf("10.0.0.%d/32", i+2)},
+			AllowedIPs:   []string{},
+			Enabled:      i != 2,
+			CreatedAt:    base.Add(time.Duration(i) * time.Hour),
+			UpdatedAt:    base,
+		}
+		if i == 4 {
+			client.Group = "lab"
+		}
+		if err := db.SaveClient(client); err != nil {
+			t.Fatalf("SaveClient failed: %v", err)
+		}
+	}
+
+	names := func(query model.ClientQuery) []string {
+		t.Helper()
+		var result []string
+		for {
+			page, err := db.QueryClients(query, false)
+			if err != nil {
+				t.Fatalf("QueryClients(%+v) failed: %v", query, err)
+			}
+			for _, clientData := range page.Clients {
+				result = append(result, clientData.Client.Name)
+			}
+			if page.NextCursor == "" {
+				return result
+			}
+			query.Cursor = page.NextCursor
+		}
+	}
+
+	enabled := true
+	_, subnet, _ := net.ParseCIDR("10.0.0.4/31")
+	tests := []struct {
+		query model.ClientQuery
+		want  string
+	}{
+		{model.ClientQuery{Limit: 2}, "Alpha bravo charlie delta echo_1"},
+		{model.ClientQuery{Sort: "-created_at", Limit: 2}, "echo_1 bravo charlie Alpha delta"},
+		{model.ClientQuery{Search: "HA"}, "Alpha charlie"},
+		{model.ClientQuery{Search: "_"}, "echo_1"},
+		{model.ClientQuery{Search: "lab"}, "echo_1"},
+		{model.ClientQuery{Group: "office", Enabled: &enabled, Limit: 1}, "Alpha bravo delta"},
+		{model.ClientQuery{CreatedAfter: base.Add(time.Hour), CreatedBefore: base.Add(3 * time.Hour)}, "Alpha charlie"},
+		{model.ClientQuery{Subnets: []*net.IPNet{subnet}, Limit: 1}, "bravo charlie"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(names(tt.query), " "); got != tt.want {
+			t.Errorf("QueryClients(%+v) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	if _, err := db.QueryClients(model.ClientQuery{Sort: "public_key"}, false); err == nil {
+		t.Error("Expected an error for an unknown sort field")
+	}
+}
+
+// testPruneRecords verifies that only records older than the cutoff are pruned.
+func testPruneRecords(t *testing.T, db store.IStore) {
+	now := time.Now().UTC()
+	old, recent := now.Add(-48*time.Hour), now.Add(-time.Hour)
+	cutoff := now.Add(-24 * time.Hour)
+
+	for i, ts := range []time.Time{old, old, recent} {
+		if err := db.SaveAPIAccessLog(model.APIAccessLog{ID: fmt.Sprintf("log%d", i), APIKeyID: "key", Timestamp: ts}); err != nil {
+			t.Fatalf("SaveAPIAccessLog failed: %v", err)
+		}
+		if err := db.SaveSecurityEvent(model.SecurityEvent{ID: fmt.Sprintf("event%d", i), EventType: "failed_login", IP: "192.0.2.1", CreatedAt: ts}); err != nil {
+			t.Fatalf("SaveSecurityEvent failed: %v", err)
+		}
+	}
+	for _, attempt := range []model.BruteForceAttempt{
+		{IP: "192.0.2.1", Attempts: 1, LastAttempt: old},
+		{IP: "192.0.2.2", Attempts: 5, LastAttempt: old, BlockedUntil: now.Add(time.Hour)},
+		{IP: "192.0.2.3", Attempts: 1, LastAttempt: recent},
+	} {
+		if err := db.SaveBruteForceAttempt(attempt); err != nil {
+			t.Fatalf("SaveBruteForceAttempt failed: %v", err)
+		}
+	}
+	for _, block := range []model.IPBlock{
+		{ID: "expired", IP: "192.0.2.1", ExpiresAt: old, CreatedAt: old},
+		{ID: "recently-expired", IP: "192.0.2.2", ExpiresAt: recent, CreatedAt: old},
+		{ID: "permanent", IP: "192.0.2.3", Permanent: true, CreatedAt: old},
+	} {
+		if err := db.SaveIPBlock(block); err != nil {
+			t.Fatalf("SaveIPBlock failed: %v", err)
+		}
+	}
+
+	for name, prune := range map[string]func(time.Time) (int, error){
+		"access logs":          db.PruneAPIAccessLogs,
+		"security events":      db.PruneSecurityEvents,
+		"brute-force attempts": db.PruneBruteForceAttempts,
+		"IP blocks":            db.PruneIPBlocks,
+	} {
+		want := 1
+		if name == "access logs" || name == "security events" {
+			want = 2
+		}
+		if n, err := prune(cutoff); err != nil || n != want {
+			t.Errorf("Pruning %s removed %d (%v), want %d", name, n, err, want)
+		}
+	}
+
+	if logs, _ := db.GetAPIAccessLogs(0); len(logs) != 1 {
+		t.Errorf("Expected 1 access log entry to remain, got %d", len(logs))
+	}
+	if _, err := db.GetBruteForceAttempt("192.0.2.2"); err != nil {
+		t.Errorf("Expected the blocked attempt to remain: %v", err)
+	}
+}
+
+// testIPReservations verifies that reservations are saved and deleted.
+func testIPReservations(t *testing.T, db store.IStore) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, address := range []string{"10.8.0.10/32", "10.8.0.16/29"} {
+		reservation := model.IPReservation{ID: fmt.Sprintf("r%d", i), Address: address, Description: "printer",
+			CreatedBy: "admin", CreatedAt: now.Add(time.Duration(i) * time.Minute)}
+		if err := db.SaveIPReservation(reservation); err != nil {
+			t.Fatalf("SaveIPReservation failed: %v", err)
+		}
+	}
+
+	reservations, err := db.GetIPReservations()
+	if err != nil {
+		t.Fatalf("GetIPReservations failed: %v", err)
+	}
+	if len(reservations) != 2 {
+		t.Fatalf("Reservations = %+v, want 2", reservations)
+	}
+	byID := map[string]model.IPReservation{}
+	for _, reservation := range reservations {
+		byID[reservation.ID] = reservation
+	}
+	if got := byID["r1"]; got.Address != "10.8.0.16/29" || got.CreatedBy != "admin" || !got.CreatedAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("Reservation r1 = %+v", got)
+	}
+
+	if err := db.DeleteIPReservation("r0"); err != nil {
+		t.Fatalf("DeleteIPReservation failed: %v", err)
+	}
+	if reservations, _ := db.GetIPReservations(); len(reservations) != 1 || reservations[0].ID != "r1" {
+		t.Errorf("Reservations after the delete = %+v, want r1", reservations)
+	}
+}
+
+// testSubnetRanges verifies that subnet ranges are saved, ordered by position
+// and updated in place.
+func testSubnetRanges(t *testing.T, db store.IStore) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, subnetRange := range []model.SubnetRange{
+		{ID: "r1", Name: "staff", CIDRs: []string{"10.8.0.0/26"}, Position: 1, CreatedAt: now, UpdatedAt: now},
+		{ID: "r2", Name: "guests", CIDRs: []string{"10.8.0.64/26", "10.8.0.128/26"}, Position: 0, CreatedAt: now, UpdatedAt: now},
+	} {
+		if err := db.SaveSubnetRange(subnetRange); err != nil {
+			t.Fatalf("SaveSubnetRange failed: %v", err)
+		}
+	}
+
+	ranges, err := db.GetSubnetRanges()
+	if err != nil {
+		t.Fatalf("GetSubnetRanges failed: %v", err)
+	}
+	if len(ranges) != 2 || ranges[0].Name != "guests" || len(ranges[0].CIDRs) != 2 {
+		t.Fatalf("Unexpected subnet ranges: %+v", ranges)
+	}
+
+	ranges[1].Position = 5
+	ranges[1].CIDRs = []string{"10.8.0.192/26"}
+	if err := db.SaveSubnetRange(ranges[1]); err != nil {
+		t.Fatalf("SaveSubnetRange failed: %v", err)
+	}
+	if err := db.DeleteSubnetRange("r2"); err != nil {
+		t.Fatalf("DeleteSubnetRange failed: %v", err)
+	}
+	ranges, _ = db.GetSubnetRanges()
+	if len(ranges) != 1 || ranges[0].CIDRs[0] != "10.8.0.192/26" || ranges[0].Position != 5 {
+		t.Errorf("Unexpected subnet ranges after update: %+v", ranges)
+	}
+}
+
+// testAppliedState verifies that the hashes detect changes to the stored
+// configuration and keep the state of the last apply.
+func testAppliedState(t *testing.T, db store.IStore) {
+	if !util.HashesChanged(db) {
+		t.Error("HashesChanged = false before the first apply")
+	}
+	client := model.Client{ID: "client1", Name: "laptop", PublicKey: "pubkey", PresharedKey: "psk",
+		AllocatedIPs: []string{"10.8.0.2/32"}, Enabled: true}
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+	state, err := util.DesiredConfigState(db)
+	if err != nil {
+		t.Fatalf("DesiredConfigState failed: %v", err)
+	}
+	if err := util.UpdateHashes(db, state); err != nil {
+		t.Fatalf("UpdateHashes failed: %v", err)
+	}
+	if util.HashesChanged(db) {
+		t.Error("HashesChanged = true right after an apply")
+	}
+
+	hashes, err := db.GetHashes()
+	if err != nil {
+		t.Fatalf("GetHashes failed: %v", err)
+	}
+	if hashes.AppliedAt == nil || hashes.Applied == nil || len(hashes.Applied.Peers) != 1 {
+		t.Fatalf("Applied state = %+v at %v, want one peer", hashes.Applied, hashes.AppliedAt)
+	}
+	if peer := hashes.Applied.Peers[0]; peer.ID != "client1" || peer.PresharedKey == "" || peer.PresharedKey == "psk" {
+		t.Errorf("Applied peer = %+v, want client1 with a preshared key fingerprint", peer)
+	}
+
+	// Changes of disabled clients are not part of the server configuration
+	client.Enabled = false
+	client.Revision++
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+	if !util.HashesChanged(db) {
+		t.Error("HashesChanged = false after a client was disabled")
+	}
+	if err := db.SaveClient(model.Client{ID: "client2", Name: "phone"}); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+	state, _ = util.DesiredConfigState(db)
+	if len(state.Peers) != 0 {
+		t.Errorf("Desired peers = %+v, want none", state.Peers)
+	}
+}
+
+// testConfigRevisions verifies that config revisions are listed newest first
+// and that a saved revision can be updated with its result.
+func testConfigRevisions(t *testing.T, db store.IStore) {
+	created := time.Now().UTC().Truncate(time.Second)
+	for want := 1; want <= 3; want++ {
+		revision := model.ConfigRevision{Path: "/etc/wireguard/wg0.conf", Content: fmt.Sprintf("# revision %d\n", want),
+			Author: "admin", Result: model.RevisionApplied, CreatedAt: created.Add(time.Duration(want) * time.Minute)}
+		id, err := db.AddConfigRevision(revision)
+		if err != nil {
+			t.Fatalf("AddConfigRevision failed: %v", err)
+		}
+		if id != want {
+			t.Fatalf("AddConfigRevision = %d, want %d", id, want)
+		}
+	}
+
+	// A failed apply updates the revision it saved
+	failed := model.ConfigRevision{ID: 3, Path: "/etc/wireguard/wg0.conf", Content: "# revision 3\n", Author: "admin",
+		Result: model.RevisionFailed, Error: "cannot configure 1 of 2 peers of wg0", RestoredID: 2, CreatedAt: created}
+	if err := db.SaveConfigRevision(failed); err != nil {
+		t.Fatalf("SaveConfigRevision failed: %v", err)
+	}
+	revisions, err := db.GetConfigRevisions()
+	if err != nil {
+		t.Fatalf("GetConfigRevisions failed: %v", err)
+	}
+	if len(revisions) != 3 || revisions[0].ID != 3 || revisions[2].ID != 1 {
+		t.Fatalf("Revisions = %+v, want 3 newest first", revisions)
+	}
+	if got := revisions[0]; got.Result != model.RevisionFailed || got.RestoredID != 2 || got.Error == "" {
+		t.Errorf("Revision 3 = %+v, want the failed result", got)
+	}
+
+	revision, err := db.GetConfigRevision(2)
+	if err != nil {
+		t.Fatalf("GetConfigRevision failed: %v", err)
+	}
+	if revision.Content != "# revision 2\n" || !revision.CreatedAt.Equal(created.Add(2*time.Minute)) {
+		t.Errorf("Revision 2 = %+v", revision)
+	}
+
+	if err := db.DeleteConfigRevision(2); err != nil {
+		t.Fatalf("DeleteConfigRevision failed: %v", err)
+	}
+	if _, err := db.GetConfigRevision(2); err == nil {
+		t.Error("GetConfigRevision of a deleted revision succeeded")
+	}
+
+	// Concurrent adds may fail, but never overwrite each other
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := make(map[int]string)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := fmt.Sprintf("# concurrent %d\n", i)
+			id, err := db.AddConfigRevision(model.ConfigRevision{Path: "/etc/wireguard/wg1.conf", Content: content,
+				Author: "admin", Result: model.RevisionApplied, CreatedAt: created})
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if other, ok := added[id]; ok {
+				t.Errorf("AddConfigRevision returned %d for %q and %q", id, other, content)
+			}
+			added[id] = content
+		}(i)
+	}
+	wg.Wait()
+	if len(added) == 0 {
+		t.Fatal("No concurrent AddConfigRevision succeeded")
+	}
+	for id, content := range added {
+		if revision, err := db.GetConfigRevision(id); err != nil || revision.Content != content {
+			t.Errorf("Revision %d = %q, %v, want %q", id, revision.Content, err, content)
+		}
+	}
+}
+
+// testWireGuardInterfaces verifies that further interfaces are stored apart
+// from the primary one and that their clients only count for them.
+func testWireGuardInterfaces(t *testing.T, db store.IStore) {
+	iface := model.WireGuardInterface{Name: "wg1", Description: "contractors", PrivateKey: "privkey", PublicKey: "pubkey",
+		Addresses: []string{"10.9.0.1/24"}, ListenPort: 51821, MTU: 1380, DNSServers: []string{"10.9.0.53"},
+		ConfigFilePath: "/etc/wireguard/wg1.conf"}
+	if err := db.SaveWireGuardInterface(iface); err != nil {
+		t.Fatalf("SaveWireGuardInterface failed: %v", err)
+	}
+	if err := db.SaveWireGuardInterface(iface); !errors.Is(err, store.ErrRevisionConflict) {
+		t.Errorf("SaveWireGuardInterface of a stale revision = %v, want a revision conflict", err)
+	}
+	got, err := db.GetWireGuardInterface("wg1")
+	if err != nil {
+		t.Fatalf("GetWireGuardInterface failed: %v", err)
+	}
+	if got.Revision != 1 || got.PrivateKey != "privkey" || got.MTU != 1380 || len(got.Addresses) != 1 || got.Applied != nil {
+		t.Errorf("Interface after reload = %+v", got)
+	}
+
+	ifaces, err := util.GetInterfaces(db)
+	if err != nil {
+		t.Fatalf("GetInterfaces failed: %v", err)
+	}
+	if len(ifaces) != 2 || !ifaces[0].Primary || ifaces[0].Name != "wg0" || ifaces[1].Name != "wg1" {
+		t.Fatalf("Interfaces = %+v, want wg0 and wg1", ifaces)
+	}
+
+	client := model.Client{ID: "client1", Name: "contractor", PublicKey: "clientkey", Interface: "wg1",
+		AllocatedIPs: []string{"10.9.0.2/32"}, Enabled: true}
+	if err := util.CheckClientInterface(db, &client); err != nil {
+		t.Errorf("CheckClientInterface failed: %v", err)
+	}
+	client.AllocatedIPs = []string{"10.8.0.2/32"}
+	if err := util.CheckClientInterface(db, &client); err == nil {
+		t.Error("CheckClientInterface accepted an address of another interface")
+	}
+	client.AllocatedIPs = []string{"10.9.0.2/32"}
+	if err := db.SaveClient(client); err != nil {
+		t.Fatalf("SaveClient failed: %v", err)
+	}
+
+	// The client is a peer of wg1 only
+	primary, err := util.DesiredConfigState(db)
+	if err != nil {
+		t.Fatalf("DesiredConfigState failed: %v", err)
+	}
+	if len(primary.Peers) != 0 {
+		t.Errorf("Peers of wg0 = %+v, want none", primary.Peers)
+	}
+	state, err := util.DesiredInterfaceState(db, got)
+	if err != nil {
+		t.Fatalf("DesiredInterfaceState failed: %v", err)
+	}
+	if len(state.Peers) != 1 || state.Settings.MTU != 1380 || state.Settings.ConfigFilePath != "/etc/wireguard/wg1.conf" {
+		t.Errorf("State of wg1 = %+v, want the client and the MTU and config file of wg1", state)
+	}
+	page, err := db.QueryClients(model.ClientQuery{Interface: &client.Interface}, false)
+	if err != nil {
+		t.Fatalf("QueryClients failed: %v", err)
+	}
+	if len(page.Clients) != 1 || page.Clients[0].Client.Interface != "wg1" {
+		t.Errorf("Clients of wg1 = %+v", page.Clients)
+	}
+
+	if err := util.UpdateAppliedState(db, got, state); err != nil {
+		t.Fatalf("UpdateAppliedState failed: %v", err)
+	}
+	applied, err := db.GetWireGuardInterface("wg1")
+	if err != nil {
+		t.Fatalf("GetWireGuardInterface failed: %v", err)
+	}
+	if applied.Applied == nil || applied.AppliedAt == nil || len(applied.Applied.Peers) != 1 || applied.Revision != 1 {
+		t.Errorf("Applied state of wg1 = %+v at %v", applied.Applied, applied.AppliedAt)
+	}
+	settings, err := db.GetGlobalSettings()
+	if err != nil {
+		t.Fatalf("GetGlobalSettings failed: %v", err)
+	}
+	if util.InterfaceChanged(db, applied, []model.ClientData{{Client: &client}}, settings) {
+		t.Error("InterfaceChanged = true right after an apply")
+	}
+
+	if err := db.DeleteWireGuardInterface("wg1"); err != nil {
+		t.Fatalf("DeleteWireGuardInterface failed: %v", err)
+	}
+	if _, err := db.GetWireGuardInterface("wg1"); err == nil {
+		t.Error("GetWireGuardInterface of a deleted interface succeeded")
+	}
+}
+
+// testNodes verifies that nodes are ordered by name and saved with a
+// compare-and-swap of their revision.
+func testNodes(t *testing.T, db store.IStore) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, node := range []model.Node{
+		{ID: "n2", Name: "zurich", URL: "https://zurich.example.com:5001", Token: "secret", CreatedAt: now, UpdatedAt: now},
+		{ID: "n1", Name: "bern", URL: "https://bern.example.com:5001", CACert: "-----BEGIN CERTIFICATE-----", CreatedAt: now, UpdatedAt: now},
+	} {
+		if err := db.SaveNode(node); err != nil {
+			t.Fatalf("SaveNode failed: %v", err)
+		}
+	}
+
+	nodes, err := db.GetNodes()
+	if err != nil {
+		t.Fatalf("GetNodes failed: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0].Name != "bern" || nodes[1].Token != "secret" || nodes[1].Revision != 1 {
+		t.Fatalf("Nodes = %+v, want bern and zurich at revision 1", nodes)
+	}
+
+	node := nodes[1]
+	node.URL = "https://zurich.example.com:5002"
+	if err := db.SaveNode(node); err != nil {
+		t.Fatalf("SaveNode failed: %v", err)
+	}
+	if err := db.SaveNode(node); !errors.Is(err, store.ErrRevisionConflict) {
+		t.Errorf("SaveNode of a stale revision = %v, want a revision conflict", err)
+	}
+	got, err := db.GetNode("n2")
+	if err != nil {
+		t.Fatalf("GetNode failed: %v", err)
+	}
+	if got.URL != node.URL || got.Revision != 2 || !got.CreatedAt.Equal(now) {
+		t.Errorf("Node after the update = %+v", got)
+	}
+
+	if err := db.DeleteNode("n2"); err != nil {
+		t.Fatalf("DeleteNode failed: %v", err)
+	}
+	if _, err := db.GetNode("n2"); err == nil {
+		t.Error("GetNode of a deleted node succeeded")
+	}
+}
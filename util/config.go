@@ -1,11 +1,6 @@
 package util
 
-import (
-	"net"
-	"strings"
-
-	"github.com/labstack/gommon/log"
-)
+import "strings"
 
 // Global runtime configuration variables.
 var (
@@ -27,8 +22,8 @@ var (
 	SessionMaxDuration int64
 	WgConfTemplate     string
 	BasePath           string
-	SubnetRanges       map[string][]*net.IPNet // Mapping of range name to slice of *net.IPNet
-	SubnetRangesOrder  []string                // Order of subnet range names
+	CapacityWarning    int
+	CapacityCritical   int
 )
 
 // Default values and environment variable names.
@@ -69,6 +64,27 @@ const (
 	DatabaseTypeEnvVar                     = "WGM_DATABASE_TYPE"
 	DatabaseDSNEnvVar                      = "WGM_DATABASE_DSN"
 	DatabasePathEnvVar                     = "WGM_DATABASE_PATH"
+	CacheTTLEnvVar                         = "WGM_CACHE_TTL"
+	EncryptionKeyEnvVar                    = "WGM_ENCRYPTION_KEY"
+	TrashRetentionEnvVar                   = "WGM_TRASH_RETENTION"
+	AccessLogRetentionEnvVar               = "WGM_ACCESS_LOG_RETENTION"
+	SecurityEventRetentionEnvVar           = "WGM_SECURITY_EVENT_RETENTION"
+	BruteForceRetentionEnvVar              = "WGM_BRUTE_FORCE_RETENTION"
+	IPBlockRetentionEnvVar                 = "WGM_IP_BLOCK_RETENTION"
+	ConfigRevisionRetentionEnvVar          = "WGM_CONFIG_REVISION_RETENTION"
+	CapacityWarningEnvVar                  = "WGM_CAPACITY_WARNING"
+	CapacityCriticalEnvVar                 = "WGM_CAPACITY_CRITICAL"
+	WGBackendEnvVar                        = "WGM_WG_BACKEND"
+	WGUserspaceEnvVar                      = "WGM_WG_USERSPACE"
+	NodeTLSCertEnvVar                      = "WGM_NODE_TLS_CERT"
+	NodeTLSKeyEnvVar                       = "WGM_NODE_TLS_KEY"
+	AgentListenEnvVar                      = "WGM_AGENT_LISTEN"
+	AgentTokenEnvVar                       = "WGM_AGENT_TOKEN"
+	AgentTokenFileEnvVar                   = "WGM_AGENT_TOKEN_FILE"
+	AgentTLSCertEnvVar                     = "WGM_AGENT_TLS_CERT"
+	AgentTLSKeyEnvVar                      = "WGM_AGENT_TLS_KEY"
+	AgentClientCAEnvVar                    = "WGM_AGENT_CLIENT_CA"
+	AgentConfigDirEnvVar                   = "WGM_AGENT_CONFIG_DIR"
 )
 
 // ParseBasePath ensures that the base path starts with a slash and does not end with one.
@@ -78,63 +94,3 @@ func ParseBasePath(basePath string) string {
 	}
 	return strings.TrimSuffix(basePath, "/")
 }
-
-// ParseSubnetRanges parses a string containing subnet ranges into a map of subnet ranges.
-// The expected format is:
-//
-//	rangeName:CIDR1,CIDR2;rangeName2:CIDR3,CIDR4
-//
-// It returns a map from the range name to a slice of *net.IPNet and populates SubnetRangesOrder.
-func ParseSubnetRanges(subnetRangesStr string) map[string][]*net.IPNet {
-	subnetRanges := make(map[string][]*net.IPNet)
-	// Reset the global order.
-	SubnetRangesOrder = []string{}
-
-	if subnetRangesStr == "" {
-		return subnetRanges
-	}
-
-	// Clean the input string.
-	subnetRangesStr = strings.TrimSpace(subnetRangesStr)
-	subnetRangesStr = strings.Trim(subnetRangesStr, ";:,")
-	ranges := strings.Split(subnetRangesStr, ";")
-
-	// Use a set to track duplicate CIDRs.
-	cidrSet := make(map[string]bool)
-
-	for _, rng := range ranges {
-		rng = strings.TrimSpace(rng)
-		parts := strings.Split(rng, ":")
-		if len(parts) != 2 {
-			log.Warnf("Unable to parse subnet range: %v. Skipped.", rng)
-			continue
-		}
-		rangeName := strings.TrimSpace(parts[0])
-		subnetRanges[rangeName] = []*net.IPNet{}
-
-		// Split the CIDRs by comma.
-		cidrs := strings.Split(parts[1], ",")
-		for _, cidr := range cidrs {
-			cidr = strings.TrimSpace(cidr)
-			_, ipnet, err := net.ParseCIDR(cidr)
-			if err != nil {
-				log.Warnf("[%v] Unable to parse CIDR: %v. Skipped.", rangeName, cidr)
-				continue
-			}
-			if cidrSet[ipnet.String()] {
-				log.Warnf("[%v] CIDR already exists: %v. Skipped.", rangeName, ipnet.String())
-				continue
-			}
-			cidrSet[ipnet.String()] = true
-			subnetRanges[rangeName] = append(subnetRanges[rangeName], ipnet)
-		}
-
-		// Remove the range if no valid CIDRs were found.
-		if len(subnetRanges[rangeName]) == 0 {
-			delete(subnetRanges, rangeName)
-		} else {
-			SubnetRangesOrder = append(SubnetRangesOrder, rangeName)
-		}
-	}
-	return subnetRanges
-}
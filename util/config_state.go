@@ -0,0 +1,97 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// NewConfigState returns the state the server configuration is rendered from.
+// Like the configuration template it only includes enabled clients.
+func NewConfigState(server model.Server, clients []model.ClientData, settings model.GlobalSetting) model.ConfigState {
+	state := model.ConfigState{
+		Interface: model.InterfaceState{Addresses: []string{}},
+		Peers:     []model.PeerState{},
+		Settings: model.SettingsState{
+			MTU:                 settings.MTU,
+			PersistentKeepalive: settings.PersistentKeepalive,
+			FirewallMark:        settings.FirewallMark,
+			Table:               settings.Table,
+			ConfigFilePath:      settings.ConfigFilePath,
+		},
+	}
+	if server.Interface != nil {
+		state.Interface.Addresses = append(state.Interface.Addresses, server.Interface.Addresses...)
+		state.Interface.ListenPort = server.Interface.ListenPort
+		state.Interface.PostUp = server.Interface.PostUp
+		state.Interface.PreDown = server.Interface.PreDown
+		state.Interface.PostDown = server.Interface.PostDown
+	}
+	if server.KeyPair != nil {
+		state.Interface.PublicKey = server.KeyPair.PublicKey
+	}
+
+	for _, clientData := range clients {
+		client := clientData.Client
+		if client == nil || !client.Enabled {
+			continue
+		}
+		peer := model.PeerState{
+			ID:         client.ID,
+			Name:       client.Name,
+			PublicKey:  client.PublicKey,
+			AllowedIPs: append([]string{}, client.AllocatedIPs...),
+			Endpoint:   client.Endpoint,
+		}
+		if client.PresharedKey != "" {
+			peer.PresharedKey = fingerprint(client.PresharedKey)
+		}
+		state.Peers = append(state.Peers, peer)
+	}
+	sort.Slice(state.Peers, func(i, j int) bool { return state.Peers[i].ID < state.Peers[j].ID })
+	return state
+}
+
+// DesiredConfigState returns the state of the config of the primary interface
+// as it is currently stored.
+func DesiredConfigState(db store.IStore) (model.ConfigState, error) {
+	iface, err := LookupInterface(db, "")
+	if err != nil {
+		return model.ConfigState{}, err
+	}
+	return DesiredInterfaceState(db, iface)
+}
+
+// DesiredInterfaceState returns the state of the config of iface as it is
+// currently stored.
+func DesiredInterfaceState(db store.IStore, iface model.WireGuardInterface) (model.ConfigState, error) {
+	clients, err := db.GetClients(false)
+	if err != nil {
+		return model.ConfigState{}, err
+	}
+	settings, err := db.GetGlobalSettings()
+	if err != nil {
+		return model.ConfigState{}, err
+	}
+	return InterfaceConfigState(iface, clients, settings), nil
+}
+
+// fingerprint identifies a secret without revealing it.
+func fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// hashJSON returns the SHA-256 of the JSON representation of value.
+func hashJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/labstack/gommon/log"
+)
+
+// WriteConfigFile replaces the file at path with data without ever leaving a
+// partly written file behind. The data is written to a temporary file in the
+// same directory, synced, given mode 0600 and the owner of the file it
+// replaces, and renamed into place. The former content is kept in path.bak.
+func WriteConfigFile(path string, data []byte) error {
+	current, err := os.ReadFile(path)
+	switch {
+	case err == nil && !bytes.Equal(current, data):
+		if err := writeFileAtomic(path+".bak", current, path); err != nil {
+			return fmt.Errorf("cannot back up %s: %w", path, err)
+		}
+	case err != nil && !os.IsNotExist(err):
+		return fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return writeFileAtomic(path, data, path)
+}
+
+// writeFileAtomic writes data to path through a temporary file that is
+// renamed into place. The file gets the owner of ownerOf, if that exists.
+func writeFileAtomic(path string, data []byte, ownerOf string) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Remove the temporary file unless it was renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if info, err := os.Stat(ownerOf); err == nil {
+		if err := chownLike(tmp, info); err != nil {
+			log.Warnf("Cannot keep the owner of %s: %v", ownerOf, err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a rename in dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return nil
+}
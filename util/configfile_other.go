@@ -0,0 +1,10 @@
+//go:build !unix
+
+package util
+
+import "os"
+
+// chownLike is a no-op where files have no Unix owner.
+func chownLike(f *os.File, info os.FileInfo) error {
+	return nil
+}
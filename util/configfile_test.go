@@ -0,0 +1,46 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wg0.conf")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteConfigFile(path, []byte("new\n")); err != nil {
+		t.Fatalf("WriteConfigFile failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new\n" {
+		t.Errorf("Config = %q, want the new content", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Config mode = %v, want 0600", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(path + ".bak"); string(data) != "old\n" {
+		t.Errorf("Backup = %q, want the old content", data)
+	}
+
+	// Writing the same content again keeps the backup of the former one
+	if err := WriteConfigFile(path, []byte("new\n")); err != nil {
+		t.Fatalf("WriteConfigFile failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path + ".bak"); string(data) != "old\n" {
+		t.Errorf("Backup = %q after an unchanged write, want the old content", data)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Directory holds %d files, want the config and its backup", len(entries))
+	}
+
+	// A file in a missing directory cannot be written
+	if err := WriteConfigFile(filepath.Join(dir, "missing", "wg0.conf"), []byte("new\n")); err == nil {
+		t.Error("WriteConfigFile into a missing directory succeeded")
+	}
+}
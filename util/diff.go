@@ -0,0 +1,187 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around a change.
+const diffContext = 3
+
+// maxEditDistance bounds the work of the line diff. Texts differing in more
+// lines get a diff replacing everything between their common ends.
+const maxEditDistance = 2000
+
+// diffLine is one line of a diff: ' ' if unchanged, '-' if removed and '+'
+// if added.
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// UnifiedDiff returns the changes from one text to another in the unified
+// diff format, or an empty string if they are equal.
+func UnifiedDiff(fromName, toName, from, to string) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+	var changes []int
+	for i, line := range lines {
+		if line.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for i := 0; i < len(changes); {
+		// Merge changes whose context overlaps into one hunk
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*diffContext+1 {
+			j++
+		}
+		start := max(changes[i]-diffContext, 0)
+		end := min(changes[j]+diffContext+1, len(lines))
+
+		fromStart, toStart := 0, 0
+		for _, line := range lines[:start] {
+			if line.kind != '+' {
+				fromStart++
+			}
+			if line.kind != '-' {
+				toStart++
+			}
+		}
+		fromCount, toCount := 0, 0
+		for _, line := range lines[start:end] {
+			if line.kind != '+' {
+				fromCount++
+			}
+			if line.kind != '-' {
+				toCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(fromStart, fromCount), hunkRange(toStart, toCount))
+		for _, line := range lines[start:end] {
+			out.WriteByte(line.kind)
+			out.WriteString(line.text)
+			out.WriteByte('\n')
+		}
+		i = j + 1
+	}
+	return out.String()
+}
+
+// hunkRange formats the start and length of a hunk. An empty range starts at
+// the line before it.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// splitLines splits a text into lines without their line breaks.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns the shortest edit from a to b, as found by Myers' diff
+// algorithm.
+func diffLines(a, b []string) []diffLine {
+	var prefix, suffix []diffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffLine{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append([]diffLine{{' ', a[len(a)-1]}}, suffix...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	lines := append(prefix, myersDiff(a, b)...)
+	return append(lines, suffix...)
+}
+
+// myersDiff finds the shortest edit from a to b. It keeps, for each edit
+// distance d, the furthest reaching x of the diagonals before step d.
+func myersDiff(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		if d > maxEditDistance {
+			return replaceLines(a, b)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+	return replaceLines(a, b)
+}
+
+// backtrack walks the trace of myersDiff back from the end of both texts.
+func backtrack(trace [][]int, a, b []string) []diffLine {
+	var lines []diffLine
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		at := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || k != d && at(k-1) < at(k+1) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			lines = append(lines, diffLine{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if d > 0 {
+			if x == prevX {
+				lines = append(lines, diffLine{'+', b[y-1]})
+			} else {
+				lines = append(lines, diffLine{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// replaceLines returns an edit removing all of a and adding all of b.
+func replaceLines(a, b []string) []diffLine {
+	lines := make([]diffLine, 0, len(a)+len(b))
+	for _, line := range a {
+		lines = append(lines, diffLine{'-', line})
+	}
+	for _, line := range b {
+		lines = append(lines, diffLine{'+', line})
+	}
+	return lines
+}
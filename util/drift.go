@@ -0,0 +1,251 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+)
+
+// DeviceController is the part of wgctrl.Client used to inspect and configure
+// a WireGuard device.
+type DeviceController interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// CheckDrift compares the listen port, the key and the peers of a live device
+// with the server interface and the enabled clients.
+func CheckDrift(device *wgtypes.Device, server model.Server, clients []model.ClientData) model.DriftReport {
+	report := model.DriftReport{
+		Device:    device.Name,
+		CheckedAt: time.Now().UTC(),
+		Peers:     []model.PeerDrift{},
+	}
+	if server.Interface != nil && device.ListenPort != server.Interface.ListenPort {
+		report.ListenPort = &model.DriftValue{Desired: server.Interface.ListenPort, Live: device.ListenPort}
+	}
+	if server.KeyPair != nil && device.PublicKey.String() != server.KeyPair.PublicKey {
+		report.PublicKey = &model.DriftValue{Desired: server.KeyPair.PublicKey, Live: device.PublicKey.String()}
+	}
+
+	byKey := make(map[string]*model.Client, len(clients))
+	for _, clientData := range clients {
+		if clientData.Client != nil {
+			byKey[clientData.Client.PublicKey] = clientData.Client
+		}
+	}
+	live := make(map[string]bool, len(device.Peers))
+	for _, peer := range device.Peers {
+		key := peer.PublicKey.String()
+		live[key] = true
+		client, ok := byKey[key]
+		switch {
+		case !ok:
+			report.Peers = append(report.Peers, model.PeerDrift{
+				PublicKey: key,
+				Status:    model.DriftUnknown,
+				Fields:    map[string]model.DriftValue{"allowed_ips": {Live: liveAllowedIPs(peer)}},
+			})
+		case !client.Enabled:
+			report.Peers = append(report.Peers, model.PeerDrift{
+				PublicKey: key,
+				Status:    model.DriftDisabled,
+				ClientID:  client.ID,
+				Name:      client.Name,
+			})
+		default:
+			if fields := peerDrift(client, peer); len(fields) > 0 {
+				report.Peers = append(report.Peers, model.PeerDrift{
+					PublicKey: key,
+					Status:    model.DriftModified,
+					ClientID:  client.ID,
+					Name:      client.Name,
+					Fields:    fields,
+				})
+			}
+		}
+	}
+	for _, clientData := range clients {
+		client := clientData.Client
+		if client == nil || !client.Enabled || live[client.PublicKey] {
+			continue
+		}
+		report.Peers = append(report.Peers, model.PeerDrift{
+			PublicKey: client.PublicKey,
+			Status:    model.DriftMissing,
+			ClientID:  client.ID,
+			Name:      client.Name,
+			Fields:    map[string]model.DriftValue{"allowed_ips": {Desired: desiredAllowedIPs(client)}},
+		})
+	}
+
+	sort.SliceStable(report.Peers, func(i, j int) bool {
+		if report.Peers[i].Status != report.Peers[j].Status {
+			return report.Peers[i].Status < report.Peers[j].Status
+		}
+		return report.Peers[i].Name < report.Peers[j].Name
+	})
+	report.InSync = report.ListenPort == nil && report.PublicKey == nil && len(report.Peers) == 0
+	return report
+}
+
+// peerDrift compares the allowed IPs and the preshared key of a live peer with
+// its client.
+func peerDrift(client *model.Client, peer wgtypes.Peer) map[string]model.DriftValue {
+	fields := make(map[string]model.DriftValue)
+	desired, actual := desiredAllowedIPs(client), liveAllowedIPs(peer)
+	if !slices.Equal(desired, actual) {
+		fields["allowed_ips"] = model.DriftValue{Desired: desired, Live: actual}
+	}
+
+	desiredPSK, livePSK := "none", "none"
+	if client.PresharedKey != "" {
+		desiredPSK = "set"
+	}
+	if peer.PresharedKey != (wgtypes.Key{}) {
+		livePSK = "set"
+		if client.PresharedKey != "" && client.PresharedKey != peer.PresharedKey.String() {
+			livePSK = "different"
+		}
+	}
+	if desiredPSK != livePSK {
+		fields["preshared_key"] = model.DriftValue{Desired: desiredPSK, Live: livePSK}
+	}
+	return fields
+}
+
+// desiredAllowedIPs returns the allocated IPs of a client the way the kernel
+// reports them: masked and sorted.
+func desiredAllowedIPs(client *model.Client) []string {
+	ips := []string{}
+	for _, cidr := range client.AllocatedIPs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			ips = append(ips, ipNet.String())
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// liveAllowedIPs returns the sorted allowed IPs of a live peer.
+func liveAllowedIPs(peer wgtypes.Peer) []string {
+	ips := []string{}
+	for _, ipNet := range peer.AllowedIPs {
+		ips = append(ips, ipNet.String())
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// PeerConfig returns the device configuration of a client's peer, replacing
+// its allowed IPs and preshared key.
+func PeerConfig(client model.Client, settings model.GlobalSetting) (wgtypes.PeerConfig, error) {
+	publicKey, err := wgtypes.ParseKey(client.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("invalid public key of client %s: %w", client.Name, err)
+	}
+	// The zero key removes a preshared key
+	var presharedKey wgtypes.Key
+	if client.PresharedKey != "" {
+		if presharedKey, err = wgtypes.ParseKey(client.PresharedKey); err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("invalid preshared key of client %s: %w", client.Name, err)
+		}
+	}
+	peer := wgtypes.PeerConfig{
+		PublicKey:         publicKey,
+		PresharedKey:      &presharedKey,
+		ReplaceAllowedIPs: true,
+	}
+	for _, cidr := range client.AllocatedIPs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("invalid allocated IP %s of client %s: %w", cidr, client.Name, err)
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, *ipNet)
+	}
+	if settings.PersistentKeepalive > 0 {
+		keepalive := time.Duration(settings.PersistentKeepalive) * time.Second
+		peer.PersistentKeepaliveInterval = &keepalive
+	}
+	if client.Endpoint != "" {
+		if peer.Endpoint, err = net.ResolveUDPAddr("udp", client.Endpoint); err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("invalid endpoint of client %s: %w", client.Name, err)
+		}
+	}
+	return peer, nil
+}
+
+// SyncDevice configures the device to match the server interface and the
+// enabled clients. Only the differences are configured: missing peers are
+// added, modified ones updated, and unknown and disabled ones removed, each
+// with its own call so a failing peer does not hold up the others. An error is
+// returned if the device cannot be read or its interface cannot be configured;
+// failures of single peers are reported in the result.
+func SyncDevice(ctrl DeviceController, name string, server model.Server, clients []model.ClientData, settings model.GlobalSetting) (model.DeviceSync, error) {
+	device, err := ctrl.Device(name)
+	if err != nil {
+		return model.DeviceSync{}, err
+	}
+	report := CheckDrift(device, server, clients)
+	result := model.DeviceSync{Device: name, Peers: []model.PeerResult{}}
+
+	var cfg wgtypes.Config
+	if report.ListenPort != nil {
+		listenPort := server.Interface.ListenPort
+		cfg.ListenPort = &listenPort
+	}
+	if report.PublicKey != nil {
+		privateKey, err := wgtypes.ParseKey(server.KeyPair.PrivateKey)
+		if err != nil {
+			return result, fmt.Errorf("invalid server private key: %w", err)
+		}
+		cfg.PrivateKey = &privateKey
+	}
+	if cfg.ListenPort != nil || cfg.PrivateKey != nil {
+		if err := ctrl.ConfigureDevice(name, cfg); err != nil {
+			return result, err
+		}
+		result.Interface = true
+	}
+
+	byKey := make(map[string]model.Client, len(clients))
+	for _, clientData := range clients {
+		if clientData.Client != nil {
+			byKey[clientData.Client.PublicKey] = *clientData.Client
+		}
+	}
+	for _, drift := range report.Peers {
+		peerResult := model.PeerResult{PublicKey: drift.PublicKey, ClientID: drift.ClientID, Name: drift.Name}
+		var peer wgtypes.PeerConfig
+		var err error
+		switch drift.Status {
+		case model.DriftUnknown, model.DriftDisabled:
+			peerResult.Action = model.ConfigChangeRemoved
+			peer.PublicKey, err = wgtypes.ParseKey(drift.PublicKey)
+			peer.Remove = true
+		case model.DriftMissing:
+			peerResult.Action = model.ConfigChangeAdded
+			peer, err = PeerConfig(byKey[drift.PublicKey], settings)
+		default:
+			peerResult.Action = model.ConfigChangeChanged
+			peer, err = PeerConfig(byKey[drift.PublicKey], settings)
+		}
+		if err == nil {
+			err = ctrl.ConfigureDevice(name, wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}})
+		}
+		if err != nil {
+			log.Errorf("Cannot configure peer %s on %s: %v", drift.PublicKey, name, err)
+			peerResult.Error = err.Error()
+			result.Failed++
+		}
+		result.Peers = append(result.Peers, peerResult)
+	}
+	return result, nil
+}
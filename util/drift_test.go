@@ -0,0 +1,112 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+)
+
+// fakeDevice is a DeviceController for one device kept in memory.
+type fakeDevice struct {
+	device  *wgtypes.Device
+	configs []wgtypes.Config
+}
+
+func (f *fakeDevice) Device(name string) (*wgtypes.Device, error) {
+	return f.device, nil
+}
+
+func (f *fakeDevice) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	f.configs = append(f.configs, cfg)
+	return nil
+}
+
+// TestDrift verifies that missing, unknown, disabled and modified peers are
+// found and configured one by one.
+func TestDrift(t *testing.T) {
+	keys := make([]wgtypes.Key, 5)
+	for i := range keys {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("GeneratePrivateKey failed: %v", err)
+		}
+		keys[i] = key.PublicKey()
+	}
+	psk, _ := wgtypes.GenerateKey()
+	allowed := func(cidr string) []net.IPNet {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		return []net.IPNet{*ipNet}
+	}
+
+	server := model.Server{Interface: &model.ServerInterface{ListenPort: 51820}}
+	clients := []model.ClientData{
+		{Client: &model.Client{ID: "in-sync", Name: "in-sync", PublicKey: keys[0].String(), AllocatedIPs: []string{"10.8.0.2/32"}, Enabled: true}},
+		{Client: &model.Client{ID: "modified", Name: "modified", PublicKey: keys[1].String(), PresharedKey: psk.String(), AllocatedIPs: []string{"10.8.0.3/32"}, Enabled: true}},
+		{Client: &model.Client{ID: "missing", Name: "missing", PublicKey: keys[2].String(), AllocatedIPs: []string{"10.8.0.4/32"}, Enabled: true}},
+		{Client: &model.Client{ID: "disabled", Name: "disabled", PublicKey: keys[3].String(), AllocatedIPs: []string{"10.8.0.5/32"}}},
+	}
+	fake := &fakeDevice{device: &wgtypes.Device{
+		Name:       "wg0",
+		ListenPort: 51821,
+		Peers: []wgtypes.Peer{
+			{PublicKey: keys[0], AllowedIPs: allowed("10.8.0.2/32")},
+			{PublicKey: keys[1], AllowedIPs: allowed("10.8.0.9/32")},
+			{PublicKey: keys[3], AllowedIPs: allowed("10.8.0.5/32")},
+			{PublicKey: keys[4], AllowedIPs: allowed("10.8.0.6/32")},
+		},
+	}}
+
+	report := CheckDrift(fake.device, server, clients)
+	if report.InSync || report.ListenPort == nil || report.ListenPort.Live != 51821 {
+		t.Errorf("Drift report = %+v, want a listen port drift", report)
+	}
+	want := map[string]string{
+		keys[1].String(): model.DriftModified,
+		keys[2].String(): model.DriftMissing,
+		keys[3].String(): model.DriftDisabled,
+		keys[4].String(): model.DriftUnknown,
+	}
+	if len(report.Peers) != len(want) {
+		t.Fatalf("Drift report has %d peers, want %d: %+v", len(report.Peers), len(want), report.Peers)
+	}
+	for _, drift := range report.Peers {
+		if want[drift.PublicKey] != drift.Status {
+			t.Errorf("Peer %s has status %s, want %s", drift.Name, drift.Status, want[drift.PublicKey])
+		}
+		if drift.Status == model.DriftModified {
+			if _, ok := drift.Fields["allowed_ips"]; !ok {
+				t.Errorf("Modified peer lacks the allowed IPs drift: %+v", drift.Fields)
+			}
+			if got := drift.Fields["preshared_key"]; got.Desired != "set" || got.Live != "none" {
+				t.Errorf("Preshared key drift = %+v, want set/none", got)
+			}
+		}
+	}
+
+	result, err := SyncDevice(fake, "wg0", server, clients, model.GlobalSetting{})
+	if err != nil {
+		t.Fatalf("SyncDevice failed: %v", err)
+	}
+	if !result.Interface || fake.configs[0].ListenPort == nil || *fake.configs[0].ListenPort != 51820 {
+		t.Errorf("Interface config = %+v, want listen port 51820", fake.configs[0])
+	}
+	// One call for the interface and one for each peer
+	if len(fake.configs) != 5 || len(result.Peers) != 4 || result.Failed != 0 {
+		t.Fatalf("SyncDevice made %d calls with result %+v, want 5 calls for 4 peers", len(fake.configs), result)
+	}
+	actions := map[string]int{}
+	for _, peer := range result.Peers {
+		actions[peer.Action]++
+	}
+	if actions[model.ConfigChangeAdded] != 1 || actions[model.ConfigChangeChanged] != 1 || actions[model.ConfigChangeRemoved] != 2 {
+		t.Errorf("Peer actions = %v, want 1 added, 1 changed and 2 removed", actions)
+	}
+	for _, cfg := range fake.configs[1:] {
+		if peer := cfg.Peers[0]; !peer.Remove && (!peer.ReplaceAllowedIPs || len(peer.AllowedIPs) != 1) {
+			t.Errorf("Peer config %+v does not replace the allowed IPs", peer)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// interfaceNameRegexp matches the interface names wg-quick accepts.
+var interfaceNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+// ValidateInterfaceName checks that name can be used for a network interface
+// and as the base name of its config file.
+func ValidateInterfaceName(name string) error {
+	if !interfaceNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid interface name %q, use up to 15 letters, digits or _=+.-", name)
+	}
+	return nil
+}
+
+// InterfaceConfigPath returns the default config file of an interface: a file
+// named after it next to the config of the primary interface.
+func InterfaceConfigPath(primaryPath, name string) string {
+	dir := filepath.Dir(primaryPath)
+	if primaryPath == "" {
+		dir = filepath.Dir(DefaultConfigFilePath)
+	}
+	return filepath.Join(dir, name+".conf")
+}
+
+// PrimaryInterface returns the interface configured by the server and the
+// global settings.
+func PrimaryInterface(server model.Server, settings model.GlobalSetting) model.WireGuardInterface {
+	iface := model.WireGuardInterface{
+		Name:           GetWireGuardInterface(settings.ConfigFilePath),
+		Primary:        true,
+		MTU:            settings.MTU,
+		DNSServers:     settings.DNSServers,
+		ConfigFilePath: settings.ConfigFilePath,
+	}
+	if server.KeyPair != nil {
+		iface.PrivateKey = server.KeyPair.PrivateKey
+		iface.PublicKey = server.KeyPair.PublicKey
+	}
+	if server.Interface != nil {
+		iface.Addresses = server.Interface.Addresses
+		iface.ListenPort = server.Interface.ListenPort
+		iface.PostUp = server.Interface.PostUp
+		iface.PreDown = server.Interface.PreDown
+		iface.PostDown = server.Interface.PostDown
+		iface.UpdatedAt = server.Interface.UpdatedAt
+		iface.Revision = server.Interface.Revision
+	}
+	return iface
+}
+
+// GetInterfaces returns all WireGuard interfaces, the primary one first.
+func GetInterfaces(db store.IStore) ([]model.WireGuardInterface, error) {
+	server, err := db.GetServer()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get server config: %w", err)
+	}
+	settings, err := db.GetGlobalSettings()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get global settings: %w", err)
+	}
+	others, err := db.GetWireGuardInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get interfaces: %w", err)
+	}
+	return append([]model.WireGuardInterface{PrimaryInterface(server, settings)}, others...), nil
+}
+
+// LookupInterface returns the WireGuard interface with the given name. An
+// empty name selects the primary interface.
+func LookupInterface(db store.IStore, name string) (model.WireGuardInterface, error) {
+	ifaces, err := GetInterfaces(db)
+	if err != nil {
+		return model.WireGuardInterface{}, err
+	}
+	if name == "" {
+		return ifaces[0], nil
+	}
+	for _, iface := range ifaces {
+		if iface.Name == name {
+			return iface, nil
+		}
+	}
+	return model.WireGuardInterface{}, fmt.Errorf("interface %s not found", name)
+}
+
+// CheckInterfaceConflicts checks that iface has a name and networks of its own
+// among ifaces, and a config file and listen port of its own among those
+// running on the same host.
+func CheckInterfaceConflicts(ifaces []model.WireGuardInterface, iface model.WireGuardInterface) error {
+	networks := serverNetworks([]model.WireGuardInterface{iface})
+	for _, other := range ifaces {
+		if other.Primary == iface.Primary && (iface.Primary || other.Name == iface.Name) {
+			continue
+		}
+		if other.Name == iface.Name {
+			return fmt.Errorf("interface %s already exists", iface.Name)
+		}
+		sameHost := other.Node == iface.Node
+		if sameHost && other.ConfigFilePath == iface.ConfigFilePath {
+			return fmt.Errorf("config file %s is used by interface %s", iface.ConfigFilePath, other.Name)
+		}
+		if sameHost && iface.ListenPort != 0 && other.ListenPort == iface.ListenPort {
+			return fmt.Errorf("listen port %d is used by interface %s", iface.ListenPort, other.Name)
+		}
+		for _, otherNetwork := range serverNetworks([]model.WireGuardInterface{other}) {
+			for _, network := range networks {
+				if otherNetwork.Contains(network.IP) || network.Contains(otherNetwork.IP) {
+					return fmt.Errorf("network %s overlaps network %s of interface %s", network, otherNetwork, other.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ClientInterfaceName returns the interface name stored with the clients of
+// iface, which is empty for the primary interface.
+func ClientInterfaceName(iface model.WireGuardInterface) string {
+	if iface.Primary {
+		return ""
+	}
+	return iface.Name
+}
+
+// CheckClientInterface checks that the interface client is bound to exists and
+// that the allocated IPs of client lie within its networks. The name of the
+// primary interface is replaced with "", under which its clients are stored.
+func CheckClientInterface(db store.IStore, client *model.Client) error {
+	iface, err := LookupInterface(db, client.Interface)
+	if err != nil {
+		return err
+	}
+	client.Interface = ClientInterfaceName(iface)
+	networks := serverNetworks([]model.WireGuardInterface{iface})
+	for _, cidr := range client.AllocatedIPs {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid ip allocation input %s. Must be in CIDR format", cidr)
+		}
+		if !containedIn(networks, ipnet) {
+			return fmt.Errorf("IP %s does not belong to any network addresses of interface %s", cidr, iface.Name)
+		}
+	}
+	return nil
+}
+
+// InterfaceClients returns the clients that are peers of iface.
+func InterfaceClients(clients []model.ClientData, iface model.WireGuardInterface) []model.ClientData {
+	name := ClientInterfaceName(iface)
+	selected := make([]model.ClientData, 0, len(clients))
+	for _, clientData := range clients {
+		if clientData.Client != nil && clientData.Client.Interface == name {
+			selected = append(selected, clientData)
+		}
+	}
+	return selected
+}
+
+// ClientInterfaces returns the interfaces by the name their clients store,
+// "" for the primary one, together with the global settings. Client configs
+// are built from them with BuildClientConfig(client, iface.Server(),
+// iface.Settings(settings)).
+func ClientInterfaces(db store.IStore) (map[string]model.WireGuardInterface, model.GlobalSetting, error) {
+	settings, err := db.GetGlobalSettings()
+	if err != nil {
+		return nil, settings, err
+	}
+	ifaces, err := GetInterfaces(db)
+	if err != nil {
+		return nil, settings, err
+	}
+	byName := make(map[string]model.WireGuardInterface, len(ifaces))
+	for _, iface := range ifaces {
+		byName[ClientInterfaceName(iface)] = iface
+	}
+	return byName, settings, nil
+}
+
+// ClientServer returns the server and the settings the config of client is
+// built from: those of the interface it is a peer of.
+func ClientServer(db store.IStore, client model.Client) (model.Server, model.GlobalSetting, error) {
+	ifaces, settings, err := ClientInterfaces(db)
+	if err != nil {
+		return model.Server{}, settings, err
+	}
+	iface, ok := ifaces[client.Interface]
+	if !ok {
+		return model.Server{}, settings, fmt.Errorf("interface %s of client %s not found", client.Interface, client.ID)
+	}
+	return iface.Server(), iface.Settings(settings), nil
+}
+
+// InterfaceConfigState returns the state the config of iface is rendered from,
+// using the clients that are peers of it.
+func InterfaceConfigState(iface model.WireGuardInterface, clients []model.ClientData, settings model.GlobalSetting) model.ConfigState {
+	return NewConfigState(iface.Server(), InterfaceClients(clients, iface), iface.Settings(settings))
+}
+
+// AppliedState returns the config state of the last successful apply of iface
+// and its time, both nil if it was never applied.
+func AppliedState(db store.IStore, iface model.WireGuardInterface) (*model.ConfigState, *time.Time, error) {
+	if !iface.Primary {
+		return iface.Applied, iface.AppliedAt, nil
+	}
+	hashes, err := db.GetHashes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return hashes.Applied, hashes.AppliedAt, nil
+}
+
+// UpdateAppliedState records state as the config last applied to iface.
+func UpdateAppliedState(db store.IStore, iface model.WireGuardInterface, state model.ConfigState) error {
+	if iface.Primary {
+		return UpdateHashes(db, state)
+	}
+	return db.SaveWireGuardInterfaceApplied(iface.Name, state, time.Now().UTC())
+}
+
+// InterfaceChanged reports whether the config of iface differs from the one
+// last applied to it.
+func InterfaceChanged(db store.IStore, iface model.WireGuardInterface, clients []model.ClientData, settings model.GlobalSetting) bool {
+	newClient, newServer := GetCurrentHash(InterfaceConfigState(iface, clients, settings))
+	if iface.Primary {
+		old, _ := db.GetHashes()
+		return old.Client != newClient || old.Server != newServer
+	}
+	if iface.Applied == nil {
+		return true
+	}
+	oldClient, oldServer := GetCurrentHash(*iface.Applied)
+	return oldClient != newClient || oldServer != newServer
+}
@@ -0,0 +1,315 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/rs/xid"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/store"
+)
+
+// The subnet ranges are kept in the store. subnetRanges and subnetRangesOrder
+// hold the copy used to serve requests, which LoadSubnetRanges replaces after
+// every change.
+var (
+	subnetRangesMutex sync.RWMutex
+	subnetRanges      = make(map[string][]*net.IPNet)
+	subnetRangesOrder []string
+)
+
+// ParseSubnetRanges parses a string containing subnet ranges. The expected
+// format is:
+//
+//	rangeName:CIDR1,CIDR2;rangeName2:CIDR3,CIDR4
+//
+// Malformed ranges and CIDRs are skipped with a warning.
+func ParseSubnetRanges(subnetRangesStr string) []model.SubnetRange {
+	var ranges []model.SubnetRange
+	if subnetRangesStr == "" {
+		return ranges
+	}
+
+	// Clean the input string.
+	subnetRangesStr = strings.TrimSpace(subnetRangesStr)
+	subnetRangesStr = strings.Trim(subnetRangesStr, ";:,")
+
+	// Use a set to track duplicate CIDRs.
+	cidrSet := make(map[string]bool)
+
+	for _, rng := range strings.Split(subnetRangesStr, ";") {
+		rng = strings.TrimSpace(rng)
+		parts := strings.Split(rng, ":")
+		if len(parts) != 2 {
+			log.Warnf("Unable to parse subnet range: %v. Skipped.", rng)
+			continue
+		}
+		subnetRange := model.SubnetRange{Name: strings.TrimSpace(parts[0]), Position: len(ranges)}
+
+		for _, cidr := range strings.Split(parts[1], ",") {
+			cidr = strings.TrimSpace(cidr)
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Warnf("[%v] Unable to parse CIDR: %v. Skipped.", subnetRange.Name, cidr)
+				continue
+			}
+			if cidrSet[ipnet.String()] {
+				log.Warnf("[%v] CIDR already exists: %v. Skipped.", subnetRange.Name, ipnet.String())
+				continue
+			}
+			cidrSet[ipnet.String()] = true
+			subnetRange.CIDRs = append(subnetRange.CIDRs, ipnet.String())
+		}
+
+		// Skip the range if no valid CIDRs were found.
+		if len(subnetRange.CIDRs) > 0 {
+			ranges = append(ranges, subnetRange)
+		}
+	}
+	return ranges
+}
+
+// SeedSubnetRanges saves the given subnet ranges, usually those of the
+// --subnet-ranges flag, unless the store already has subnet ranges. CIDRs
+// outside of the server networks are skipped with a warning.
+func SeedSubnetRanges(db store.IStore, ranges []model.SubnetRange) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	existing, err := db.GetSubnetRanges()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+	ifaces, err := GetInterfaces(db)
+	if err != nil {
+		return err
+	}
+
+	// Save all ranges or none, as a partial seed would never be completed:
+	// the next start finds subnet ranges in the store and skips the seed
+	now := time.Now().UTC()
+	return db.WithTx(func(tx store.IStore) error {
+		for _, subnetRange := range ranges {
+			subnetRange.CIDRs = validServerCIDRs(ifaces, subnetRange)
+			if len(subnetRange.CIDRs) == 0 {
+				log.Warnf("[%v] No valid CIDRs in this subnet range. Removed.", subnetRange.Name)
+				continue
+			}
+			subnetRange.ID = xid.New().String()
+			subnetRange.CreatedAt = now
+			subnetRange.UpdatedAt = now
+			if err := tx.SaveSubnetRange(subnetRange); err != nil {
+				return err
+			}
+			log.Infof("Saved subnet range %s from the --subnet-ranges flag", subnetRange.Name)
+		}
+		return nil
+	})
+}
+
+// LoadSubnetRanges replaces the subnet ranges in memory with those of the
+// store. CIDRs that are no longer within the server networks are left out.
+func LoadSubnetRanges(db store.IStore) error {
+	ranges, err := db.GetSubnetRanges()
+	if err != nil {
+		return err
+	}
+	ifaces, err := GetInterfaces(db)
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string][]*net.IPNet)
+	var order []string
+	for _, subnetRange := range ranges {
+		for _, cidr := range validServerCIDRs(ifaces, subnetRange) {
+			_, ipnet, _ := net.ParseCIDR(cidr)
+			loaded[subnetRange.Name] = append(loaded[subnetRange.Name], ipnet)
+		}
+		if len(loaded[subnetRange.Name]) > 0 {
+			order = append(order, subnetRange.Name)
+		}
+	}
+
+	subnetRangesMutex.Lock()
+	defer subnetRangesMutex.Unlock()
+	subnetRanges = loaded
+	subnetRangesOrder = order
+
+	// The cached indexes refer to the previous order.
+	ipToSubnetRangeMutex.Lock()
+	IPToSubnetRange = make(map[string]uint16)
+	ipToSubnetRangeMutex.Unlock()
+	return nil
+}
+
+// ValidateSubnetRange checks that a subnet range has a name and that its
+// CIDRs are valid, distinct and within the networks of the interfaces. The
+// CIDRs are normalized to their network addresses.
+func ValidateSubnetRange(ifaces []model.WireGuardInterface, subnetRange *model.SubnetRange) error {
+	subnetRange.Name = strings.TrimSpace(subnetRange.Name)
+	if subnetRange.Name == "" {
+		return fmt.Errorf("subnet range name is required")
+	}
+	if strings.ContainsAny(subnetRange.Name, ":;,") {
+		return fmt.Errorf("subnet range name must not contain ':', ';' or ','")
+	}
+	if len(subnetRange.CIDRs) == 0 {
+		return fmt.Errorf("subnet range %s has no CIDRs", subnetRange.Name)
+	}
+
+	serverSubnets := serverNetworks(ifaces)
+	seen := make(map[string]bool)
+	for i, cidr := range subnetRange.CIDRs {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %s", cidr)
+		}
+		if seen[ipnet.String()] {
+			return fmt.Errorf("CIDR %s is listed more than once", ipnet)
+		}
+		seen[ipnet.String()] = true
+		if !containedIn(serverSubnets, ipnet) {
+			return fmt.Errorf("CIDR %s is outside of all server subnets", ipnet)
+		}
+		subnetRange.CIDRs[i] = ipnet.String()
+	}
+	return nil
+}
+
+// validServerCIDRs returns the CIDRs of a subnet range that are within the
+// networks of the interfaces and warns about the others.
+func validServerCIDRs(ifaces []model.WireGuardInterface, subnetRange model.SubnetRange) []string {
+	serverSubnets := serverNetworks(ifaces)
+	var valid []string
+	for _, cidr := range subnetRange.CIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil || !containedIn(serverSubnets, ipnet) {
+			log.Warnf("[%v] CIDR is outside of all server subnets: %v. Removed.", subnetRange.Name, cidr)
+			continue
+		}
+		valid = append(valid, ipnet.String())
+	}
+	return valid
+}
+
+// serverNetworks returns the networks of the interface addresses.
+func serverNetworks(ifaces []model.WireGuardInterface) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, iface := range ifaces {
+		for _, addr := range iface.Addresses {
+			if _, netAddr, err := net.ParseCIDR(strings.TrimSpace(addr)); err == nil {
+				networks = append(networks, netAddr)
+			}
+		}
+	}
+	return networks
+}
+
+// containedIn reports whether ipnet lies within one of the networks.
+func containedIn(networks []*net.IPNet, ipnet *net.IPNet) bool {
+	for _, network := range networks {
+		if ContainsCIDR(network, ipnet) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSubnetRange returns the networks of the named subnet range.
+func GetSubnetRange(name string) ([]*net.IPNet, bool) {
+	subnetRangesMutex.RLock()
+	defer subnetRangesMutex.RUnlock()
+	cidrs, ok := subnetRanges[name]
+	return cidrs, ok
+}
+
+// GetSubnetRangeNames returns the names of the subnet ranges in order.
+func GetSubnetRangeNames() []string {
+	subnetRangesMutex.RLock()
+	defer subnetRangesMutex.RUnlock()
+	return append([]string{}, subnetRangesOrder...)
+}
+
+// findSubnetRangeForIP finds the subnet range for a given CIDR.
+// It uses a cache (IPToSubnetRange) and must be called with subnetRangesMutex
+// held for reading.
+func findSubnetRangeForIP(cidr string) (uint16, error) {
+	// Parse the provided CIDR.
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, err
+	}
+	ipStr := ip.String()
+
+	// Check the cache first using a read lock.
+	ipToSubnetRangeMutex.RLock()
+	if sr, ok := IPToSubnetRange[ipStr]; ok {
+		ipToSubnetRangeMutex.RUnlock()
+		return sr, nil
+	}
+	ipToSubnetRangeMutex.RUnlock()
+
+	// Iterate over the subnet ranges in order to compute the subnet range index.
+	for index, srName := range subnetRangesOrder {
+		// For each CIDR in the current subnet range, check if it contains the IP.
+		for _, ipnet := range subnetRanges[srName] {
+			if ipnet.Contains(ip) {
+				// Lock for writing and store the computed index in the cache.
+				ipToSubnetRangeMutex.Lock()
+				IPToSubnetRange[ipStr] = uint16(index)
+				ipToSubnetRangeMutex.Unlock()
+				return uint16(index), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("subnet range not found for IP %s", ipStr)
+}
+
+// FillClientSubnetRange appends the subnet range names to the client data.
+func FillClientSubnetRange(client model.ClientData) model.ClientData {
+	subnetRangesMutex.RLock()
+	defer subnetRangesMutex.RUnlock()
+
+	cl := *client.Client
+	for _, ip := range cl.AllocatedIPs {
+		if sr, err := findSubnetRangeForIP(ip); err == nil {
+			cl.SubnetRanges = append(cl.SubnetRanges, subnetRangesOrder[sr])
+		}
+	}
+	return model.ClientData{
+		Client: &cl,
+		QRCode: client.QRCode,
+	}
+}
+
+// GetSubnetRangesString returns a formatted string representing active subnet ranges.
+func GetSubnetRangesString() string {
+	subnetRangesMutex.RLock()
+	defer subnetRangesMutex.RUnlock()
+
+	var sb strings.Builder
+	for _, rng := range subnetRangesOrder {
+		cidrs := subnetRanges[rng]
+		if len(cidrs) > 0 {
+			sb.WriteString(rng)
+			sb.WriteString(":[")
+			for i, cidr := range cidrs {
+				if i > 0 {
+					sb.WriteString(", ")
+				}
+				sb.WriteString(cidr.String())
+			}
+			sb.WriteString("]  ")
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
@@ -4,8 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/gob"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -13,8 +11,6 @@ import (
 	"math/rand"
 	"net"
 	"os"
-	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
@@ -23,7 +19,6 @@ import (
 	"github.com/chmike/domain"
 	"github.com/swissmakers/wireguard-manager/model"
 	"github.com/swissmakers/wireguard-manager/store"
-	"golang.org/x/mod/sumdb/dirhash"
 
 	externalip "github.com/glendc/go-external-ip"
 	"github.com/labstack/gommon/log"
@@ -231,313 +226,52 @@ func GetPublicIP() (model.Interface, error) {
 }
 
 //
-// IP Extraction and Allocation
-//
-
-// GetIPFromCIDR extracts the IP portion from a CIDR notation.
-func GetIPFromCIDR(cidr string) (string, error) {
-	ip, _, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return "", err
-	}
-	return ip.String(), nil
-}
-
-// GetAllocatedIPs returns all IP addresses allocated to clients and the server.
-// The ignoreClientID parameter can be used to exclude a specific client.
-func GetAllocatedIPs(ignoreClientID string) ([]string, error) {
-	var allocatedIPs []string
-
-	// Initialize the scribble DB.
-	db, err := scribble.New("./db", nil)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read server interface addresses.
-	var serverInterface model.ServerInterface
-	if err := db.Read("server", "interfaces", &serverInterface); err != nil {
-		return nil, err
-	}
-	for _, cidr := range serverInterface.Addresses {
-		ip, err := GetIPFromCIDR(cidr)
-		if err != nil {
-			return nil, err
-		}
-		allocatedIPs = append(allocatedIPs, ip)
-	}
-
-	// Read clients.
-	records, err := db.ReadAll("clients")
-	if err != nil {
-		return nil, err
-	}
-	for _, record := range records {
-		var client model.Client
-		if err := json.Unmarshal(record, &client); err != nil {
-			return nil, err
-		}
-		if client.ID != ignoreClientID {
-			for _, cidr := range client.AllocatedIPs {
-				ip, err := GetIPFromCIDR(cidr)
-				if err != nil {
-					return nil, err
-				}
-				allocatedIPs = append(allocatedIPs, ip)
-			}
-		}
-	}
-
-	return allocatedIPs, nil
-}
-
-// inc increments an IP address by one.
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
-	}
-}
-
-// GetBroadcastIP computes the broadcast address of a given network.
-func GetBroadcastIP(n *net.IPNet) net.IP {
-	broadcast := make(net.IP, len(n.IP))
-	for i := range n.IP {
-		broadcast[i] = n.IP[i] | ^n.Mask[i]
-	}
-	return broadcast
-}
-
-// GetBroadcastAndNetworkAddrsLookup returns a map of addresses (broadcast and network addresses)
-// for the given interface addresses (CIDRs).
-func GetBroadcastAndNetworkAddrsLookup(interfaceAddresses []string) map[string]bool {
-	list := make(map[string]bool)
-	for _, ifa := range interfaceAddresses {
-		_, netAddr, err := net.ParseCIDR(ifa)
-		if err != nil {
-			continue
-		}
-		list[GetBroadcastIP(netAddr).String()] = true
-		list[netAddr.IP.String()] = true
-	}
-	return list
-}
-
-// GetAvailableIP returns an available IP from the given CIDR that is not allocated and is not a network/broadcast address.
-func GetAvailableIP(cidr string, allocatedList, interfaceAddresses []string) (string, error) {
-	ip, netAddr, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return "", err
-	}
-	unavailableIPs := GetBroadcastAndNetworkAddrsLookup(interfaceAddresses)
-	for ip := ip.Mask(netAddr.Mask); netAddr.Contains(ip); inc(ip) {
-		suggestedAddr := ip.String()
-		available := true
-		for _, allocated := range allocatedList {
-			if suggestedAddr == allocated {
-				available = false
-				break
-			}
-		}
-		if available && !unavailableIPs[suggestedAddr] {
-			return suggestedAddr, nil
-		}
-	}
-	return "", errors.New("no more available ip address")
-}
-
-// ValidateIPAllocation validates the client's requested IP allocation.
-func ValidateIPAllocation(serverAddresses []string, ipAllocatedList []string, ipAllocationList []string) (bool, error) {
-	for _, clientCIDR := range ipAllocationList {
-		ip, _, _ := net.ParseCIDR(clientCIDR)
-		if ip == nil {
-			return false, fmt.Errorf("invalid ip allocation input %s. Must be in CIDR format", clientCIDR)
-		}
-		for _, allocated := range ipAllocatedList {
-			if allocated == ip.String() {
-				return false, fmt.Errorf("IP %s already allocated", ip)
-			}
-		}
-		var isValid bool
-		for _, serverCIDR := range serverAddresses {
-			_, serverNet, _ := net.ParseCIDR(serverCIDR)
-			if serverNet.Contains(ip) {
-				isValid = true
-				break
-			}
-		}
-		if !isValid {
-			return false, fmt.Errorf("IP %s does not belong to any network addresses of WireGuard server", ip)
-		}
-	}
-	return true, nil
-}
-
-//
-// Subnet Ranges and Client Data Helpers
+// WireGuard Server Configuration File
 //
 
-// findSubnetRangeForIP finds the subnet range for a given CIDR.
-// It uses a cache (IPToSubnetRange) and the global SubnetRanges and SubnetRangesOrder.
-func findSubnetRangeForIP(cidr string) (uint16, error) {
-	// Parse the provided CIDR.
-	ip, _, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return 0, err
-	}
-	ipStr := ip.String()
-
-	// Check the cache first using a read lock.
-	ipToSubnetRangeMutex.RLock()
-	if sr, ok := IPToSubnetRange[ipStr]; ok {
-		ipToSubnetRangeMutex.RUnlock()
-		return sr, nil
-	}
-	ipToSubnetRangeMutex.RUnlock()
-
-	// Iterate over the global SubnetRangesOrder to compute the subnet range index.
-	for index, srName := range SubnetRangesOrder {
-		cidrList, ok := SubnetRanges[srName]
-		if !ok {
-			continue
-		}
-		// For each CIDR in the current subnet range, check if it contains the IP.
-		for _, ipnet := range cidrList {
-			if ipnet.Contains(ip) {
-				// Lock for writing and store the computed index in the cache.
-				ipToSubnetRangeMutex.Lock()
-				IPToSubnetRange[ipStr] = uint16(index)
-				ipToSubnetRangeMutex.Unlock()
-				return uint16(index), nil
-			}
-		}
-	}
-	return 0, fmt.Errorf("subnet range not found for IP %s", ipStr)
-}
-
-// FillClientSubnetRange appends the subnet range names to the client data.
-func FillClientSubnetRange(client model.ClientData) model.ClientData {
-	cl := *client.Client
-	for _, ip := range cl.AllocatedIPs {
-		if sr, err := findSubnetRangeForIP(ip); err == nil {
-			cl.SubnetRanges = append(cl.SubnetRanges, SubnetRangesOrder[sr])
-		}
-	}
-	return model.ClientData{
-		Client: &cl,
-		QRCode: client.QRCode,
-	}
-}
-
-// ValidateAndFixSubnetRanges checks and removes non-valid CIDRs from the global SubnetRanges.
-func ValidateAndFixSubnetRanges(db store.IStore) error {
-	if len(SubnetRangesOrder) == 0 {
-		return nil
-	}
-	server, err := db.GetServer()
+// WriteWireGuardServerConfig writes the WireGuard server configuration (wg.conf) using a template.
+// If WgConfTemplate is set, it is used; otherwise, a default embedded template is read.
+// The config is rendered completely before the file is replaced with WriteConfigFile.
+func WriteWireGuardServerConfig(tmplDir fs.FS, serverConfig model.Server, clientDataList []model.ClientData, usersList []model.User, globalSettings model.GlobalSetting) error {
+	data, err := RenderWireGuardServerConfig(tmplDir, serverConfig, clientDataList, usersList, globalSettings)
 	if err != nil {
 		return err
 	}
-	var serverSubnets []*net.IPNet
-	for _, addr := range server.Interface.Addresses {
-		addr = strings.TrimSpace(addr)
-		_, netAddr, err := net.ParseCIDR(addr)
-		if err != nil {
-			return err
-		}
-		serverSubnets = append(serverSubnets, netAddr)
-	}
-	for _, rng := range SubnetRangesOrder {
-		cidrs := SubnetRanges[rng]
-		if len(cidrs) > 0 {
-			newCIDRs := make([]*net.IPNet, 0)
-			for _, cidr := range cidrs {
-				valid := false
-				for _, serverSubnet := range serverSubnets {
-					if ContainsCIDR(serverSubnet, cidr) {
-						valid = true
-						break
-					}
-				}
-				if valid {
-					newCIDRs = append(newCIDRs, cidr)
-				} else {
-					log.Warnf("[%v] CIDR is outside of all server subnets: %v. Removed.", rng, cidr)
-				}
-			}
-			if len(newCIDRs) > 0 {
-				SubnetRanges[rng] = newCIDRs
-			} else {
-				delete(SubnetRanges, rng)
-				log.Warnf("[%v] No valid CIDRs in this subnet range. Removed.", rng)
-			}
-		}
-	}
-	return nil
-}
-
-// GetSubnetRangesString returns a formatted string representing active subnet ranges.
-func GetSubnetRangesString() string {
-	if len(SubnetRangesOrder) == 0 {
-		return ""
-	}
-	var sb strings.Builder
-	for _, rng := range SubnetRangesOrder {
-		cidrs := SubnetRanges[rng]
-		if len(cidrs) > 0 {
-			sb.WriteString(rng)
-			sb.WriteString(":[")
-			for i, cidr := range cidrs {
-				if i > 0 {
-					sb.WriteString(", ")
-				}
-				sb.WriteString(cidr.String())
-			}
-			sb.WriteString("]  ")
-		}
-	}
-	return strings.TrimSpace(sb.String())
+	return WriteConfigFile(globalSettings.ConfigFilePath, data)
 }
 
-//
-// WireGuard Server Configuration File
-//
-
-// WriteWireGuardServerConfig writes the WireGuard server configuration (wg.conf) using a template.
-// If WgConfTemplate is set, it is used; otherwise, a default embedded template is read.
-func WriteWireGuardServerConfig(tmplDir fs.FS, serverConfig model.Server, clientDataList []model.ClientData, usersList []model.User, globalSettings model.GlobalSetting) error {
+// RenderWireGuardServerConfig renders the WireGuard server configuration
+// into memory, from the same template WriteWireGuardServerConfig uses.
+func RenderWireGuardServerConfig(tmplDir fs.FS, serverConfig model.Server, clientDataList []model.ClientData, usersList []model.User, globalSettings model.GlobalSetting) ([]byte, error) {
 	var tmplWireGuardConf string
 	if len(WgConfTemplate) > 0 {
 		data, err := os.ReadFile(WgConfTemplate)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		tmplWireGuardConf = string(data)
 	} else {
 		fileContent, err := StringFromEmbedFile(tmplDir, "wg.conf")
 		if err != nil {
-			return err
+			return nil, err
 		}
 		tmplWireGuardConf = fileContent
 	}
 	tmplParsed, err := template.New("wg_config").Parse(tmplWireGuardConf)
 	if err != nil {
-		return err
-	}
-	f, err := os.Create(globalSettings.ConfigFilePath)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
 	config := map[string]interface{}{
 		"serverConfig":   serverConfig,
 		"clientDataList": clientDataList,
 		"globalSettings": globalSettings,
 		"usersList":      usersList,
 	}
-	return tmplParsed.Execute(f, config)
+	var buf bytes.Buffer
+	if err := tmplParsed.Execute(&buf, config); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 //
@@ -634,28 +368,51 @@ func ParseLogLevel(lvl string) (log.Lvl, error) {
 // Hashing and Database Helpers
 //
 
-// GetCurrentHash returns current hashes for clients and server configuration.
-func GetCurrentHash(db store.IStore) (string, string) {
-	hashClients, _ := dirhash.HashDir(path.Join(db.GetPath(), "clients"), "prefix", dirhash.Hash1)
-	files := append([]string(nil), "prefix/global_settings.json", "prefix/interfaces.json", "prefix/keypair.json")
-	osOpen := func(name string) (io.ReadCloser, error) {
-		return os.Open(filepath.Join(path.Join(db.GetPath(), "server"), strings.TrimPrefix(name, "prefix")))
-	}
-	hashServer, _ := dirhash.Hash1(files, osOpen)
+// GetCurrentHash returns the hashes of the peers and of the interface and
+// settings of a configuration state.
+func GetCurrentHash(state model.ConfigState) (string, string) {
+	hashClients := hashJSON(state.Peers)
+	hashServer := hashJSON(struct {
+		Interface model.InterfaceState `json:"interface"`
+		Settings  model.SettingsState  `json:"settings"`
+	}{state.Interface, state.Settings})
 	return hashClients, hashServer
 }
 
-// HashesChanged returns true if the current hashes differ from those stored in the database.
+// HashesChanged returns true if the config of any interface differs from the
+// one last applied to it.
 func HashesChanged(db store.IStore) bool {
-	old, _ := db.GetHashes()
-	newClient, newServer := GetCurrentHash(db)
-	return old.Client != newClient || old.Server != newServer
+	ifaces, err := GetInterfaces(db)
+	if err != nil {
+		log.Error("Cannot get interfaces: ", err)
+		return true
+	}
+	clients, err := db.GetClients(false)
+	if err != nil {
+		log.Error("Cannot get clients: ", err)
+		return true
+	}
+	settings, err := db.GetGlobalSettings()
+	if err != nil {
+		log.Error("Cannot get global settings: ", err)
+		return true
+	}
+	for _, iface := range ifaces {
+		if InterfaceChanged(db, iface, clients, settings) {
+			return true
+		}
+	}
+	return false
 }
 
-// UpdateHashes updates the stored hashes in the database.
-func UpdateHashes(db store.IStore) error {
+// UpdateHashes stores the hashes of an applied configuration state along with
+// the state itself.
+func UpdateHashes(db store.IStore, state model.ConfigState) error {
 	var clientServerHashes model.ClientServerHashes
-	clientServerHashes.Client, clientServerHashes.Server = GetCurrentHash(db)
+	clientServerHashes.Client, clientServerHashes.Server = GetCurrentHash(state)
+	appliedAt := time.Now().UTC()
+	clientServerHashes.Applied = &state
+	clientServerHashes.AppliedAt = &appliedAt
 	return db.SaveHashes(clientServerHashes)
 }
 
@@ -0,0 +1,311 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+)
+
+// secretConfigKey matches the lines of a WireGuard config holding a secret.
+var secretConfigKey = regexp.MustCompile(`(?m)^(\s*(?:PrivateKey|PresharedKey)\s*=\s*)(\S+)(\s*)$`)
+
+// ConfigToken identifies a rendered configuration, so an apply can be bound
+// to exactly the text that was previewed.
+func ConfigToken(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// RedactWireGuardConfig replaces the private and preshared keys of a
+// WireGuard config with a fingerprint, so changed keys still show in a diff.
+func RedactWireGuardConfig(data []byte) string {
+	return secretConfigKey.ReplaceAllStringFunc(string(data), func(line string) string {
+		match := secretConfigKey.FindStringSubmatch(line)
+		return match[1] + "[redacted:" + fingerprint(match[2]) + "]" + match[3]
+	})
+}
+
+// ValidateWireGuardConfig parses a WireGuard config the way wg-quick reads
+// it and returns a description of each problem found, prefixed by its line.
+func ValidateWireGuardConfig(data []byte) []string {
+	problems := []string{}
+	report := func(line int, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+	}
+
+	section := ""
+	interfaces := 0
+	peerLine := 0
+	peerHasKey := false
+	publicKeys := make(map[string]int)
+	endPeer := func() {
+		if peerLine > 0 && !peerHasKey {
+			report(peerLine, "[Peer] has no PublicKey")
+		}
+		peerLine, peerHasKey = 0, false
+	}
+	hasPrivateKey := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			endPeer()
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+				interfaces++
+				if interfaces > 1 {
+					report(number, "more than one [Interface] section")
+				}
+			case "peer":
+				peerLine = number
+			default:
+				report(number, "unknown section %s", line)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			report(number, "expected key = value, got %q", line)
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		var err error
+		switch section {
+		case "interface":
+			switch key {
+			case "privatekey":
+				hasPrivateKey = true
+				_, err = wgtypes.ParseKey(value)
+			case "listenport":
+				err = validatePort(value)
+			case "address":
+				err = validateList(value, validateCIDR)
+			case "dns":
+				err = validateList(value, func(item string) error {
+					if net.ParseIP(item) == nil && !ValidateDomainName(item) {
+						return fmt.Errorf("invalid DNS server %q", item)
+					}
+					return nil
+				})
+			case "mtu":
+				err = validateNumber(value, 576, 65535)
+			case "fwmark":
+				if value != "" && value != "off" {
+					_, err = strconv.ParseUint(value, 0, 32)
+				}
+			case "table":
+				if value != "" && value != "off" && value != "auto" {
+					_, err = strconv.ParseUint(value, 10, 32)
+				}
+			case "saveconfig":
+				if value != "true" && value != "false" {
+					err = fmt.Errorf("SaveConfig must be true or false")
+				}
+			case "preup", "postup", "predown", "postdown":
+			default:
+				report(number, "unknown [Interface] key %s", key)
+			}
+		case "peer":
+			switch key {
+			case "publickey":
+				peerHasKey = true
+				if _, err = wgtypes.ParseKey(value); err == nil {
+					if first, ok := publicKeys[value]; ok {
+						err = fmt.Errorf("public key also used by the peer on line %d", first)
+					}
+					publicKeys[value] = number
+				}
+			case "presharedkey":
+				_, err = wgtypes.ParseKey(value)
+			case "allowedips":
+				err = validateList(value, validateCIDR)
+			case "endpoint":
+				if value != "" {
+					var port string
+					if _, port, err = net.SplitHostPort(value); err == nil {
+						err = validatePort(port)
+					}
+				}
+			case "persistentkeepalive":
+				if value != "" && value != "off" {
+					err = validateNumber(value, 0, 65535)
+				}
+			default:
+				report(number, "unknown [Peer] key %s", key)
+			}
+		default:
+			report(number, "%s outside of a section", key)
+		}
+		if err != nil {
+			report(number, "invalid %s: %v", key, err)
+		}
+	}
+	endPeer()
+
+	if interfaces == 0 {
+		problems = append(problems, "no [Interface] section")
+	} else if !hasPrivateKey {
+		problems = append(problems, "[Interface] has no PrivateKey")
+	}
+	return problems
+}
+
+// ParseServerConfig reads the server, the enabled clients and the settings back
+// from a server config written from the default template. Clients are
+// identified by the "# ID:" and "# Name:" comments before their [Peer]
+// section, if present, and by their public key otherwise.
+func ParseServerConfig(data []byte) (model.Server, []model.ClientData, model.GlobalSetting, error) {
+	server := model.Server{KeyPair: &model.ServerKeypair{}, Interface: &model.ServerInterface{Addresses: []string{}}}
+	var clients []model.ClientData
+	var settings model.GlobalSetting
+	if problems := ValidateWireGuardConfig(data); len(problems) > 0 {
+		return server, clients, settings, fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
+	var client *model.Client
+	var id, name string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if comment, ok := strings.CutPrefix(line, "#"); ok {
+			if key, value, ok := strings.Cut(comment, ":"); ok {
+				switch strings.TrimSpace(key) {
+				case "ID":
+					id = strings.TrimSpace(value)
+				case "Name":
+					name = strings.TrimSpace(value)
+				}
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		switch strings.ToLower(line) {
+		case "[interface]":
+			client = nil
+			continue
+		case "[peer]":
+			client = &model.Client{ID: id, Name: name, AllocatedIPs: []string{}, Enabled: true}
+			clients = append(clients, model.ClientData{Client: client})
+			id, name = "", ""
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if client == nil {
+			switch key {
+			case "privatekey":
+				privateKey, _ := wgtypes.ParseKey(value)
+				server.KeyPair.PrivateKey = value
+				server.KeyPair.PublicKey = privateKey.PublicKey().String()
+			case "listenport":
+				server.Interface.ListenPort, _ = strconv.Atoi(value)
+			case "address":
+				server.Interface.Addresses = splitList(value)
+			case "postup":
+				server.Interface.PostUp = value
+			case "predown":
+				server.Interface.PreDown = value
+			case "postdown":
+				server.Interface.PostDown = value
+			case "mtu":
+				settings.MTU, _ = strconv.Atoi(value)
+			case "fwmark":
+				settings.FirewallMark = value
+			case "table":
+				settings.Table = value
+			}
+			continue
+		}
+		switch key {
+		case "publickey":
+			client.PublicKey = value
+		case "presharedkey":
+			client.PresharedKey = value
+		case "allowedips":
+			client.AllocatedIPs = splitList(value)
+		case "endpoint":
+			client.Endpoint = value
+		case "persistentkeepalive":
+			settings.PersistentKeepalive, _ = strconv.Atoi(value)
+		}
+	}
+	for _, clientData := range clients {
+		if clientData.Client.ID == "" {
+			clientData.Client.ID = clientData.Client.PublicKey
+		}
+		if clientData.Client.Name == "" {
+			clientData.Client.Name = clientData.Client.PublicKey
+		}
+	}
+	return server, clients, settings, nil
+}
+
+// splitList splits a comma separated list, leaving out empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateList validates each item of a comma separated list.
+func validateList(value string, validate func(string) error) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if err := validate(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCIDR(value string) error {
+	_, _, err := net.ParseCIDR(value)
+	return err
+}
+
+func validatePort(value string) error {
+	return validateNumber(value, 0, 65535)
+}
+
+func validateNumber(value string, min, max int) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n < min || n > max {
+		return fmt.Errorf("%d is not between %d and %d", n, min, max)
+	}
+	return nil
+}
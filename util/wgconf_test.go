@@ -0,0 +1,64 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	to := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	want := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -8,3 +8,4 @@
+ h
+ i
+ j
++k
+`
+	if got := UnifiedDiff("old", "new", from, to); got != want {
+		t.Errorf("UnifiedDiff =\n%s\nwant\n%s", got, want)
+	}
+	if got := UnifiedDiff("old", "new", from, from); got != "" {
+		t.Errorf("UnifiedDiff of equal texts = %q, want empty", got)
+	}
+	if got := UnifiedDiff("old", "new", "", "a\n"); got != "--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n" {
+		t.Errorf("UnifiedDiff from an empty text = %q", got)
+	}
+}
+
+func TestValidateWireGuardConfig(t *testing.T) {
+	privateKey, _ := wgtypes.GeneratePrivateKey()
+	peerKey := privateKey.PublicKey().String()
+	valid := "# comment\n[Interface]\nAddress = 10.8.0.1/24\nListenPort = 51820\nPrivateKey = " + privateKey.String() +
+		"\nPostUp = \nTable = \n\n[Peer]\nPublicKey = " + peerKey + "\nAllowedIPs = 10.8.0.2/32\nEndpoint = vpn.example.com:51820\n"
+	if problems := ValidateWireGuardConfig([]byte(valid)); len(problems) != 0 {
+		t.Errorf("Valid config has problems: %v", problems)
+	}
+
+	invalid := "[Interface]\nListenPort = 70000\n[Peer]\nPublicKey = " + peerKey + "\nAllowedIPs = 10.8.0.300/32\n[Peer]\nPublicKey = " + peerKey + "\nFoo = bar\n"
+	problems := ValidateWireGuardConfig([]byte(invalid))
+	for _, want := range []string{"line 2: invalid listenport", "line 5: invalid allowedips", "line 7: invalid publickey", "line 8: unknown [Peer] key foo", "no PrivateKey"} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem, want)
+		}
+		if !found {
+			t.Errorf("Problems %v lack %q", problems, want)
+		}
+	}
+
+	redacted := RedactWireGuardConfig([]byte(valid))
+	if strings.Contains(redacted, privateKey.String()) || !strings.Contains(redacted, "PrivateKey = [redacted:") {
+		t.Errorf("Redacted config still holds the private key:\n%s", redacted)
+	}
+}
@@ -0,0 +1,134 @@
+package wgctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Names of the available backends
+const (
+	WGQuick   = "wg-quick"
+	Systemd   = "systemd"
+	Userspace = "userspace"
+	Fake      = "fake"
+)
+
+// Backend controls the lifecycle of WireGuard interfaces and reads and
+// configures their devices. It satisfies util.DeviceController.
+type Backend interface {
+	// Name returns the name the backend was selected by.
+	Name() string
+
+	// Up brings the interface up from its config file.
+	Up(iface string) error
+
+	// Down takes the interface down.
+	Down(iface string) error
+
+	// Restart takes the interface down and brings it up again.
+	Restart(iface string) error
+
+	// IsUp reports whether the interface is running.
+	IsUp(iface string) (bool, error)
+
+	// Devices returns all WireGuard devices.
+	Devices() ([]*wgtypes.Device, error)
+
+	// Device returns the device of an interface. The error wraps
+	// os.ErrNotExist if the interface is not running.
+	Device(name string) (*wgtypes.Device, error)
+
+	// ConfigureDevice changes the configuration of a running device.
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// New returns the backend with the given name. userspace is the WireGuard
+// implementation the userspace backend falls back to, e.g. "wireguard-go" or
+// "boringtun-cli".
+func New(name, userspace string) (Backend, error) {
+	switch strings.ToLower(name) {
+	case "", WGQuick:
+		return WGQuickBackend{}, nil
+	case Systemd:
+		return SystemdBackend{}, nil
+	case Userspace:
+		if userspace == "" {
+			return nil, fmt.Errorf("the userspace backend needs a WireGuard implementation")
+		}
+		return UserspaceBackend{Implementation: userspace}, nil
+	case Fake:
+		return NewFakeBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown WireGuard backend %q, use %s, %s, %s or %s", name, WGQuick, Systemd, Userspace, Fake)
+	}
+}
+
+// restart takes an interface down and brings it up again. A failure to take
+// it down is only logged, as the interface might not be running.
+func restart(b Backend, iface string) error {
+	if err := b.Down(iface); err != nil {
+		log.Warnf("Failed to stop WireGuard during restart: %v", err)
+	}
+	return b.Up(iface)
+}
+
+// run runs a command that changes the state of an interface.
+func run(cmd *exec.Cmd, action, iface string) error {
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Errorf("Failed to %s WireGuard interface %s: %v, output: %s", action, iface, err, string(output))
+		return fmt.Errorf("failed to %s WireGuard: %w", action, err)
+	}
+	log.Infof("Successfully ran %s for WireGuard interface %s", action, iface)
+	return nil
+}
+
+// kernelDevices reads and configures devices through wgctrl, which talks to
+// the kernel module as well as to userspace implementations.
+type kernelDevices struct{}
+
+// Devices returns all WireGuard devices.
+func (kernelDevices) Devices() ([]*wgtypes.Device, error) {
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer wgClient.Close()
+	return wgClient.Devices()
+}
+
+// Device returns the device of an interface.
+func (kernelDevices) Device(name string) (*wgtypes.Device, error) {
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer wgClient.Close()
+	return wgClient.Device(name)
+}
+
+// ConfigureDevice changes the configuration of a running device.
+func (kernelDevices) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer wgClient.Close()
+	return wgClient.ConfigureDevice(name, cfg)
+}
+
+// isUp reports whether a device exists for the interface.
+func (k kernelDevices) isUp(iface string) (bool, error) {
+	_, err := k.Device(iface)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,159 @@
+package wgctl
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// FakeBackend keeps its devices in memory. It runs without root or the
+// WireGuard tools, so the apply flow can be exercised in tests and CI.
+type FakeBackend struct {
+	mu      sync.Mutex
+	devices map[string]*wgtypes.Device
+}
+
+// NewFakeBackend returns a fake backend without devices.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{devices: make(map[string]*wgtypes.Device)}
+}
+
+// Name returns "fake".
+func (*FakeBackend) Name() string {
+	return Fake
+}
+
+// Up creates an empty device for the interface if it is not running.
+func (f *FakeBackend) Up(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.devices[iface]; !ok {
+		f.devices[iface] = &wgtypes.Device{Name: iface, Type: wgtypes.Userspace}
+	}
+	return nil
+}
+
+// Down removes the device of the interface.
+func (f *FakeBackend) Down(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.devices[iface]; !ok {
+		return fmt.Errorf("failed to stop WireGuard: interface %s is not running", iface)
+	}
+	delete(f.devices, iface)
+	return nil
+}
+
+// Restart removes the device and creates an empty one, as the config file
+// is not read.
+func (f *FakeBackend) Restart(iface string) error {
+	f.mu.Lock()
+	delete(f.devices, iface)
+	f.mu.Unlock()
+	return f.Up(iface)
+}
+
+// IsUp reports whether the interface has a device.
+func (f *FakeBackend) IsUp(iface string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.devices[iface]
+	return ok, nil
+}
+
+// Devices returns copies of all devices.
+func (f *FakeBackend) Devices() ([]*wgtypes.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	devices := make([]*wgtypes.Device, 0, len(f.devices))
+	for _, device := range f.devices {
+		devices = append(devices, copyDevice(device))
+	}
+	return devices, nil
+}
+
+// Device returns a copy of the device of an interface.
+func (f *FakeBackend) Device(name string) (*wgtypes.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	device, ok := f.devices[name]
+	if !ok {
+		return nil, fmt.Errorf("interface %s: %w", name, os.ErrNotExist)
+	}
+	return copyDevice(device), nil
+}
+
+// ConfigureDevice applies the config to the device like the kernel would.
+func (f *FakeBackend) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	device, ok := f.devices[name]
+	if !ok {
+		return fmt.Errorf("interface %s: %w", name, os.ErrNotExist)
+	}
+
+	if cfg.PrivateKey != nil {
+		device.PrivateKey = *cfg.PrivateKey
+		device.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ListenPort != nil {
+		device.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		device.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		device.Peers = nil
+	}
+	for _, peerCfg := range cfg.Peers {
+		index := -1
+		for i, peer := range device.Peers {
+			if peer.PublicKey == peerCfg.PublicKey {
+				index = i
+				break
+			}
+		}
+		if peerCfg.Remove {
+			if index >= 0 {
+				device.Peers = append(device.Peers[:index], device.Peers[index+1:]...)
+			}
+			continue
+		}
+		if peerCfg.UpdateOnly && index < 0 {
+			continue
+		}
+		if index < 0 {
+			device.Peers = append(device.Peers, wgtypes.Peer{PublicKey: peerCfg.PublicKey})
+			index = len(device.Peers) - 1
+		}
+		peer := &device.Peers[index]
+		if peerCfg.PresharedKey != nil {
+			peer.PresharedKey = *peerCfg.PresharedKey
+		}
+		if peerCfg.Endpoint != nil {
+			peer.Endpoint = peerCfg.Endpoint
+		}
+		if peerCfg.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *peerCfg.PersistentKeepaliveInterval
+		}
+		if peerCfg.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, peerCfg.AllowedIPs...)
+	}
+	return nil
+}
+
+// copyDevice returns a copy of a device that shares no slices with it.
+func copyDevice(device *wgtypes.Device) *wgtypes.Device {
+	c := *device
+	c.Peers = make([]wgtypes.Peer, len(device.Peers))
+	for i, peer := range device.Peers {
+		c.Peers[i] = peer
+		c.Peers[i].AllowedIPs = append([]net.IPNet(nil), peer.AllowedIPs...)
+	}
+	return &c
+}
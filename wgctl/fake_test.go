@@ -0,0 +1,75 @@
+package wgctl
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/swissmakers/wireguard-manager/model"
+	"github.com/swissmakers/wireguard-manager/util"
+)
+
+// TestFakeApply runs the apply flow against the fake backend and verifies
+// the device matches the database afterwards.
+func TestFakeApply(t *testing.T) {
+	backend, err := New(Fake, "")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := backend.Device("wg0"); err == nil {
+		t.Fatal("Device of a stopped interface succeeded")
+	}
+	if up, _ := backend.IsUp("wg0"); up {
+		t.Fatal("IsUp = true before Up")
+	}
+	if err := backend.Up("wg0"); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	clientKeys := make([]wgtypes.Key, 3)
+	for i := range clientKeys {
+		key, _ := wgtypes.GeneratePrivateKey()
+		clientKeys[i] = key.PublicKey()
+	}
+	psk, _ := wgtypes.GenerateKey()
+	server := model.Server{
+		KeyPair:   &model.ServerKeypair{PrivateKey: serverKey.String(), PublicKey: serverKey.PublicKey().String()},
+		Interface: &model.ServerInterface{ListenPort: 51820},
+	}
+	clients := []model.ClientData{
+		{Client: &model.Client{ID: "a", Name: "a", PublicKey: clientKeys[0].String(), PresharedKey: psk.String(), AllocatedIPs: []string{"10.8.0.2/32"}, Enabled: true}},
+		{Client: &model.Client{ID: "b", Name: "b", PublicKey: clientKeys[1].String(), AllocatedIPs: []string{"10.8.0.3/32"}, Enabled: true}},
+		{Client: &model.Client{ID: "c", Name: "c", PublicKey: clientKeys[2].String(), AllocatedIPs: []string{"10.8.0.4/32"}}},
+	}
+
+	result, err := util.SyncDevice(backend, "wg0", server, clients, model.GlobalSetting{})
+	if err != nil || result.Failed > 0 {
+		t.Fatalf("SyncDevice = %+v, %v", result, err)
+	}
+	device, _ := backend.Device("wg0")
+	if report := util.CheckDrift(device, server, clients); !report.InSync {
+		t.Fatalf("Device drifts after the first apply: %+v", report)
+	}
+	if len(device.Peers) != 2 || device.PublicKey != serverKey.PublicKey() {
+		t.Fatalf("Device = %+v, want 2 peers and the server key", device)
+	}
+
+	// Disable a client and move another one to a new address
+	clients[0].Client.Enabled = false
+	clients[1].Client.AllocatedIPs = []string{"10.8.0.9/32"}
+	if result, err = util.SyncDevice(backend, "wg0", server, clients, model.GlobalSetting{}); err != nil || len(result.Peers) != 2 {
+		t.Fatalf("SyncDevice = %+v, %v, want 2 changed peers", result, err)
+	}
+	device, _ = backend.Device("wg0")
+	if report := util.CheckDrift(device, server, clients); !report.InSync {
+		t.Fatalf("Device drifts after the second apply: %+v", report)
+	}
+
+	if err := backend.Down("wg0"); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if devices, _ := backend.Devices(); len(devices) != 0 {
+		t.Fatalf("Devices = %d after Down, want none", len(devices))
+	}
+}
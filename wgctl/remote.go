@@ -0,0 +1,43 @@
+package wgctl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/swissmakers/wireguard-manager/model"
+)
+
+// RemoteConfigs is implemented by backends that run some interfaces on other
+// hosts. The config files of those interfaces are read and applied on their
+// host; ok is false for an interface whose config file is on this host.
+type RemoteConfigs interface {
+	// ReadConfig returns the config file of a remote interface. The error
+	// wraps os.ErrNotExist if the file does not exist.
+	ReadConfig(iface string) (content []byte, ok bool, err error)
+
+	// ApplyConfig writes the config file of a remote interface and configures
+	// its device if it is running. The host restores the former file if the
+	// device cannot be configured.
+	ApplyConfig(iface string, content []byte) (result model.DeviceSync, ok bool, err error)
+}
+
+// UnreachableError is returned by Devices together with the devices that
+// could be read if some hosts could not be reached.
+type UnreachableError struct {
+	// Hosts maps the name of each unreachable host to its error
+	Hosts map[string]error
+}
+
+func (e *UnreachableError) Error() string {
+	names := make([]string, 0, len(e.Hosts))
+	for name := range e.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var msgs []string
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, e.Hosts[name]))
+	}
+	return "cannot reach " + strings.Join(msgs, "; ")
+}
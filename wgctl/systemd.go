@@ -0,0 +1,47 @@
+package wgctl
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// SystemdBackend controls interfaces through the wg-quick@<iface> units of
+// systemd, so they come up again on boot and show up in the journal.
+type SystemdBackend struct {
+	kernelDevices
+}
+
+// Name returns "systemd".
+func (SystemdBackend) Name() string {
+	return Systemd
+}
+
+// unit returns the systemd unit of an interface.
+func unit(iface string) string {
+	return "wg-quick@" + iface
+}
+
+// Up starts the unit.
+func (SystemdBackend) Up(iface string) error {
+	return run(exec.Command("systemctl", "start", unit(iface)), "start", iface)
+}
+
+// Down stops the unit.
+func (SystemdBackend) Down(iface string) error {
+	return run(exec.Command("systemctl", "stop", unit(iface)), "stop", iface)
+}
+
+// Restart restarts the unit.
+func (SystemdBackend) Restart(iface string) error {
+	return run(exec.Command("systemctl", "restart", unit(iface)), "restart", iface)
+}
+
+// IsUp reports whether the unit is active.
+func (SystemdBackend) IsUp(iface string) (bool, error) {
+	err := exec.Command("systemctl", "is-active", "--quiet", unit(iface)).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,73 @@
+package wgctl
+
+import (
+	"os"
+	"os/exec"
+)
+
+// WGQuickBackend brings interfaces up and down with wg-quick.
+type WGQuickBackend struct {
+	kernelDevices
+}
+
+// Name returns "wg-quick".
+func (WGQuickBackend) Name() string {
+	return WGQuick
+}
+
+// Up runs wg-quick up.
+func (WGQuickBackend) Up(iface string) error {
+	return run(exec.Command("wg-quick", "up", iface), "start", iface)
+}
+
+// Down runs wg-quick down.
+func (WGQuickBackend) Down(iface string) error {
+	return run(exec.Command("wg-quick", "down", iface), "stop", iface)
+}
+
+// Restart runs wg-quick down and up.
+func (b WGQuickBackend) Restart(iface string) error {
+	return restart(b, iface)
+}
+
+// IsUp reports whether the device exists.
+func (b WGQuickBackend) IsUp(iface string) (bool, error) {
+	return b.isUp(iface)
+}
+
+// UserspaceBackend brings interfaces up with wg-quick, which falls back to a
+// userspace implementation such as wireguard-go or boringtun on kernels
+// without the WireGuard module.
+type UserspaceBackend struct {
+	kernelDevices
+
+	// Implementation is the userspace binary wg-quick runs
+	Implementation string
+}
+
+// Name returns "userspace".
+func (UserspaceBackend) Name() string {
+	return Userspace
+}
+
+// Up runs wg-quick up with the userspace implementation.
+func (b UserspaceBackend) Up(iface string) error {
+	cmd := exec.Command("wg-quick", "up", iface)
+	cmd.Env = append(os.Environ(), "WG_QUICK_USERSPACE_IMPLEMENTATION="+b.Implementation)
+	return run(cmd, "start", iface)
+}
+
+// Down runs wg-quick down, which also ends the userspace process.
+func (UserspaceBackend) Down(iface string) error {
+	return run(exec.Command("wg-quick", "down", iface), "stop", iface)
+}
+
+// Restart runs wg-quick down and up.
+func (b UserspaceBackend) Restart(iface string) error {
+	return restart(b, iface)
+}
+
+// IsUp reports whether the device exists.
+func (b UserspaceBackend) IsUp(iface string) (bool, error) {
+	return b.isUp(iface)
+}